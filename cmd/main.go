@@ -2,14 +2,26 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
 	"log"
 	"net/http"
+	"os"
 
+	"github.com/benhuri/phone-book-api/internal/apikeys"
+	"github.com/benhuri/phone-book-api/internal/auth"
 	"github.com/benhuri/phone-book-api/internal/config"
 	"github.com/benhuri/phone-book-api/internal/contacts"
 	"github.com/benhuri/phone-book-api/internal/database"
+	"github.com/benhuri/phone-book-api/internal/idempotency"
+	"github.com/benhuri/phone-book-api/internal/jobs"
 	"github.com/benhuri/phone-book-api/internal/metrics"
+	"github.com/benhuri/phone-book-api/internal/organizations"
+	"github.com/benhuri/phone-book-api/internal/outbox"
+	"github.com/benhuri/phone-book-api/internal/roles"
 	"github.com/benhuri/phone-book-api/internal/router"
+	"github.com/benhuri/phone-book-api/internal/shares"
+	"github.com/benhuri/phone-book-api/internal/users"
+	"github.com/benhuri/phone-book-api/internal/webhooks"
 )
 
 func main() {
@@ -19,27 +31,171 @@ func main() {
 	// Initialize the database connection
 	database.InitDB()
 
-	// Create the contacts table if it doesn't exist
-	createTableQuery := `
-    CREATE TABLE IF NOT EXISTS contacts (
-        id SERIAL PRIMARY KEY,
-        first_name VARCHAR(50),
-        last_name VARCHAR(50),
-        phone_number VARCHAR(20),
-        address VARCHAR(100)
-    );`
-	_, err := database.DB.ExecContext(context.Background(), createTableQuery)
+	// Create or upgrade the database schema
+	if err := database.CreateSchema(context.Background(), database.DB); err != nil {
+		log.Fatalf("Error creating database schema: %v", err)
+	}
+
+	// Token subjects stored before subjects named their issuer can only be
+	// moved to it when a single issuer is trusted
+	if len(config.AppConfig.JWTIssuers) == 1 {
+		moved, err := database.QualifyTokenSubjects(context.Background(), database.DB, config.AppConfig.JWTIssuers[0])
+		if err != nil {
+			log.Fatalf("Error qualifying token subjects: %v", err)
+		}
+		if moved > 0 {
+			log.Printf("Moved %d rows to the subjects of issuer %s", moved, config.AppConfig.JWTIssuers[0])
+		}
+	}
+
+	// Share links need a stable secret to survive restarts
+	linkSecret := []byte(config.AppConfig.ShareLinkSecret)
+	if len(linkSecret) == 0 {
+		log.Printf("SHARE_LINK_SECRET is not set, share links will stop working on restart")
+		linkSecret = make([]byte, 32)
+		if _, err := rand.Read(linkSecret); err != nil {
+			log.Fatalf("Error generating share link secret: %v", err)
+		}
+	}
+
+	isolation, err := database.ParseIsolation(config.AppConfig.TxIsolation)
+	if err != nil {
+		log.Fatalf("Error reading TX_ISOLATION: %v", err)
+	}
+
+	duplicatePolicy, err := contacts.ParseDuplicatePolicy(config.AppConfig.DuplicatePolicy)
 	if err != nil {
-		log.Fatalf("Error creating contacts table: %v", err)
+		log.Fatalf("Error reading DUPLICATE_POLICY: %v", err)
+	}
+
+	// Initialize the webhooks repository, service, and handler, and deliver
+	// the queued deliveries unless the workers are disabled
+	webhooksRepo := webhooks.NewRepository(database.DB)
+	webhooksService := webhooks.NewService(webhooksRepo, config.AppConfig.WebhookMaxAttempts, config.AppConfig.WebhookBackoff, config.AppConfig.WebhookAllowPrivate)
+	webhookHandler := webhooks.NewHandler(webhooksService)
+	if config.AppConfig.WebhookWorkers > 0 {
+		go webhooksService.Run(context.Background(), config.AppConfig.WebhookWorkers)
 	}
 
 	// Initialize the contacts repository, service, and handler
-	contactsRepo := contacts.NewRepository(database.DB)
-	contactsService := contacts.NewService(contactsRepo)
+	contactsRepo := contacts.NewRepository(database.DB, contacts.TxConfig{Isolation: isolation, MaxRetries: config.AppConfig.TxMaxRetries}, config.AppConfig.PhoneCountryCode)
+	contactsService := contacts.NewService(contactsRepo, linkSecret, config.AppConfig.PublicURL, config.AppConfig.PhoneCountryCode, duplicatePolicy)
 	contactHandler := contacts.NewHandler(contactsService)
 
+	// Normalize the phone numbers of contacts saved before they were checked
+	// for duplicates
+	keyed, err := contactsRepo.KeyPhoneNumbers(context.Background())
+	if err != nil {
+		log.Fatalf("Error normalizing phone numbers: %v", err)
+	}
+	if keyed > 0 {
+		log.Printf("Normalized the phone numbers of %d contacts", keyed)
+	}
+
+	// Back the unique custom fields defined before they were indexed
+	unindexed, err := contactsRepo.IndexUniqueFields(context.Background())
+	if err != nil {
+		log.Fatalf("Error indexing unique custom fields: %v", err)
+	}
+	for _, field := range unindexed {
+		log.Printf("Custom field %s has values shared by several contacts and is not indexed", field)
+	}
+
+	// Initialize the organizations repository, service, and handler
+	organizationsRepo := organizations.NewRepository(database.DB)
+	organizationsService := organizations.NewService(organizationsRepo)
+	organizationHandler := organizations.NewHandler(organizationsService)
+
+	// Initialize the api keys repository, service, and handler
+	keysRepo := apikeys.NewRepository(database.DB)
+	keysService := apikeys.NewService(keysRepo, config.AppConfig.BootstrapAPIKey, config.AppConfig.DefaultTenant)
+	keyHandler := apikeys.NewHandler(keysService)
+
+	// Initialize the roles repository, service, and handler
+	rolesRepo := roles.NewRepository(database.DB)
+	rolesService := roles.NewService(rolesRepo)
+	roleHandler := roles.NewHandler(rolesService)
+
+	// Initialize the users repository, service, and handler
+	usersRepo := users.NewRepository(database.DB)
+	usersService := users.NewService(usersRepo, config.AppConfig.SessionTTL, config.AppConfig.DefaultTenant)
+	userHandler := users.NewHandler(usersService, config.AppConfig.SessionCookieSecure)
+
+	// Initialize the shares repository, service, and handler
+	sharesRepo := shares.NewRepository(database.DB)
+	sharesService := shares.NewService(sharesRepo)
+	shareHandler := shares.NewHandler(sharesService)
+
+	// Initialize the jobs repository, service, and handler, and run the
+	// workers unless they are disabled
+	jobsRepo := jobs.NewRepository(database.DB)
+	jobsService := jobs.NewService(jobsRepo, contactsService)
+	jobHandler := jobs.NewHandler(jobsService)
+	if config.AppConfig.JobWorkers > 0 {
+		go jobsService.Run(context.Background(), config.AppConfig.JobWorkers)
+	}
+
+	// Relay the contact events written to the outbox to the configured sinks
+	if err := outbox.CheckSinks(config.AppConfig.OutboxSinks); err != nil {
+		log.Fatalf("Error reading OUTBOX_SINKS: %v", err)
+	}
+	outboxRepo := outbox.NewRepository(database.DB)
+	relay := outbox.NewRelay(outboxRepo)
+	var stream *outbox.Stream
+	for _, sink := range config.AppConfig.OutboxSinks {
+		switch sink {
+		case outbox.SinkWebhooks:
+			relay.Add(sink, webhooksService)
+		case outbox.SinkFile:
+			fileSink, err := outbox.NewFileSink(config.AppConfig.OutboxFile)
+			if err != nil {
+				log.Fatalf("Error opening OUTBOX_FILE: %v", err)
+			}
+			relay.Add(sink, fileSink)
+		case outbox.SinkStdout:
+			relay.Add(sink, outbox.NewWriterSink(os.Stdout))
+		case outbox.SinkSSE:
+			stream = outbox.NewStream(outboxRepo)
+			relay.AddLive(sink, stream)
+		}
+	}
+	eventHandler := outbox.NewHandler(stream)
+	go relay.Run(context.Background())
+
+	// Keep the responses of requests sent with an idempotency key
+	idempotencyService := idempotency.NewService(idempotency.NewRepository(database.DB), config.AppConfig.IdempotencyTTL)
+	go idempotencyService.Run(context.Background())
+
+	// Accept JWTs when any signing key is configured
+	authenticators := router.Authenticators{keysService}
+	var jwtKeys []auth.KeySource
+	if config.AppConfig.JWTSecret != "" {
+		jwtKeys = append(jwtKeys, auth.StaticKeys{auth.NewHMACKey("", []byte(config.AppConfig.JWTSecret))})
+	}
+	if config.AppConfig.JWTPublicKeyFile != "" {
+		data, err := os.ReadFile(config.AppConfig.JWTPublicKeyFile)
+		if err != nil {
+			log.Fatalf("Error reading JWT public key: %v", err)
+		}
+		key, err := auth.ParsePublicKeyPEM("", data)
+		if err != nil {
+			log.Fatalf("Error parsing JWT public key: %v", err)
+		}
+		jwtKeys = append(jwtKeys, auth.StaticKeys{key})
+	}
+	if config.AppConfig.JWKSURL != "" {
+		jwtKeys = append(jwtKeys, auth.NewJWKS(config.AppConfig.JWKSURL, config.AppConfig.JWKSCacheTTL))
+	}
+	if len(jwtKeys) > 0 {
+		authenticators = append(authenticators, auth.NewJWTAuthenticator(auth.JWTConfig{
+			Issuers:   config.AppConfig.JWTIssuers,
+			Audience:  config.AppConfig.JWTAudience,
+			ClockSkew: config.AppConfig.JWTClockSkew,
+		}, jwtKeys...))
+	}
+
 	// Initialize the router
-	r := router.NewRouter(contactHandler)
+	r := router.NewRouter(contactHandler, organizationHandler, keyHandler, roleHandler, userHandler, shareHandler, jobHandler, webhookHandler, eventHandler, idempotencyService, authenticators, auth.NewPolicy(rolesService))
 
 	// Apply the metrics middleware
 	r.Use(metrics.Middleware)
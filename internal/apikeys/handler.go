@@ -0,0 +1,118 @@
+package apikeys
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/benhuri/phone-book-api/internal/httputil"
+	"github.com/go-playground/validator/v10"
+	"github.com/gorilla/mux"
+)
+
+const (
+	contentType         = "Content-Type"
+	applicationJSON     = "application/json"
+	idParam             = "id"
+	invalidRequestError = "Invalid request payload"
+	invalidKeyID        = "Invalid api key ID"
+	internalServerError = "Internal Server Error"
+)
+
+type Handler struct {
+	Service *Service
+}
+
+func NewHandler(service *Service) *Handler {
+	return &Handler{Service: service}
+}
+
+var validate *validator.Validate
+
+func init() {
+	validate = validator.New()
+}
+
+func (h *Handler) GetKeysHandler(w http.ResponseWriter, r *http.Request) {
+	keys, err := h.Service.GetKeys(r.Context())
+	if err != nil {
+		log.Printf("Error getting api keys: %v", err)
+		http.Error(w, internalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(contentType, applicationJSON)
+	json.NewEncoder(w).Encode(keys)
+}
+
+func (h *Handler) AddKeyHandler(w http.ResponseWriter, r *http.Request) {
+	var key APIKey
+	if err := json.NewDecoder(r.Body).Decode(&key); err != nil {
+		log.Printf("Error decoding api key: %v", err)
+		http.Error(w, invalidRequestError, http.StatusBadRequest)
+		return
+	}
+
+	if err := validate.Struct(key); err != nil {
+		log.Printf("Validation error: %v", err)
+		http.Error(w, httputil.FormatValidationError(err), http.StatusBadRequest)
+		return
+	}
+
+	if err := h.Service.AddKey(r.Context(), &key); err != nil {
+		log.Printf("Error adding api key: %v", err)
+		http.Error(w, internalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(contentType, applicationJSON)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(key)
+}
+
+func (h *Handler) RotateKeyHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)[idParam])
+	if err != nil {
+		log.Printf("Invalid api key ID: %v", err)
+		http.Error(w, invalidKeyID, http.StatusBadRequest)
+		return
+	}
+
+	key, err := h.Service.RotateKey(r.Context(), id)
+	if errors.Is(err, ErrKeyNotFound) {
+		http.Error(w, keyNotFoundError, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error rotating api key: %v", err)
+		http.Error(w, internalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(contentType, applicationJSON)
+	json.NewEncoder(w).Encode(key)
+}
+
+func (h *Handler) RevokeKeyHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)[idParam])
+	if err != nil {
+		log.Printf("Invalid api key ID: %v", err)
+		http.Error(w, invalidKeyID, http.StatusBadRequest)
+		return
+	}
+
+	err = h.Service.RevokeKey(r.Context(), id)
+	if errors.Is(err, ErrKeyNotFound) {
+		http.Error(w, keyNotFoundError, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error revoking api key: %v", err)
+		http.Error(w, internalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,20 @@
+package apikeys
+
+import "time"
+
+type APIKey struct {
+	ID         int        `json:"id"`
+	Name       string     `json:"name" validate:"required,min=1,max=100"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes" validate:"required,min=1,unique,dive,oneof=contacts:read contacts:write admin"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	// Token is the full key. It is only returned when a key is created or
+	// rotated and is never stored.
+	Token string `json:"token,omitempty"`
+
+	tenantID string
+	salt     []byte
+	hash     []byte
+}
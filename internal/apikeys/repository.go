@@ -0,0 +1,154 @@
+package apikeys
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/benhuri/phone-book-api/internal/auth"
+	"github.com/lib/pq"
+)
+
+const (
+	keyColumns           = "id, tenant_id, name, prefix, scopes, salt, hash, created_at, last_used_at, revoked_at"
+	selectKeysQuery      = "SELECT " + keyColumns + " FROM api_keys WHERE tenant_id = $1 ORDER BY id"
+	selectKeyByPrefix    = "SELECT " + keyColumns + " FROM api_keys WHERE prefix = $1"
+	insertKeyQuery       = "INSERT INTO api_keys (tenant_id, name, prefix, scopes, salt, hash) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id, created_at"
+	rotateKeyQuery       = "UPDATE api_keys SET salt = $3, hash = $4 WHERE tenant_id = $1 AND id = $2 AND revoked_at IS NULL RETURNING " + keyColumns
+	revokeKeyQuery       = "UPDATE api_keys SET revoked_at = now() WHERE tenant_id = $1 AND id = $2 AND revoked_at IS NULL"
+	touchKeyQuery        = "UPDATE api_keys SET last_used_at = now() WHERE id = $1 AND (last_used_at IS NULL OR last_used_at < now() - interval '1 minute')"
+	fetchKeysError       = "failed to fetch api keys: %w"
+	getKeyError          = "failed to get api key: %w"
+	createKeyError       = "failed to create api key: %w"
+	rotateKeyError       = "failed to rotate api key: %w"
+	revokeKeyError       = "failed to revoke api key: %w"
+	touchKeyError        = "failed to record api key use: %w"
+	getRowsAffectedError = "failed to get rows affected: %w"
+	rowsError            = "rows error: %w"
+	keyNotFoundError     = "api key not found"
+)
+
+var ErrKeyNotFound = errors.New(keyNotFoundError)
+
+type Repository interface {
+	FetchKeys(ctx context.Context) ([]APIKey, error)
+	// GetKeyByPrefix is used to authenticate a request, before a tenant is
+	// known, and is therefore the only unscoped lookup.
+	GetKeyByPrefix(ctx context.Context, prefix string) (*APIKey, error)
+	CreateKey(ctx context.Context, key *APIKey) error
+	RotateKey(ctx context.Context, key *APIKey) error
+	RevokeKey(ctx context.Context, id int) error
+	TouchKey(ctx context.Context, id int) error
+}
+
+type keyRepository struct {
+	db *sql.DB
+}
+
+func NewRepository(db *sql.DB) Repository {
+	return &keyRepository{db: db}
+}
+
+func (r *keyRepository) FetchKeys(ctx context.Context) ([]APIKey, error) {
+	tenantID, err := auth.TenantID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := r.db.QueryContext(ctx, selectKeysQuery, tenantID)
+	if err != nil {
+		return nil, fmt.Errorf(fetchKeysError, err)
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		var key APIKey
+		if err := scanKey(rows, &key); err != nil {
+			return nil, fmt.Errorf(fetchKeysError, err)
+		}
+		keys = append(keys, key)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf(rowsError, err)
+	}
+
+	return keys, nil
+}
+
+func (r *keyRepository) GetKeyByPrefix(ctx context.Context, prefix string) (*APIKey, error) {
+	var key APIKey
+	err := scanKey(r.db.QueryRowContext(ctx, selectKeyByPrefix, prefix), &key)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrKeyNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf(getKeyError, err)
+	}
+	return &key, nil
+}
+
+func (r *keyRepository) CreateKey(ctx context.Context, key *APIKey) error {
+	tenantID, err := auth.TenantID(ctx)
+	if err != nil {
+		return err
+	}
+	key.tenantID = tenantID
+	err = r.db.QueryRowContext(ctx, insertKeyQuery, tenantID, key.Name, key.Prefix, pq.Array(key.Scopes), key.salt, key.hash).Scan(&key.ID, &key.CreatedAt)
+	if err != nil {
+		return fmt.Errorf(createKeyError, err)
+	}
+	return nil
+}
+
+func (r *keyRepository) RotateKey(ctx context.Context, key *APIKey) error {
+	tenantID, err := auth.TenantID(ctx)
+	if err != nil {
+		return err
+	}
+	salt, hash := key.salt, key.hash
+	err = scanKey(r.db.QueryRowContext(ctx, rotateKeyQuery, tenantID, key.ID, salt, hash), key)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrKeyNotFound
+	}
+	if err != nil {
+		return fmt.Errorf(rotateKeyError, err)
+	}
+	return nil
+}
+
+func (r *keyRepository) RevokeKey(ctx context.Context, id int) error {
+	tenantID, err := auth.TenantID(ctx)
+	if err != nil {
+		return err
+	}
+	result, err := r.db.ExecContext(ctx, revokeKeyQuery, tenantID, id)
+	if err != nil {
+		return fmt.Errorf(revokeKeyError, err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf(getRowsAffectedError, err)
+	}
+	if rowsAffected == 0 {
+		return ErrKeyNotFound
+	}
+	return nil
+}
+
+func (r *keyRepository) TouchKey(ctx context.Context, id int) error {
+	if _, err := r.db.ExecContext(ctx, touchKeyQuery, id); err != nil {
+		return fmt.Errorf(touchKeyError, err)
+	}
+	return nil
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanKey(row rowScanner, key *APIKey) error {
+	return row.Scan(&key.ID, &key.tenantID, &key.Name, &key.Prefix, pq.Array(&key.Scopes), &key.salt, &key.hash,
+		&key.CreatedAt, &key.LastUsedAt, &key.RevokedAt)
+}
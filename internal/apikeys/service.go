@@ -0,0 +1,144 @@
+package apikeys
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/benhuri/phone-book-api/internal/auth"
+)
+
+const (
+	tokenPrefix      = "pbk_"
+	tokenSeparator   = "."
+	prefixBytes      = 6
+	secretBytes      = 32
+	saltBytes        = 16
+	bootstrapSubject = "bootstrap"
+	keySubject       = "apikey:"
+	invalidKeyError  = "invalid api key: %w"
+	generateKeyError = "failed to generate api key: %w"
+)
+
+// ErrInvalidKey is returned for unknown, malformed, revoked or mismatching keys
+// alike so callers cannot tell which part of a key was wrong.
+var ErrInvalidKey = fmt.Errorf(invalidKeyError, auth.ErrUnauthenticated)
+
+type Service struct {
+	repo Repository
+	// bootstrapToken authenticates as admin of bootstrapTenant so that the
+	// first real keys can be created. It is disabled when empty.
+	bootstrapToken  string
+	bootstrapTenant string
+}
+
+func NewService(repo Repository, bootstrapToken, bootstrapTenant string) *Service {
+	return &Service{repo: repo, bootstrapToken: bootstrapToken, bootstrapTenant: bootstrapTenant}
+}
+
+func (s *Service) GetKeys(ctx context.Context) ([]APIKey, error) {
+	return s.repo.FetchKeys(ctx)
+}
+
+func (s *Service) AddKey(ctx context.Context, key *APIKey) error {
+	prefix := make([]byte, prefixBytes)
+	if _, err := rand.Read(prefix); err != nil {
+		return fmt.Errorf(generateKeyError, err)
+	}
+	key.Prefix = hex.EncodeToString(prefix)
+
+	secret, err := newSecret(key)
+	if err != nil {
+		return err
+	}
+	if err := s.repo.CreateKey(ctx, key); err != nil {
+		return err
+	}
+	key.Token = tokenPrefix + key.Prefix + tokenSeparator + secret
+	return nil
+}
+
+// RotateKey replaces the secret of a key and keeps its ID and prefix, so the
+// old token stops working immediately while its history is preserved.
+func (s *Service) RotateKey(ctx context.Context, id int) (*APIKey, error) {
+	key := &APIKey{ID: id}
+	secret, err := newSecret(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.repo.RotateKey(ctx, key); err != nil {
+		return nil, err
+	}
+	key.Token = tokenPrefix + key.Prefix + tokenSeparator + secret
+	return key, nil
+}
+
+func (s *Service) RevokeKey(ctx context.Context, id int) error {
+	return s.repo.RevokeKey(ctx, id)
+}
+
+// Authenticate resolves a bearer token to the principal it was issued for.
+func (s *Service) Authenticate(ctx context.Context, token string) (*auth.Principal, error) {
+	if s.bootstrapToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.bootstrapToken)) == 1 {
+		return &auth.Principal{Subject: bootstrapSubject, TenantID: s.bootstrapTenant, Scopes: []string{auth.ScopeAdmin}}, nil
+	}
+
+	rest := strings.TrimPrefix(token, tokenPrefix)
+	prefix, secret, ok := strings.Cut(rest, tokenSeparator)
+	if rest == token || !ok {
+		return nil, ErrInvalidKey
+	}
+
+	key, err := s.repo.GetKeyByPrefix(ctx, prefix)
+	if errors.Is(err, ErrKeyNotFound) {
+		return nil, ErrInvalidKey
+	}
+	if err != nil {
+		return nil, err
+	}
+	if key.RevokedAt != nil || subtle.ConstantTimeCompare(hashSecret(key.salt, secret), key.hash) != 1 {
+		return nil, ErrInvalidKey
+	}
+
+	if err := s.repo.TouchKey(ctx, key.ID); err != nil {
+		log.Printf("Error recording api key use: %v", err)
+	}
+
+	return &auth.Principal{
+		Subject:  keySubject + strconv.Itoa(key.ID),
+		TenantID: key.tenantID,
+		Scopes:   key.Scopes,
+		KeyID:    key.ID,
+	}, nil
+}
+
+// newSecret generates a secret for the key and stores its salted hash on it.
+func newSecret(key *APIKey) (string, error) {
+	secret := make([]byte, secretBytes)
+	salt := make([]byte, saltBytes)
+	if _, err := rand.Read(secret); err != nil {
+		return "", fmt.Errorf(generateKeyError, err)
+	}
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf(generateKeyError, err)
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(secret)
+	key.salt = salt
+	key.hash = hashSecret(salt, encoded)
+	return encoded, nil
+}
+
+func hashSecret(salt []byte, secret string) []byte {
+	h := sha256.New()
+	h.Write(salt)
+	h.Write([]byte(secret))
+	return h.Sum(nil)
+}
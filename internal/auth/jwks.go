@@ -0,0 +1,202 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// jwksMinRefresh bounds how often unknown key IDs can trigger a fetch.
+	jwksMinRefresh   = 30 * time.Second
+	jwksFetchTimeout = 10 * time.Second
+	jwksMaxBytes     = 1 << 20
+
+	fetchJWKSError    = "failed to fetch JWKS: %w"
+	jwksStatusError   = "unexpected JWKS response status %s"
+	invalidJWKError   = "invalid %s key %q"
+	unsupportedJWKKty = "unsupported key type %q"
+)
+
+// JWKS is a KeySource backed by a JSON Web Key Set loaded from a file or an
+// http(s) URL. Keys are cached for the TTL and refetched early when a token
+// names a key ID that is not cached yet, so that rotated keys are picked up.
+type JWKS struct {
+	location string
+	ttl      time.Duration
+	client   *http.Client
+
+	mu          sync.Mutex
+	keys        StaticKeys
+	err         error
+	fetchedAt   time.Time
+	attemptedAt time.Time
+}
+
+func NewJWKS(location string, ttl time.Duration) *JWKS {
+	return &JWKS{location: location, ttl: ttl, client: &http.Client{Timeout: jwksFetchTimeout}}
+}
+
+func (j *JWKS) LookupKey(ctx context.Context, kid, alg string) (*Key, error) {
+	// Holding the lock while fetching makes concurrent misses share one fetch
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if time.Since(j.fetchedAt) > j.ttl && j.canRefresh() {
+		j.refresh(ctx)
+	}
+
+	key, err := j.keys.LookupKey(ctx, kid, alg)
+	if errors.Is(err, ErrKeyNotFound) && kid != "" && j.canRefresh() {
+		j.refresh(ctx)
+		key, err = j.keys.LookupKey(ctx, kid, alg)
+	}
+	if err != nil && j.keys == nil && j.err != nil {
+		return nil, j.err
+	}
+	return key, err
+}
+
+// canRefresh never allows fetches more often than the TTL or jwksMinRefresh.
+func (j *JWKS) canRefresh() bool {
+	interval := jwksMinRefresh
+	if j.ttl < interval {
+		interval = j.ttl
+	}
+	return time.Since(j.attemptedAt) >= interval
+}
+
+// refresh keeps serving the cached keys when the fetch fails.
+func (j *JWKS) refresh(ctx context.Context) {
+	j.attemptedAt = time.Now()
+	keys, err := j.fetch(ctx)
+	if err != nil {
+		log.Printf("Error refreshing JWKS from %s: %v", j.location, err)
+		j.err = err
+		return
+	}
+	j.keys, j.err, j.fetchedAt = keys, nil, j.attemptedAt
+}
+
+func (j *JWKS) fetch(ctx context.Context) (StaticKeys, error) {
+	data, err := j.read(ctx)
+	if err != nil {
+		return nil, fmt.Errorf(fetchJWKSError, err)
+	}
+	return ParseJWKS(data)
+}
+
+func (j *JWKS) read(ctx context.Context) ([]byte, error) {
+	if !strings.HasPrefix(j.location, "http://") && !strings.HasPrefix(j.location, "https://") {
+		return os.ReadFile(j.location)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, j.location, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := j.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf(jwksStatusError, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, jwksMaxBytes))
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+// ParseJWKS parses a JSON Web Key Set. Encryption keys and keys for
+// unsupported algorithms are skipped.
+func ParseJWKS(data []byte) (StaticKeys, error) {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+
+	keys := StaticKeys{}
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.key()
+		if err != nil {
+			log.Printf("Skipping JWKS key %q: %v", jwk.Kid, err)
+			continue
+		}
+		if jwk.Alg != "" && jwk.Alg != key.Algorithm {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (jwk jsonWebKey) key() (Key, error) {
+	switch jwk.Kty {
+	case "oct":
+		secret, err := decodeJWKField(jwk.K)
+		if err != nil || len(secret) == 0 {
+			return Key{}, fmt.Errorf(invalidJWKError, jwk.Kty, jwk.Kid)
+		}
+		return NewHMACKey(jwk.Kid, secret), nil
+	case "RSA":
+		n, errN := decodeJWKField(jwk.N)
+		e, errE := decodeJWKField(jwk.E)
+		if errN != nil || errE != nil || len(n) == 0 || len(e) == 0 || len(e) > 4 {
+			return Key{}, fmt.Errorf(invalidJWKError, jwk.Kty, jwk.Kid)
+		}
+		return NewPublicKey(jwk.Kid, &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		})
+	case "EC":
+		if jwk.Crv != "P-256" {
+			return Key{}, fmt.Errorf(unsupportedCurveError, jwk.Crv)
+		}
+		x, errX := decodeJWKField(jwk.X)
+		y, errY := decodeJWKField(jwk.Y)
+		if errX != nil || errY != nil {
+			return Key{}, fmt.Errorf(invalidJWKError, jwk.Kty, jwk.Kid)
+		}
+		public := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !public.Curve.IsOnCurve(public.X, public.Y) {
+			return Key{}, fmt.Errorf(invalidJWKError, jwk.Kty, jwk.Kid)
+		}
+		return NewPublicKey(jwk.Kid, public)
+	}
+	return Key{}, fmt.Errorf(unsupportedJWKKty, jwk.Kty)
+}
+
+func decodeJWKField(value string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+}
@@ -0,0 +1,300 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+	"time"
+)
+
+const (
+	AlgHS256 = "HS256"
+	AlgRS256 = "RS256"
+	AlgES256 = "ES256"
+
+	es256CoordinateBytes = 32
+
+	malformedTokenError    = "malformed token"
+	unsupportedAlgError    = "unsupported algorithm %q"
+	unknownKeyError        = "no %s key for kid %q"
+	invalidSignatureError  = "invalid signature"
+	missingClaimError      = "missing %s claim"
+	tokenExpiredError      = "token expired"
+	tokenNotYetValidError  = "token not valid yet"
+	untrustedIssuerError   = "untrusted issuer %q"
+	invalidAudienceError   = "token is not intended for %q"
+	keyNotFoundError       = "key not found"
+	invalidPEMError        = "no PEM data found"
+	unsupportedKeyError    = "unsupported public key type %T"
+	unsupportedCurveError  = "unsupported curve %s"
+	subjectTooLongError    = "subject is longer than %d characters"
+	unauthenticatedWrapper = "%w: "
+)
+
+// ErrKeyNotFound is returned by a KeySource that has no key for a token.
+var ErrKeyNotFound = errors.New(keyNotFoundError)
+
+// Key is a JWT verification key for a single algorithm.
+type Key struct {
+	ID        string
+	Algorithm string
+	secret    []byte
+	public    crypto.PublicKey
+}
+
+func NewHMACKey(id string, secret []byte) Key {
+	return Key{ID: id, Algorithm: AlgHS256, secret: secret}
+}
+
+// NewPublicKey infers the algorithm from the key: RS256 for RSA keys and
+// ES256 for P-256 keys.
+func NewPublicKey(id string, public crypto.PublicKey) (Key, error) {
+	switch k := public.(type) {
+	case *rsa.PublicKey:
+		return Key{ID: id, Algorithm: AlgRS256, public: k}, nil
+	case *ecdsa.PublicKey:
+		if k.Curve.Params().Name != "P-256" {
+			return Key{}, fmt.Errorf(unsupportedCurveError, k.Curve.Params().Name)
+		}
+		return Key{ID: id, Algorithm: AlgES256, public: k}, nil
+	}
+	return Key{}, fmt.Errorf(unsupportedKeyError, public)
+}
+
+// ParsePublicKeyPEM parses a PEM encoded PKIX public key.
+func ParsePublicKeyPEM(id string, data []byte) (Key, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return Key{}, errors.New(invalidPEMError)
+	}
+	public, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return Key{}, err
+	}
+	return NewPublicKey(id, public)
+}
+
+// matches reports whether the key can verify a token. Keys without an ID
+// match any kid so that a single configured key needs no kid.
+func (k Key) matches(kid, alg string) bool {
+	return k.Algorithm == alg && (k.ID == "" || k.ID == kid)
+}
+
+func (k Key) verify(signed string, signature []byte) bool {
+	digest := sha256.Sum256([]byte(signed))
+	switch k.Algorithm {
+	case AlgHS256:
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write([]byte(signed))
+		return hmac.Equal(signature, mac.Sum(nil))
+	case AlgRS256:
+		public, ok := k.public.(*rsa.PublicKey)
+		return ok && rsa.VerifyPKCS1v15(public, crypto.SHA256, digest[:], signature) == nil
+	case AlgES256:
+		public, ok := k.public.(*ecdsa.PublicKey)
+		if !ok || len(signature) != 2*es256CoordinateBytes {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:es256CoordinateBytes])
+		s := new(big.Int).SetBytes(signature[es256CoordinateBytes:])
+		return ecdsa.Verify(public, digest[:], r, s)
+	}
+	return false
+}
+
+type KeySource interface {
+	// LookupKey returns ErrKeyNotFound when the source has no matching key.
+	LookupKey(ctx context.Context, kid, alg string) (*Key, error)
+}
+
+// StaticKeys is a fixed set of keys, typically loaded from config.
+type StaticKeys []Key
+
+func (keys StaticKeys) LookupKey(_ context.Context, kid, alg string) (*Key, error) {
+	for i := range keys {
+		if keys[i].matches(kid, alg) {
+			return &keys[i], nil
+		}
+	}
+	return nil, ErrKeyNotFound
+}
+
+type JWTConfig struct {
+	// Issuers lists the accepted iss claims. Any issuer is accepted when empty.
+	Issuers []string
+	// Audience must be one of the token's aud claims when set.
+	Audience string
+	// ClockSkew is tolerated when checking exp and nbf.
+	ClockSkew time.Duration
+}
+
+// JWTAuthenticator verifies bearer JWTs signed with HS256, RS256 or ES256.
+type JWTAuthenticator struct {
+	config  JWTConfig
+	sources []KeySource
+	now     func() time.Time
+}
+
+func NewJWTAuthenticator(config JWTConfig, sources ...KeySource) *JWTAuthenticator {
+	return &JWTAuthenticator{config: config, sources: sources, now: time.Now}
+}
+
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+}
+
+type jwtClaims struct {
+	Subject   string     `json:"sub"`
+	Issuer    string     `json:"iss"`
+	Audience  stringList `json:"aud"`
+	ExpiresAt *float64   `json:"exp"`
+	NotBefore *float64   `json:"nbf"`
+	TenantID  string     `json:"tenant_id"`
+	Roles     stringList `json:"roles"`
+	Scope     string     `json:"scope"`
+	Teams     stringList `json:"teams"`
+}
+
+// stringList accepts either a single string or an array of strings, as
+// allowed for the aud claim.
+type stringList []string
+
+func (l *stringList) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*l = stringList{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*l = list
+	return nil
+}
+
+// Authenticate verifies the token and maps its claims to a principal: iss and
+// sub make up the subject, tenant_id the tenant, roles the roles, scope the
+// space-separated scopes and teams the teams.
+func (a *JWTAuthenticator) Authenticate(ctx context.Context, token string) (*Principal, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, unauthenticated(malformedTokenError)
+	}
+
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, unauthenticated(malformedTokenError)
+	}
+	if header.Algorithm != AlgHS256 && header.Algorithm != AlgRS256 && header.Algorithm != AlgES256 {
+		return nil, unauthenticated(unsupportedAlgError, header.Algorithm)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, unauthenticated(malformedTokenError)
+	}
+
+	key, err := a.lookupKey(ctx, header.KeyID, header.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	if !key.verify(parts[0]+"."+parts[1], signature) {
+		return nil, unauthenticated(invalidSignatureError)
+	}
+
+	var claims jwtClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, unauthenticated(malformedTokenError)
+	}
+	if err := a.checkClaims(&claims); err != nil {
+		return nil, err
+	}
+
+	return &Principal{
+		Subject:  TokenSubject(claims.Issuer, claims.Subject),
+		TenantID: claims.TenantID,
+		Roles:    claims.Roles,
+		Scopes:   strings.Fields(claims.Scope),
+		Teams:    claims.Teams,
+	}, nil
+}
+
+func (a *JWTAuthenticator) lookupKey(ctx context.Context, kid, alg string) (*Key, error) {
+	for _, source := range a.sources {
+		key, err := source.LookupKey(ctx, kid, alg)
+		if errors.Is(err, ErrKeyNotFound) {
+			continue
+		}
+		return key, err
+	}
+	return nil, unauthenticated(unknownKeyError, alg, kid)
+}
+
+func (a *JWTAuthenticator) checkClaims(claims *jwtClaims) error {
+	now := a.now()
+	if claims.ExpiresAt == nil {
+		return unauthenticated(missingClaimError, "exp")
+	}
+	if now.After(numericDate(*claims.ExpiresAt).Add(a.config.ClockSkew)) {
+		return unauthenticated(tokenExpiredError)
+	}
+	if claims.NotBefore != nil && now.Add(a.config.ClockSkew).Before(numericDate(*claims.NotBefore)) {
+		return unauthenticated(tokenNotYetValidError)
+	}
+	if len(a.config.Issuers) > 0 && !containsString(a.config.Issuers, claims.Issuer) {
+		return unauthenticated(untrustedIssuerError, claims.Issuer)
+	}
+	if a.config.Audience != "" && !containsString(claims.Audience, a.config.Audience) {
+		return unauthenticated(invalidAudienceError, a.config.Audience)
+	}
+	if claims.Subject == "" {
+		return unauthenticated(missingClaimError, "sub")
+	}
+	if len(TokenSubject(claims.Issuer, claims.Subject)) > MaxSubjectLength {
+		return unauthenticated(subjectTooLongError, MaxSubjectLength)
+	}
+	if claims.TenantID == "" {
+		return unauthenticated(missingClaimError, "tenant_id")
+	}
+	return nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// numericDate converts a JWT NumericDate, which may have a fractional part.
+func numericDate(seconds float64) time.Time {
+	whole, frac := math.Modf(seconds)
+	return time.Unix(int64(whole), int64(frac*float64(time.Second)))
+}
+
+func unauthenticated(format string, args ...interface{}) error {
+	return fmt.Errorf(unauthenticatedWrapper+format, append([]interface{}{ErrUnauthenticated}, args...)...)
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,135 @@
+package auth
+
+import "context"
+
+const (
+	RoleViewer  = "viewer"
+	RoleEditor  = "editor"
+	RoleAdmin   = "admin"
+	RoleAuditor = "auditor"
+
+	PermContactsRead  = "contacts:read"
+	PermContactsWrite = "contacts:write"
+	// PermContactsForce lets callers override checks such as the duplicate
+	// policy when adding contacts.
+	PermContactsForce = "contacts:force"
+	PermSchemaWrite   = "schema:write"
+	PermAPIKeysRead   = "api_keys:read"
+	PermAPIKeysWrite  = "api_keys:write"
+	PermRolesRead     = "roles:read"
+	PermRolesWrite    = "roles:write"
+	PermUsersRead     = "users:read"
+	PermUsersWrite    = "users:write"
+	PermWebhooksRead  = "webhooks:read"
+	PermWebhooksWrite = "webhooks:write"
+	// PermEventsRead lets callers stream the changes to every contact of
+	// the tenant.
+	PermEventsRead = "events:read"
+)
+
+// rolePermissions is the single source of truth for what each role may do.
+var rolePermissions = map[string][]string{
+	RoleViewer:  {PermContactsRead},
+	RoleEditor:  {PermContactsRead, PermContactsWrite},
+	RoleAuditor: {PermContactsRead, PermAPIKeysRead, PermRolesRead, PermUsersRead, PermWebhooksRead, PermEventsRead},
+	RoleAdmin: {
+		PermContactsRead, PermContactsWrite, PermContactsForce, PermSchemaWrite,
+		PermAPIKeysRead, PermAPIKeysWrite, PermRolesRead, PermRolesWrite,
+		PermUsersRead, PermUsersWrite, PermWebhooksRead, PermWebhooksWrite, PermEventsRead,
+	},
+}
+
+// scopeRoles maps API key and token scopes that stand for a whole role.
+// Other scopes grant the permission of the same name.
+var scopeRoles = map[string]string{
+	ScopeAdmin: RoleAdmin,
+}
+
+// IsRole reports whether the name is a known role.
+func IsRole(name string) bool {
+	_, ok := rolePermissions[name]
+	return ok
+}
+
+// RoleStore returns the roles an admin assigned to a user of the current
+// tenant, and the roles the tenant only grants with MFA.
+type RoleStore interface {
+	FetchRoles(ctx context.Context, userID string) ([]string, error)
+	FetchMFARoles(ctx context.Context) ([]string, error)
+}
+
+// Policy decides whether a principal holds a permission, based on its roles,
+// the roles assigned to its user and its scopes. API keys are authorized by
+// their scopes alone.
+type Policy struct {
+	store RoleStore
+}
+
+func NewPolicy(store RoleStore) *Policy {
+	return &Policy{store: store}
+}
+
+func (p *Policy) Authorize(ctx context.Context, principal *Principal, permission string) (bool, error) {
+	roles := principal.Roles
+	if p.store != nil && principal.Subject != "" && principal.KeyID == 0 {
+		assigned, err := p.store.FetchRoles(ctx, principal.Subject)
+		if err != nil {
+			return false, err
+		}
+		roles = append(append([]string{}, roles...), assigned...)
+	}
+	if p.store != nil && principal.MFAMissing {
+		enforced, err := p.store.FetchMFARoles(ctx)
+		if err != nil {
+			return false, err
+		}
+		roles = withoutRoles(roles, enforced)
+	}
+
+	for _, role := range roles {
+		if containsString(rolePermissions[role], permission) {
+			return true, nil
+		}
+	}
+	for _, scope := range principal.Scopes {
+		if role, ok := scopeRoles[scope]; ok && containsString(rolePermissions[role], permission) {
+			return true, nil
+		}
+		if scope == permission {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+type policyKey struct{}
+
+// WithPolicy returns a context that carries the policy a request was
+// authorized with, so that handlers can check further permissions.
+func WithPolicy(ctx context.Context, policy *Policy) context.Context {
+	return context.WithValue(ctx, policyKey{}, policy)
+}
+
+// Allowed reports whether the principal of ctx has the permission under the
+// policy of ctx, or under its roles and scopes alone when there is none.
+func Allowed(ctx context.Context, permission string) (bool, error) {
+	principal, ok := FromContext(ctx)
+	if !ok {
+		return false, nil
+	}
+	policy, ok := ctx.Value(policyKey{}).(*Policy)
+	if !ok || policy == nil {
+		policy = &Policy{}
+	}
+	return policy.Authorize(ctx, principal, permission)
+}
+
+func withoutRoles(roles, removed []string) []string {
+	var kept []string
+	for _, role := range roles {
+		if !containsString(removed, role) {
+			kept = append(kept, role)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,111 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+const (
+	noTenantError        = "no tenant in request context"
+	unauthenticatedError = "unauthenticated"
+
+	ScopeContactsRead  = "contacts:read"
+	ScopeContactsWrite = "contacts:write"
+	ScopeAdmin         = "admin"
+
+	// Subjects are namespaced by where the caller authenticated, since local
+	// user IDs and the subjects of every token issuer are picked
+	// independently of each other and may collide
+	userSubjectPrefix  = "user:"
+	tokenSubjectPrefix = "jwt:"
+	issuerSeparator    = "|"
+	// MaxSubjectLength is the longest subject roles, phone books and shares
+	// are stored for.
+	MaxSubjectLength = 255
+)
+
+// ErrNoTenant is returned when a request reaches the data layer without an
+// authenticated principal. Repositories fail closed on it instead of reading
+// across tenants.
+var ErrNoTenant = errors.New(noTenantError)
+
+// ErrUnauthenticated is wrapped by authenticators when credentials are invalid,
+// as opposed to failing to check them.
+var ErrUnauthenticated = errors.New(unauthenticatedError)
+
+// Principal is the authenticated caller of a request.
+type Principal struct {
+	Subject  string
+	TenantID string
+	Roles    []string
+	Scopes   []string
+	// Teams are the teams the caller belongs to, which shares can name.
+	Teams []string
+	// KeyID is set when the caller authenticated with an API key.
+	KeyID int
+	// UserID is set when the caller is a local user with a session.
+	UserID int
+	// MFAMissing is set for user sessions without a second factor, which do
+	// not get the roles that require MFA.
+	MFAMissing bool
+}
+
+// Owner returns the user whose personal phone book the principal works in.
+// API keys and admin tokens act for the whole tenant and have none.
+func (p *Principal) Owner() string {
+	if p.KeyID != 0 || containsString(p.Scopes, ScopeAdmin) {
+		return ""
+	}
+	return p.Subject
+}
+
+// UserSubject returns the subject of a local user's sessions.
+func UserSubject(userID int) string {
+	return userSubjectPrefix + strconv.Itoa(userID)
+}
+
+// TokenSubject returns the subject of a token's caller, which is only
+// unique together with the issuer of the token.
+func TokenSubject(issuer, subject string) string {
+	return tokenSubjectPrefix + issuer + issuerSeparator + subject
+}
+
+// IsSubject reports whether s is a user or token subject, which roles are
+// assigned to and phone books shared with.
+func IsSubject(s string) bool {
+	if len(s) > MaxSubjectLength {
+		return false
+	}
+	switch {
+	case strings.HasPrefix(s, userSubjectPrefix):
+		id := strings.TrimPrefix(s, userSubjectPrefix)
+		userID, err := strconv.Atoi(id)
+		return err == nil && userID > 0 && strconv.Itoa(userID) == id
+	case strings.HasPrefix(s, tokenSubjectPrefix):
+		separator := strings.LastIndex(s, issuerSeparator)
+		return separator > 0 && separator < len(s)-1
+	}
+	return false
+}
+
+type principalKey struct{}
+
+func NewContext(ctx context.Context, principal *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+func FromContext(ctx context.Context) (*Principal, bool) {
+	principal, ok := ctx.Value(principalKey{}).(*Principal)
+	return principal, ok && principal != nil
+}
+
+// TenantID returns the tenant that every query of the request must be scoped to.
+func TenantID(ctx context.Context) (string, error) {
+	principal, ok := FromContext(ctx)
+	if !ok || principal.TenantID == "" {
+		return "", ErrNoTenant
+	}
+	return principal.TenantID, nil
+}
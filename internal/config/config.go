@@ -2,6 +2,7 @@ package config
 
 import (
 	"log"
+	"time"
 
 	"github.com/spf13/viper"
 )
@@ -12,6 +13,42 @@ type Config struct {
 	DBName     string
 	DBHost     string
 	DBPort     string
+
+	DefaultTenant   string
+	AuthRequired    bool
+	BootstrapAPIKey string
+
+	JWTIssuers       []string
+	JWTAudience      string
+	JWTClockSkew     time.Duration
+	JWTSecret        string
+	JWTPublicKeyFile string
+	JWKSURL          string
+	JWKSCacheTTL     time.Duration
+
+	SessionTTL          time.Duration
+	SessionCookieSecure bool
+
+	PublicURL       string
+	ShareLinkSecret string
+
+	JobWorkers int
+
+	IdempotencyTTL time.Duration
+
+	TxIsolation  string
+	TxMaxRetries int
+
+	PhoneCountryCode string
+	DuplicatePolicy  string
+
+	WebhookWorkers      int
+	WebhookMaxAttempts  int
+	WebhookBackoff      time.Duration
+	WebhookAllowPrivate bool
+
+	OutboxSinks []string
+	OutboxFile  string
 }
 
 var AppConfig Config
@@ -26,6 +63,57 @@ const (
 	dbNameEnv      = "DB_NAME"
 	dbHostEnv      = "DB_HOST"
 	dbPortEnv      = "DB_PORT"
+
+	defaultTenantEnv   = "DEFAULT_TENANT"
+	defaultTenant      = "default"
+	authRequiredEnv    = "AUTH_REQUIRED"
+	bootstrapAPIKeyEnv = "BOOTSTRAP_API_KEY"
+
+	jwtIssuersEnv       = "JWT_ISSUERS"
+	jwtAudienceEnv      = "JWT_AUDIENCE"
+	jwtClockSkewEnv     = "JWT_CLOCK_SKEW"
+	jwtClockSkew        = time.Minute
+	jwtSecretEnv        = "JWT_SECRET"
+	jwtPublicKeyFileEnv = "JWT_PUBLIC_KEY_FILE"
+	jwksURLEnv          = "JWKS_URL"
+	jwksCacheTTLEnv     = "JWKS_CACHE_TTL"
+	jwksCacheTTL        = 10 * time.Minute
+
+	sessionTTLEnv          = "SESSION_TTL"
+	sessionTTL             = 12 * time.Hour
+	sessionCookieSecureEnv = "SESSION_COOKIE_SECURE"
+
+	publicURLEnv       = "PUBLIC_URL"
+	shareLinkSecretEnv = "SHARE_LINK_SECRET"
+
+	jobWorkersEnv = "JOB_WORKERS"
+	jobWorkers    = 2
+
+	idempotencyTTLEnv = "IDEMPOTENCY_TTL"
+	idempotencyTTL    = 24 * time.Hour
+
+	txIsolationEnv  = "TX_ISOLATION"
+	txIsolation     = "read-committed"
+	txMaxRetriesEnv = "TX_MAX_RETRIES"
+	txMaxRetries    = 3
+
+	phoneCountryCodeEnv = "PHONE_COUNTRY_CODE"
+	phoneCountryCode    = "972"
+	duplicatePolicyEnv  = "DUPLICATE_POLICY"
+	duplicatePolicy     = "warn"
+
+	webhookWorkersEnv      = "WEBHOOK_WORKERS"
+	webhookWorkers         = 1
+	webhookMaxAttemptsEnv  = "WEBHOOK_MAX_ATTEMPTS"
+	webhookMaxAttempts     = 8
+	webhookBackoffEnv      = "WEBHOOK_BACKOFF"
+	webhookBackoff         = 30 * time.Second
+	webhookAllowPrivateEnv = "WEBHOOK_ALLOW_PRIVATE"
+
+	outboxSinksEnv = "OUTBOX_SINKS"
+	outboxSinks    = "webhooks sse"
+	outboxFileEnv  = "OUTBOX_FILE"
+	outboxFile     = "events.ndjson"
 )
 
 func InitConfig() {
@@ -41,6 +129,51 @@ func InitConfig() {
 	viper.BindEnv(dbNameEnv)
 	viper.BindEnv(dbHostEnv)
 	viper.BindEnv(dbPortEnv)
+	viper.BindEnv(defaultTenantEnv)
+	viper.BindEnv(authRequiredEnv)
+	viper.BindEnv(bootstrapAPIKeyEnv)
+	viper.BindEnv(jwtIssuersEnv)
+	viper.BindEnv(jwtAudienceEnv)
+	viper.BindEnv(jwtClockSkewEnv)
+	viper.BindEnv(jwtSecretEnv)
+	viper.BindEnv(jwtPublicKeyFileEnv)
+	viper.BindEnv(jwksURLEnv)
+	viper.BindEnv(jwksCacheTTLEnv)
+	viper.BindEnv(sessionTTLEnv)
+	viper.BindEnv(sessionCookieSecureEnv)
+	viper.BindEnv(publicURLEnv)
+	viper.BindEnv(shareLinkSecretEnv)
+	viper.BindEnv(jobWorkersEnv)
+	viper.BindEnv(idempotencyTTLEnv)
+	viper.BindEnv(txIsolationEnv)
+	viper.BindEnv(txMaxRetriesEnv)
+	viper.BindEnv(phoneCountryCodeEnv)
+	viper.BindEnv(duplicatePolicyEnv)
+	viper.BindEnv(webhookWorkersEnv)
+	viper.BindEnv(webhookMaxAttemptsEnv)
+	viper.BindEnv(webhookBackoffEnv)
+	viper.BindEnv(webhookAllowPrivateEnv)
+	viper.BindEnv(outboxSinksEnv)
+	viper.BindEnv(outboxFileEnv)
+
+	viper.SetDefault(defaultTenantEnv, defaultTenant)
+	viper.SetDefault(authRequiredEnv, true)
+	viper.SetDefault(jwtClockSkewEnv, jwtClockSkew)
+	viper.SetDefault(jwksCacheTTLEnv, jwksCacheTTL)
+	viper.SetDefault(sessionTTLEnv, sessionTTL)
+	viper.SetDefault(sessionCookieSecureEnv, true)
+	viper.SetDefault(jobWorkersEnv, jobWorkers)
+	viper.SetDefault(idempotencyTTLEnv, idempotencyTTL)
+	viper.SetDefault(txIsolationEnv, txIsolation)
+	viper.SetDefault(txMaxRetriesEnv, txMaxRetries)
+	viper.SetDefault(phoneCountryCodeEnv, phoneCountryCode)
+	viper.SetDefault(duplicatePolicyEnv, duplicatePolicy)
+	viper.SetDefault(webhookWorkersEnv, webhookWorkers)
+	viper.SetDefault(webhookMaxAttemptsEnv, webhookMaxAttempts)
+	viper.SetDefault(webhookBackoffEnv, webhookBackoff)
+	viper.SetDefault(webhookAllowPrivateEnv, false)
+	viper.SetDefault(outboxSinksEnv, outboxSinks)
+	viper.SetDefault(outboxFileEnv, outboxFile)
 
 	if err := viper.ReadInConfig(); err != nil {
 		log.Printf("Error reading config file, %s", err)
@@ -52,5 +185,41 @@ func InitConfig() {
 		DBName:     viper.GetString(dbNameEnv),
 		DBHost:     viper.GetString(dbHostEnv),
 		DBPort:     viper.GetString(dbPortEnv),
+
+		DefaultTenant:   viper.GetString(defaultTenantEnv),
+		AuthRequired:    viper.GetBool(authRequiredEnv),
+		BootstrapAPIKey: viper.GetString(bootstrapAPIKeyEnv),
+
+		JWTIssuers:       viper.GetStringSlice(jwtIssuersEnv),
+		JWTAudience:      viper.GetString(jwtAudienceEnv),
+		JWTClockSkew:     viper.GetDuration(jwtClockSkewEnv),
+		JWTSecret:        viper.GetString(jwtSecretEnv),
+		JWTPublicKeyFile: viper.GetString(jwtPublicKeyFileEnv),
+		JWKSURL:          viper.GetString(jwksURLEnv),
+		JWKSCacheTTL:     viper.GetDuration(jwksCacheTTLEnv),
+
+		SessionTTL:          viper.GetDuration(sessionTTLEnv),
+		SessionCookieSecure: viper.GetBool(sessionCookieSecureEnv),
+
+		PublicURL:       viper.GetString(publicURLEnv),
+		ShareLinkSecret: viper.GetString(shareLinkSecretEnv),
+
+		JobWorkers: viper.GetInt(jobWorkersEnv),
+
+		IdempotencyTTL: viper.GetDuration(idempotencyTTLEnv),
+
+		TxIsolation:  viper.GetString(txIsolationEnv),
+		TxMaxRetries: viper.GetInt(txMaxRetriesEnv),
+
+		PhoneCountryCode: viper.GetString(phoneCountryCodeEnv),
+		DuplicatePolicy:  viper.GetString(duplicatePolicyEnv),
+
+		WebhookWorkers:      viper.GetInt(webhookWorkersEnv),
+		WebhookMaxAttempts:  viper.GetInt(webhookMaxAttemptsEnv),
+		WebhookBackoff:      viper.GetDuration(webhookBackoffEnv),
+		WebhookAllowPrivate: viper.GetBool(webhookAllowPrivateEnv),
+
+		OutboxSinks: viper.GetStringSlice(outboxSinksEnv),
+		OutboxFile:  viper.GetString(outboxFileEnv),
 	}
 }
@@ -0,0 +1,134 @@
+package contacts
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+)
+
+const (
+	missingBatchContactError = "contact is required"
+	invalidBatchContactError = "contact is not a valid contact object"
+	missingBatchIDError      = "id or id_ref is required"
+	unknownBatchRefError     = "id_ref does not name an earlier create"
+	batchRolledBackError     = "rolled back because another operation failed"
+	batchNotRunError         = "not run because an earlier operation failed"
+)
+
+var (
+	ErrMissingBatchContact = errors.New(missingBatchContactError)
+	ErrInvalidBatchContact = errors.New(invalidBatchContactError)
+	ErrMissingBatchID      = errors.New(missingBatchIDError)
+	ErrUnknownBatchRef     = errors.New(unknownBatchRefError)
+	ErrBatchRolledBack     = errors.New(batchRolledBackError)
+	ErrBatchNotRun         = errors.New(batchNotRunError)
+
+	errBatchFailed = errors.New("batch operation failed")
+)
+
+// Batch applies the operations in order and returns their outcomes. Atomic
+// batches run in one transaction and stop at the first failure, which rolls
+// back the operations before it.
+func (s *Service) Batch(ctx context.Context, batch BatchRequest) ([]BatchOutcome, error) {
+	outcomes := make([]BatchOutcome, len(batch.Operations))
+	if batch.Mode == BatchPartial {
+		s.applyOperations(ctx, batch.Operations, outcomes, false)
+		return outcomes, nil
+	}
+
+	failed := -1
+	err := s.repo.WithTx(ctx, func(repo Repository) error {
+		if failed = s.withRepo(repo).applyOperations(ctx, batch.Operations, outcomes, true); failed >= 0 {
+			// A conflict with another transaction runs the batch again
+			if isRetryable(outcomes[failed].Err) {
+				return outcomes[failed].Err
+			}
+			return errBatchFailed
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errBatchFailed) {
+		return nil, err
+	}
+	if failed >= 0 {
+		for i := range outcomes {
+			switch {
+			case i < failed:
+				outcomes[i] = BatchOutcome{ID: batch.Operations[i].ID, Err: ErrBatchRolledBack}
+			case i > failed:
+				outcomes[i] = BatchOutcome{ID: batch.Operations[i].ID, Err: ErrBatchNotRun}
+			}
+		}
+	}
+	return outcomes, nil
+}
+
+// applyOperations fills in the outcome of every operation and returns the
+// index of the one it stopped at, or -1.
+func (s *Service) applyOperations(ctx context.Context, operations []BatchOperation, outcomes []BatchOutcome, stopOnError bool) int {
+	refs := make(map[string]int)
+	for i, operation := range operations {
+		outcomes[i] = s.applyOperation(ctx, operation, refs)
+		if outcomes[i].Err != nil && stopOnError {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *Service) applyOperation(ctx context.Context, operation BatchOperation, refs map[string]int) BatchOutcome {
+	id := operation.ID
+	if operation.Op == BatchCreate {
+		id = 0
+	} else if operation.IDRef != "" {
+		var ok bool
+		if id, ok = refs[operation.IDRef]; !ok {
+			return BatchOutcome{Err: ErrUnknownBatchRef}
+		}
+	}
+	if id == 0 && operation.Op != BatchCreate {
+		return BatchOutcome{Err: ErrMissingBatchID}
+	}
+
+	if operation.Op == BatchDelete {
+		return BatchOutcome{ID: id, Err: s.DeleteContact(ctx, id)}
+	}
+
+	// Patches change the fields they name on the stored contact
+	contact := &Contact{}
+	if operation.Op == BatchPatch {
+		stored, err := s.repo.FetchContact(ctx, id)
+		if err != nil {
+			return BatchOutcome{ID: id, Err: err}
+		}
+		contact = stored
+	}
+	if len(operation.Contact) == 0 {
+		return BatchOutcome{ID: id, Err: ErrMissingBatchContact}
+	}
+	if err := json.Unmarshal(operation.Contact, contact); err != nil {
+		return BatchOutcome{ID: id, Err: ErrInvalidBatchContact}
+	}
+	contact.ID = id
+
+	if err := validate.Struct(contact); err != nil {
+		return BatchOutcome{ID: id, Err: err}
+	}
+	if err := s.ValidateCustomFields(ctx, contact); err != nil {
+		return BatchOutcome{ID: id, Err: err}
+	}
+
+	if operation.Op == BatchCreate {
+		if _, err := s.AddContact(ctx, contact, false); err != nil {
+			return BatchOutcome{Err: err}
+		}
+		if operation.Ref != "" {
+			refs[operation.Ref] = contact.ID
+		}
+		return BatchOutcome{ID: contact.ID, Contact: contact}
+	}
+	if err := s.EditContact(ctx, contact); err != nil {
+		return BatchOutcome{ID: id, Err: err}
+	}
+	return BatchOutcome{ID: id, Contact: contact}
+}
@@ -0,0 +1,62 @@
+package contacts
+
+import (
+	"html/template"
+	"io"
+	"strings"
+)
+
+// cardTemplate is the minimal page shown when a share link is opened in a
+// browser. html/template escapes every value.
+var cardTemplate = template.Must(template.New("card").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>{{.Name}}</title>
+<style>
+body { font-family: sans-serif; margin: 2rem auto; max-width: 28rem; color: #222; }
+dl { display: grid; grid-template-columns: max-content auto; gap: .4rem 1rem; }
+dt { color: #666; }
+dd { margin: 0; }
+</style>
+</head>
+<body>
+<h1>{{.Name}}</h1>
+{{with .Title}}<p>{{.}}</p>{{end}}
+<dl>
+<dt>Phone</dt><dd><a href="tel:{{.Contact.PhoneNumber}}">{{.Contact.PhoneNumber}}</a></dd>
+<dt>Address</dt><dd>{{.Contact.Address}}</dd>
+{{with .Contact.Birthday}}<dt>Birthday</dt><dd>{{.}}</dd>{{end}}
+</dl>
+<p><a href="{{.VCardURL}}">Add to contacts</a></p>
+</body>
+</html>
+`))
+
+// writeContactCard renders the card with a link to download it from vcardURL.
+func writeContactCard(w io.Writer, contact Contact, vcardURL string) error {
+	// The title line reads like "Engineer, Platform at Acme"
+	title := strings.Join(nonEmpty(contact.JobTitle, contact.Department), ", ")
+	if contact.Organization != "" {
+		title = strings.TrimSpace(title + " at " + contact.Organization)
+		title = strings.TrimPrefix(title, "at ")
+	}
+	return cardTemplate.Execute(w, struct {
+		Name     string
+		Title    string
+		Contact  Contact
+		VCardURL string
+	}{strings.TrimSpace(contact.FirstName + " " + contact.LastName), title, contact, vcardURL})
+}
+
+func nonEmpty(values ...string) []string {
+	var kept []string
+	for _, value := range values {
+		if value != "" {
+			kept = append(kept, value)
+		}
+	}
+	return kept
+}
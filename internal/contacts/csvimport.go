@@ -0,0 +1,410 @@
+package contacts
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"io"
+	"strings"
+	"time"
+
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+)
+
+const (
+	ProfileAuto    = "auto"
+	ProfileGoogle  = "google"
+	ProfileOutlook = "outlook"
+	// profileHeader maps columns named after the targets, such as first_name
+	// or custom.employee_id, which is the layout of the CSV export.
+	profileHeader = "header"
+
+	targetFirstName    = "first_name"
+	targetLastName     = "last_name"
+	targetName         = "name"
+	targetPhoneNumber  = "phone_number"
+	targetEmail        = "email"
+	targetAddress      = "address"
+	targetBirthday     = "birthday"
+	targetAnniversary  = "anniversary"
+	targetGroups       = "groups"
+	targetOrganization = "organization"
+	targetJobTitle     = "job_title"
+	targetDepartment   = "department"
+	targetNote         = "note"
+	targetCustomPrefix = "custom."
+
+	outlookEmptyDate = "0/0/00"
+	usDateLayout     = "1/2/2006"
+
+	unsupportedEncodingError = "unsupported encoding"
+	unknownLayoutError       = "no mapping profile matches the CSV header"
+	emptyCSVError            = "request body contains no CSV header"
+)
+
+var (
+	ErrUnsupportedEncoding = errors.New(unsupportedEncodingError)
+	ErrUnknownLayout       = errors.New(unknownLayoutError)
+	ErrEmptyCSV            = errors.New(emptyCSVError)
+)
+
+var importTargets = []string{targetFirstName, targetLastName, targetName, targetPhoneNumber, targetEmail, targetAddress,
+	targetBirthday, targetAnniversary, targetGroups, targetOrganization, targetJobTitle, targetDepartment, targetNote}
+
+// builtinProfiles cover the CSV exports of Google Contacts, in both its
+// current and legacy layouts, and of Outlook.
+var builtinProfiles = map[string]map[string]string{
+	ProfileGoogle: {
+		"First Name":                  targetFirstName,
+		"Given Name":                  targetFirstName,
+		"Last Name":                   targetLastName,
+		"Family Name":                 targetLastName,
+		"Name":                        targetName,
+		"Phone 1 - Value":             targetPhoneNumber,
+		"Phone 2 - Value":             targetPhoneNumber,
+		"Phone 3 - Value":             targetPhoneNumber,
+		"E-mail 1 - Value":            targetEmail,
+		"E-mail 2 - Value":            targetEmail,
+		"Address 1 - Formatted":       targetAddress,
+		"Birthday":                    targetBirthday,
+		"Labels":                      targetGroups,
+		"Group Membership":            targetGroups,
+		"Organization Name":           targetOrganization,
+		"Organization 1 - Name":       targetOrganization,
+		"Organization Title":          targetJobTitle,
+		"Organization 1 - Title":      targetJobTitle,
+		"Organization Department":     targetDepartment,
+		"Organization 1 - Department": targetDepartment,
+		"Notes":                       targetNote,
+	},
+	ProfileOutlook: {
+		"First Name":          targetFirstName,
+		"Last Name":           targetLastName,
+		"Primary Phone":       targetPhoneNumber,
+		"Mobile Phone":        targetPhoneNumber,
+		"Home Phone":          targetPhoneNumber,
+		"Business Phone":      targetPhoneNumber,
+		"Other Phone":         targetPhoneNumber,
+		"Business Fax":        targetPhoneNumber,
+		"Pager":               targetPhoneNumber,
+		"E-mail Address":      targetEmail,
+		"E-mail 2 Address":    targetEmail,
+		"E-mail 3 Address":    targetEmail,
+		"Home Street":         targetAddress,
+		"Home City":           targetAddress,
+		"Home State":          targetAddress,
+		"Home Postal Code":    targetAddress,
+		"Home Country/Region": targetAddress,
+		"Birthday":            targetBirthday,
+		"Anniversary":         targetAnniversary,
+		"Categories":          targetGroups,
+		"Company":             targetOrganization,
+		"Job Title":           targetJobTitle,
+		"Department":          targetDepartment,
+		"Notes":               targetNote,
+	},
+}
+
+// phoneColumnTypes gives phone columns a TEL type from their header, e.g.
+// Mobile Phone is a cell number, so extra numbers find matching custom fields.
+var phoneColumnTypes = []struct{ word, telType string }{
+	{"mobile", "cell"},
+	{"fax", "fax"},
+	{"pager", "pager"},
+	{"business", "work"},
+	{"work", "work"},
+	{"home", "home"},
+}
+
+func isImportTarget(target string) bool {
+	if name := strings.TrimPrefix(target, targetCustomPrefix); name != target {
+		return fieldNamePattern.MatchString(name)
+	}
+	return containsString(importTargets, target)
+}
+
+// decodeCSV converts the body to UTF-8. UTF-16 follows its byte order mark
+// and is otherwise little-endian, as Outlook writes it.
+func decodeCSV(body []byte, encoding string) ([]byte, error) {
+	var decoder transform.Transformer
+	switch strings.ToLower(encoding) {
+	case "", "utf-8", "utf8":
+		decoder = unicode.UTF8BOM.NewDecoder()
+	case "utf-16", "utf16":
+		decoder = unicode.UTF16(unicode.LittleEndian, unicode.UseBOM).NewDecoder()
+	case "windows-1255", "cp1255":
+		decoder = charmap.Windows1255.NewDecoder()
+	default:
+		return nil, ErrUnsupportedEncoding
+	}
+	decoded, _, err := transform.Bytes(decoder, body)
+	return decoded, err
+}
+
+// detectDelimiter picks the most frequent of the usual delimiters in the
+// header line.
+func detectDelimiter(body []byte) rune {
+	header := body
+	if i := bytes.IndexByte(body, '\n'); i >= 0 {
+		header = body[:i]
+	}
+	delimiter, most := ',', 0
+	for _, candidate := range []rune{',', ';', '\t', '|'} {
+		if count := bytes.Count(header, []byte(string(candidate))); count > most {
+			delimiter, most = candidate, count
+		}
+	}
+	return delimiter
+}
+
+// headerProfile maps columns named like targets, with any case and spaces
+// for underscores, and columns named after custom fields.
+func headerProfile(header []string, fields []CustomField) map[string]string {
+	columns := map[string]string{}
+	for _, column := range header {
+		name := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(column), " ", "_"))
+		if isImportTarget(name) {
+			columns[column] = name
+			continue
+		}
+		if hasCustomField(fields, name) {
+			columns[column] = targetCustomPrefix + name
+		}
+	}
+	return columns
+}
+
+// columnTargets returns the target of every column, matching headers without
+// regard to case or surrounding space.
+func columnTargets(header []string, profile map[string]string) ([]string, int) {
+	byHeader := make(map[string]string, len(profile))
+	for column, target := range profile {
+		byHeader[strings.ToLower(strings.TrimSpace(column))] = target
+	}
+	targets := make([]string, len(header))
+	mapped := 0
+	for i, column := range header {
+		if target, ok := byHeader[strings.ToLower(strings.TrimSpace(column))]; ok {
+			targets[i] = target
+			mapped++
+		}
+	}
+	return targets, mapped
+}
+
+// mapCSVRow maps a row onto a contact like mapVCard does for cards.
+func mapCSVRow(line int, header, row, targets []string, fields []CustomField) importedCard {
+	imported := importedCard{line: line, lines: map[string]int{}}
+	contact := &imported.contact
+	var fullName string
+	var addressParts []string
+	var tels []vcardTel
+	var emails []vcardProperty
+	for i, value := range row {
+		value = strings.TrimSpace(value)
+		if i >= len(targets) || targets[i] == "" || value == "" {
+			continue
+		}
+
+		switch target := targets[i]; target {
+		case targetFirstName:
+			setFirst(&contact.FirstName, value)
+		case targetLastName:
+			setFirst(&contact.LastName, value)
+		case targetName:
+			setFirst(&fullName, value)
+		case targetPhoneNumber:
+			tels = append(tels, vcardTel{line: line, number: cleanPhoneNumber(value), types: columnTelTypes(header[i])})
+		case targetEmail:
+			emails = append(emails, vcardProperty{line: line, value: value})
+		case targetAddress:
+			addressParts = append(addressParts, strings.Join(strings.Fields(strings.ReplaceAll(value, "\n", ", ")), " "))
+		case targetBirthday, targetAnniversary:
+			date, err := parseCSVDate(value)
+			if errors.Is(err, errYearlessDate) {
+				continue
+			}
+			if err != nil {
+				imported.addError(line, header[i]+": "+err.Error())
+				continue
+			}
+			if target == targetBirthday {
+				setFirst(&contact.Birthday, date)
+			} else {
+				setFirst(&contact.Anniversary, date)
+			}
+		case targetGroups:
+			for _, group := range splitCSVGroups(value) {
+				if !containsString(contact.Groups, group) {
+					contact.Groups = append(contact.Groups, group)
+				}
+			}
+		case targetOrganization:
+			setFirst(&imported.organization, value)
+		case targetJobTitle:
+			setFirst(&contact.JobTitle, value)
+		case targetDepartment:
+			setFirst(&contact.Department, value)
+		case targetNote:
+			imported.notes = append(imported.notes, importedNote{line: line, text: value})
+		default:
+			name := strings.TrimPrefix(target, targetCustomPrefix)
+			imported.setCustom(name, customValue(fields, name, value), line)
+		}
+	}
+
+	if contact.FirstName == "" && contact.LastName == "" && fullName != "" {
+		contact.FirstName = fullName
+		if i := strings.LastIndexByte(fullName, ' '); i > 0 {
+			contact.FirstName, contact.LastName = fullName[:i], fullName[i+1:]
+		}
+	}
+	contact.Address = strings.Join(addressParts, ", ")
+	imported.mapTels(tels, fields)
+	imported.mapEmails(emails, fields)
+	return imported
+}
+
+func setFirst(target *string, value string) {
+	if *target == "" {
+		*target = value
+	}
+}
+
+func columnTelTypes(column string) []string {
+	column = strings.ToLower(column)
+	for _, t := range phoneColumnTypes {
+		if strings.Contains(column, t.word) {
+			return []string{t.telType}
+		}
+	}
+	return nil
+}
+
+// splitCSVGroups splits Google labels, separated by " ::: ", and Outlook
+// categories, separated by semicolons. Google's system labels, such as
+// "* myContacts", are dropped.
+func splitCSVGroups(value string) []string {
+	var groups []string
+	for _, part := range strings.Split(value, ":::") {
+		for _, group := range strings.Split(part, ";") {
+			if group = strings.TrimSpace(group); group != "" && !strings.HasPrefix(group, "*") {
+				groups = append(groups, group)
+			}
+		}
+	}
+	return groups
+}
+
+// parseCSVDate accepts ISO dates and the US dates Outlook writes, where
+// 0/0/00 means no date.
+func parseCSVDate(value string) (string, error) {
+	if value == outlookEmptyDate {
+		return "", errYearlessDate
+	}
+	if date, err := time.Parse(usDateLayout, value); err == nil {
+		return date.Format(dateLayout), nil
+	}
+	return parseVCardDate(value, "")
+}
+
+// readCSVImport decodes the body and maps every row, returning the profile
+// that was used. Rows the CSV reader cannot parse are recorded as errors.
+func readCSVImport(body []byte, opts CSVImportOptions, profiles []ImportProfile, fields []CustomField) ([]importedCard, string, error) {
+	body, err := decodeCSV(body, opts.Encoding)
+	if err != nil {
+		return nil, "", err
+	}
+	reader := csv.NewReader(bytes.NewReader(body))
+	reader.Comma = opts.Delimiter
+	if reader.Comma == 0 {
+		reader.Comma = detectDelimiter(body)
+	}
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if errors.Is(err, io.EOF) {
+		return nil, "", ErrEmptyCSV
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	profile, targets, err := chooseProfile(header, opts.Profile, profiles, fields)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var rows []importedCard
+	for {
+		row, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			imported := importedCard{line: parseErr.StartLine, lines: map[string]int{}}
+			imported.addError(parseErr.Line, parseErr.Err.Error())
+			rows = append(rows, imported)
+			continue
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		line, _ := reader.FieldPos(0)
+		rows = append(rows, mapCSVRow(line, header, row, targets, fields))
+	}
+	return rows, profile, nil
+}
+
+// chooseProfile resolves the named profile, or picks the one that maps the
+// most header columns.
+func chooseProfile(header []string, name string, profiles []ImportProfile, fields []CustomField) (string, []string, error) {
+	candidates := map[string]map[string]string{profileHeader: headerProfile(header, fields)}
+	order := []string{ProfileGoogle, ProfileOutlook, profileHeader}
+	for builtin, columns := range builtinProfiles {
+		candidates[builtin] = columns
+	}
+	for _, profile := range profiles {
+		candidates[profile.Name] = profile.Columns
+		order = append(order, profile.Name)
+	}
+
+	if name != "" && name != ProfileAuto {
+		columns, ok := candidates[name]
+		if !ok || name == profileHeader {
+			return "", nil, ErrProfileNotFound
+		}
+		targets, _ := columnTargets(header, columns)
+		return name, targets, nil
+	}
+
+	best, bestTargets, most := "", []string(nil), 0
+	for _, candidate := range order {
+		if targets, mapped := columnTargets(header, candidates[candidate]); mapped > most {
+			best, bestTargets, most = candidate, targets, mapped
+		}
+	}
+	if most == 0 {
+		return "", nil, ErrUnknownLayout
+	}
+	return best, bestTargets, nil
+}
+
+// parseDelimiter reads the delimiter option, which is a single character or
+// "tab".
+func parseDelimiter(value string) (rune, bool) {
+	switch value {
+	case "":
+		return 0, true
+	case "tab", `\t`:
+		return '\t', true
+	}
+	runes := []rune(value)
+	if len(runes) != 1 || runes[0] == '"' || runes[0] == '\r' || runes[0] == '\n' {
+		return 0, false
+	}
+	return runes[0], true
+}
@@ -0,0 +1,433 @@
+package contacts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const (
+	// Contacts with the same phone number are duplicates with a confidence
+	// of at least phoneMatchWeight, rising with the similarity of their
+	// names. Contacts with different numbers only match on names at least
+	// nameMatchThreshold similar, with at most nameOnlyWeight confidence.
+	phoneMatchWeight   = 0.5
+	nameOnlyWeight     = 0.8
+	nameMatchThreshold = 0.9
+	// DefaultMinConfidence is the confidence a match needs to be reported
+	// when the request does not ask for another.
+	DefaultMinConfidence = 0.7
+
+	// jaroWinkler gives this weight to each of up to four leading characters
+	// two names share
+	prefixScale  = 0.1
+	maxPrefixLen = 4
+
+	organizationField = "organization_id"
+
+	nothingToMergeError = "contact_ids must name a contact other than the survivor"
+	mergeChoiceError    = "fields must choose contacts of the merge"
+
+	// DuplicatesAllow adds contacts whatever their number, DuplicatesWarn
+	// also reports the contacts that have it, and DuplicatesReject refuses
+	// to add a contact whose number the caller already has.
+	DuplicatesAllow  DuplicatePolicy = "allow"
+	DuplicatesWarn   DuplicatePolicy = "warn"
+	DuplicatesReject DuplicatePolicy = "reject"
+)
+
+var (
+	ErrNothingToMerge = errors.New(nothingToMergeError)
+	ErrMergeChoice    = errors.New(mergeChoiceError)
+)
+
+// DuplicatePolicy is what adding a contact does when the caller can see
+// other contacts with the same phone number.
+type DuplicatePolicy string
+
+// ParseDuplicatePolicy returns the duplicate policy with the name, such as
+// reject.
+func ParseDuplicatePolicy(name string) (DuplicatePolicy, error) {
+	switch policy := DuplicatePolicy(name); policy {
+	case DuplicatesAllow, DuplicatesWarn, DuplicatesReject:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown duplicate policy %q, must be allow, warn or reject", name)
+}
+
+// DuplicateError is returned when a contact is rejected because the caller
+// can see contacts with its phone number.
+type DuplicateError struct {
+	ContactIDs []int
+}
+
+func (e *DuplicateError) Error() string {
+	return duplicateContactError
+}
+
+func (e *DuplicateError) Unwrap() error {
+	return ErrDuplicateContact
+}
+
+// mergeFields returns the contact fields a merge can choose, other than the
+// organization.
+var mergeFields = map[string]func(c *Contact) *string{
+	"first_name":   func(c *Contact) *string { return &c.FirstName },
+	"last_name":    func(c *Contact) *string { return &c.LastName },
+	"phone_number": func(c *Contact) *string { return &c.PhoneNumber },
+	"address":      func(c *Contact) *string { return &c.Address },
+	"birthday":     func(c *Contact) *string { return &c.Birthday },
+	"anniversary":  func(c *Contact) *string { return &c.Anniversary },
+	"job_title":    func(c *Contact) *string { return &c.JobTitle },
+	"department":   func(c *Contact) *string { return &c.Department },
+}
+
+// isMergeField reports whether a merge can choose the field, which is a
+// contact field or custom.<field>.
+func isMergeField(name string) bool {
+	if custom := strings.TrimPrefix(name, customFieldPrefix); custom != name {
+		return fieldNamePattern.MatchString(custom)
+	}
+	_, ok := mergeFields[name]
+	return ok || name == organizationField
+}
+
+// FindDuplicates groups the contacts the caller can see into clusters of
+// likely duplicates, most confident first. Contacts match when their phone
+// numbers are the same once normalized or their names are similar, and a
+// cluster holds the contacts joined by matches of at least minConfidence.
+func (s *Service) FindDuplicates(ctx context.Context, minConfidence float64) ([]DuplicateCluster, error) {
+	var all []Contact
+	err := s.repo.ExportContacts(ctx, ExportFilter{}, func(contact Contact, _ []string) error {
+		all = append(all, contact)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	phones := make([]string, len(all))
+	names := make([]string, len(all))
+	swapped := make([]string, len(all))
+	// Only contacts that share a number or the first letter of their last
+	// name are compared, so large phone books are not compared pairwise
+	blocks := make(map[string][]int)
+	for i, contact := range all {
+		phones[i] = normalizePhone(contact.PhoneNumber, s.phoneCountry)
+		names[i] = normalizeName(contact.FirstName + " " + contact.LastName)
+		swapped[i] = normalizeName(contact.LastName + " " + contact.FirstName)
+		if phones[i] != "" {
+			blocks["tel:"+phones[i]] = append(blocks["tel:"+phones[i]], i)
+		}
+		if last := normalizeName(contact.LastName); last != "" {
+			initial := string([]rune(last)[0])
+			blocks["name:"+initial] = append(blocks["name:"+initial], i)
+		}
+	}
+
+	var matches []DuplicateMatch
+	compared := make(map[[2]int]bool)
+	for _, block := range blocks {
+		for x := 0; x < len(block); x++ {
+			for y := x + 1; y < len(block); y++ {
+				i, j := block[x], block[y]
+				if compared[[2]int{i, j}] {
+					continue
+				}
+				compared[[2]int{i, j}] = true
+
+				similarity := jaroWinkler(names[i], names[j])
+				// The same name with first and last swapped is the same name
+				if other := jaroWinkler(names[i], swapped[j]); other > similarity {
+					similarity = other
+				}
+				match := DuplicateMatch{
+					ContactID:      all[i].ID,
+					OtherID:        all[j].ID,
+					PhoneMatch:     phones[i] != "" && phones[i] == phones[j],
+					NameSimilarity: roundScore(similarity),
+				}
+				switch {
+				case match.PhoneMatch:
+					match.Confidence = phoneMatchWeight + (1-phoneMatchWeight)*similarity
+				case similarity >= nameMatchThreshold:
+					match.Confidence = nameOnlyWeight * similarity
+				}
+				match.Confidence = roundScore(match.Confidence)
+				if match.Confidence > 0 && match.Confidence >= minConfidence {
+					matches = append(matches, match)
+				}
+			}
+		}
+	}
+	return clusterMatches(all, matches), nil
+}
+
+// clusterMatches joins the contacts of every match into clusters.
+func clusterMatches(all []Contact, matches []DuplicateMatch) []DuplicateCluster {
+	parent := make(map[int]int)
+	var root func(id int) int
+	root = func(id int) int {
+		if p, ok := parent[id]; ok && p != id {
+			parent[id] = root(p)
+			return parent[id]
+		}
+		parent[id] = id
+		return id
+	}
+	for _, match := range matches {
+		parent[root(match.ContactID)] = root(match.OtherID)
+	}
+
+	byRoot := make(map[int]*DuplicateCluster)
+	var roots []int
+	for _, contact := range all {
+		if _, ok := parent[contact.ID]; !ok {
+			continue
+		}
+		id := root(contact.ID)
+		cluster, ok := byRoot[id]
+		if !ok {
+			cluster = &DuplicateCluster{Confidence: 1}
+			byRoot[id] = cluster
+			roots = append(roots, id)
+		}
+		cluster.Contacts = append(cluster.Contacts, contact)
+	}
+	for _, match := range matches {
+		cluster := byRoot[root(match.ContactID)]
+		cluster.Matches = append(cluster.Matches, match)
+		if match.Confidence < cluster.Confidence {
+			cluster.Confidence = match.Confidence
+		}
+	}
+
+	clusters := make([]DuplicateCluster, 0, len(roots))
+	for _, id := range roots {
+		cluster := byRoot[id]
+		sort.Slice(cluster.Matches, func(i, j int) bool {
+			if cluster.Matches[i].ContactID != cluster.Matches[j].ContactID {
+				return cluster.Matches[i].ContactID < cluster.Matches[j].ContactID
+			}
+			return cluster.Matches[i].OtherID < cluster.Matches[j].OtherID
+		})
+		clusters = append(clusters, *cluster)
+	}
+	sort.SliceStable(clusters, func(i, j int) bool { return clusters[i].Confidence > clusters[j].Confidence })
+	return clusters
+}
+
+// Merge merges the contacts into the survivor in one transaction. Fields the
+// request does not choose keep the survivor's value, or the first value set
+// on the others, and the survivor joins every group of the others.
+func (s *Service) Merge(ctx context.Context, request MergeRequest) (*Merge, error) {
+	ids := []int{request.SurvivorID}
+	seen := map[int]bool{request.SurvivorID: true}
+	for _, id := range request.ContactIDs {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 1 {
+		return nil, ErrNothingToMerge
+	}
+	for _, id := range request.Fields {
+		if !seen[id] {
+			return nil, ErrMergeChoice
+		}
+	}
+
+	var merge *Merge
+	err := s.repo.WithTx(ctx, func(repo Repository) error {
+		cluster := make([]Contact, len(ids))
+		for i, id := range ids {
+			contact, err := repo.FetchContact(ctx, id)
+			if err != nil {
+				return err
+			}
+			cluster[i] = *contact
+		}
+		survivor := mergeContacts(cluster, request.Fields)
+		var err error
+		merge, err = repo.MergeContacts(ctx, survivor, cluster)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return merge, nil
+}
+
+func (s *Service) GetMerges(ctx context.Context, page, limit int) ([]Merge, error) {
+	offset := (page - 1) * limit
+	return s.repo.FetchMerges(ctx, limit, offset)
+}
+
+func (s *Service) UndoMerge(ctx context.Context, id int) (*Merge, error) {
+	return s.repo.UndoMerge(ctx, id)
+}
+
+// mergeContacts returns the survivor, the first contact of the cluster, with
+// the chosen fields and the fields it lacks taken from the others.
+func mergeContacts(cluster []Contact, choices map[string]int) *Contact {
+	survivor := cluster[0]
+	survivor.Groups = append([]string{}, cluster[0].Groups...)
+	survivor.CustomFields = make(map[string]interface{}, len(cluster[0].CustomFields))
+	for name, value := range cluster[0].CustomFields {
+		survivor.CustomFields[name] = value
+	}
+
+	for _, other := range cluster[1:] {
+		other := other
+		for _, field := range mergeFields {
+			if *field(&survivor) == "" {
+				*field(&survivor) = *field(&other)
+			}
+		}
+		if survivor.OrganizationID == nil {
+			survivor.OrganizationID = other.OrganizationID
+		}
+		for name, value := range other.CustomFields {
+			if _, ok := survivor.CustomFields[name]; !ok {
+				survivor.CustomFields[name] = value
+			}
+		}
+		for _, group := range other.Groups {
+			if !containsString(survivor.Groups, group) {
+				survivor.Groups = append(survivor.Groups, group)
+			}
+		}
+	}
+
+	for name, id := range choices {
+		var from *Contact
+		for i := range cluster {
+			if cluster[i].ID == id {
+				from = &cluster[i]
+			}
+		}
+		custom := strings.TrimPrefix(name, customFieldPrefix)
+		switch {
+		case custom != name:
+			if value, ok := from.CustomFields[custom]; ok {
+				survivor.CustomFields[custom] = value
+			} else {
+				delete(survivor.CustomFields, custom)
+			}
+		case name == organizationField:
+			survivor.OrganizationID = from.OrganizationID
+		default:
+			*mergeFields[name](&survivor) = *mergeFields[name](from)
+		}
+	}
+	return &survivor
+}
+
+// normalizePhone reduces a phone number to the digits of its international
+// form, so that +972 54-123-4567, 00972541234567 and 0541234567 are equal
+// when countryCode is 972. Numbers with neither a country code nor a trunk
+// prefix are kept as they are.
+func normalizePhone(number, countryCode string) string {
+	number = strings.TrimSpace(number)
+	international := strings.HasPrefix(number, "+")
+	digits := strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, number)
+	switch {
+	case international:
+		return digits
+	case strings.HasPrefix(digits, "00"):
+		return digits[2:]
+	case strings.HasPrefix(digits, "0") && countryCode != "":
+		return countryCode + digits[1:]
+	}
+	return digits
+}
+
+// normalizeName lowercases a name and collapses its punctuation and spaces.
+func normalizeName(name string) string {
+	return strings.Join(strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}), " ")
+}
+
+// jaroWinkler returns the Jaro-Winkler similarity of two strings, from 0 for
+// nothing in common to 1 for equal strings.
+func jaroWinkler(a, b string) float64 {
+	ra, rb := []rune(a), []rune(b)
+	if len(ra) == 0 || len(rb) == 0 {
+		if len(ra) == len(rb) {
+			return 1
+		}
+		return 0
+	}
+
+	window := maxInt(len(ra), len(rb))/2 - 1
+	if window < 0 {
+		window = 0
+	}
+	matchedA := make([]bool, len(ra))
+	matchedB := make([]bool, len(rb))
+	matches := 0
+	for i := range ra {
+		for j := maxInt(0, i-window); j < minInt(len(rb), i+window+1); j++ {
+			if !matchedB[j] && ra[i] == rb[j] {
+				matchedA[i], matchedB[j] = true, true
+				matches++
+				break
+			}
+		}
+	}
+	if matches == 0 {
+		return 0
+	}
+
+	transpositions := 0
+	j := 0
+	for i := range ra {
+		if !matchedA[i] {
+			continue
+		}
+		for !matchedB[j] {
+			j++
+		}
+		if ra[i] != rb[j] {
+			transpositions++
+		}
+		j++
+	}
+
+	m := float64(matches)
+	jaro := (m/float64(len(ra)) + m/float64(len(rb)) + (m-float64(transpositions)/2)/m) / 3
+	prefix := 0
+	for prefix < maxPrefixLen && prefix < len(ra) && prefix < len(rb) && ra[prefix] == rb[prefix] {
+		prefix++
+	}
+	return jaro + float64(prefix)*prefixScale*(1-jaro)
+}
+
+// roundScore keeps scores to three decimals in responses.
+func roundScore(score float64) float64 {
+	return float64(int(score*1000+0.5)) / 1000
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,63 @@
+package contacts
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	EventCreated = "contact.created"
+	EventUpdated = "contact.updated"
+	EventDeleted = "contact.deleted"
+	EventMerged  = "contact.merged"
+
+	// insertEventQuery numbers the event without waiting for other
+	// transactions, so an event may commit after one numbered above it. The
+	// outbox is read only up to the number below which every event has
+	// committed or rolled back, which it tells by the transactions running
+	// when the number was taken, so the transaction is given its ID first.
+	// Writers never wait on each other for their events, but a long
+	// transaction holds back the events numbered after its own until it
+	// ends.
+	insertEventQuery = "INSERT INTO outbox (tenant_id, type, contact_id, contact, merged_ids) SELECT $1, $2, $3, $4, $5 FROM (SELECT pg_current_xact_id()) AS tx"
+	recordEventError = "failed to record contact event: %w"
+)
+
+// Event is a change made to a contact, numbered in the order the changes
+// were written. Deleted contacts carry only their ID, and merges carry the
+// survivor with the IDs of the contacts merged into it.
+type Event struct {
+	Seq        int64     `json:"seq"`
+	Type       string    `json:"type"`
+	TenantID   string    `json:"tenant_id"`
+	ContactID  int       `json:"contact_id"`
+	Contact    *Contact  `json:"contact,omitempty"`
+	MergedIDs  []int     `json:"merged_ids,omitempty"`
+	OccurredAt time.Time `json:"occurred_at"`
+}
+
+// recordEvent writes the event to the outbox in the transaction that makes
+// the change, so that the event is relayed if and only if it commits.
+func recordEvent(ctx context.Context, tx *sql.Tx, tenantID string, event Event) error {
+	var contact []byte
+	if event.Contact != nil {
+		var err error
+		if contact, err = json.Marshal(event.Contact); err != nil {
+			return fmt.Errorf(recordEventError, err)
+		}
+	}
+	var mergedIDs interface{}
+	if len(event.MergedIDs) > 0 {
+		mergedIDs = pq.Array(int64s(event.MergedIDs))
+	}
+	_, err := tx.ExecContext(ctx, insertEventQuery, tenantID, event.Type, event.ContactID, contact, mergedIDs)
+	if err != nil {
+		return fmt.Errorf(recordEventError, err)
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+package contacts
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	FormatCSV    = "csv"
+	FormatNDJSON = "ndjson"
+	FormatVCard  = "vcf"
+
+	fieldID        = "id"
+	fieldOwner     = "owner"
+	fieldUpdatedAt = "updated_at"
+
+	// exportFlushRows is how many rows are written between flushes, so
+	// clients see a large export arrive steadily.
+	exportFlushRows = 500
+
+	unknownExportFieldError = "unknown export field"
+)
+
+var ErrUnknownExportField = errors.New(unknownExportFieldError)
+
+// defaultExportFields are exported when no fields are asked for, followed by
+// every custom field. They are named like the CSV import targets, so an
+// export imports again with the header profile.
+var defaultExportFields = []string{fieldID, targetFirstName, targetLastName, targetPhoneNumber, targetAddress,
+	targetBirthday, targetAnniversary, targetGroups, targetOrganization, targetJobTitle, targetDepartment}
+
+// optionalExportFields are only exported when asked for.
+var optionalExportFields = []string{targetNote, fieldOwner, fieldUpdatedAt}
+
+// exportFieldList checks the requested fields against the tenant's custom
+// fields and fills in the defaults when none are requested.
+func exportFieldList(requested []string, fields []CustomField) ([]string, error) {
+	if len(requested) == 0 {
+		list := append([]string(nil), defaultExportFields...)
+		for _, field := range fields {
+			list = append(list, targetCustomPrefix+field.Name)
+		}
+		return list, nil
+	}
+
+	for _, name := range requested {
+		if containsString(defaultExportFields, name) || containsString(optionalExportFields, name) {
+			continue
+		}
+		custom := strings.TrimPrefix(name, targetCustomPrefix)
+		if custom == name || !hasCustomField(fields, custom) {
+			return nil, ErrUnknownExportField
+		}
+	}
+	return requested, nil
+}
+
+func hasCustomField(fields []CustomField, name string) bool {
+	for _, field := range fields {
+		if field.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// exportValue returns the value of one field of a contact.
+func exportValue(contact Contact, notes []string, field string) interface{} {
+	switch field {
+	case fieldID:
+		return contact.ID
+	case targetFirstName:
+		return contact.FirstName
+	case targetLastName:
+		return contact.LastName
+	case targetPhoneNumber:
+		return contact.PhoneNumber
+	case targetAddress:
+		return contact.Address
+	case targetBirthday:
+		return contact.Birthday
+	case targetAnniversary:
+		return contact.Anniversary
+	case targetGroups:
+		return nonNilStrings(contact.Groups)
+	case targetOrganization:
+		return contact.Organization
+	case targetJobTitle:
+		return contact.JobTitle
+	case targetDepartment:
+		return contact.Department
+	case targetNote:
+		return strings.Join(notes, "\n\n")
+	case fieldOwner:
+		return contact.Owner
+	case fieldUpdatedAt:
+		return contact.UpdatedAt.UTC()
+	}
+	return contact.CustomFields[strings.TrimPrefix(field, targetCustomPrefix)]
+}
+
+// rowWriter writes exported contacts, one row or card each.
+type rowWriter interface {
+	write(contact Contact, notes []string) error
+	flush() error
+}
+
+func newRowWriter(w io.Writer, opts ExportOptions, fields []CustomField) (rowWriter, error) {
+	if opts.Format == FormatVCard {
+		fieldTypes := make(map[string]string, len(fields))
+		for _, field := range fields {
+			fieldTypes[field.Name] = field.Type
+		}
+		return &vcardWriter{w: w, version: opts.Version, fieldTypes: fieldTypes}, nil
+	}
+
+	names, err := exportFieldList(opts.Fields, fields)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Format == FormatNDJSON {
+		return &ndjsonWriter{w: bufio.NewWriter(w), fields: names}, nil
+	}
+	cw := &csvWriter{w: csv.NewWriter(w), fields: names}
+	return cw, cw.w.Write(names)
+}
+
+type vcardWriter struct {
+	w          io.Writer
+	version    string
+	fieldTypes map[string]string
+}
+
+func (vw *vcardWriter) write(contact Contact, notes []string) error {
+	return writeVCard(vw.w, vw.version, contact, notes, vw.fieldTypes)
+}
+
+func (vw *vcardWriter) flush() error {
+	return nil
+}
+
+type csvWriter struct {
+	w      *csv.Writer
+	fields []string
+}
+
+func (cw *csvWriter) write(contact Contact, notes []string) error {
+	record := make([]string, len(cw.fields))
+	for i, field := range cw.fields {
+		record[i] = csvText(exportValue(contact, notes, field))
+	}
+	return cw.w.Write(record)
+}
+
+func (cw *csvWriter) flush() error {
+	cw.w.Flush()
+	return cw.w.Error()
+}
+
+// csvText formats a value for a CSV cell. Groups are separated the way the
+// CSV import splits them.
+func csvText(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case int:
+		return strconv.Itoa(v)
+	case []string:
+		return strings.Join(v, "; ")
+	case time.Time:
+		return v.Format(time.RFC3339)
+	}
+	return customValueText(value)
+}
+
+// ndjsonWriter writes one JSON object per line, with the keys in the order
+// of the requested fields.
+type ndjsonWriter struct {
+	w      *bufio.Writer
+	fields []string
+}
+
+func (nw *ndjsonWriter) write(contact Contact, notes []string) error {
+	nw.w.WriteByte('{')
+	for i, field := range nw.fields {
+		if i > 0 {
+			nw.w.WriteByte(',')
+		}
+		key, _ := json.Marshal(field)
+		value, err := json.Marshal(exportValue(contact, notes, field))
+		if err != nil {
+			return err
+		}
+		nw.w.Write(key)
+		nw.w.WriteByte(':')
+		nw.w.Write(value)
+	}
+	nw.w.WriteByte('}')
+	return nw.w.WriteByte('\n')
+}
+
+func (nw *ndjsonWriter) flush() error {
+	return nw.w.Flush()
+}
@@ -1,26 +1,118 @@
 package contacts
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"mime"
 	"net/http"
+	"net/url"
+	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/benhuri/phone-book-api/internal/auth"
+	"github.com/benhuri/phone-book-api/internal/httputil"
 	"github.com/go-playground/validator/v10"
 	"github.com/gorilla/mux"
 )
 
 const (
-	contentType         = "Content-Type"
-	applicationJSON     = "application/json"
-	idParam             = "id"
-	pageParam           = "page"
-	limitParam          = "limit"
-	queryParam          = "query"
-	invalidRequestError = "Invalid request payload"
-	invalidContactID    = "Invalid contact ID"
-	internalServerError = "Internal Server Error"
+	contentType           = "Content-Type"
+	applicationJSON       = "application/json"
+	idParam               = "id"
+	noteIDParam           = "noteId"
+	relationIDParam       = "relationId"
+	linkIDParam           = "linkId"
+	expiresParam          = "expires"
+	signatureParam        = "signature"
+	formatParam           = "format"
+	formatJSON            = "json"
+	formatHTML            = "html"
+	textVCard             = "text/vcard; charset=utf-8"
+	textHTML              = "text/html; charset=utf-8"
+	vcardAttachment       = `attachment; filename="contact.vcf"`
+	contactVCardFile      = `attachment; filename="contact-%d.vcf"`
+	exportVCardFile       = `attachment; filename="contacts.vcf"`
+	exportCSVFile         = `attachment; filename="contacts.csv"`
+	exportNDJSONFile      = `attachment; filename="contacts.ndjson"`
+	textCSV               = "text/csv; charset=utf-8"
+	applicationNDJSON     = "application/x-ndjson"
+	fieldsParam           = "fields"
+	versionParam          = "version"
+	dryRunParam           = "dry_run"
+	profileParam          = "profile"
+	encodingParam         = "encoding"
+	delimiterParam        = "delimiter"
+	modeParam             = "mode"
+	bestEffortMode        = "best-effort"
+	allOrNothingMode      = "all-or-nothing"
+	maxImportBytes        = 10 << 20
+	acceptHeader          = "Accept"
+	cacheControl          = "Cache-Control"
+	noStore               = "no-store"
+	referrerPolicy        = "Referrer-Policy"
+	noReferrer            = "no-referrer"
+	contentTypeOptions    = "X-Content-Type-Options"
+	nosniff               = "nosniff"
+	contentDisposition    = "Content-Disposition"
+	depthParam            = "depth"
+	maxRelationDepth      = 5
+	queryParam            = "query"
+	groupParam            = "group"
+	viewParam             = "view"
+	sharedView            = "shared"
+	textCalendar          = "text/calendar; charset=utf-8"
+	etagHeader            = "ETag"
+	ifNoneMatch           = "If-None-Match"
+	lastModified          = "Last-Modified"
+	ifModifiedSince       = "If-Modified-Since"
+	invalidRequestError   = "Invalid request payload"
+	invalidContactID      = "Invalid contact ID"
+	invalidOrganizationID = "Invalid organization ID"
+	invalidFieldID        = "Invalid custom field ID"
+	invalidNoteID         = "Invalid note ID"
+	invalidRelationID     = "Invalid relation ID"
+	invalidDepth          = "Invalid depth, must be between 1 and 5"
+	invalidView           = "Invalid view, must be shared"
+	invalidLinkID         = "Invalid share link ID"
+	invalidFormat         = "Invalid format, must be json, vcf or html"
+	invalidVersion        = "Invalid version, must be 3.0 or 4.0"
+	invalidExportFormat   = "Invalid format, must be csv, ndjson or vcf"
+	invalidExportField    = "Invalid fields, must be contact fields or defined custom fields"
+	invalidDryRun         = "Invalid dry_run, must be true or false"
+	unsupportedImportType = "Unsupported media type, must be text/vcard"
+	unsupportedCSVType    = "Unsupported media type, must be text/csv"
+	invalidDelimiter      = "Invalid delimiter, must be a single character or tab"
+	invalidMode           = "Invalid mode, must be best-effort or all-or-nothing"
+	invalidEncoding       = "Invalid encoding, must be utf-8, utf-16 or windows-1255"
+	invalidCSVHeader      = "Invalid CSV header"
+	invalidProfileID      = "Invalid import profile ID"
+	invalidMergeID        = "Invalid merge ID"
+	invalidForce          = "Invalid force, must be true or false"
+	forceNotAllowed       = "force requires the %s permission"
+	forceParam            = "force"
+	contactsBasePath      = "/contacts/"
+	linkHeader            = "Link"
+	duplicateLink         = `<%s>; rel="duplicate"`
+	locationHeader        = "Location"
+	warningHeader         = "Warning"
+	duplicateWarning      = `299 - "Likely duplicate of contacts %s"`
+	invalidMinConfidence  = "Invalid min_confidence, must be between 0 and 1"
+	minConfidenceParam    = "min_confidence"
+	mergeIDParam          = "mergeId"
+	importTooLarge        = "Request body too large"
+	importLineTooLong     = "vCard line too long"
+	customFieldPrefix     = "custom."
+	internalServerError   = "Internal Server Error"
 )
 
 type Handler struct {
@@ -33,24 +125,40 @@ func NewHandler(service *Service) *Handler {
 
 var validate *validator.Validate
 
+var fieldNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
 func init() {
 	validate = validator.New()
+	validate.RegisterValidation("fieldname", func(fl validator.FieldLevel) bool {
+		return fieldNamePattern.MatchString(fl.Field().String())
+	})
+	validate.RegisterValidation("relationtype", func(fl validator.FieldLevel) bool {
+		_, ok := inverseRelations[fl.Field().String()]
+		return ok
+	})
+	validate.RegisterValidation("importtarget", func(fl validator.FieldLevel) bool {
+		return isImportTarget(fl.Field().String())
+	})
+	validate.RegisterValidation("mergefield", func(fl validator.FieldLevel) bool {
+		return isMergeField(fl.Field().String())
+	})
+	validate.RegisterValidation("regexp", func(fl validator.FieldLevel) bool {
+		_, err := regexp.Compile(fl.Field().String())
+		return err == nil
+	})
 }
 
 func (h *Handler) GetContactsHandler(w http.ResponseWriter, r *http.Request) {
-	pageStr := r.URL.Query().Get(pageParam)
-	page, err := strconv.Atoi(pageStr)
-	if err != nil || page < 1 {
-		page = 1
-	}
+	page, limit := httputil.ParsePagination(r)
 
-	limitStr := r.URL.Query().Get(limitParam)
-	limit, err := strconv.Atoi(limitStr)
-	if err != nil || limit < 1 {
-		limit = 10 // default limit
+	// view=shared lists only the contacts other users shared with the caller
+	view := r.URL.Query().Get(viewParam)
+	if view != "" && view != sharedView {
+		http.Error(w, invalidView, http.StatusBadRequest)
+		return
 	}
 
-	contacts, err := h.Service.GetContacts(page, limit)
+	contacts, err := h.Service.GetContacts(r.Context(), view == sharedView, page, limit)
 	if err != nil {
 		log.Printf("Error getting contacts: %v", err)
 		http.Error(w, internalServerError, http.StatusInternalServerError)
@@ -63,7 +171,8 @@ func (h *Handler) GetContactsHandler(w http.ResponseWriter, r *http.Request) {
 
 func (h *Handler) SearchContactHandler(w http.ResponseWriter, r *http.Request) {
 	query := r.URL.Query().Get(queryParam)
-	contacts, err := h.Service.SearchContact(query)
+
+	contacts, err := h.Service.SearchContact(r.Context(), query, customFieldParams(r.URL.Query()))
 	if err != nil {
 		log.Printf("Error searching contacts: %v", err)
 		http.Error(w, internalServerError, http.StatusInternalServerError)
@@ -84,21 +193,103 @@ func (h *Handler) AddContactHandler(w http.ResponseWriter, r *http.Request) {
 
 	if err := validate.Struct(contact); err != nil {
 		log.Printf("Validation error: %v", err)
-		http.Error(w, formatValidationError(err), http.StatusBadRequest)
+		http.Error(w, httputil.FormatValidationError(err), http.StatusBadRequest)
+		return
+	}
+
+	if !h.validateCustomFields(w, r, &contact) {
+		return
+	}
+
+	force, ok := h.parseForce(w, r)
+	if !ok {
 		return
 	}
 
-	if err := h.Service.AddContact(&contact); err != nil {
+	duplicates, err := h.Service.AddContact(r.Context(), &contact, force)
+	var duplicateErr *DuplicateError
+	if errors.As(err, &duplicateErr) {
+		writeDuplicateProblem(w, duplicateErr.ContactIDs)
+		return
+	}
+	if errors.Is(err, ErrOrganizationNotFound) {
+		http.Error(w, organizationNotFound, http.StatusBadRequest)
+		return
+	}
+	// Another contact may have taken a unique value since it was checked
+	var validationErr *ValidationError
+	if errors.As(err, &validationErr) {
+		http.Error(w, validationErr.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
 		log.Printf("Error adding contact: %v", err)
 		http.Error(w, internalServerError, http.StatusInternalServerError)
 		return
 	}
 
+	if len(duplicates) > 0 {
+		ids := make([]string, len(duplicates))
+		for i, id := range duplicates {
+			ids[i] = strconv.Itoa(id)
+			w.Header().Add(linkHeader, fmt.Sprintf(duplicateLink, contactPath(id)))
+		}
+		w.Header().Set(warningHeader, fmt.Sprintf(duplicateWarning, strings.Join(ids, ", ")))
+	}
 	w.WriteHeader(http.StatusCreated)
 	w.Header().Set(contentType, applicationJSON)
 	json.NewEncoder(w).Encode(contact)
 }
 
+// parseForce reads the force parameter, which only callers allowed to
+// override the duplicate policy may set.
+func (h *Handler) parseForce(w http.ResponseWriter, r *http.Request) (bool, bool) {
+	value := r.URL.Query().Get(forceParam)
+	if value == "" {
+		return false, true
+	}
+	force, err := strconv.ParseBool(value)
+	if err != nil {
+		http.Error(w, invalidForce, http.StatusBadRequest)
+		return false, false
+	}
+	if !force {
+		return false, true
+	}
+	allowed, err := auth.Allowed(r.Context(), auth.PermContactsForce)
+	if err != nil {
+		log.Printf("Error authorizing force: %v", err)
+		http.Error(w, internalServerError, http.StatusInternalServerError)
+		return false, false
+	}
+	if !allowed {
+		httputil.WriteProblem(w, http.StatusForbidden, fmt.Sprintf(forceNotAllowed, auth.PermContactsForce))
+		return false, false
+	}
+	return true, true
+}
+
+// duplicateProblem is the conflict a contact is rejected with, pointing to
+// the contacts that already have its phone number.
+type duplicateProblem struct {
+	httputil.Problem
+	Contact    string `json:"contact"`
+	ContactIDs []int  `json:"contact_ids"`
+}
+
+func writeDuplicateProblem(w http.ResponseWriter, ids []int) {
+	w.Header().Set(locationHeader, contactPath(ids[0]))
+	httputil.WriteProblemBody(w, http.StatusConflict, duplicateProblem{
+		Problem:    httputil.NewProblem(http.StatusConflict, duplicateContactError),
+		Contact:    contactPath(ids[0]),
+		ContactIDs: ids,
+	})
+}
+
+func contactPath(id int) string {
+	return contactsBasePath + strconv.Itoa(id)
+}
+
 func (h *Handler) EditContactHandler(w http.ResponseWriter, r *http.Request) {
 	var contact Contact
 	if err := json.NewDecoder(r.Body).Decode(&contact); err != nil {
@@ -109,7 +300,7 @@ func (h *Handler) EditContactHandler(w http.ResponseWriter, r *http.Request) {
 
 	if err := validate.Struct(contact); err != nil {
 		log.Printf("Validation error: %v", err)
-		http.Error(w, formatValidationError(err), http.StatusBadRequest)
+		http.Error(w, httputil.FormatValidationError(err), http.StatusBadRequest)
 		return
 	}
 
@@ -122,7 +313,26 @@ func (h *Handler) EditContactHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	contact.ID = id
 
-	if err := h.Service.EditContact(contact); err != nil {
+	if !h.validateCustomFields(w, r, &contact) {
+		return
+	}
+
+	err = h.Service.EditContact(r.Context(), &contact)
+	if errors.Is(err, ErrContactNotFound) {
+		http.Error(w, contactNotFoundError, http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, ErrOrganizationNotFound) {
+		http.Error(w, organizationNotFound, http.StatusBadRequest)
+		return
+	}
+	// Another contact may have taken a unique value since it was checked
+	var validationErr *ValidationError
+	if errors.As(err, &validationErr) {
+		http.Error(w, validationErr.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
 		log.Printf("Error editing contact: %v", err)
 		http.Error(w, internalServerError, http.StatusInternalServerError)
 		return
@@ -142,7 +352,12 @@ func (h *Handler) DeleteContactHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := h.Service.DeleteContact(id); err != nil {
+	err = h.Service.DeleteContact(r.Context(), id)
+	if errors.Is(err, ErrContactNotFound) {
+		http.Error(w, contactNotFoundError, http.StatusNotFound)
+		return
+	}
+	if err != nil {
 		log.Printf("Error deleting contact: %v", err)
 		http.Error(w, internalServerError, http.StatusInternalServerError)
 		return
@@ -151,19 +366,1254 @@ func (h *Handler) DeleteContactHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNoContent)
 }
 
-func formatValidationError(err error) string {
-	var errors []string
-	for _, err := range err.(validator.ValidationErrors) {
-		switch err.Tag() {
-		case "required":
-			errors = append(errors, err.Field()+" is required")
-		case "min":
-			errors = append(errors, err.Field()+" must be at least "+err.Param()+" characters")
-		case "max":
-			errors = append(errors, err.Field()+" must be at most "+err.Param()+" characters")
-		default:
-			errors = append(errors, err.Field()+" is invalid")
+// GetTrashHandler lists the deleted contacts, most recently deleted first.
+func (h *Handler) GetTrashHandler(w http.ResponseWriter, r *http.Request) {
+	page, limit := httputil.ParsePagination(r)
+	contacts, err := h.Service.GetTrash(r.Context(), page, limit)
+	if err != nil {
+		log.Printf("Error getting trash: %v", err)
+		http.Error(w, internalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(contentType, applicationJSON)
+	json.NewEncoder(w).Encode(contacts)
+}
+
+func (h *Handler) RestoreContactHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)[idParam])
+	if err != nil {
+		log.Printf("Invalid contact ID: %v", err)
+		http.Error(w, invalidContactID, http.StatusBadRequest)
+		return
+	}
+
+	contact, err := h.Service.RestoreContact(r.Context(), id)
+	if errors.Is(err, ErrContactNotFound) {
+		http.Error(w, contactNotFoundError, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error restoring contact: %v", err)
+		http.Error(w, internalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(contentType, applicationJSON)
+	json.NewEncoder(w).Encode(contact)
+}
+
+func (h *Handler) PurgeContactHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)[idParam])
+	if err != nil {
+		log.Printf("Invalid contact ID: %v", err)
+		http.Error(w, invalidContactID, http.StatusBadRequest)
+		return
+	}
+
+	err = h.Service.PurgeContact(r.Context(), id)
+	if errors.Is(err, ErrContactNotFound) {
+		http.Error(w, contactNotFoundError, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error purging contact: %v", err)
+		http.Error(w, internalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// BatchHandler applies an ordered list of contact changes and reports each
+// with the status it would have had as a request of its own. Atomic batches
+// that fail answer 422 and apply nothing.
+func (h *Handler) BatchHandler(w http.ResponseWriter, r *http.Request) {
+	var batch BatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+		log.Printf("Error decoding batch: %v", err)
+		http.Error(w, invalidRequestError, http.StatusBadRequest)
+		return
+	}
+	if err := validate.Struct(batch); err != nil {
+		log.Printf("Validation error: %v", err)
+		http.Error(w, httputil.FormatValidationError(err), http.StatusBadRequest)
+		return
+	}
+	if batch.Mode == "" {
+		batch.Mode = BatchAtomic
+	}
+
+	outcomes, err := h.Service.Batch(r.Context(), batch)
+	if err != nil {
+		log.Printf("Error applying batch: %v", err)
+		http.Error(w, internalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	response := BatchResponse{Mode: batch.Mode, Results: make([]BatchResult, len(outcomes))}
+	for i, outcome := range outcomes {
+		operation := batch.Operations[i]
+		result := BatchResult{Ref: operation.Ref, Op: operation.Op, ID: outcome.ID, Contact: outcome.Contact}
+		result.Status, result.Error = batchStatus(operation.Op, outcome.Err)
+		response.Results[i] = result
+		// Atomic batches stop at the first failure and roll back
+		if outcome.Err != nil && batch.Mode == BatchAtomic {
+			response.RolledBack = true
+		}
+	}
+
+	w.Header().Set(contentType, applicationJSON)
+	if response.RolledBack {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// batchStatus returns the status and error message a batch operation would
+// have had as a request of its own.
+func batchStatus(op string, err error) (int, string) {
+	var validationErrs validator.ValidationErrors
+	var validationErr *ValidationError
+	switch {
+	case err == nil && op == BatchCreate:
+		return http.StatusCreated, ""
+	case err == nil && op == BatchDelete:
+		return http.StatusNoContent, ""
+	case err == nil:
+		return http.StatusOK, ""
+	case errors.As(err, &validationErrs):
+		return http.StatusBadRequest, httputil.FormatValidationError(err)
+	case errors.As(err, &validationErr):
+		return http.StatusBadRequest, validationErr.Error()
+	case errors.Is(err, ErrContactNotFound):
+		return http.StatusNotFound, contactNotFoundError
+	case errors.Is(err, ErrOrganizationNotFound):
+		return http.StatusBadRequest, organizationNotFound
+	case errors.Is(err, ErrDuplicateContact):
+		return http.StatusConflict, duplicateContactError
+	case errors.Is(err, ErrMissingBatchContact), errors.Is(err, ErrInvalidBatchContact),
+		errors.Is(err, ErrMissingBatchID), errors.Is(err, ErrUnknownBatchRef):
+		return http.StatusBadRequest, err.Error()
+	case errors.Is(err, ErrBatchRolledBack), errors.Is(err, ErrBatchNotRun):
+		return http.StatusFailedDependency, err.Error()
+	}
+	log.Printf("Error applying batch operation: %v", err)
+	return http.StatusInternalServerError, internalServerError
+}
+
+// DuplicatesHandler lists clusters of likely duplicate contacts, most
+// confident first (supports pagination).
+func (h *Handler) DuplicatesHandler(w http.ResponseWriter, r *http.Request) {
+	minConfidence := DefaultMinConfidence
+	if value := r.URL.Query().Get(minConfidenceParam); value != "" {
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil || parsed < 0 || parsed > 1 {
+			http.Error(w, invalidMinConfidence, http.StatusBadRequest)
+			return
+		}
+		minConfidence = parsed
+	}
+
+	clusters, err := h.Service.FindDuplicates(r.Context(), minConfidence)
+	if err != nil {
+		log.Printf("Error finding duplicates: %v", err)
+		http.Error(w, internalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	page, limit := httputil.ParsePagination(r)
+	start := minInt((page-1)*limit, len(clusters))
+	end := minInt(start+limit, len(clusters))
+
+	w.Header().Set(contentType, applicationJSON)
+	json.NewEncoder(w).Encode(clusters[start:end])
+}
+
+// MergeHandler merges contacts into a surviving contact and returns the
+// merge, with the survivor as it now is.
+func (h *Handler) MergeHandler(w http.ResponseWriter, r *http.Request) {
+	var request MergeRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		log.Printf("Error decoding merge: %v", err)
+		http.Error(w, invalidRequestError, http.StatusBadRequest)
+		return
+	}
+
+	if err := validate.Struct(request); err != nil {
+		log.Printf("Validation error: %v", err)
+		http.Error(w, httputil.FormatValidationError(err), http.StatusBadRequest)
+		return
+	}
+
+	merge, err := h.Service.Merge(r.Context(), request)
+	if errors.Is(err, ErrNothingToMerge) || errors.Is(err, ErrMergeChoice) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, ErrContactNotFound) {
+		http.Error(w, contactNotFoundError, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error merging contacts: %v", err)
+		http.Error(w, internalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(contentType, applicationJSON)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(merge)
+}
+
+func (h *Handler) GetMergesHandler(w http.ResponseWriter, r *http.Request) {
+	page, limit := httputil.ParsePagination(r)
+	merges, err := h.Service.GetMerges(r.Context(), page, limit)
+	if err != nil {
+		log.Printf("Error getting merges: %v", err)
+		http.Error(w, internalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(contentType, applicationJSON)
+	json.NewEncoder(w).Encode(merges)
+}
+
+// UndoMergeHandler restores the contacts of a merge. Merges whose survivor
+// has changed since cannot be undone.
+func (h *Handler) UndoMergeHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)[mergeIDParam])
+	if err != nil {
+		log.Printf("Invalid merge ID: %v", err)
+		http.Error(w, invalidMergeID, http.StatusBadRequest)
+		return
+	}
+
+	merge, err := h.Service.UndoMerge(r.Context(), id)
+	if errors.Is(err, ErrMergeNotFound) {
+		http.Error(w, mergeNotFoundError, http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, ErrMergeUndone) || errors.Is(err, ErrMergeStale) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Error undoing merge: %v", err)
+		http.Error(w, internalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(contentType, applicationJSON)
+	json.NewEncoder(w).Encode(merge)
+}
+
+func (h *Handler) BirthdayCalendarHandler(w http.ResponseWriter, r *http.Request) {
+	// Read before the contacts, so that the feed is never older than it says
+	modified, err := h.Service.GetCalendarModified(r.Context())
+	if err != nil {
+		log.Printf("Error getting birthday calendar: %v", err)
+		http.Error(w, internalServerError, http.StatusInternalServerError)
+		return
+	}
+	contacts, err := h.Service.GetDatedContacts(r.Context(), r.URL.Query().Get(groupParam))
+	if err != nil {
+		log.Printf("Error getting birthday calendar: %v", err)
+		http.Error(w, internalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	// The feed is validated by its content, so that contacts dropping out of
+	// it, which leave no newer timestamp behind, still change the validator
+	var calendar bytes.Buffer
+	if err := writeBirthdayCalendar(&calendar, contacts); err != nil {
+		log.Printf("Error writing birthday calendar: %v", err)
+		http.Error(w, internalServerError, http.StatusInternalServerError)
+		return
+	}
+	sum := sha256.Sum256(calendar.Bytes())
+	tag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	w.Header().Set(etagHeader, tag)
+
+	// Clients that only keep the date get the time any of the tenant's
+	// contacts last changed or was deleted. It does not move when a share
+	// ends, so If-None-Match, when sent, decides alone as RFC 7232 asks.
+	// HTTP dates only carry whole seconds.
+	modified = modified.UTC().Truncate(time.Second)
+	if !modified.IsZero() {
+		w.Header().Set(lastModified, modified.Format(http.TimeFormat))
+	}
+	if match := r.Header.Get(ifNoneMatch); match != "" {
+		if etagMatches(match, tag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	} else if since, err := http.ParseTime(r.Header.Get(ifModifiedSince)); err == nil && !modified.IsZero() && !modified.After(since) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set(contentType, textCalendar)
+	w.Write(calendar.Bytes())
+}
+
+// etagMatches reports whether an If-None-Match header lists the entity tag,
+// compared weakly as RFC 7232 asks for GET requests.
+func etagMatches(header, tag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == tag || candidate == "*" {
+			return true
 		}
 	}
-	return "Validation error: " + strings.Join(errors, ", ")
+	return false
+}
+
+func (h *Handler) GetVCardHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)[idParam])
+	if err != nil {
+		log.Printf("Invalid contact ID: %v", err)
+		http.Error(w, invalidContactID, http.StatusBadRequest)
+		return
+	}
+	version, ok := vcardVersion(r.URL.Query())
+	if !ok {
+		http.Error(w, invalidVersion, http.StatusBadRequest)
+		return
+	}
+
+	// A single card is small, so render it first to answer 404 for contacts
+	// the caller cannot see
+	var card bytes.Buffer
+	opts := ExportOptions{Format: FormatVCard, Version: version, Filter: ExportFilter{ContactID: id}}
+	count, err := h.Service.Export(r.Context(), &card, opts, nil)
+	if err != nil {
+		log.Printf("Error exporting vCard: %v", err)
+		http.Error(w, internalServerError, http.StatusInternalServerError)
+		return
+	}
+	if count == 0 {
+		http.Error(w, contactNotFoundError, http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set(contentType, textVCard)
+	w.Header().Set(contentDisposition, fmt.Sprintf(contactVCardFile, id))
+	if _, err := card.WriteTo(w); err != nil {
+		log.Printf("Error writing vCard: %v", err)
+	}
+}
+
+// ExportVCardsHandler streams the cards of every visible contact, or of one
+// group, as they are read.
+func (h *Handler) ExportVCardsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	query.Set(formatParam, FormatVCard)
+	opts, err := ParseExportOptions(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	h.export(w, r, opts)
+}
+
+// ExportContactsHandler streams the contacts as CSV or NDJSON rows, selected
+// with the filters of listing and searching contacts.
+func (h *Handler) ExportContactsHandler(w http.ResponseWriter, r *http.Request) {
+	opts, err := ParseExportOptions(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	h.export(w, r, opts)
+}
+
+func (h *Handler) export(w http.ResponseWriter, r *http.Request, opts ExportOptions) {
+	switch opts.Format {
+	case FormatVCard:
+		w.Header().Set(contentType, textVCard)
+		w.Header().Set(contentDisposition, exportVCardFile)
+	case FormatNDJSON:
+		w.Header().Set(contentType, applicationNDJSON)
+		w.Header().Set(contentDisposition, exportNDJSONFile)
+	default:
+		w.Header().Set(contentType, textCSV)
+		w.Header().Set(contentDisposition, exportCSVFile)
+	}
+	count, err := h.Service.Export(r.Context(), w, opts, nil)
+	switch {
+	case errors.Is(err, ErrUnknownExportField):
+		w.Header().Del(contentDisposition)
+		http.Error(w, invalidExportField, http.StatusBadRequest)
+	case err != nil && count == 0:
+		// Nothing has been sent yet, so the error can still be reported
+		log.Printf("Error exporting contacts: %v", err)
+		w.Header().Del(contentDisposition)
+		http.Error(w, internalServerError, http.StatusInternalServerError)
+	case err != nil && r.Context().Err() != nil:
+		log.Printf("Client left the export after %d contacts", count)
+	case err != nil:
+		log.Printf("Error exporting contacts after %d contacts: %v", count, err)
+	}
+}
+
+// ImportVCardsHandler imports a body of vCards and reports the outcome of
+// every card. With dry_run=true nothing is written.
+func (h *Handler) ImportVCardsHandler(w http.ResponseWriter, r *http.Request) {
+	if ImportFormat(r.Header.Get(contentType)) != FormatVCard {
+		http.Error(w, unsupportedImportType, http.StatusUnsupportedMediaType)
+		return
+	}
+	dryRun, ok := boolParam(r.URL.Query(), dryRunParam)
+	if !ok {
+		http.Error(w, invalidDryRun, http.StatusBadRequest)
+		return
+	}
+	body, ok := readImportBody(w, r)
+	if !ok {
+		return
+	}
+
+	result, err := h.Service.ImportVCards(r.Context(), bytes.NewReader(body), dryRun, nil)
+	if message, ok := ImportErrorMessage(err); ok {
+		http.Error(w, message, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("Error importing vCards: %v", err)
+		http.Error(w, internalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(contentType, applicationJSON)
+	json.NewEncoder(w).Encode(result)
+}
+
+// ImportCSVHandler imports the rows of a CSV body. All-or-nothing imports
+// that are rejected answer 422 with the same report.
+func (h *Handler) ImportCSVHandler(w http.ResponseWriter, r *http.Request) {
+	if ImportFormat(r.Header.Get(contentType)) != FormatCSV {
+		http.Error(w, unsupportedCSVType, http.StatusUnsupportedMediaType)
+		return
+	}
+	opts, err := ParseCSVImportOptions(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	body, ok := readImportBody(w, r)
+	if !ok {
+		return
+	}
+
+	result, err := h.Service.ImportCSV(r.Context(), body, opts, nil)
+	if message, ok := ImportErrorMessage(err); ok {
+		http.Error(w, message, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("Error importing CSV: %v", err)
+		http.Error(w, internalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(contentType, applicationJSON)
+	if result.Rejected {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+func (h *Handler) GetImportProfilesHandler(w http.ResponseWriter, r *http.Request) {
+	profiles, err := h.Service.GetImportProfiles(r.Context())
+	if err != nil {
+		log.Printf("Error getting import profiles: %v", err)
+		http.Error(w, internalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(contentType, applicationJSON)
+	json.NewEncoder(w).Encode(profiles)
+}
+
+func (h *Handler) AddImportProfileHandler(w http.ResponseWriter, r *http.Request) {
+	var profile ImportProfile
+	if err := json.NewDecoder(r.Body).Decode(&profile); err != nil {
+		log.Printf("Error decoding import profile: %v", err)
+		http.Error(w, invalidRequestError, http.StatusBadRequest)
+		return
+	}
+
+	if err := validate.Struct(profile); err != nil {
+		log.Printf("Validation error: %v", err)
+		http.Error(w, httputil.FormatValidationError(err), http.StatusBadRequest)
+		return
+	}
+
+	err := h.Service.AddImportProfile(r.Context(), &profile)
+	if errors.Is(err, ErrProfileExists) {
+		http.Error(w, profileExistsError, http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Error adding import profile: %v", err)
+		http.Error(w, internalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(contentType, applicationJSON)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(profile)
+}
+
+func (h *Handler) EditImportProfileHandler(w http.ResponseWriter, r *http.Request) {
+	var profile ImportProfile
+	if err := json.NewDecoder(r.Body).Decode(&profile); err != nil {
+		log.Printf("Error decoding import profile: %v", err)
+		http.Error(w, invalidRequestError, http.StatusBadRequest)
+		return
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)[idParam])
+	if err != nil {
+		log.Printf("Invalid import profile ID: %v", err)
+		http.Error(w, invalidProfileID, http.StatusBadRequest)
+		return
+	}
+	profile.ID = id
+
+	if err := validate.Struct(profile); err != nil {
+		log.Printf("Validation error: %v", err)
+		http.Error(w, httputil.FormatValidationError(err), http.StatusBadRequest)
+		return
+	}
+
+	err = h.Service.EditImportProfile(r.Context(), &profile)
+	if errors.Is(err, ErrProfileNotFound) {
+		http.Error(w, profileNotFoundError, http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, ErrProfileExists) {
+		http.Error(w, profileExistsError, http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Error editing import profile: %v", err)
+		http.Error(w, internalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(contentType, applicationJSON)
+	json.NewEncoder(w).Encode(profile)
+}
+
+func (h *Handler) DeleteImportProfileHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)[idParam])
+	if err != nil {
+		log.Printf("Invalid import profile ID: %v", err)
+		http.Error(w, invalidProfileID, http.StatusBadRequest)
+		return
+	}
+
+	err = h.Service.DeleteImportProfile(r.Context(), id)
+	if errors.Is(err, ErrProfileNotFound) {
+		http.Error(w, profileNotFoundError, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error deleting import profile: %v", err)
+		http.Error(w, internalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// importMediaTypes are the media types accepted for each import format.
+var importMediaTypes = map[string][]string{
+	FormatVCard: {"text/vcard", "text/x-vcard", "text/directory"},
+	FormatCSV:   {"text/csv", "application/csv", "text/tab-separated-values"},
+}
+
+// ImportFormat returns the import format of a Content-Type header, or an
+// empty string when it is not one that can be imported.
+func ImportFormat(header string) string {
+	mediaType, _, _ := mime.ParseMediaType(header)
+	for format, mediaTypes := range importMediaTypes {
+		if containsString(mediaTypes, mediaType) {
+			return format
+		}
+	}
+	return ""
+}
+
+// ImportErrorMessage returns the message for an import that failed because
+// of its body or options rather than on the server.
+func ImportErrorMessage(err error) (string, bool) {
+	var parseErr *csv.ParseError
+	switch {
+	case errors.Is(err, ErrNoVCards):
+		return noVCardsError, true
+	case errors.Is(err, bufio.ErrTooLong):
+		return importLineTooLong, true
+	case errors.Is(err, ErrUnsupportedEncoding):
+		return invalidEncoding, true
+	case errors.Is(err, ErrProfileNotFound):
+		return profileNotFoundError, true
+	case errors.Is(err, ErrUnknownLayout), errors.Is(err, ErrEmptyCSV):
+		return err.Error(), true
+	case errors.As(err, &parseErr):
+		return invalidCSVHeader, true
+	}
+	return "", false
+}
+
+// ParseCSVImportOptions reads the options of a CSV import from its query
+// parameters. The error is the message to answer with.
+func ParseCSVImportOptions(query url.Values) (CSVImportOptions, error) {
+	opts := CSVImportOptions{Profile: query.Get(profileParam), Encoding: query.Get(encodingParam)}
+	var ok bool
+	if opts.Delimiter, ok = parseDelimiter(query.Get(delimiterParam)); !ok {
+		return opts, errors.New(invalidDelimiter)
+	}
+	switch query.Get(modeParam) {
+	case "", bestEffortMode:
+	case allOrNothingMode:
+		opts.AllOrNothing = true
+	default:
+		return opts, errors.New(invalidMode)
+	}
+	if opts.DryRun, ok = boolParam(query, dryRunParam); !ok {
+		return opts, errors.New(invalidDryRun)
+	}
+	return opts, nil
+}
+
+// ParseExportOptions reads the format, fields and filters of an export from
+// its query parameters. The filters are those of listing and searching
+// contacts. The error is the message to answer with.
+func ParseExportOptions(query url.Values) (ExportOptions, error) {
+	opts := ExportOptions{Format: query.Get(formatParam)}
+	switch opts.Format {
+	case "":
+		opts.Format = FormatCSV
+	case FormatCSV, FormatNDJSON:
+	case FormatVCard:
+		var ok bool
+		if opts.Version, ok = vcardVersion(query); !ok {
+			return opts, errors.New(invalidVersion)
+		}
+	default:
+		return opts, errors.New(invalidExportFormat)
+	}
+	if value := query.Get(fieldsParam); value != "" {
+		for _, field := range strings.Split(value, ",") {
+			opts.Fields = append(opts.Fields, strings.TrimSpace(field))
+		}
+	}
+
+	view := query.Get(viewParam)
+	if view != "" && view != sharedView {
+		return opts, errors.New(invalidView)
+	}
+	opts.Filter = ExportFilter{
+		Group:        query.Get(groupParam),
+		SharedOnly:   view == sharedView,
+		Query:        query.Get(queryParam),
+		CustomFields: customFieldParams(query),
+	}
+	return opts, nil
+}
+
+// boolParam reads an optional boolean query parameter, which defaults to false.
+func boolParam(query url.Values, name string) (bool, bool) {
+	value := query.Get(name)
+	if value == "" {
+		return false, true
+	}
+	parsed, err := strconv.ParseBool(value)
+	return parsed, err == nil
+}
+
+// readImportBody reads an import body of at most maxImportBytes, writing the
+// error response and returning false when it is larger.
+func readImportBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxImportBytes))
+	if err != nil {
+		log.Printf("Error reading import: %v", err)
+		http.Error(w, importTooLarge, http.StatusRequestEntityTooLarge)
+		return nil, false
+	}
+	return body, true
+}
+
+// customFieldParams reads parameters such as custom.employee_id=42, which
+// filter on custom field values.
+func customFieldParams(query url.Values) map[string]string {
+	fields := make(map[string]string)
+	for key, values := range query {
+		if name := strings.TrimPrefix(key, customFieldPrefix); name != key && len(values) > 0 {
+			fields[name] = values[0]
+		}
+	}
+	return fields
+}
+
+func vcardVersion(query url.Values) (string, bool) {
+	switch version := query.Get(versionParam); version {
+	case "":
+		return VCard4, true
+	case VCard3, VCard4:
+		return version, true
+	}
+	return "", false
+}
+
+func (h *Handler) GetOrganizationContactsHandler(w http.ResponseWriter, r *http.Request) {
+	organizationID, err := strconv.Atoi(mux.Vars(r)[idParam])
+	if err != nil {
+		log.Printf("Invalid organization ID: %v", err)
+		http.Error(w, invalidOrganizationID, http.StatusBadRequest)
+		return
+	}
+
+	page, limit := httputil.ParsePagination(r)
+	contacts, err := h.Service.GetOrganizationContacts(r.Context(), organizationID, page, limit)
+	if err != nil {
+		log.Printf("Error getting organization contacts: %v", err)
+		http.Error(w, internalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(contentType, applicationJSON)
+	json.NewEncoder(w).Encode(contacts)
+}
+
+func (h *Handler) GetCustomFieldsHandler(w http.ResponseWriter, r *http.Request) {
+	fields, err := h.Service.GetCustomFields(r.Context())
+	if err != nil {
+		log.Printf("Error getting custom fields: %v", err)
+		http.Error(w, internalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(contentType, applicationJSON)
+	json.NewEncoder(w).Encode(fields)
+}
+
+func (h *Handler) AddCustomFieldHandler(w http.ResponseWriter, r *http.Request) {
+	var field CustomField
+	if err := json.NewDecoder(r.Body).Decode(&field); err != nil {
+		log.Printf("Error decoding custom field: %v", err)
+		http.Error(w, invalidRequestError, http.StatusBadRequest)
+		return
+	}
+
+	if err := validate.Struct(field); err != nil {
+		log.Printf("Validation error: %v", err)
+		http.Error(w, httputil.FormatValidationError(err), http.StatusBadRequest)
+		return
+	}
+
+	err := h.Service.AddCustomField(r.Context(), &field)
+	if errors.Is(err, ErrCustomFieldExists) {
+		http.Error(w, customFieldExistsError, http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Error adding custom field: %v", err)
+		http.Error(w, internalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(contentType, applicationJSON)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(field)
+}
+
+func (h *Handler) EditCustomFieldHandler(w http.ResponseWriter, r *http.Request) {
+	var field CustomField
+	if err := json.NewDecoder(r.Body).Decode(&field); err != nil {
+		log.Printf("Error decoding custom field: %v", err)
+		http.Error(w, invalidRequestError, http.StatusBadRequest)
+		return
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)[idParam])
+	if err != nil {
+		log.Printf("Invalid custom field ID: %v", err)
+		http.Error(w, invalidFieldID, http.StatusBadRequest)
+		return
+	}
+	field.ID = id
+
+	// The name is immutable, so only the remaining attributes are validated
+	if err := validate.StructExcept(field, "Name"); err != nil {
+		log.Printf("Validation error: %v", err)
+		http.Error(w, httputil.FormatValidationError(err), http.StatusBadRequest)
+		return
+	}
+
+	err = h.Service.EditCustomField(r.Context(), &field)
+	if errors.Is(err, ErrCustomFieldNotFound) {
+		http.Error(w, customFieldNotFoundError, http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, ErrCustomValuesTaken) {
+		http.Error(w, customValuesTakenError, http.StatusConflict)
+		return
+	}
+	if errors.Is(err, ErrCustomValuesInvalid) {
+		http.Error(w, customValuesInvalidError, http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Error editing custom field: %v", err)
+		http.Error(w, internalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(contentType, applicationJSON)
+	json.NewEncoder(w).Encode(field)
+}
+
+func (h *Handler) DeleteCustomFieldHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)[idParam])
+	if err != nil {
+		log.Printf("Invalid custom field ID: %v", err)
+		http.Error(w, invalidFieldID, http.StatusBadRequest)
+		return
+	}
+
+	err = h.Service.DeleteCustomField(r.Context(), id)
+	if errors.Is(err, ErrCustomFieldNotFound) {
+		http.Error(w, customFieldNotFoundError, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error deleting custom field: %v", err)
+		http.Error(w, internalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) GetNotesHandler(w http.ResponseWriter, r *http.Request) {
+	contactID, err := strconv.Atoi(mux.Vars(r)[idParam])
+	if err != nil {
+		log.Printf("Invalid contact ID: %v", err)
+		http.Error(w, invalidContactID, http.StatusBadRequest)
+		return
+	}
+
+	page, limit := httputil.ParsePagination(r)
+	notes, err := h.Service.GetNotes(r.Context(), contactID, page, limit)
+	if err != nil {
+		log.Printf("Error getting notes: %v", err)
+		http.Error(w, internalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(contentType, applicationJSON)
+	json.NewEncoder(w).Encode(notes)
+}
+
+func (h *Handler) AddNoteHandler(w http.ResponseWriter, r *http.Request) {
+	var note Note
+	if err := json.NewDecoder(r.Body).Decode(&note); err != nil {
+		log.Printf("Error decoding note: %v", err)
+		http.Error(w, invalidRequestError, http.StatusBadRequest)
+		return
+	}
+
+	if err := validate.Struct(note); err != nil {
+		log.Printf("Validation error: %v", err)
+		http.Error(w, httputil.FormatValidationError(err), http.StatusBadRequest)
+		return
+	}
+
+	contactID, err := strconv.Atoi(mux.Vars(r)[idParam])
+	if err != nil {
+		log.Printf("Invalid contact ID: %v", err)
+		http.Error(w, invalidContactID, http.StatusBadRequest)
+		return
+	}
+	note.ContactID = contactID
+
+	err = h.Service.AddNote(r.Context(), &note)
+	if errors.Is(err, ErrContactNotFound) {
+		http.Error(w, contactNotFoundError, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error adding note: %v", err)
+		http.Error(w, internalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(contentType, applicationJSON)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(note)
+}
+
+func (h *Handler) EditNoteHandler(w http.ResponseWriter, r *http.Request) {
+	var note Note
+	if err := json.NewDecoder(r.Body).Decode(&note); err != nil {
+		log.Printf("Error decoding note: %v", err)
+		http.Error(w, invalidRequestError, http.StatusBadRequest)
+		return
+	}
+
+	// Only the text of a note can be edited; the author stays as recorded
+	if err := validate.StructPartial(note, "Text"); err != nil {
+		log.Printf("Validation error: %v", err)
+		http.Error(w, httputil.FormatValidationError(err), http.StatusBadRequest)
+		return
+	}
+
+	vars := mux.Vars(r)
+	contactID, err := strconv.Atoi(vars[idParam])
+	if err != nil {
+		log.Printf("Invalid contact ID: %v", err)
+		http.Error(w, invalidContactID, http.StatusBadRequest)
+		return
+	}
+	id, err := strconv.Atoi(vars[noteIDParam])
+	if err != nil {
+		log.Printf("Invalid note ID: %v", err)
+		http.Error(w, invalidNoteID, http.StatusBadRequest)
+		return
+	}
+	note.ID = id
+	note.ContactID = contactID
+
+	err = h.Service.EditNote(r.Context(), &note)
+	if errors.Is(err, ErrNoteNotFound) {
+		http.Error(w, noteNotFoundError, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error editing note: %v", err)
+		http.Error(w, internalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(contentType, applicationJSON)
+	json.NewEncoder(w).Encode(note)
+}
+
+func (h *Handler) DeleteNoteHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	contactID, err := strconv.Atoi(vars[idParam])
+	if err != nil {
+		log.Printf("Invalid contact ID: %v", err)
+		http.Error(w, invalidContactID, http.StatusBadRequest)
+		return
+	}
+	id, err := strconv.Atoi(vars[noteIDParam])
+	if err != nil {
+		log.Printf("Invalid note ID: %v", err)
+		http.Error(w, invalidNoteID, http.StatusBadRequest)
+		return
+	}
+
+	err = h.Service.DeleteNote(r.Context(), contactID, id)
+	if errors.Is(err, ErrNoteNotFound) {
+		http.Error(w, noteNotFoundError, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error deleting note: %v", err)
+		http.Error(w, internalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) GetRelationsHandler(w http.ResponseWriter, r *http.Request) {
+	contactID, err := strconv.Atoi(mux.Vars(r)[idParam])
+	if err != nil {
+		log.Printf("Invalid contact ID: %v", err)
+		http.Error(w, invalidContactID, http.StatusBadRequest)
+		return
+	}
+
+	depth := 1
+	if depthStr := r.URL.Query().Get(depthParam); depthStr != "" {
+		depth, err = strconv.Atoi(depthStr)
+		if err != nil || depth < 1 || depth > maxRelationDepth {
+			http.Error(w, invalidDepth, http.StatusBadRequest)
+			return
+		}
+	}
+
+	relations, err := h.Service.GetRelations(r.Context(), contactID, depth)
+	if err != nil {
+		log.Printf("Error getting relations: %v", err)
+		http.Error(w, internalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(contentType, applicationJSON)
+	json.NewEncoder(w).Encode(relations)
+}
+
+func (h *Handler) AddRelationHandler(w http.ResponseWriter, r *http.Request) {
+	var relation Relation
+	if err := json.NewDecoder(r.Body).Decode(&relation); err != nil {
+		log.Printf("Error decoding relation: %v", err)
+		http.Error(w, invalidRequestError, http.StatusBadRequest)
+		return
+	}
+
+	contactID, err := strconv.Atoi(mux.Vars(r)[idParam])
+	if err != nil {
+		log.Printf("Invalid contact ID: %v", err)
+		http.Error(w, invalidContactID, http.StatusBadRequest)
+		return
+	}
+	relation.ContactID = contactID
+	relation.Depth = 0
+
+	if err := validate.Struct(relation); err != nil {
+		log.Printf("Validation error: %v", err)
+		http.Error(w, httputil.FormatValidationError(err), http.StatusBadRequest)
+		return
+	}
+
+	err = h.Service.AddRelation(r.Context(), &relation)
+	if errors.Is(err, ErrContactNotFound) {
+		http.Error(w, contactNotFoundError, http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, ErrRelationExists) {
+		http.Error(w, relationExistsError, http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Error adding relation: %v", err)
+		http.Error(w, internalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(contentType, applicationJSON)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(relation)
+}
+
+func (h *Handler) DeleteRelationHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	contactID, err := strconv.Atoi(vars[idParam])
+	if err != nil {
+		log.Printf("Invalid contact ID: %v", err)
+		http.Error(w, invalidContactID, http.StatusBadRequest)
+		return
+	}
+	id, err := strconv.Atoi(vars[relationIDParam])
+	if err != nil {
+		log.Printf("Invalid relation ID: %v", err)
+		http.Error(w, invalidRelationID, http.StatusBadRequest)
+		return
+	}
+
+	err = h.Service.DeleteRelation(r.Context(), contactID, id)
+	if errors.Is(err, ErrRelationNotFound) {
+		http.Error(w, relationNotFoundError, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error deleting relation: %v", err)
+		http.Error(w, internalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) GetShareLinksHandler(w http.ResponseWriter, r *http.Request) {
+	contactID, err := strconv.Atoi(mux.Vars(r)[idParam])
+	if err != nil {
+		log.Printf("Invalid contact ID: %v", err)
+		http.Error(w, invalidContactID, http.StatusBadRequest)
+		return
+	}
+
+	links, err := h.Service.GetShareLinks(r.Context(), contactID)
+	if err != nil {
+		log.Printf("Error getting share links: %v", err)
+		http.Error(w, internalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(contentType, applicationJSON)
+	json.NewEncoder(w).Encode(links)
+}
+
+func (h *Handler) AddShareLinkHandler(w http.ResponseWriter, r *http.Request) {
+	contactID, err := strconv.Atoi(mux.Vars(r)[idParam])
+	if err != nil {
+		log.Printf("Invalid contact ID: %v", err)
+		http.Error(w, invalidContactID, http.StatusBadRequest)
+		return
+	}
+
+	// The body is optional, links default to a week without a view limit
+	var link ShareLink
+	if err := json.NewDecoder(r.Body).Decode(&link); err != nil && !errors.Is(err, io.EOF) {
+		log.Printf("Error decoding share link: %v", err)
+		http.Error(w, invalidRequestError, http.StatusBadRequest)
+		return
+	}
+
+	if err := validate.Struct(link); err != nil {
+		log.Printf("Validation error: %v", err)
+		http.Error(w, httputil.FormatValidationError(err), http.StatusBadRequest)
+		return
+	}
+	link.ContactID = contactID
+
+	err = h.Service.AddShareLink(r.Context(), &link)
+	if errors.Is(err, ErrShareLinkExpiry) {
+		http.Error(w, shareLinkExpiryError, http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, ErrContactNotFound) {
+		http.Error(w, contactNotFoundError, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error adding share link: %v", err)
+		http.Error(w, internalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(contentType, applicationJSON)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(link)
+}
+
+func (h *Handler) RevokeShareLinkHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	contactID, err := strconv.Atoi(vars[idParam])
+	if err != nil {
+		log.Printf("Invalid contact ID: %v", err)
+		http.Error(w, invalidContactID, http.StatusBadRequest)
+		return
+	}
+	id, err := strconv.Atoi(vars[linkIDParam])
+	if err != nil {
+		log.Printf("Invalid share link ID: %v", err)
+		http.Error(w, invalidLinkID, http.StatusBadRequest)
+		return
+	}
+
+	err = h.Service.RevokeShareLink(r.Context(), contactID, id)
+	if errors.Is(err, ErrShareLinkNotFound) {
+		http.Error(w, shareLinkNotFoundError, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error revoking share link: %v", err)
+		http.Error(w, internalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// PublicContactHandler serves share links without authentication. Malformed
+// and forged links are not found, links that were valid are gone.
+func (h *Handler) PublicContactHandler(w http.ResponseWriter, r *http.Request) {
+	// Every view counts and the URL is the credential, so keep both out of
+	// caches and referrers
+	w.Header().Set(cacheControl, noStore)
+	w.Header().Set(referrerPolicy, noReferrer)
+	w.Header().Set(contentTypeOptions, nosniff)
+
+	format, ok := cardFormat(r)
+	if !ok {
+		http.Error(w, invalidFormat, http.StatusBadRequest)
+		return
+	}
+	id, errID := strconv.Atoi(mux.Vars(r)[linkIDParam])
+	expires, errExpires := strconv.ParseInt(r.URL.Query().Get(expiresParam), 10, 64)
+	if errID != nil || errExpires != nil {
+		http.Error(w, shareLinkNotFoundError, http.StatusNotFound)
+		return
+	}
+
+	contact, err := h.Service.ViewShareLink(r.Context(), id, expires, r.URL.Query().Get(signatureParam))
+	if errors.Is(err, ErrShareLinkNotFound) {
+		http.Error(w, shareLinkNotFoundError, http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, ErrShareLinkGone) {
+		http.Error(w, shareLinkGoneError, http.StatusGone)
+		return
+	}
+	if err != nil {
+		log.Printf("Error viewing share link: %v", err)
+		http.Error(w, internalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	switch format {
+	case FormatVCard:
+		w.Header().Set(contentType, textVCard)
+		w.Header().Set(contentDisposition, vcardAttachment)
+		err = writeVCard(w, VCard3, *contact, nil, nil)
+	case formatHTML:
+		vcardURL := *r.URL
+		query := vcardURL.Query()
+		query.Set(formatParam, FormatVCard)
+		vcardURL.RawQuery = query.Encode()
+		w.Header().Set(contentType, textHTML)
+		err = writeContactCard(w, *contact, vcardURL.RequestURI())
+	default:
+		w.Header().Set(contentType, applicationJSON)
+		err = json.NewEncoder(w).Encode(contact)
+	}
+	if err != nil {
+		log.Printf("Error writing shared contact: %v", err)
+	}
+}
+
+// cardFormat picks the format from the format parameter, falling back to the
+// Accept header so that browsers get the HTML card.
+func cardFormat(r *http.Request) (string, bool) {
+	switch format := r.URL.Query().Get(formatParam); format {
+	case formatJSON, FormatVCard, formatHTML:
+		return format, true
+	case "":
+	default:
+		return "", false
+	}
+	accept := r.Header.Get(acceptHeader)
+	switch {
+	case strings.Contains(accept, "text/html"):
+		return formatHTML, true
+	case strings.Contains(accept, "text/vcard"), strings.Contains(accept, "text/x-vcard"):
+		return FormatVCard, true
+	}
+	return formatJSON, true
+}
+
+// validateCustomFields writes the error response and returns false when the
+// contact's custom field values are invalid.
+func (h *Handler) validateCustomFields(w http.ResponseWriter, r *http.Request, contact *Contact) bool {
+	err := h.Service.ValidateCustomFields(r.Context(), contact)
+	var validationErr *ValidationError
+	if errors.As(err, &validationErr) {
+		log.Printf("Validation error: %v", err)
+		http.Error(w, validationErr.Error(), http.StatusBadRequest)
+		return false
+	}
+	if err != nil {
+		log.Printf("Error validating custom fields: %v", err)
+		http.Error(w, internalServerError, http.StatusInternalServerError)
+		return false
+	}
+	return true
 }
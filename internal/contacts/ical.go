@@ -0,0 +1,105 @@
+package contacts
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	icalDateLayout      = "20060102"
+	icalTimestampLayout = "20060102T150405Z"
+	icalMaxLineOctets   = 75
+	icalProductID       = "-//phone-book-api//Birthdays//EN"
+	icalUIDDomain       = "phone-book-api"
+	icalCalendarName    = "Contact birthdays"
+)
+
+type calendarEvent struct {
+	kind    string
+	summary string
+	date    time.Time
+}
+
+// writeBirthdayCalendar renders an RFC 5545 calendar with one yearly
+// recurring all-day event per birthday and anniversary.
+func writeBirthdayCalendar(w io.Writer, contacts []Contact) error {
+	cw := &icalWriter{w: w}
+	cw.line("BEGIN:VCALENDAR")
+	cw.line("VERSION:2.0")
+	cw.line("PRODID:" + icalProductID)
+	cw.line("CALSCALE:GREGORIAN")
+	cw.line("METHOD:PUBLISH")
+	cw.line("X-WR-CALNAME:" + icalEscape(icalCalendarName))
+
+	for _, contact := range contacts {
+		for _, event := range contactEvents(contact) {
+			cw.line("BEGIN:VEVENT")
+			// The UID only depends on the contact ID and event kind so that
+			// subscribed clients update events in place instead of duplicating them.
+			cw.line(fmt.Sprintf("UID:%s-%d@%s", event.kind, contact.ID, icalUIDDomain))
+			cw.line("DTSTAMP:" + contact.UpdatedAt.UTC().Format(icalTimestampLayout))
+			cw.line("DTSTART;VALUE=DATE:" + event.date.Format(icalDateLayout))
+			cw.line("DTEND;VALUE=DATE:" + event.date.AddDate(0, 0, 1).Format(icalDateLayout))
+			cw.line("RRULE:" + yearlyRule(event.date))
+			cw.line("SUMMARY:" + icalEscape(event.summary))
+			cw.line("TRANSP:TRANSPARENT")
+			cw.line("END:VEVENT")
+		}
+	}
+
+	cw.line("END:VCALENDAR")
+	return cw.err
+}
+
+func contactEvents(contact Contact) []calendarEvent {
+	name := strings.TrimSpace(contact.FirstName + " " + contact.LastName)
+	var events []calendarEvent
+	if date, err := time.Parse(dateLayout, contact.Birthday); err == nil {
+		events = append(events, calendarEvent{kind: "birthday", summary: name + "'s birthday", date: date})
+	}
+	if date, err := time.Parse(dateLayout, contact.Anniversary); err == nil {
+		events = append(events, calendarEvent{kind: "anniversary", summary: name + "'s anniversary", date: date})
+	}
+	return events
+}
+
+// yearlyRule moves February 29th events to the last day of February in
+// non-leap years, which a plain FREQ=YEARLY rule would skip.
+func yearlyRule(date time.Time) string {
+	if date.Month() == time.February && date.Day() == 29 {
+		return "FREQ=YEARLY;BYMONTH=2;BYMONTHDAY=-1"
+	}
+	return "FREQ=YEARLY"
+}
+
+func icalEscape(value string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`).Replace(value)
+}
+
+type icalWriter struct {
+	w   io.Writer
+	err error
+}
+
+// line writes a content line terminated by CRLF, folding it at 75 octets
+// without splitting UTF-8 sequences.
+func (cw *icalWriter) line(content string) {
+	if cw.err != nil {
+		return
+	}
+	var b strings.Builder
+	width := 0
+	for _, r := range content {
+		size := len(string(r))
+		if width+size > icalMaxLineOctets {
+			b.WriteString("\r\n ")
+			width = 1
+		}
+		b.WriteRune(r)
+		width += size
+	}
+	b.WriteString("\r\n")
+	_, cw.err = io.WriteString(cw.w, b.String())
+}
@@ -0,0 +1,310 @@
+package contacts
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/benhuri/phone-book-api/internal/auth"
+)
+
+// memoryRepository is a Repository that keeps contacts in memory, for tests
+// of the service without a database. It implements the contact methods and
+// WithTx; calling any other method panics. Contacts are scoped by tenant
+// only, with no phone books or shares, and no events are recorded.
+type memoryRepository struct {
+	Repository
+
+	phoneCountry string
+	mu           *sync.Mutex
+	committed    *memoryState
+	// tx is the working copy of the transaction the repository runs in
+	tx *memoryState
+}
+
+type memoryState struct {
+	contacts map[string]map[int]Contact
+	nextID   int
+}
+
+// NewMemoryRepository returns an empty in-memory Repository. Transactions
+// hold a lock until they end and change a copy of the contacts, which
+// replaces them when the transaction commits. Transactions therefore never
+// conflict, but fn must only use the repository WithTx gives it, since the
+// others wait for the transaction to end.
+func NewMemoryRepository(phoneCountry string) Repository {
+	return &memoryRepository{
+		phoneCountry: phoneCountry,
+		mu:           &sync.Mutex{},
+		committed:    &memoryState{contacts: map[string]map[int]Contact{}},
+	}
+}
+
+func (r *memoryRepository) WithTx(ctx context.Context, fn func(Repository) error) error {
+	if r.tx != nil {
+		return fn(r)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	tx := r.committed.clone()
+	if err := fn(&memoryRepository{phoneCountry: r.phoneCountry, mu: r.mu, committed: r.committed, tx: tx}); err != nil {
+		return err
+	}
+	*r.committed = *tx
+	return nil
+}
+
+// state returns the contacts the repository's calls see, and the function
+// that ends the call. Outside a transaction the call is one of its own.
+func (r *memoryRepository) state() (*memoryState, func()) {
+	if r.tx != nil {
+		return r.tx, func() {}
+	}
+	r.mu.Lock()
+	return r.committed, r.mu.Unlock
+}
+
+func (s *memoryState) clone() *memoryState {
+	copied := &memoryState{contacts: make(map[string]map[int]Contact, len(s.contacts)), nextID: s.nextID}
+	for tenantID, contacts := range s.contacts {
+		copied.contacts[tenantID] = make(map[int]Contact, len(contacts))
+		for id, contact := range contacts {
+			copied.contacts[tenantID][id] = contact
+		}
+	}
+	return copied
+}
+
+// tenant returns the caller's contacts, creating the tenant's map.
+func (s *memoryState) tenant(ctx context.Context) (map[int]Contact, error) {
+	tenantID, err := auth.TenantID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if s.contacts[tenantID] == nil {
+		s.contacts[tenantID] = map[int]Contact{}
+	}
+	return s.contacts[tenantID], nil
+}
+
+// stored copies the contact, so that the caller's later changes to its
+// groups or custom fields do not reach the stored one.
+func stored(contact Contact) Contact {
+	contact.Groups = append([]string(nil), contact.Groups...)
+	if contact.CustomFields != nil {
+		customFields := make(map[string]interface{}, len(contact.CustomFields))
+		for name, value := range contact.CustomFields {
+			customFields[name] = value
+		}
+		contact.CustomFields = customFields
+	}
+	return contact
+}
+
+// page returns the contacts that match, ordered by ID.
+func page(contacts map[int]Contact, match func(Contact) bool, limit, offset int) []Contact {
+	matched := []Contact{}
+	for _, contact := range contacts {
+		if match(contact) {
+			matched = append(matched, stored(contact))
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool { return matched[i].ID < matched[j].ID })
+	if offset >= len(matched) {
+		return []Contact{}
+	}
+	matched = matched[offset:]
+	if limit < len(matched) {
+		matched = matched[:limit]
+	}
+	return matched
+}
+
+func (r *memoryRepository) FetchContacts(ctx context.Context, sharedOnly bool, limit, offset int) ([]Contact, error) {
+	state, done := r.state()
+	defer done()
+	contacts, err := state.tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return page(contacts, func(contact Contact) bool {
+		return !sharedOnly && contact.DeletedAt == nil
+	}, limit, offset), nil
+}
+
+func (r *memoryRepository) FetchContact(ctx context.Context, id int) (*Contact, error) {
+	state, done := r.state()
+	defer done()
+	contacts, err := state.tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+	contact, ok := contacts[id]
+	if !ok || contact.DeletedAt != nil {
+		return nil, ErrContactNotFound
+	}
+	contact = stored(contact)
+	return &contact, nil
+}
+
+func (r *memoryRepository) CreateContact(ctx context.Context, contact *Contact) error {
+	state, done := r.state()
+	defer done()
+	return r.createContact(ctx, state, contact, false)
+}
+
+func (r *memoryRepository) CreateUniqueContact(ctx context.Context, contact *Contact) error {
+	state, done := r.state()
+	defer done()
+	return r.createContact(ctx, state, contact, true)
+}
+
+func (r *memoryRepository) createContact(ctx context.Context, state *memoryState, contact *Contact, unique bool) error {
+	contacts, err := state.tenant(ctx)
+	if err != nil {
+		return err
+	}
+	if unique {
+		if ids := r.samePhone(contacts, contact); len(ids) > 0 {
+			return &DuplicateError{ContactIDs: ids}
+		}
+	}
+	state.nextID++
+	contact.ID = state.nextID
+	contact.Owner = ownerOf(ctx)
+	contact.UpdatedAt = time.Now()
+	contacts[contact.ID] = stored(*contact)
+	return nil
+}
+
+func (r *memoryRepository) FindSamePhone(ctx context.Context, contact *Contact) ([]int, error) {
+	state, done := r.state()
+	defer done()
+	contacts, err := state.tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return r.samePhone(contacts, contact), nil
+}
+
+func (r *memoryRepository) samePhone(contacts map[int]Contact, contact *Contact) []int {
+	phoneKey := normalizePhone(contact.PhoneNumber, r.phoneCountry)
+	if phoneKey == "" {
+		return nil
+	}
+	var ids []int
+	for _, other := range page(contacts, func(other Contact) bool {
+		return other.ID != contact.ID && other.DeletedAt == nil && normalizePhone(other.PhoneNumber, r.phoneCountry) == phoneKey
+	}, len(contacts), 0) {
+		ids = append(ids, other.ID)
+	}
+	return ids
+}
+
+func (r *memoryRepository) UpdateContact(ctx context.Context, contact *Contact) error {
+	state, done := r.state()
+	defer done()
+	contacts, err := state.tenant(ctx)
+	if err != nil {
+		return err
+	}
+	current, ok := contacts[contact.ID]
+	if !ok || current.DeletedAt != nil {
+		return ErrContactNotFound
+	}
+	contact.Owner = current.Owner
+	contact.UpdatedAt = time.Now()
+	contacts[contact.ID] = stored(*contact)
+	return nil
+}
+
+func (r *memoryRepository) RemoveContact(ctx context.Context, id int) error {
+	state, done := r.state()
+	defer done()
+	contacts, err := state.tenant(ctx)
+	if err != nil {
+		return err
+	}
+	contact, ok := contacts[id]
+	if !ok || contact.DeletedAt != nil {
+		return ErrContactNotFound
+	}
+	deletedAt := time.Now()
+	contact.DeletedAt = &deletedAt
+	contacts[id] = contact
+	return nil
+}
+
+func (r *memoryRepository) FetchTrash(ctx context.Context, limit, offset int) ([]Contact, error) {
+	state, done := r.state()
+	defer done()
+	contacts, err := state.tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+	trash := page(contacts, func(contact Contact) bool {
+		return contact.DeletedAt != nil
+	}, len(contacts), 0)
+	sort.SliceStable(trash, func(i, j int) bool { return trash[i].DeletedAt.After(*trash[j].DeletedAt) })
+	if offset >= len(trash) {
+		return []Contact{}, nil
+	}
+	trash = trash[offset:]
+	if limit < len(trash) {
+		trash = trash[:limit]
+	}
+	return trash, nil
+}
+
+func (r *memoryRepository) RestoreContact(ctx context.Context, id int) (*Contact, error) {
+	state, done := r.state()
+	defer done()
+	contacts, err := state.tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+	contact, ok := contacts[id]
+	if !ok || contact.DeletedAt == nil {
+		return nil, ErrContactNotFound
+	}
+	contact.DeletedAt = nil
+	contacts[id] = contact
+	contact = stored(contact)
+	return &contact, nil
+}
+
+func (r *memoryRepository) PurgeContact(ctx context.Context, id int) error {
+	state, done := r.state()
+	defer done()
+	contacts, err := state.tenant(ctx)
+	if err != nil {
+		return err
+	}
+	contact, ok := contacts[id]
+	if !ok || contact.DeletedAt == nil {
+		return ErrContactNotFound
+	}
+	delete(contacts, id)
+	return nil
+}
+
+func (r *memoryRepository) ContactWritable(ctx context.Context, id int) (bool, error) {
+	_, err := r.FetchContact(ctx, id)
+	if errors.Is(err, ErrContactNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// FetchCustomFields returns no fields, as the repository keeps none, so
+// contacts with custom field values fail validation.
+func (r *memoryRepository) FetchCustomFields(ctx context.Context) ([]CustomField, error) {
+	return nil, nil
+}
+
+func (r *memoryRepository) CustomValueTaken(ctx context.Context, name string, value interface{}, contactID int) (bool, error) {
+	return false, nil
+}
@@ -1,9 +1,273 @@
 package contacts
 
+import (
+	"encoding/json"
+	"time"
+)
+
+const dateLayout = "2006-01-02"
+
 type Contact struct {
-	ID          int    `json:"id"`
-	FirstName   string `json:"first_name" validate:"required,min=1,max=50"`
-	LastName    string `json:"last_name" validate:"required,min=1,max=50"`
-	PhoneNumber string `json:"phone_number" validate:"required,len=10"`
-	Address     string `json:"address" validate:"required,min=2,max=100"`
+	ID          int       `json:"id"`
+	FirstName   string    `json:"first_name" validate:"required,min=1,max=50"`
+	LastName    string    `json:"last_name" validate:"required,min=1,max=50"`
+	PhoneNumber string    `json:"phone_number" validate:"required,len=10"`
+	Address     string    `json:"address" validate:"required,min=2,max=100"`
+	Birthday    string    `json:"birthday,omitempty" validate:"omitempty,datetime=2006-01-02"`
+	Anniversary string    `json:"anniversary,omitempty" validate:"omitempty,datetime=2006-01-02"`
+	Groups      []string  `json:"groups,omitempty" validate:"omitempty,dive,min=1,max=50"`
+	UpdatedAt   time.Time `json:"updated_at"`
+
+	OrganizationID *int   `json:"organization_id,omitempty" validate:"omitempty,min=1"`
+	Organization   string `json:"organization,omitempty"`
+	JobTitle       string `json:"job_title,omitempty" validate:"omitempty,max=100"`
+	Department     string `json:"department,omitempty" validate:"omitempty,max=100"`
+
+	CustomFields map[string]interface{} `json:"custom_fields,omitempty"`
+
+	// Owner is the user whose phone book the contact is in, empty for
+	// contacts of the whole tenant.
+	Owner string `json:"owner,omitempty"`
+
+	// DeletedAt is when the contact was moved to the trash, set only on
+	// contacts listed from the trash.
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+// ExportFilter selects the contacts to export: a single contact when
+// ContactID is set, otherwise every contact, or those in Group. The other
+// filters are those of listing and searching contacts.
+type ExportFilter struct {
+	ContactID    int               `json:"contact_id,omitempty"`
+	Group        string            `json:"group,omitempty"`
+	SharedOnly   bool              `json:"shared_only,omitempty"`
+	Query        string            `json:"query,omitempty"`
+	CustomFields map[string]string `json:"custom_fields,omitempty"`
+}
+
+// ExportOptions choose the format of an export and the contacts in it.
+// Version applies to vCards and Fields to CSV and NDJSON.
+type ExportOptions struct {
+	Format  string       `json:"format"`
+	Version string       `json:"version,omitempty"`
+	Fields  []string     `json:"fields,omitempty"`
+	Filter  ExportFilter `json:"filter"`
+}
+
+const (
+	ImportCreate = "create"
+	ImportUpdate = "update"
+	ImportSkip   = "skip"
+)
+
+// ImportResult reports what an import did, or would do in a dry run, with a
+// record for every card in the order they were read.
+type ImportResult struct {
+	DryRun bool `json:"dry_run"`
+	// Profile is the CSV mapping profile used, which may have been detected.
+	Profile string `json:"profile,omitempty"`
+	// Rejected is set when an all-or-nothing import wrote nothing because
+	// some records had errors.
+	Rejected bool           `json:"rejected,omitempty"`
+	Created  int            `json:"created"`
+	Updated  int            `json:"updated"`
+	Skipped  int            `json:"skipped"`
+	Records  []ImportRecord `json:"records"`
+}
+
+// ImportRecord is the outcome for one card. Cards with errors are skipped.
+type ImportRecord struct {
+	Line    int           `json:"line"`
+	Action  string        `json:"action"`
+	Contact *Contact      `json:"contact,omitempty"`
+	Errors  []ImportError `json:"errors,omitempty"`
+}
+
+type ImportError struct {
+	Line    int    `json:"line"`
+	Message string `json:"message"`
+}
+
+// ImportProfile maps the columns of a CSV layout, by header, onto contact
+// fields: first_name, last_name, name, phone_number, email, address,
+// birthday, anniversary, groups, organization, job_title, department, note,
+// or custom.<field>.
+type ImportProfile struct {
+	ID      int               `json:"id"`
+	Name    string            `json:"name" validate:"required,max=50,ne=auto,ne=google,ne=outlook"`
+	Columns map[string]string `json:"columns" validate:"required,min=1,dive,keys,required,max=100,endkeys,importtarget"`
+}
+
+// CSVImportOptions control how a CSV body is read and written. An empty
+// Profile detects the layout from the header and an empty Delimiter from the
+// header line.
+type CSVImportOptions struct {
+	Profile      string `json:"profile,omitempty"`
+	Encoding     string `json:"encoding,omitempty"`
+	Delimiter    rune   `json:"delimiter,omitempty"`
+	AllOrNothing bool   `json:"all_or_nothing,omitempty"`
+	DryRun       bool   `json:"dry_run,omitempty"`
+}
+
+// Progress is told how many of the total contacts an import or export has
+// done so far.
+type Progress func(done, total int)
+
+const (
+	BatchCreate = "create"
+	BatchUpdate = "update"
+	BatchPatch  = "patch"
+	BatchDelete = "delete"
+
+	BatchAtomic  = "atomic"
+	BatchPartial = "partial"
+)
+
+// BatchRequest is an ordered list of changes. Atomic batches, the default,
+// apply all of them or none; partial batches apply those that succeed.
+type BatchRequest struct {
+	Mode       string           `json:"mode,omitempty" validate:"omitempty,oneof=atomic partial"`
+	Operations []BatchOperation `json:"operations" validate:"required,min=1,max=1000,dive"`
+}
+
+// BatchOperation changes one contact. Ref is the client's reference for the
+// operation, which later operations name in IDRef to change a contact the
+// batch created. Contact is the contact to create or replace, or for a patch
+// only the fields to change.
+type BatchOperation struct {
+	Op      string          `json:"op" validate:"required,oneof=create update patch delete"`
+	Ref     string          `json:"ref,omitempty" validate:"max=100"`
+	ID      int             `json:"id,omitempty" validate:"omitempty,min=1"`
+	IDRef   string          `json:"id_ref,omitempty" validate:"max=100"`
+	Contact json.RawMessage `json:"contact,omitempty"`
+}
+
+// BatchOutcome is what one operation did, or the error it would have failed
+// with as a request of its own.
+type BatchOutcome struct {
+	ID      int
+	Contact *Contact
+	Err     error
+}
+
+// BatchResult reports an operation with the status it would have had as a
+// request of its own.
+type BatchResult struct {
+	Ref     string   `json:"ref,omitempty"`
+	Op      string   `json:"op"`
+	Status  int      `json:"status"`
+	ID      int      `json:"id,omitempty"`
+	Contact *Contact `json:"contact,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+type BatchResponse struct {
+	Mode string `json:"mode"`
+	// RolledBack is set when an atomic batch applied nothing because an
+	// operation failed.
+	RolledBack bool          `json:"rolled_back,omitempty"`
+	Results    []BatchResult `json:"results"`
+}
+
+// ShareLink is a signed public URL to a single contact card. Anyone with the
+// URL can view the card until it expires, is revoked or runs out of views.
+type ShareLink struct {
+	ID        int        `json:"id"`
+	ContactID int        `json:"contact_id"`
+	URL       string     `json:"url"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	MaxViews  *int       `json:"max_views,omitempty" validate:"omitempty,min=1"`
+	Views     int        `json:"views"`
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+const (
+	FieldTypeString = "string"
+	FieldTypeNumber = "number"
+	FieldTypeDate   = "date"
+	FieldTypeEnum   = "enum"
+	FieldTypePhone  = "phone"
+	FieldTypeEmail  = "email"
+)
+
+type CustomField struct {
+	ID       int      `json:"id"`
+	Name     string   `json:"name" validate:"required,max=50,fieldname"`
+	Type     string   `json:"type" validate:"required,oneof=string number date enum phone email"`
+	Required bool     `json:"required"`
+	Unique   bool     `json:"unique"`
+	Pattern  string   `json:"pattern,omitempty" validate:"omitempty,regexp"`
+	Options  []string `json:"options,omitempty" validate:"required_if=Type enum,omitempty,unique,dive,min=1,max=100"`
+}
+
+type Note struct {
+	ID        int        `json:"id"`
+	ContactID int        `json:"contact_id"`
+	Author    string     `json:"author" validate:"required,min=1,max=100"`
+	Text      string     `json:"text" validate:"required,min=1,max=10000"`
+	CreatedAt time.Time  `json:"created_at"`
+	EditedAt  *time.Time `json:"edited_at,omitempty"`
+}
+
+type Relation struct {
+	ID        int    `json:"id"`
+	ContactID int    `json:"contact_id"`
+	RelatedID int    `json:"related_id" validate:"required,min=1,nefield=ContactID"`
+	Type      string `json:"type" validate:"required,relationtype"`
+	Depth     int    `json:"depth,omitempty"`
+}
+
+// inverseRelations maps each relation type to the type recorded in the other
+// direction: if B is A's manager, then A is B's report.
+var inverseRelations = map[string]string{
+	"spouse":                "spouse",
+	"sibling":               "sibling",
+	"manager":               "report",
+	"report":                "manager",
+	"parent":                "child",
+	"child":                 "parent",
+	"assistant":             "executive",
+	"executive":             "assistant",
+	"emergency_contact":     "emergency_contact_for",
+	"emergency_contact_for": "emergency_contact",
+}
+
+// DuplicateCluster is a set of contacts that are likely the same person.
+// Confidence is that of the weakest match that joined the cluster.
+type DuplicateCluster struct {
+	Confidence float64          `json:"confidence"`
+	Contacts   []Contact        `json:"contacts"`
+	Matches    []DuplicateMatch `json:"matches"`
+}
+
+// DuplicateMatch is why two contacts of a cluster are thought to be the
+// same: the same phone number once normalized, similar names, or both.
+type DuplicateMatch struct {
+	ContactID      int     `json:"contact_id"`
+	OtherID        int     `json:"other_id"`
+	Confidence     float64 `json:"confidence"`
+	PhoneMatch     bool    `json:"phone_match"`
+	NameSimilarity float64 `json:"name_similarity"`
+}
+
+// MergeRequest merges ContactIDs into SurvivorID. Fields choose, by field
+// name or custom.<field>, the contact whose value the survivor keeps. Other
+// fields keep the survivor's value, or the first one set on the others.
+type MergeRequest struct {
+	SurvivorID int            `json:"survivor_id" validate:"required,min=1"`
+	ContactIDs []int          `json:"contact_ids" validate:"required,min=1,max=50,dive,min=1"`
+	Fields     map[string]int `json:"fields,omitempty" validate:"omitempty,dive,keys,mergefield,endkeys,min=1"`
+}
+
+// Merge records a merge so that it can be undone while the survivor has not
+// changed since.
+type Merge struct {
+	ID         int        `json:"id"`
+	SurvivorID int        `json:"survivor_id"`
+	MergedIDs  []int      `json:"merged_ids"`
+	MergedBy   string     `json:"merged_by,omitempty"`
+	Contact    *Contact   `json:"contact,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UndoneAt   *time.Time `json:"undone_at,omitempty"`
 }
@@ -3,123 +3,1959 @@ package contacts
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/benhuri/phone-book-api/internal/auth"
+	"github.com/lib/pq"
 )
 
 const (
-	selectContactsQuery  = "SELECT id, first_name, last_name, phone_number, address FROM contacts"
-	selectContactByQuery = "SELECT id, first_name, last_name, phone_number, address FROM contacts WHERE first_name LIKE $1 OR last_name LIKE $2 OR phone_number LIKE $3"
-	insertContactQuery   = "INSERT INTO contacts (first_name, last_name, phone_number, address) VALUES ($1, $2, $3, $4) RETURNING id"
-	updateContactQuery   = "UPDATE contacts SET first_name = $1, last_name = $2, phone_number = $3, address = $4 WHERE id = $5"
-	deleteContactQuery   = "DELETE FROM contacts WHERE id = $1"
+	// Queries on contacts take the viewer as their first three arguments: the
+	// tenant, the caller's own phone book and the caller's teams. A contact is
+	// visible when it belongs to the whole tenant, to the caller, or to a phone
+	// book or group shared with the caller. Callers without a phone book of
+	// their own act for the tenant and see every contact. Contacts in the
+	// trash are left out of everything but the trash.
+	activeShare        = "shares.tenant_id = contacts.tenant_id AND shares.owner_id = contacts.owner_id AND (shares.group_name = '' OR shares.group_name = ANY(contacts.groups)) AND ((shares.user_id <> '' AND shares.user_id = $2) OR (shares.team <> '' AND shares.team = ANY($3))) AND (shares.expires_at IS NULL OR shares.expires_at > now())"
+	readableContact    = "($2 = '' OR contacts.owner_id IN ('', $2) OR EXISTS (SELECT 1 FROM shares WHERE " + activeShare + "))"
+	editableContact    = "($2 = '' OR contacts.owner_id IN ('', $2) OR EXISTS (SELECT 1 FROM shares WHERE " + activeShare + " AND shares.permission = 'write'))"
+	visibleContact     = "contacts.deleted_at IS NULL AND " + readableContact
+	writableContact    = "contacts.deleted_at IS NULL AND " + editableContact
+	visibleTrash       = "contacts.deleted_at IS NOT NULL AND " + readableContact
+	writableTrash      = "contacts.deleted_at IS NOT NULL AND " + editableContact
+	visibleContactIDs  = "SELECT id FROM contacts WHERE tenant_id = $1 AND " + visibleContact
+	writableContactIDs = "SELECT id FROM contacts WHERE tenant_id = $1 AND " + writableContact
+	sharedContactsOnly = " AND contacts.owner_id NOT IN ('', $2) AND EXISTS (SELECT 1 FROM shares WHERE " + activeShare + ")"
+
+	organizationName     = "COALESCE((SELECT name FROM organizations WHERE organizations.id = contacts.organization_id), '')"
+	contactColumns       = "id, first_name, last_name, phone_number, address, COALESCE(to_char(birthday, 'YYYY-MM-DD'), ''), COALESCE(to_char(anniversary, 'YYYY-MM-DD'), ''), groups, updated_at, organization_id, " + organizationName + ", job_title, department, custom_fields, owner_id"
+	selectContactsQuery  = "SELECT " + contactColumns + " FROM contacts WHERE tenant_id = $1 AND " + visibleContact
+	selectByOrgQuery     = "SELECT " + contactColumns + " FROM contacts WHERE tenant_id = $1 AND " + visibleContact + " AND organization_id = $4 ORDER BY last_name, first_name, id LIMIT $5 OFFSET $6"
+	selectDatedQuery     = "SELECT " + contactColumns + " FROM contacts WHERE tenant_id = $1 AND " + visibleContact + " AND (birthday IS NOT NULL OR anniversary IS NOT NULL) AND ($4 = '' OR $4 = ANY(groups)) ORDER BY id"
+	insertContactQuery   = "INSERT INTO contacts (tenant_id, first_name, last_name, phone_number, address, birthday, anniversary, groups, organization_id, job_title, department, custom_fields, owner_id, phone_key, duplicate) VALUES ($1, $2, $3, $4, $5, NULLIF($6, '')::date, NULLIF($7, '')::date, $8, $9, $10, $11, $12, $13, NULLIF($14, ''), $15 OR EXISTS (SELECT 1 FROM contacts WHERE tenant_id = $1 AND phone_key = $14 AND NOT duplicate)) ON CONFLICT (tenant_id, phone_key) WHERE NOT duplicate DO NOTHING RETURNING id, updated_at, " + organizationName
+	updateContactQuery   = "UPDATE contacts SET first_name = $4, last_name = $5, phone_number = $6, address = $7, birthday = NULLIF($8, '')::date, anniversary = NULLIF($9, '')::date, groups = $10, organization_id = $11, job_title = $12, department = $13, custom_fields = $14, phone_key = NULLIF($16, ''), duplicate = $17 OR EXISTS (" + phoneClaimed + " AND claimed.phone_key = $16 AND claimed.id <> $15), updated_at = now() WHERE tenant_id = $1 AND id = $15 AND " + writableContact + " RETURNING updated_at, " + organizationName + ", owner_id"
+	phoneClaimed         = "SELECT 1 FROM contacts claimed WHERE claimed.tenant_id = $1 AND NOT claimed.duplicate"
+	selectSamePhoneQuery = "SELECT id FROM contacts WHERE tenant_id = $1 AND " + visibleContact + " AND phone_key = $4 AND id <> $5 ORDER BY id"
+	selectUnkeyedQuery   = "SELECT tenant_id, id, phone_number FROM contacts WHERE phone_key IS NULL AND phone_number <> '' AND deleted_at IS NULL ORDER BY id"
+	keyPhoneQuery        = "UPDATE contacts SET phone_key = $3, duplicate = EXISTS (" + phoneClaimed + " AND claimed.phone_key = $3 AND claimed.id <> $2) WHERE tenant_id = $1 AND id = $2 AND phone_key IS NULL"
+	contactNotes         = "ARRAY(SELECT body FROM contact_notes WHERE contact_notes.contact_id = contacts.id ORDER BY created_at, id)"
+	selectExportQuery    = "SELECT " + contactColumns + ", " + contactNotes + " FROM contacts WHERE tenant_id = $1 AND " + visibleContact + " AND ($4 = 0 OR id = $4) AND ($5 = '' OR $5 = ANY(groups))"
+	exportOrder          = " ORDER BY last_name, first_name, id"
+	organizationExists   = "SELECT EXISTS (SELECT 1 FROM organizations WHERE tenant_id = $1 AND id = $2)"
+	organizationByName   = "SELECT id FROM organizations WHERE tenant_id = $1 AND lower(name) = lower($2) ORDER BY id LIMIT 1"
+	contactWritableQuery = "SELECT EXISTS (SELECT 1 FROM contacts WHERE tenant_id = $1 AND id = $4 AND " + writableContact + ")"
+	selectContactQuery   = selectContactsQuery + " AND id = $4"
 	fetchContactsError   = "failed to fetch contacts: %w"
 	scanContactError     = "failed to scan contact: %w"
 	rowsError            = "rows error: %w"
 	findContactError     = "failed to find contact: %w"
+	fetchContactError    = "failed to fetch contact: %w"
 	createContactError   = "failed to create contact: %w"
 	updateContactError   = "failed to update contact: %w"
 	getRowsAffectedError = "failed to get rows affected: %w"
+	transactionError     = "transaction failed: %w"
 	contactNotFoundError = "contact not found"
 	removeContactError   = "failed to remove contact: %w"
+	fetchDatedError      = "failed to fetch dated contacts: %w"
+	fetchByOrgError      = "failed to fetch organization contacts: %w"
+	exportContactsError  = "failed to export contacts: %w"
+	checkOrgError        = "failed to check organization: %w"
+	findOrgError         = "failed to find organization: %w"
+	organizationNotFound = "organization not found"
+
+	// Contacts moved to or from the trash or merged away leave no newer
+	// updated_at behind, so each marks the tenant's calendar as changed
+	calendarChangedQuery  = "INSERT INTO calendar_changes (tenant_id, changed_at) VALUES ($1, now()) ON CONFLICT (tenant_id) DO UPDATE SET changed_at = now()"
+	calendarModifiedQuery = "SELECT GREATEST((SELECT max(updated_at) FROM contacts WHERE tenant_id = $1), (SELECT changed_at FROM calendar_changes WHERE tenant_id = $1))"
+	calendarModifiedError = "failed to fetch calendar modification time: %w"
+
+	// A contact moved to the trash gives up its phone number, so that it does
+	// not hold off new contacts with it, and takes its notes along. Restoring
+	// it claims the number again unless another contact has taken it.
+	trashContactQuery   = "UPDATE contacts SET deleted_at = now(), duplicate = true WHERE tenant_id = $1 AND id = $4 AND " + writableContact + " RETURNING deleted_at"
+	trashNotesQuery     = "UPDATE contact_notes SET deleted_at = $3 WHERE tenant_id = $1 AND contact_id = $2"
+	selectTrashQuery    = "SELECT " + contactColumns + ", deleted_at FROM contacts WHERE tenant_id = $1 AND " + visibleTrash + " ORDER BY deleted_at DESC, id DESC LIMIT $4 OFFSET $5"
+	restoreTrashedQuery = "UPDATE contacts SET deleted_at = NULL, duplicate = $5 OR EXISTS (" + phoneClaimed + " AND claimed.phone_key = contacts.phone_key AND claimed.id <> contacts.id) WHERE tenant_id = $1 AND id = $4 AND " + writableTrash
+	restoreNotesInTrash = "UPDATE contact_notes SET deleted_at = NULL WHERE tenant_id = $1 AND contact_id = $2 AND deleted_at IS NOT NULL"
+	purgeContactQuery   = "DELETE FROM contacts WHERE tenant_id = $1 AND id = $4 AND " + writableTrash
+	fetchTrashError     = "failed to fetch trash: %w"
+	restoreContactError = "failed to restore contact: %w"
+	purgeContactError   = "failed to purge contact: %w"
+
+	// searchFilter matches a pattern against the names, the phone number and
+	// the organization name, and the words of the query against the notes
+	searchFilter = " AND (first_name LIKE $%[1]d OR last_name LIKE $%[1]d OR phone_number LIKE $%[1]d OR EXISTS (SELECT 1 FROM contact_notes WHERE contact_notes.contact_id = contacts.id AND contact_notes.deleted_at IS NULL AND to_tsvector('simple', contact_notes.body) @@ plainto_tsquery('simple', $%[2]d)) OR EXISTS (SELECT 1 FROM organizations WHERE organizations.id = contacts.organization_id AND organizations.name LIKE $%[1]d))"
+	// Exports read from a server-side cursor in batches, so memory stays
+	// constant however many contacts there are
+	declareExportCursor = "DECLARE export_contacts NO SCROLL CURSOR FOR "
+	fetchExportCursor   = "FETCH FORWARD %d FROM export_contacts"
+	exportBatchSize     = 500
+	countExportQuery    = "SELECT count(*) FROM (%s) exported"
+	closeExportCursor   = "CLOSE export_contacts"
+	countContactsError  = "failed to count contacts: %w"
+	// Transactions aborted by a conflict with another one run again after
+	// txRetryDelay, doubled on every attempt
+	serializationFailureCode = "40001"
+	deadlockDetectedCode     = "40P01"
+	txRetryDelay             = 20 * time.Millisecond
+
+	selectCustomFieldsQuery = "SELECT id, name, type, required, is_unique, pattern, options FROM custom_fields WHERE tenant_id = $1 ORDER BY id"
+	insertCustomFieldQuery  = "INSERT INTO custom_fields (tenant_id, name, type, required, is_unique, pattern, options) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id"
+	updateCustomFieldQuery  = "UPDATE custom_fields SET type = $2, required = $3, is_unique = $4, pattern = $5, options = $6 WHERE tenant_id = $1 AND id = $7 RETURNING name"
+	deleteCustomFieldQuery  = "DELETE FROM custom_fields WHERE tenant_id = $1 AND id = $2 RETURNING name"
+	stripCustomFieldQuery   = "UPDATE contacts SET custom_fields = custom_fields - $2 WHERE tenant_id = $1 AND custom_fields ? $2"
+	customValueTakenQuery   = "SELECT EXISTS (SELECT 1 FROM contacts WHERE tenant_id = $1 AND custom_fields -> $2 = $3::jsonb AND id <> $4)"
+	customFieldFilter       = " AND custom_fields ->> $%d = $%d"
+	// The values of unique fields are copied to custom_field_values, whose
+	// unique constraint keeps concurrent writes from both storing a value.
+	// Storing a contact's values returns the fields whose value was taken.
+	clearCustomValuesQuery   = "DELETE FROM custom_field_values WHERE tenant_id = $1 AND contact_id = ANY($2)"
+	uniqueFieldsOfContact    = "FROM contacts JOIN custom_fields ON custom_fields.tenant_id = contacts.tenant_id AND custom_fields.is_unique AND contacts.custom_fields ? custom_fields.name WHERE contacts.tenant_id = $1 AND contacts.id = $2"
+	storeCustomValuesQuery   = "WITH stored AS (INSERT INTO custom_field_values (tenant_id, field_id, contact_id, value) SELECT contacts.tenant_id, custom_fields.id, contacts.id, contacts.custom_fields -> custom_fields.name " + uniqueFieldsOfContact + " ON CONFLICT DO NOTHING RETURNING field_id) SELECT custom_fields.name " + uniqueFieldsOfContact + " AND custom_fields.id NOT IN (SELECT field_id FROM stored) ORDER BY custom_fields.name"
+	indexCustomFieldQuery    = "INSERT INTO custom_field_values (tenant_id, field_id, contact_id, value) SELECT tenant_id, $2, id, custom_fields -> $3 FROM contacts WHERE tenant_id = $1 AND custom_fields ? $3 ON CONFLICT (contact_id, field_id) DO NOTHING"
+	unindexCustomFieldQuery  = "DELETE FROM custom_field_values WHERE field_id = $1"
+	selectUniqueFieldsQuery  = "SELECT tenant_id, id, name FROM custom_fields WHERE is_unique ORDER BY id"
+	selectFieldValuesQuery   = "SELECT custom_fields -> $2 FROM contacts WHERE tenant_id = $1 AND custom_fields ? $2"
+	storeCustomValuesError   = "failed to store custom field values: %w"
+	fetchCustomFieldsError   = "failed to fetch custom fields: %w"
+	createCustomFieldError   = "failed to create custom field: %w"
+	updateCustomFieldError   = "failed to update custom field: %w"
+	removeCustomFieldError   = "failed to remove custom field: %w"
+	checkCustomValueError    = "failed to check custom field value: %w"
+	indexCustomFieldsError   = "failed to index unique custom fields: %w"
+	encodeCustomFieldsError  = "failed to encode custom fields: %w"
+	customFieldNotFoundError = "custom field not found"
+	customFieldExistsError   = "custom field already exists"
+	customValuesTakenError   = "custom field has values used by several contacts"
+	customValuesInvalidError = "custom field has values that do not conform to it"
+	uniqueViolationCode      = "23505"
+
+	noteColumns             = "id, contact_id, author, body, created_at, edited_at"
+	selectNotesQuery        = "SELECT " + noteColumns + " FROM contact_notes WHERE tenant_id = $1 AND contact_id = $4 AND contact_id IN (" + visibleContactIDs + ") ORDER BY created_at DESC, id DESC LIMIT $5 OFFSET $6"
+	insertNoteQuery         = "INSERT INTO contact_notes (tenant_id, contact_id, author, body) SELECT tenant_id, id, $5, $6 FROM contacts WHERE tenant_id = $1 AND id = $4 AND " + writableContact + " RETURNING id, created_at"
+	updateNoteQuery         = "UPDATE contact_notes SET body = $4, edited_at = now() WHERE tenant_id = $1 AND id = $5 AND contact_id = $6 AND contact_id IN (" + writableContactIDs + ") RETURNING " + noteColumns
+	deleteNoteQuery         = "DELETE FROM contact_notes WHERE tenant_id = $1 AND id = $4 AND contact_id = $5 AND contact_id IN (" + writableContactIDs + ")"
+	fetchNotesError         = "failed to fetch notes: %w"
+	createNoteError         = "failed to create note: %w"
+	updateNoteError         = "failed to update note: %w"
+	removeNoteError         = "failed to remove note: %w"
+	noteNotFoundError       = "note not found"
+	foreignKeyViolationCode = "23503"
+
+	// insertRelationQuery only inserts when the caller may write both contacts,
+	// since the inverse relation changes the related contact too
+	insertRelationQuery = "INSERT INTO contact_relations (tenant_id, contact_id, related_id, type) SELECT c.tenant_id, c.id, r.id, $6 FROM contacts c, contacts r WHERE c.tenant_id = $1 AND c.id = $4 AND r.tenant_id = $1 AND r.id = $5 AND c.id IN (" + writableContactIDs + ") AND r.id IN (" + writableContactIDs + ") RETURNING id"
+	deleteRelationQuery = "DELETE FROM contact_relations WHERE tenant_id = $1 AND id = $4 AND contact_id = $5 AND contact_id IN (" + writableContactIDs + ") AND related_id IN (" + writableContactIDs + ") RETURNING related_id, type"
+	deleteInverseQuery  = "DELETE FROM contact_relations WHERE tenant_id = $1 AND contact_id = $2 AND related_id = $3 AND type = $4"
+	// walkRelationsQuery follows relations breadth-first up to the given depth,
+	// skipping contacts already on the path so cycles terminate. The walk never
+	// passes through contacts the caller cannot see.
+	walkRelationsQuery = `WITH RECURSIVE visible AS (` + visibleContactIDs + `), walk AS (
+		SELECT id, contact_id, related_id, type, 1 AS depth, ARRAY[contact_id, related_id] AS path
+		FROM contact_relations WHERE tenant_id = $1 AND contact_id = $4
+		AND contact_id IN (SELECT id FROM visible) AND related_id IN (SELECT id FROM visible)
+		UNION ALL
+		SELECT r.id, r.contact_id, r.related_id, r.type, w.depth + 1, w.path || r.related_id
+		FROM contact_relations r JOIN walk w ON r.contact_id = w.related_id
+		WHERE r.tenant_id = $1 AND w.depth < $5 AND NOT r.related_id = ANY(w.path)
+		AND r.related_id IN (SELECT id FROM visible)
+	)
+	SELECT id, contact_id, related_id, type, depth FROM (
+		SELECT DISTINCT ON (id) id, contact_id, related_id, type, depth FROM walk ORDER BY id, depth
+	) shortest ORDER BY depth, id`
+	fetchRelationsError   = "failed to fetch relations: %w"
+	createRelationError   = "failed to create relation: %w"
+	removeRelationError   = "failed to remove relation: %w"
+	relationNotFoundError = "relation not found"
+	relationExistsError   = "relation already exists"
+
+	linkColumns      = "id, contact_id, expires_at, max_views, views, created_at, revoked_at"
+	selectLinksQuery = "SELECT " + linkColumns + " FROM share_links WHERE tenant_id = $1 AND contact_id = $4 AND contact_id IN (" + writableContactIDs + ") ORDER BY id"
+	insertLinkQuery  = "INSERT INTO share_links (tenant_id, contact_id, expires_at, max_views) SELECT tenant_id, id, $5, $6 FROM contacts WHERE tenant_id = $1 AND id = $4 AND " + writableContact + " RETURNING id, created_at"
+	revokeLinkQuery  = "UPDATE share_links SET revoked_at = now() WHERE tenant_id = $1 AND id = $4 AND contact_id = $5 AND revoked_at IS NULL AND contact_id IN (" + writableContactIDs + ")"
+	// viewLinkQuery counts the view and returns the contact in one statement,
+	// so concurrent views cannot exceed the maximum. Links to a contact in
+	// the trash are gone.
+	viewLinkQuery = `WITH link AS (
+		UPDATE share_links SET views = views + 1
+		WHERE id = $1 AND revoked_at IS NULL AND expires_at > now() AND (max_views IS NULL OR views < max_views)
+		AND EXISTS (SELECT 1 FROM contacts WHERE contacts.id = share_links.contact_id AND contacts.deleted_at IS NULL)
+		RETURNING tenant_id, contact_id
+	)
+	SELECT ` + contactColumns + ` FROM contacts, link WHERE contacts.tenant_id = link.tenant_id AND contacts.id = link.contact_id`
+	fetchLinksError        = "failed to fetch share links: %w"
+	createLinkError        = "failed to create share link: %w"
+	revokeLinkError        = "failed to revoke share link: %w"
+	viewLinkError          = "failed to view share link: %w"
+	shareLinkNotFoundError = "share link not found"
+	shareLinkGoneError     = "share link expired, revoked or used up"
+
+	selectProfilesQuery  = "SELECT id, name, columns FROM import_profiles WHERE tenant_id = $1 ORDER BY name"
+	insertProfileQuery   = "INSERT INTO import_profiles (tenant_id, name, columns) VALUES ($1, $2, $3) RETURNING id"
+	updateProfileQuery   = "UPDATE import_profiles SET name = $2, columns = $3 WHERE tenant_id = $1 AND id = $4"
+	deleteProfileQuery   = "DELETE FROM import_profiles WHERE tenant_id = $1 AND id = $2"
+	fetchProfilesError   = "failed to fetch import profiles: %w"
+	createProfileError   = "failed to create import profile: %w"
+	updateProfileError   = "failed to update import profile: %w"
+	removeProfileError   = "failed to remove import profile: %w"
+	profileNotFoundError = "import profile not found"
+	profileExistsError   = "import profile already exists"
+
+	// Merges move the rows of the merged contacts to the survivor and keep
+	// the rows as they were, so that undoing the merge can put them back
+	moveNotesQuery        = "UPDATE contact_notes SET contact_id = $3 FROM contact_notes moved WHERE contact_notes.id = moved.id AND contact_notes.tenant_id = $1 AND moved.contact_id = ANY($2) RETURNING contact_notes.id, moved.contact_id"
+	moveLinksQuery        = "UPDATE share_links SET contact_id = $3 FROM share_links moved WHERE share_links.id = moved.id AND share_links.tenant_id = $1 AND moved.contact_id = ANY($2) RETURNING share_links.id, moved.contact_id"
+	takeRelationsQuery    = "DELETE FROM contact_relations WHERE tenant_id = $1 AND (contact_id = ANY($2) OR related_id = ANY($2)) RETURNING id, contact_id, related_id, type"
+	putRelationQuery      = "INSERT INTO contact_relations (id, tenant_id, contact_id, related_id, type) SELECT $1, $2, $3, $4, $5 WHERE EXISTS (SELECT 1 FROM contacts WHERE tenant_id = $2 AND id = $3) AND EXISTS (SELECT 1 FROM contacts WHERE tenant_id = $2 AND id = $4) ON CONFLICT DO NOTHING"
+	deleteMergedQuery     = "DELETE FROM contacts WHERE tenant_id = $1 AND id = ANY($4) AND " + writableContact
+	insertMergeQuery      = "INSERT INTO contact_merges (tenant_id, survivor_id, merged_ids, merged_by, snapshot, survivor_updated_at) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id, created_at"
+	mergeColumns          = "contact_merges.id, contact_merges.survivor_id, contact_merges.merged_ids, contact_merges.merged_by, contact_merges.created_at, contact_merges.undone_at"
+	selectMergesQuery     = "SELECT " + mergeColumns + " FROM contact_merges JOIN contacts ON contacts.id = contact_merges.survivor_id WHERE contact_merges.tenant_id = $1 AND " + visibleContact + " ORDER BY contact_merges.id DESC LIMIT $4 OFFSET $5"
+	selectUndoQuery       = "SELECT " + mergeColumns + ", contact_merges.snapshot, contacts.updated_at = contact_merges.survivor_updated_at FROM contact_merges JOIN contacts ON contacts.id = contact_merges.survivor_id WHERE contact_merges.tenant_id = $1 AND contact_merges.id = $4 AND " + writableContact + " FOR UPDATE OF contact_merges"
+	restoreContactQuery   = "INSERT INTO contacts (tenant_id, id, first_name, last_name, phone_number, address, birthday, anniversary, groups, organization_id, job_title, department, custom_fields, owner_id, phone_key, duplicate) VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, '')::date, NULLIF($8, '')::date, $9, (SELECT id FROM organizations WHERE tenant_id = $1 AND id = $10), $11, $12, $13, $15, NULLIF($14, ''), $16 OR EXISTS (" + phoneClaimed + " AND claimed.phone_key = $14))"
+	restoreSurvivorQuery  = "UPDATE contacts SET first_name = $3, last_name = $4, phone_number = $5, address = $6, birthday = NULLIF($7, '')::date, anniversary = NULLIF($8, '')::date, groups = $9, organization_id = (SELECT id FROM organizations WHERE tenant_id = $1 AND id = $10), job_title = $11, department = $12, custom_fields = $13, phone_key = NULLIF($14, ''), duplicate = $15 OR EXISTS (" + phoneClaimed + " AND claimed.phone_key = $14 AND claimed.id <> $2), updated_at = now() WHERE tenant_id = $1 AND id = $2"
+	restoreNotesQuery     = "UPDATE contact_notes SET contact_id = moved.contact_id FROM unnest($3::int[], $4::int[]) AS moved (id, contact_id) WHERE contact_notes.tenant_id = $1 AND contact_notes.contact_id = $2 AND contact_notes.id = moved.id"
+	restoreLinksQuery     = "UPDATE share_links SET contact_id = moved.contact_id FROM unnest($3::int[], $4::int[]) AS moved (id, contact_id) WHERE share_links.tenant_id = $1 AND share_links.contact_id = $2 AND share_links.id = moved.id"
+	dropRelationsQuery    = "DELETE FROM contact_relations WHERE tenant_id = $1 AND id = ANY($2)"
+	markUndoneQuery       = "UPDATE contact_merges SET undone_at = now() WHERE id = $1 RETURNING undone_at"
+	mergeContactsError    = "failed to merge contacts: %w"
+	fetchMergesError      = "failed to fetch merges: %w"
+	undoMergeError        = "failed to undo merge: %w"
+	mergeNotFoundError    = "merge not found"
+	mergeUndoneError      = "merge already undone"
+	mergeStaleError       = "the surviving contact changed since the merge"
+	findSamePhoneError    = "failed to find contacts with the same phone number: %w"
+	keyPhonesError        = "failed to key phone numbers: %w"
+	duplicateContactError = "a contact with this phone number already exists"
+)
+
+// The partial unique index lets one contact of a tenant claim a phone number.
+// A write that loses the number to a concurrent one violates it, which would
+// abort the whole transaction, so such writes run under a savepoint and are
+// rolled back to it and run again as a duplicate.
+const (
+	phoneKeyIndex       = "contacts_phone_key_idx"
+	claimSavepointQuery = "SAVEPOINT claim_phone"
+	rollbackClaimQuery  = "ROLLBACK TO SAVEPOINT claim_phone"
+	releaseClaimQuery   = "RELEASE SAVEPOINT claim_phone"
+	reclaimPhoneQuery   = "UPDATE contacts SET duplicate = $3 OR EXISTS (" + phoneClaimed + " AND claimed.phone_key = contacts.phone_key AND claimed.id <> contacts.id) WHERE tenant_id = $1 AND id = $2"
+)
+
+var (
+	ErrContactNotFound      = errors.New(contactNotFoundError)
+	ErrOrganizationNotFound = errors.New(organizationNotFound)
+	ErrNoteNotFound         = errors.New(noteNotFoundError)
+	ErrRelationNotFound     = errors.New(relationNotFoundError)
+	ErrRelationExists       = errors.New(relationExistsError)
+	ErrCustomFieldNotFound  = errors.New(customFieldNotFoundError)
+	ErrCustomFieldExists    = errors.New(customFieldExistsError)
+	ErrCustomValuesTaken    = errors.New(customValuesTakenError)
+	ErrCustomValuesInvalid  = errors.New(customValuesInvalidError)
+	ErrShareLinkNotFound    = errors.New(shareLinkNotFoundError)
+	ErrShareLinkGone        = errors.New(shareLinkGoneError)
+	ErrProfileNotFound      = errors.New(profileNotFoundError)
+	ErrProfileExists        = errors.New(profileExistsError)
+	ErrMergeNotFound        = errors.New(mergeNotFoundError)
+	ErrMergeUndone          = errors.New(mergeUndoneError)
+	ErrMergeStale           = errors.New(mergeStaleError)
+	ErrDuplicateContact     = errors.New(duplicateContactError)
 )
 
 type Repository interface {
-	FetchContacts(ctx context.Context, limit, offset int) ([]Contact, error)
-	FindContact(ctx context.Context, query string) ([]Contact, error)
+	// WithTx calls fn with a repository whose statements all run in one
+	// transaction, which commits when fn returns nil and rolls back
+	// otherwise. Calls within fn join the transaction. fn runs again when
+	// the transaction is aborted by a conflict with another one, so it must
+	// not have effects outside the repository. Implementations that are not
+	// backed by SQL give fn the same all-or-nothing guarantee, for example by
+	// applying its changes to a copy under a lock.
+	WithTx(ctx context.Context, fn func(Repository) error) error
+
+	// FetchContacts returns the contacts visible to the caller, or only those
+	// shared with the caller from other users' phone books.
+	FetchContacts(ctx context.Context, sharedOnly bool, limit, offset int) ([]Contact, error)
+	FindContact(ctx context.Context, query string, fields map[string]string) ([]Contact, error)
+	FetchContact(ctx context.Context, id int) (*Contact, error)
+	// CreateContact adds the contact even when another has the same phone
+	// number. CreateUniqueContact instead returns a *DuplicateError naming
+	// the contacts the caller can see with the number. Creating, updating,
+	// removing and merging contacts records an Event in the outbox in the
+	// same transaction.
 	CreateContact(ctx context.Context, contact *Contact) error
-	UpdateContact(ctx context.Context, contact Contact) error
+	CreateUniqueContact(ctx context.Context, contact *Contact) error
+	// FindSamePhone returns the IDs of the other contacts the caller can see
+	// whose phone number is the contact's once normalized.
+	FindSamePhone(ctx context.Context, contact *Contact) ([]int, error)
+	UpdateContact(ctx context.Context, contact *Contact) error
+	// RemoveContact moves the contact and its notes to the trash.
 	RemoveContact(ctx context.Context, id int) error
+	// FetchTrash returns the contacts in the trash the caller can see, most
+	// recently deleted first. RestoreContact takes one out of the trash with
+	// its notes, and PurgeContact deletes one for good.
+	FetchTrash(ctx context.Context, limit, offset int) ([]Contact, error)
+	RestoreContact(ctx context.Context, id int) (*Contact, error)
+	PurgeContact(ctx context.Context, id int) error
+	FetchDatedContacts(ctx context.Context, group string) ([]Contact, error)
+	// CalendarModified returns when a contact of the tenant was last updated
+	// or deleted, or the zero time when it has never had any.
+	CalendarModified(ctx context.Context) (time.Time, error)
+	// ExportContacts calls each for every matching contact, with the text of
+	// its notes, while reading them so that exports need not fit in memory.
+	ExportContacts(ctx context.Context, filter ExportFilter, each func(Contact, []string) error) error
+	CountContacts(ctx context.Context, filter ExportFilter) (int, error)
+	// ContactWritable reports whether the contact exists and the caller may
+	// edit it.
+	ContactWritable(ctx context.Context, id int) (bool, error)
+	// FindOrganizationID returns the ID of the organization with the name,
+	// ignoring case, or 0 when there is none.
+	FindOrganizationID(ctx context.Context, name string) (int, error)
+	FetchOrganizationContacts(ctx context.Context, organizationID, limit, offset int) ([]Contact, error)
+	FetchCustomFields(ctx context.Context) ([]CustomField, error)
+	CreateCustomField(ctx context.Context, field *CustomField) error
+	UpdateCustomField(ctx context.Context, field *CustomField) error
+	RemoveCustomField(ctx context.Context, id int) error
+	CustomValueTaken(ctx context.Context, name string, value interface{}, contactID int) (bool, error)
+	FetchImportProfiles(ctx context.Context) ([]ImportProfile, error)
+	CreateImportProfile(ctx context.Context, profile *ImportProfile) error
+	UpdateImportProfile(ctx context.Context, profile *ImportProfile) error
+	RemoveImportProfile(ctx context.Context, id int) error
+	FetchNotes(ctx context.Context, contactID, limit, offset int) ([]Note, error)
+	CreateNote(ctx context.Context, note *Note) error
+	UpdateNote(ctx context.Context, note *Note) error
+	RemoveNote(ctx context.Context, contactID, id int) error
+	FetchRelations(ctx context.Context, contactID, depth int) ([]Relation, error)
+	CreateRelation(ctx context.Context, relation *Relation) error
+	RemoveRelation(ctx context.Context, contactID, id int) error
+	FetchShareLinks(ctx context.Context, contactID int) ([]ShareLink, error)
+	CreateShareLink(ctx context.Context, link *ShareLink) error
+	RevokeShareLink(ctx context.Context, contactID, id int) error
+	// ViewShareLink serves public links, which carry no tenant, and is
+	// therefore an unscoped lookup. It counts the view and returns
+	// ErrShareLinkGone when the link can no longer be viewed.
+	ViewShareLink(ctx context.Context, id int) (*Contact, error)
+	// MergeContacts replaces the first contact of the cluster, as stored, with
+	// survivor. The notes, share links and relations of the other contacts
+	// move to the survivor and the contacts are deleted. The merge is recorded
+	// with the rows as they were, for UndoMerge.
+	MergeContacts(ctx context.Context, survivor *Contact, cluster []Contact) (*Merge, error)
+	// FetchMerges returns the merges into contacts the caller can see, newest
+	// first.
+	FetchMerges(ctx context.Context, limit, offset int) ([]Merge, error)
+	// UndoMerge restores the contacts of a merge as they were before it. It
+	// returns ErrMergeStale when the survivor has changed since.
+	UndoMerge(ctx context.Context, id int) (*Merge, error)
+	// KeyPhoneNumbers normalizes the phone numbers of contacts saved before
+	// numbers were normalized, in every tenant, and returns how many it
+	// keyed. It is meant to run once at startup.
+	KeyPhoneNumbers(ctx context.Context) (int, error)
+	// IndexUniqueFields copies the values of unique custom fields saved
+	// before custom_field_values kept them, in every tenant. It returns the
+	// names of the fields it left unindexed because contacts already share
+	// their values. It is meant to run once at startup.
+	IndexUniqueFields(ctx context.Context) ([]string, error)
+}
+
+// TxConfig configures the transactions of the repository.
+type TxConfig struct {
+	Isolation sql.IsolationLevel
+	// MaxRetries is how many more times a transaction runs after it is
+	// aborted by a serialization failure or a deadlock.
+	MaxRetries int
 }
 
 type contactRepository struct {
-	db *sql.DB
+	db       *sql.DB
+	txConfig TxConfig
+	// phoneCountry is the calling code of numbers written without one
+	phoneCountry string
+	// tx is set on the repository WithTx passes to its function
+	tx *sql.Tx
+}
+
+// NewRepository returns a repository that keys contacts by their phone
+// number, normalized with phoneCountry as the calling code of numbers
+// written without one.
+func NewRepository(db *sql.DB, txConfig TxConfig, phoneCountry string) Repository {
+	return &contactRepository{db: db, txConfig: txConfig, phoneCountry: phoneCountry}
+}
+
+// queryer runs statements on the database or in a transaction.
+type queryer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func (r *contactRepository) conn() queryer {
+	if r.tx != nil {
+		return r.tx
+	}
+	return r.db
+}
+
+func (r *contactRepository) WithTx(ctx context.Context, fn func(Repository) error) error {
+	return r.atomic(ctx, func(tx *sql.Tx) error {
+		return fn(r.inTx(tx))
+	})
+}
+
+// inTx returns a repository whose statements run in tx.
+func (r *contactRepository) inTx(tx *sql.Tx) *contactRepository {
+	return &contactRepository{db: r.db, txConfig: r.txConfig, phoneCountry: r.phoneCountry, tx: tx}
+}
+
+// atomic runs fn in a transaction at the configured isolation level, and
+// again when the transaction is aborted by a conflict. A transaction that
+// joins the repository's own one is retried by whoever began it.
+func (r *contactRepository) atomic(ctx context.Context, fn func(*sql.Tx) error) error {
+	opts := &sql.TxOptions{Isolation: r.txConfig.Isolation}
+	for attempt := 0; ; attempt++ {
+		err := r.transaction(ctx, opts, fn)
+		if r.tx != nil || attempt >= r.txConfig.MaxRetries || !isRetryable(err) {
+			return err
+		}
+		// Jitter keeps the conflicting transactions from meeting again
+		delay := txRetryDelay << attempt
+		delay += time.Duration(rand.Int63n(int64(delay)))
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+	}
 }
 
-func NewRepository(db *sql.DB) Repository {
-	return &contactRepository{db: db}
+// transaction runs fn in a new transaction, or in the repository's own one
+// when it has one, which then commits or rolls back with the whole of it.
+func (r *contactRepository) transaction(ctx context.Context, opts *sql.TxOptions, fn func(*sql.Tx) error) error {
+	if r.tx != nil {
+		return fn(r.tx)
+	}
+	tx, err := r.db.BeginTx(ctx, opts)
+	if err != nil {
+		return fmt.Errorf(transactionError, err)
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf(transactionError, err)
+	}
+	return nil
 }
 
-func (r *contactRepository) FetchContacts(ctx context.Context, limit, offset int) ([]Contact, error) {
-	rows, err := r.db.QueryContext(ctx, selectContactsQuery+" LIMIT $1 OFFSET $2", limit, offset)
+func (r *contactRepository) FetchContacts(ctx context.Context, sharedOnly bool, limit, offset int) ([]Contact, error) {
+	args, err := viewer(ctx)
+	if err != nil {
+		return nil, err
+	}
+	query := selectContactsQuery
+	if sharedOnly {
+		query += sharedContactsOnly
+	}
+	rows, err := r.conn().QueryContext(ctx, query+" LIMIT $4 OFFSET $5", append(args, limit, offset)...)
 	if err != nil {
 		return nil, fmt.Errorf(fetchContactsError, err)
 	}
 	defer rows.Close()
 
-	var contacts []Contact
-	for rows.Next() {
-		var contact Contact
-		if err := rows.Scan(&contact.ID, &contact.FirstName, &contact.LastName, &contact.PhoneNumber, &contact.Address); err != nil {
-			return nil, fmt.Errorf(scanContactError, err)
+	return scanContacts(rows)
+}
+
+func (r *contactRepository) FindContact(ctx context.Context, query string, fields map[string]string) ([]Contact, error) {
+	args, err := viewer(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sqlQuery := selectContactsQuery + fmt.Sprintf(searchFilter, len(args)+1, len(args)+2)
+	args = append(args, "%"+query+"%", query)
+	sqlQuery, args = filterCustomFields(sqlQuery, args, fields)
+
+	rows, err := r.conn().QueryContext(ctx, sqlQuery, args...)
+	if err != nil {
+		return nil, fmt.Errorf(findContactError, err)
+	}
+	defer rows.Close()
+
+	return scanContacts(rows)
+}
+
+func (r *contactRepository) FetchContact(ctx context.Context, id int) (*Contact, error) {
+	args, err := viewer(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var contact Contact
+	err = scanContact(r.conn().QueryRowContext(ctx, selectContactQuery, append(args, id)...), &contact)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrContactNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf(fetchContactError, err)
+	}
+	return &contact, nil
+}
+
+func (r *contactRepository) CreateContact(ctx context.Context, contact *Contact) error {
+	return r.createContact(ctx, contact, false)
+}
+
+func (r *contactRepository) CreateUniqueContact(ctx context.Context, contact *Contact) error {
+	return r.createContact(ctx, contact, true)
+}
+
+func (r *contactRepository) createContact(ctx context.Context, contact *Contact, unique bool) error {
+	tenantID, err := auth.TenantID(ctx)
+	if err != nil {
+		return err
+	}
+	return r.atomic(ctx, func(tx *sql.Tx) error {
+		if err := r.inTx(tx).insertContact(ctx, tenantID, contact, unique); err != nil {
+			return err
 		}
-		contacts = append(contacts, contact)
+		return recordEvent(ctx, tx, tenantID, Event{Type: EventCreated, ContactID: contact.ID, Contact: contact})
+	})
+}
+
+func (r *contactRepository) insertContact(ctx context.Context, tenantID string, contact *Contact, unique bool) error {
+	if err := r.checkOrganization(ctx, tenantID, contact.OrganizationID); err != nil {
+		return err
+	}
+	customFields, err := encodeCustomFields(contact.CustomFields)
+	if err != nil {
+		return err
+	}
+	// Users add contacts to their own phone book, other callers to the tenant's
+	contact.Owner = ownerOf(ctx)
+	phoneKey := normalizePhone(contact.PhoneNumber, r.phoneCountry)
+
+	// The contact claims its number unless another contact of the tenant has.
+	// When another insert claims it first, the contact is added again as a
+	// duplicate, unless it must be unique and the caller can see the other.
+	for duplicate := false; ; duplicate = true {
+		if unique {
+			ids, err := r.findSamePhone(ctx, phoneKey, 0)
+			if err != nil {
+				return err
+			}
+			if len(ids) > 0 {
+				return &DuplicateError{ContactIDs: ids}
+			}
+		}
+		err = r.conn().QueryRowContext(ctx, insertContactQuery, tenantID, contact.FirstName, contact.LastName, contact.PhoneNumber, contact.Address,
+			contact.Birthday, contact.Anniversary, pq.Array(nonNilStrings(contact.Groups)), contact.OrganizationID, contact.JobTitle, contact.Department,
+			customFields, contact.Owner, phoneKey, duplicate).Scan(&contact.ID, &contact.UpdatedAt, &contact.Organization)
+		if !errors.Is(err, sql.ErrNoRows) || duplicate {
+			break
+		}
+	}
+	if isForeignKeyViolation(err) {
+		return ErrOrganizationNotFound
+	}
+	if err != nil {
+		return fmt.Errorf(createContactError, err)
+	}
+	return r.storeCustomValues(ctx, tenantID, contact.ID)
+}
+
+func (r *contactRepository) FindSamePhone(ctx context.Context, contact *Contact) ([]int, error) {
+	return r.findSamePhone(ctx, normalizePhone(contact.PhoneNumber, r.phoneCountry), contact.ID)
+}
+
+func (r *contactRepository) findSamePhone(ctx context.Context, phoneKey string, excludeID int) ([]int, error) {
+	if phoneKey == "" {
+		return nil, nil
+	}
+	args, err := viewer(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := r.conn().QueryContext(ctx, selectSamePhoneQuery, append(args, phoneKey, excludeID)...)
+	if err != nil {
+		return nil, fmt.Errorf(findSamePhoneError, err)
 	}
+	defer rows.Close()
 
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf(findSamePhoneError, err)
+		}
+		ids = append(ids, id)
+	}
 	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf(rowsError, err)
+		return nil, fmt.Errorf(findSamePhoneError, err)
 	}
+	return ids, nil
+}
 
-	return contacts, nil
+func (r *contactRepository) UpdateContact(ctx context.Context, contact *Contact) error {
+	args, err := viewer(ctx)
+	if err != nil {
+		return err
+	}
+	return r.atomic(ctx, func(tx *sql.Tx) error {
+		if err := r.inTx(tx).updateContact(ctx, args, contact); err != nil {
+			return err
+		}
+		return recordEvent(ctx, tx, args[0].(string), Event{Type: EventUpdated, ContactID: contact.ID, Contact: contact})
+	})
 }
 
-func (r *contactRepository) FindContact(ctx context.Context, query string) ([]Contact, error) {
-	rows, err := r.db.QueryContext(ctx, selectContactByQuery, "%"+query+"%", "%"+query+"%", "%"+query+"%")
+func (r *contactRepository) updateContact(ctx context.Context, args []interface{}, contact *Contact) error {
+	if err := r.checkOrganization(ctx, args[0].(string), contact.OrganizationID); err != nil {
+		return err
+	}
+	customFields, err := encodeCustomFields(contact.CustomFields)
 	if err != nil {
-		return nil, fmt.Errorf(findContactError, err)
+		return err
+	}
+	phoneKey := normalizePhone(contact.PhoneNumber, r.phoneCountry)
+	err = claimPhone(ctx, r.tx, func(duplicate bool) error {
+		return r.tx.QueryRowContext(ctx, updateContactQuery, append(args, contact.FirstName, contact.LastName, contact.PhoneNumber, contact.Address,
+			contact.Birthday, contact.Anniversary, pq.Array(nonNilStrings(contact.Groups)), contact.OrganizationID, contact.JobTitle, contact.Department,
+			customFields, contact.ID, phoneKey, duplicate)...).Scan(&contact.UpdatedAt, &contact.Organization, &contact.Owner)
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrContactNotFound
+	}
+	if isForeignKeyViolation(err) {
+		return ErrOrganizationNotFound
+	}
+	if err != nil {
+		return fmt.Errorf(updateContactError, err)
+	}
+	return r.storeCustomValues(ctx, args[0].(string), contact.ID)
+}
+
+func (r *contactRepository) RemoveContact(ctx context.Context, id int) error {
+	args, err := viewer(ctx)
+	if err != nil {
+		return err
+	}
+	return r.atomic(ctx, func(tx *sql.Tx) error {
+		var deletedAt time.Time
+		err := tx.QueryRowContext(ctx, trashContactQuery, append(args, id)...).Scan(&deletedAt)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrContactNotFound
+		}
+		if err != nil {
+			return fmt.Errorf(removeContactError, err)
+		}
+		if _, err := tx.ExecContext(ctx, trashNotesQuery, args[0], id, deletedAt); err != nil {
+			return fmt.Errorf(removeContactError, err)
+		}
+		if _, err := tx.ExecContext(ctx, calendarChangedQuery, args[0]); err != nil {
+			return fmt.Errorf(removeContactError, err)
+		}
+		return recordEvent(ctx, tx, args[0].(string), Event{Type: EventDeleted, ContactID: id})
+	})
+}
+
+func (r *contactRepository) FetchTrash(ctx context.Context, limit, offset int) ([]Contact, error) {
+	args, err := viewer(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := r.conn().QueryContext(ctx, selectTrashQuery, append(args, limit, offset)...)
+	if err != nil {
+		return nil, fmt.Errorf(fetchTrashError, err)
 	}
 	defer rows.Close()
 
-	var contacts []Contact
+	contacts := []Contact{}
 	for rows.Next() {
 		var contact Contact
-		if err := rows.Scan(&contact.ID, &contact.FirstName, &contact.LastName, &contact.PhoneNumber, &contact.Address); err != nil {
-			return nil, fmt.Errorf(scanContactError, err)
+		if err := scanContact(rows, &contact, &contact.DeletedAt); err != nil {
+			return nil, fmt.Errorf(fetchTrashError, err)
 		}
 		contacts = append(contacts, contact)
 	}
-
 	if err := rows.Err(); err != nil {
 		return nil, fmt.Errorf(rowsError, err)
 	}
-
 	return contacts, nil
 }
 
-func (r *contactRepository) CreateContact(ctx context.Context, contact *Contact) error {
-	err := r.db.QueryRowContext(ctx, insertContactQuery, contact.FirstName, contact.LastName, contact.PhoneNumber, contact.Address).Scan(&contact.ID)
+func (r *contactRepository) RestoreContact(ctx context.Context, id int) (*Contact, error) {
+	args, err := viewer(ctx)
 	if err != nil {
-		return fmt.Errorf(createContactError, err)
+		return nil, err
 	}
-	return nil
+	var contact Contact
+	err = r.atomic(ctx, func(tx *sql.Tx) error {
+		var rowsAffected int64
+		err := claimPhone(ctx, tx, func(duplicate bool) error {
+			result, err := tx.ExecContext(ctx, restoreTrashedQuery, append(args, id, duplicate)...)
+			if err != nil {
+				return err
+			}
+			rowsAffected, err = result.RowsAffected()
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf(restoreContactError, err)
+		}
+		if rowsAffected == 0 {
+			return ErrContactNotFound
+		}
+		if _, err := tx.ExecContext(ctx, restoreNotesInTrash, args[0], id); err != nil {
+			return fmt.Errorf(restoreContactError, err)
+		}
+		if _, err := tx.ExecContext(ctx, calendarChangedQuery, args[0]); err != nil {
+			return fmt.Errorf(restoreContactError, err)
+		}
+		if err := scanContact(tx.QueryRowContext(ctx, selectContactQuery, append(args, id)...), &contact); err != nil {
+			return fmt.Errorf(restoreContactError, err)
+		}
+		// Consumers saw the contact deleted, so it comes back as a new one
+		return recordEvent(ctx, tx, args[0].(string), Event{Type: EventCreated, ContactID: id, Contact: &contact})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &contact, nil
 }
 
-func (r *contactRepository) UpdateContact(ctx context.Context, contact Contact) error {
-	result, err := r.db.ExecContext(ctx, updateContactQuery, contact.FirstName, contact.LastName, contact.PhoneNumber, contact.Address, contact.ID)
+func (r *contactRepository) PurgeContact(ctx context.Context, id int) error {
+	args, err := viewer(ctx)
 	if err != nil {
-		return fmt.Errorf(updateContactError, err)
+		return err
+	}
+	result, err := r.conn().ExecContext(ctx, purgeContactQuery, append(args, id)...)
+	if err != nil {
+		return fmt.Errorf(purgeContactError, err)
 	}
 	rowsAffected, err := result.RowsAffected()
 	if err != nil {
 		return fmt.Errorf(getRowsAffectedError, err)
 	}
 	if rowsAffected == 0 {
-		return errors.New(contactNotFoundError)
+		return ErrContactNotFound
 	}
 	return nil
 }
 
-func (r *contactRepository) RemoveContact(ctx context.Context, id int) error {
-	result, err := r.db.ExecContext(ctx, deleteContactQuery, id)
+func (r *contactRepository) FetchDatedContacts(ctx context.Context, group string) ([]Contact, error) {
+	args, err := viewer(ctx)
 	if err != nil {
-		return fmt.Errorf(removeContactError, err)
+		return nil, err
 	}
-	rowsAffected, err := result.RowsAffected()
+	rows, err := r.conn().QueryContext(ctx, selectDatedQuery, append(args, group)...)
 	if err != nil {
-		return fmt.Errorf(getRowsAffectedError, err)
+		return nil, fmt.Errorf(fetchDatedError, err)
 	}
-	if rowsAffected == 0 {
-		return errors.New(contactNotFoundError)
+	defer rows.Close()
+
+	return scanContacts(rows)
+}
+
+func (r *contactRepository) CalendarModified(ctx context.Context) (time.Time, error) {
+	tenantID, err := auth.TenantID(ctx)
+	if err != nil {
+		return time.Time{}, err
 	}
-	return nil
+	var modified sql.NullTime
+	if err := r.conn().QueryRowContext(ctx, calendarModifiedQuery, tenantID).Scan(&modified); err != nil {
+		return time.Time{}, fmt.Errorf(calendarModifiedError, err)
+	}
+	return modified.Time, nil
+}
+
+// ExportContacts calls each for every contact the filter selects, reading
+// them from a cursor in a read-only transaction. The cursor is closed with
+// the transaction when each fails or the context is canceled. Exports are
+// not retried, since each has already seen the contacts.
+func (r *contactRepository) ExportContacts(ctx context.Context, filter ExportFilter, each func(Contact, []string) error) error {
+	query, args, err := exportQuery(ctx, filter)
+	if err != nil {
+		return err
+	}
+
+	return r.transaction(ctx, &sql.TxOptions{ReadOnly: true}, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, declareExportCursor+query+exportOrder, args...); err != nil {
+			return fmt.Errorf(exportContactsError, err)
+		}
+		for {
+			fetched, err := fetchExportBatch(ctx, tx, each)
+			if err != nil {
+				return err
+			}
+			if fetched < exportBatchSize {
+				break
+			}
+		}
+		// A transaction the export joined may declare the cursor again
+		if _, err := tx.ExecContext(ctx, closeExportCursor); err != nil {
+			return fmt.Errorf(exportContactsError, err)
+		}
+		return nil
+	})
+}
+
+func (r *contactRepository) CountContacts(ctx context.Context, filter ExportFilter) (int, error) {
+	query, args, err := exportQuery(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	var count int
+	if err := r.conn().QueryRowContext(ctx, fmt.Sprintf(countExportQuery, query), args...).Scan(&count); err != nil {
+		return 0, fmt.Errorf(countContactsError, err)
+	}
+	return count, nil
+}
+
+// exportQuery selects the contacts of an export, without an order.
+func exportQuery(ctx context.Context, filter ExportFilter) (string, []interface{}, error) {
+	args, err := viewer(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	query := selectExportQuery
+	args = append(args, filter.ContactID, filter.Group)
+	if filter.SharedOnly {
+		query += sharedContactsOnly
+	}
+	if filter.Query != "" {
+		query += fmt.Sprintf(searchFilter, len(args)+1, len(args)+2)
+		args = append(args, "%"+filter.Query+"%", filter.Query)
+	}
+	query, args = filterCustomFields(query, args, filter.CustomFields)
+	return query, args, nil
+}
+
+func fetchExportBatch(ctx context.Context, tx *sql.Tx, each func(Contact, []string) error) (int, error) {
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf(fetchExportCursor, exportBatchSize))
+	if err != nil {
+		return 0, fmt.Errorf(exportContactsError, err)
+	}
+	defer rows.Close()
+
+	fetched := 0
+	for rows.Next() {
+		fetched++
+		var contact Contact
+		var notes []string
+		if err := scanContact(rows, &contact, pq.Array(&notes)); err != nil {
+			return 0, fmt.Errorf(scanContactError, err)
+		}
+		if err := each(contact, notes); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf(rowsError, err)
+	}
+	return fetched, nil
+}
+
+func (r *contactRepository) ContactWritable(ctx context.Context, id int) (bool, error) {
+	args, err := viewer(ctx)
+	if err != nil {
+		return false, err
+	}
+	var writable bool
+	if err := r.conn().QueryRowContext(ctx, contactWritableQuery, append(args, id)...).Scan(&writable); err != nil {
+		return false, fmt.Errorf(findContactError, err)
+	}
+	return writable, nil
+}
+
+func (r *contactRepository) FindOrganizationID(ctx context.Context, name string) (int, error) {
+	tenantID, err := auth.TenantID(ctx)
+	if err != nil {
+		return 0, err
+	}
+	var id int
+	err = r.conn().QueryRowContext(ctx, organizationByName, tenantID, name).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf(findOrgError, err)
+	}
+	return id, nil
+}
+
+func (r *contactRepository) FetchOrganizationContacts(ctx context.Context, organizationID, limit, offset int) ([]Contact, error) {
+	args, err := viewer(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := r.conn().QueryContext(ctx, selectByOrgQuery, append(args, organizationID, limit, offset)...)
+	if err != nil {
+		return nil, fmt.Errorf(fetchByOrgError, err)
+	}
+	defer rows.Close()
+
+	return scanContacts(rows)
+}
+
+func (r *contactRepository) FetchCustomFields(ctx context.Context) ([]CustomField, error) {
+	tenantID, err := auth.TenantID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := r.conn().QueryContext(ctx, selectCustomFieldsQuery, tenantID)
+	if err != nil {
+		return nil, fmt.Errorf(fetchCustomFieldsError, err)
+	}
+	defer rows.Close()
+
+	var fields []CustomField
+	for rows.Next() {
+		var field CustomField
+		if err := rows.Scan(&field.ID, &field.Name, &field.Type, &field.Required, &field.Unique, &field.Pattern, pq.Array(&field.Options)); err != nil {
+			return nil, fmt.Errorf(fetchCustomFieldsError, err)
+		}
+		fields = append(fields, field)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf(rowsError, err)
+	}
+
+	return fields, nil
+}
+
+func (r *contactRepository) CreateCustomField(ctx context.Context, field *CustomField) error {
+	tenantID, err := auth.TenantID(ctx)
+	if err != nil {
+		return err
+	}
+	return r.atomic(ctx, func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx, insertCustomFieldQuery, tenantID, field.Name, field.Type, field.Required, field.Unique, field.Pattern,
+			pq.Array(nonNilStrings(field.Options))).Scan(&field.ID)
+		if isUniqueViolation(err) {
+			return ErrCustomFieldExists
+		}
+		if err != nil {
+			return fmt.Errorf(createCustomFieldError, err)
+		}
+		if field.Unique {
+			return indexCustomField(ctx, tx, tenantID, field.ID, field.Name)
+		}
+		return nil
+	})
+}
+
+func (r *contactRepository) UpdateCustomField(ctx context.Context, field *CustomField) error {
+	tenantID, err := auth.TenantID(ctx)
+	if err != nil {
+		return err
+	}
+	return r.atomic(ctx, func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx, updateCustomFieldQuery, tenantID, field.Type, field.Required, field.Unique, field.Pattern,
+			pq.Array(nonNilStrings(field.Options)), field.ID).Scan(&field.Name)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrCustomFieldNotFound
+		}
+		if err != nil {
+			return fmt.Errorf(updateCustomFieldError, err)
+		}
+		if err := checkStoredValues(ctx, tx, tenantID, *field); err != nil {
+			return err
+		}
+		if field.Unique {
+			return indexCustomField(ctx, tx, tenantID, field.ID, field.Name)
+		}
+		if _, err := tx.ExecContext(ctx, unindexCustomFieldQuery, field.ID); err != nil {
+			return fmt.Errorf(updateCustomFieldError, err)
+		}
+		return nil
+	})
+}
+
+func (r *contactRepository) RemoveCustomField(ctx context.Context, id int) error {
+	tenantID, err := auth.TenantID(ctx)
+	if err != nil {
+		return err
+	}
+	return r.atomic(ctx, func(tx *sql.Tx) error {
+		var name string
+		err := tx.QueryRowContext(ctx, deleteCustomFieldQuery, tenantID, id).Scan(&name)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrCustomFieldNotFound
+		}
+		if err != nil {
+			return fmt.Errorf(removeCustomFieldError, err)
+		}
+
+		// Drop the stored values so a field later defined with the same name starts empty
+		if _, err := tx.ExecContext(ctx, stripCustomFieldQuery, tenantID, name); err != nil {
+			return fmt.Errorf(removeCustomFieldError, err)
+		}
+		return nil
+	})
+}
+
+// checkStoredValues checks the values contacts have for a field against its
+// definition. It returns ErrCustomValuesInvalid when one does not conform.
+func checkStoredValues(ctx context.Context, tx *sql.Tx, tenantID string, field CustomField) error {
+	rows, err := tx.QueryContext(ctx, selectFieldValuesQuery, tenantID, field.Name)
+	if err != nil {
+		return fmt.Errorf(updateCustomFieldError, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var encoded []byte
+		if err := rows.Scan(&encoded); err != nil {
+			return fmt.Errorf(updateCustomFieldError, err)
+		}
+		var value interface{}
+		if err := json.Unmarshal(encoded, &value); err != nil {
+			return fmt.Errorf(updateCustomFieldError, err)
+		}
+		if checkCustomValue(field, value) != "" {
+			return ErrCustomValuesInvalid
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf(rowsError, err)
+	}
+	return nil
+}
+
+// indexCustomField copies the values contacts have for a field to
+// custom_field_values. It returns ErrCustomValuesTaken when contacts already
+// share a value of the field.
+func indexCustomField(ctx context.Context, tx *sql.Tx, tenantID string, id int, name string) error {
+	_, err := tx.ExecContext(ctx, indexCustomFieldQuery, tenantID, id, name)
+	if isUniqueViolation(err) {
+		return ErrCustomValuesTaken
+	}
+	if err != nil {
+		return fmt.Errorf(indexCustomFieldsError, err)
+	}
+	return nil
+}
+
+func (r *contactRepository) IndexUniqueFields(ctx context.Context) ([]string, error) {
+	type uniqueField struct {
+		tenantID string
+		id       int
+		name     string
+	}
+	rows, err := r.conn().QueryContext(ctx, selectUniqueFieldsQuery)
+	if err != nil {
+		return nil, fmt.Errorf(indexCustomFieldsError, err)
+	}
+	var fields []uniqueField
+	for rows.Next() {
+		var field uniqueField
+		if err := rows.Scan(&field.tenantID, &field.id, &field.name); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf(indexCustomFieldsError, err)
+		}
+		fields = append(fields, field)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf(indexCustomFieldsError, err)
+	}
+
+	var unindexed []string
+	for _, field := range fields {
+		err := r.atomic(ctx, func(tx *sql.Tx) error {
+			return indexCustomField(ctx, tx, field.tenantID, field.id, field.name)
+		})
+		if errors.Is(err, ErrCustomValuesTaken) {
+			unindexed = append(unindexed, field.tenantID+"/"+field.name)
+			continue
+		}
+		if err != nil {
+			return unindexed, err
+		}
+	}
+	return unindexed, nil
+}
+
+// storeCustomValues copies the values of a contact's unique fields to
+// custom_field_values, replacing those it had. It returns a
+// *ValidationError naming the fields whose value another contact has.
+func (r *contactRepository) storeCustomValues(ctx context.Context, tenantID string, id int) error {
+	if _, err := r.conn().ExecContext(ctx, clearCustomValuesQuery, tenantID, pq.Array([]int64{int64(id)})); err != nil {
+		return fmt.Errorf(storeCustomValuesError, err)
+	}
+	rows, err := r.conn().QueryContext(ctx, storeCustomValuesQuery, tenantID, id)
+	if err != nil {
+		return fmt.Errorf(storeCustomValuesError, err)
+	}
+	defer rows.Close()
+
+	var problems []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return fmt.Errorf(storeCustomValuesError, err)
+		}
+		problems = append(problems, fmt.Sprintf(fieldTakenProblem, name))
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf(rowsError, err)
+	}
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+func (r *contactRepository) FetchImportProfiles(ctx context.Context) ([]ImportProfile, error) {
+	tenantID, err := auth.TenantID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := r.conn().QueryContext(ctx, selectProfilesQuery, tenantID)
+	if err != nil {
+		return nil, fmt.Errorf(fetchProfilesError, err)
+	}
+	defer rows.Close()
+
+	var profiles []ImportProfile
+	for rows.Next() {
+		var profile ImportProfile
+		var columns []byte
+		if err := rows.Scan(&profile.ID, &profile.Name, &columns); err != nil {
+			return nil, fmt.Errorf(fetchProfilesError, err)
+		}
+		if err := json.Unmarshal(columns, &profile.Columns); err != nil {
+			return nil, fmt.Errorf(fetchProfilesError, err)
+		}
+		profiles = append(profiles, profile)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf(rowsError, err)
+	}
+
+	return profiles, nil
+}
+
+func (r *contactRepository) CreateImportProfile(ctx context.Context, profile *ImportProfile) error {
+	tenantID, err := auth.TenantID(ctx)
+	if err != nil {
+		return err
+	}
+	columns, err := json.Marshal(profile.Columns)
+	if err != nil {
+		return fmt.Errorf(createProfileError, err)
+	}
+	err = r.conn().QueryRowContext(ctx, insertProfileQuery, tenantID, profile.Name, columns).Scan(&profile.ID)
+	if isUniqueViolation(err) {
+		return ErrProfileExists
+	}
+	if err != nil {
+		return fmt.Errorf(createProfileError, err)
+	}
+	return nil
+}
+
+func (r *contactRepository) UpdateImportProfile(ctx context.Context, profile *ImportProfile) error {
+	tenantID, err := auth.TenantID(ctx)
+	if err != nil {
+		return err
+	}
+	columns, err := json.Marshal(profile.Columns)
+	if err != nil {
+		return fmt.Errorf(updateProfileError, err)
+	}
+	result, err := r.conn().ExecContext(ctx, updateProfileQuery, tenantID, profile.Name, columns, profile.ID)
+	if isUniqueViolation(err) {
+		return ErrProfileExists
+	}
+	if err != nil {
+		return fmt.Errorf(updateProfileError, err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf(getRowsAffectedError, err)
+	}
+	if rowsAffected == 0 {
+		return ErrProfileNotFound
+	}
+	return nil
+}
+
+func (r *contactRepository) RemoveImportProfile(ctx context.Context, id int) error {
+	tenantID, err := auth.TenantID(ctx)
+	if err != nil {
+		return err
+	}
+	result, err := r.conn().ExecContext(ctx, deleteProfileQuery, tenantID, id)
+	if err != nil {
+		return fmt.Errorf(removeProfileError, err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf(getRowsAffectedError, err)
+	}
+	if rowsAffected == 0 {
+		return ErrProfileNotFound
+	}
+	return nil
+}
+
+func (r *contactRepository) CustomValueTaken(ctx context.Context, name string, value interface{}, contactID int) (bool, error) {
+	tenantID, err := auth.TenantID(ctx)
+	if err != nil {
+		return false, err
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return false, fmt.Errorf(checkCustomValueError, err)
+	}
+	var taken bool
+	if err := r.conn().QueryRowContext(ctx, customValueTakenQuery, tenantID, name, string(encoded), contactID).Scan(&taken); err != nil {
+		return false, fmt.Errorf(checkCustomValueError, err)
+	}
+	return taken, nil
+}
+
+func (r *contactRepository) FetchNotes(ctx context.Context, contactID, limit, offset int) ([]Note, error) {
+	args, err := viewer(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := r.conn().QueryContext(ctx, selectNotesQuery, append(args, contactID, limit, offset)...)
+	if err != nil {
+		return nil, fmt.Errorf(fetchNotesError, err)
+	}
+	defer rows.Close()
+
+	notes := []Note{}
+	for rows.Next() {
+		var note Note
+		if err := scanNote(rows, &note); err != nil {
+			return nil, fmt.Errorf(fetchNotesError, err)
+		}
+		notes = append(notes, note)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf(rowsError, err)
+	}
+
+	return notes, nil
+}
+
+func (r *contactRepository) CreateNote(ctx context.Context, note *Note) error {
+	args, err := viewer(ctx)
+	if err != nil {
+		return err
+	}
+	err = r.conn().QueryRowContext(ctx, insertNoteQuery, append(args, note.ContactID, note.Author, note.Text)...).Scan(&note.ID, &note.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrContactNotFound
+	}
+	if err != nil {
+		return fmt.Errorf(createNoteError, err)
+	}
+	return nil
+}
+
+func (r *contactRepository) UpdateNote(ctx context.Context, note *Note) error {
+	args, err := viewer(ctx)
+	if err != nil {
+		return err
+	}
+	err = scanNote(r.conn().QueryRowContext(ctx, updateNoteQuery, append(args, note.Text, note.ID, note.ContactID)...), note)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNoteNotFound
+	}
+	if err != nil {
+		return fmt.Errorf(updateNoteError, err)
+	}
+	return nil
+}
+
+func (r *contactRepository) RemoveNote(ctx context.Context, contactID, id int) error {
+	args, err := viewer(ctx)
+	if err != nil {
+		return err
+	}
+	result, err := r.conn().ExecContext(ctx, deleteNoteQuery, append(args, id, contactID)...)
+	if err != nil {
+		return fmt.Errorf(removeNoteError, err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf(getRowsAffectedError, err)
+	}
+	if rowsAffected == 0 {
+		return ErrNoteNotFound
+	}
+	return nil
+}
+
+func (r *contactRepository) FetchRelations(ctx context.Context, contactID, depth int) ([]Relation, error) {
+	args, err := viewer(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := r.conn().QueryContext(ctx, walkRelationsQuery, append(args, contactID, depth)...)
+	if err != nil {
+		return nil, fmt.Errorf(fetchRelationsError, err)
+	}
+	defer rows.Close()
+
+	relations := []Relation{}
+	for rows.Next() {
+		var relation Relation
+		if err := rows.Scan(&relation.ID, &relation.ContactID, &relation.RelatedID, &relation.Type, &relation.Depth); err != nil {
+			return nil, fmt.Errorf(fetchRelationsError, err)
+		}
+		relations = append(relations, relation)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf(rowsError, err)
+	}
+
+	return relations, nil
+}
+
+// CreateRelation stores the relation together with its inverse so the graph
+// can be walked from either side.
+func (r *contactRepository) CreateRelation(ctx context.Context, relation *Relation) error {
+	args, err := viewer(ctx)
+	if err != nil {
+		return err
+	}
+	return r.atomic(ctx, func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx, insertRelationQuery, append(args, relation.ContactID, relation.RelatedID, relation.Type)...).Scan(&relation.ID)
+		if err == nil {
+			var inverseID int
+			err = tx.QueryRowContext(ctx, insertRelationQuery, append(args, relation.RelatedID, relation.ContactID, inverseRelations[relation.Type])...).Scan(&inverseID)
+		}
+		if isUniqueViolation(err) {
+			return ErrRelationExists
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrContactNotFound
+		}
+		if err != nil {
+			return fmt.Errorf(createRelationError, err)
+		}
+		return nil
+	})
+}
+
+func (r *contactRepository) RemoveRelation(ctx context.Context, contactID, id int) error {
+	args, err := viewer(ctx)
+	if err != nil {
+		return err
+	}
+	return r.atomic(ctx, func(tx *sql.Tx) error {
+		var relatedID int
+		var relationType string
+		err := tx.QueryRowContext(ctx, deleteRelationQuery, append(args, id, contactID)...).Scan(&relatedID, &relationType)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrRelationNotFound
+		}
+		if err != nil {
+			return fmt.Errorf(removeRelationError, err)
+		}
+
+		if _, err := tx.ExecContext(ctx, deleteInverseQuery, args[0], relatedID, contactID, inverseRelations[relationType]); err != nil {
+			return fmt.Errorf(removeRelationError, err)
+		}
+		return nil
+	})
+}
+
+func (r *contactRepository) FetchShareLinks(ctx context.Context, contactID int) ([]ShareLink, error) {
+	args, err := viewer(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := r.conn().QueryContext(ctx, selectLinksQuery, append(args, contactID)...)
+	if err != nil {
+		return nil, fmt.Errorf(fetchLinksError, err)
+	}
+	defer rows.Close()
+
+	links := []ShareLink{}
+	for rows.Next() {
+		var link ShareLink
+		if err := rows.Scan(&link.ID, &link.ContactID, &link.ExpiresAt, &link.MaxViews, &link.Views, &link.CreatedAt, &link.RevokedAt); err != nil {
+			return nil, fmt.Errorf(fetchLinksError, err)
+		}
+		links = append(links, link)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf(rowsError, err)
+	}
+
+	return links, nil
+}
+
+func (r *contactRepository) CreateShareLink(ctx context.Context, link *ShareLink) error {
+	args, err := viewer(ctx)
+	if err != nil {
+		return err
+	}
+	err = r.conn().QueryRowContext(ctx, insertLinkQuery, append(args, link.ContactID, link.ExpiresAt, link.MaxViews)...).Scan(&link.ID, &link.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrContactNotFound
+	}
+	if err != nil {
+		return fmt.Errorf(createLinkError, err)
+	}
+	return nil
+}
+
+func (r *contactRepository) RevokeShareLink(ctx context.Context, contactID, id int) error {
+	args, err := viewer(ctx)
+	if err != nil {
+		return err
+	}
+	result, err := r.conn().ExecContext(ctx, revokeLinkQuery, append(args, id, contactID)...)
+	if err != nil {
+		return fmt.Errorf(revokeLinkError, err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf(getRowsAffectedError, err)
+	}
+	if rowsAffected == 0 {
+		return ErrShareLinkNotFound
+	}
+	return nil
+}
+
+func (r *contactRepository) ViewShareLink(ctx context.Context, id int) (*Contact, error) {
+	var contact Contact
+	err := scanContact(r.conn().QueryRowContext(ctx, viewLinkQuery, id), &contact)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrShareLinkGone
+	}
+	if err != nil {
+		return nil, fmt.Errorf(viewLinkError, err)
+	}
+	return &contact, nil
+}
+
+// mergeSnapshot is what a merge changed: the contacts as they were, the
+// survivor first, the notes and share links it moved with the contact they
+// belonged to, and the relations of the merged contacts.
+type mergeSnapshot struct {
+	Contacts  []Contact  `json:"contacts"`
+	Notes     []movedRow `json:"notes,omitempty"`
+	Links     []movedRow `json:"links,omitempty"`
+	Relations []Relation `json:"relations,omitempty"`
+}
+
+type movedRow struct {
+	ID        int `json:"id"`
+	ContactID int `json:"contact_id"`
+}
+
+func (r *contactRepository) MergeContacts(ctx context.Context, survivor *Contact, cluster []Contact) (*Merge, error) {
+	args, err := viewer(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tenantID := args[0].(string)
+	merge := &Merge{SurvivorID: survivor.ID, MergedBy: subjectOf(ctx)}
+	for _, contact := range cluster[1:] {
+		merge.MergedIDs = append(merge.MergedIDs, contact.ID)
+	}
+	mergedIDs := pq.Array(int64s(merge.MergedIDs))
+
+	err = r.atomic(ctx, func(tx *sql.Tx) error {
+		// The survivor may take the unique custom values of the merged contacts
+		if _, err := tx.ExecContext(ctx, clearCustomValuesQuery, tenantID, mergedIDs); err != nil {
+			return fmt.Errorf(mergeContactsError, err)
+		}
+		if err := r.inTx(tx).UpdateContact(ctx, survivor); err != nil {
+			return err
+		}
+
+		snapshot := mergeSnapshot{Contacts: cluster}
+		if snapshot.Notes, err = moveRows(ctx, tx, moveNotesQuery, tenantID, mergedIDs, survivor.ID); err != nil {
+			return fmt.Errorf(mergeContactsError, err)
+		}
+		if snapshot.Links, err = moveRows(ctx, tx, moveLinksQuery, tenantID, mergedIDs, survivor.ID); err != nil {
+			return fmt.Errorf(mergeContactsError, err)
+		}
+		if snapshot.Relations, err = takeRelations(ctx, tx, tenantID, mergedIDs); err != nil {
+			return fmt.Errorf(mergeContactsError, err)
+		}
+		// Relations between the merged contacts would relate the survivor to
+		// itself, and those the survivor already has would repeat
+		merged := make(map[int]bool, len(merge.MergedIDs))
+		for _, id := range merge.MergedIDs {
+			merged[id] = true
+		}
+		for _, relation := range snapshot.Relations {
+			if merged[relation.ContactID] {
+				relation.ContactID = survivor.ID
+			}
+			if merged[relation.RelatedID] {
+				relation.RelatedID = survivor.ID
+			}
+			if relation.ContactID == relation.RelatedID {
+				continue
+			}
+			if err := putRelation(ctx, tx, tenantID, relation); err != nil {
+				return fmt.Errorf(mergeContactsError, err)
+			}
+		}
+
+		result, err := tx.ExecContext(ctx, deleteMergedQuery, append(args, mergedIDs)...)
+		if err != nil {
+			return fmt.Errorf(mergeContactsError, err)
+		}
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return fmt.Errorf(getRowsAffectedError, err)
+		}
+		if int(rowsAffected) != len(merge.MergedIDs) {
+			return ErrContactNotFound
+		}
+		// The survivor takes the number back when a merged contact had it
+		err = claimPhone(ctx, tx, func(duplicate bool) error {
+			_, err := tx.ExecContext(ctx, reclaimPhoneQuery, tenantID, survivor.ID, duplicate)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf(mergeContactsError, err)
+		}
+		if _, err := tx.ExecContext(ctx, calendarChangedQuery, tenantID); err != nil {
+			return fmt.Errorf(mergeContactsError, err)
+		}
+
+		encoded, err := json.Marshal(snapshot)
+		if err != nil {
+			return fmt.Errorf(mergeContactsError, err)
+		}
+		err = tx.QueryRowContext(ctx, insertMergeQuery, tenantID, survivor.ID, mergedIDs, merge.MergedBy, encoded, survivor.UpdatedAt).
+			Scan(&merge.ID, &merge.CreatedAt)
+		if err != nil {
+			return fmt.Errorf(mergeContactsError, err)
+		}
+		// The survivor's update is followed by the merge that removed the others
+		return recordEvent(ctx, tx, tenantID, Event{Type: EventMerged, ContactID: survivor.ID, Contact: survivor, MergedIDs: merge.MergedIDs})
+	})
+	if err != nil {
+		return nil, err
+	}
+	merge.Contact = survivor
+	return merge, nil
+}
+
+func (r *contactRepository) FetchMerges(ctx context.Context, limit, offset int) ([]Merge, error) {
+	args, err := viewer(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := r.conn().QueryContext(ctx, selectMergesQuery, append(args, limit, offset)...)
+	if err != nil {
+		return nil, fmt.Errorf(fetchMergesError, err)
+	}
+	defer rows.Close()
+
+	merges := []Merge{}
+	for rows.Next() {
+		var merge Merge
+		if err := scanMerge(rows, &merge); err != nil {
+			return nil, fmt.Errorf(fetchMergesError, err)
+		}
+		merges = append(merges, merge)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf(rowsError, err)
+	}
+
+	return merges, nil
+}
+
+func (r *contactRepository) UndoMerge(ctx context.Context, id int) (*Merge, error) {
+	args, err := viewer(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tenantID := args[0].(string)
+
+	var merge Merge
+	err = r.atomic(ctx, func(tx *sql.Tx) error {
+		var encoded []byte
+		var unchanged bool
+		err := scanMerge(tx.QueryRowContext(ctx, selectUndoQuery, append(args, id)...), &merge, &encoded, &unchanged)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrMergeNotFound
+		}
+		if err != nil {
+			return fmt.Errorf(undoMergeError, err)
+		}
+		if merge.UndoneAt != nil {
+			return ErrMergeUndone
+		}
+		if !unchanged {
+			return ErrMergeStale
+		}
+		var snapshot mergeSnapshot
+		if err := json.Unmarshal(encoded, &snapshot); err != nil {
+			return fmt.Errorf(undoMergeError, err)
+		}
+
+		for i, contact := range snapshot.Contacts {
+			query := restoreContactQuery
+			if i == 0 {
+				query = restoreSurvivorQuery
+			}
+			restoreArgs, err := restoreArgs(tenantID, contact)
+			if err != nil {
+				return err
+			}
+			restoreArgs = append(restoreArgs, normalizePhone(contact.PhoneNumber, r.phoneCountry))
+			if i > 0 {
+				restoreArgs = append(restoreArgs, contact.Owner)
+			}
+			err = claimPhone(ctx, tx, func(duplicate bool) error {
+				_, err := tx.ExecContext(ctx, query, append(restoreArgs, duplicate)...)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf(undoMergeError, err)
+			}
+			if err := r.inTx(tx).storeCustomValues(ctx, tenantID, contact.ID); err != nil {
+				return err
+			}
+		}
+		if err := restoreRows(ctx, tx, restoreNotesQuery, tenantID, merge.SurvivorID, snapshot.Notes); err != nil {
+			return fmt.Errorf(undoMergeError, err)
+		}
+		if err := restoreRows(ctx, tx, restoreLinksQuery, tenantID, merge.SurvivorID, snapshot.Links); err != nil {
+			return fmt.Errorf(undoMergeError, err)
+		}
+		relationIDs := make([]int64, len(snapshot.Relations))
+		for i, relation := range snapshot.Relations {
+			relationIDs[i] = int64(relation.ID)
+		}
+		if _, err := tx.ExecContext(ctx, dropRelationsQuery, tenantID, pq.Array(relationIDs)); err != nil {
+			return fmt.Errorf(undoMergeError, err)
+		}
+		for _, relation := range snapshot.Relations {
+			if err := putRelation(ctx, tx, tenantID, relation); err != nil {
+				return fmt.Errorf(undoMergeError, err)
+			}
+		}
+
+		if err := tx.QueryRowContext(ctx, markUndoneQuery, merge.ID).Scan(&merge.UndoneAt); err != nil {
+			return fmt.Errorf(undoMergeError, err)
+		}
+
+		// The survivor is restored and the merged contacts are added back
+		for i := range snapshot.Contacts {
+			event := Event{Type: EventCreated, ContactID: snapshot.Contacts[i].ID, Contact: &snapshot.Contacts[i]}
+			if i == 0 {
+				event.Type = EventUpdated
+			}
+			if err := recordEvent(ctx, tx, tenantID, event); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &merge, nil
+}
+
+func (r *contactRepository) KeyPhoneNumbers(ctx context.Context) (int, error) {
+	type unkeyed struct {
+		tenantID string
+		id       int
+		phone    string
+	}
+	rows, err := r.conn().QueryContext(ctx, selectUnkeyedQuery)
+	if err != nil {
+		return 0, fmt.Errorf(keyPhonesError, err)
+	}
+	var contacts []unkeyed
+	for rows.Next() {
+		var contact unkeyed
+		if err := rows.Scan(&contact.tenantID, &contact.id, &contact.phone); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf(keyPhonesError, err)
+		}
+		contacts = append(contacts, contact)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf(keyPhonesError, err)
+	}
+
+	// Contacts are keyed in the order they were added, so the oldest with a
+	// number claims it and the others are marked duplicates
+	keyed := 0
+	for _, contact := range contacts {
+		phoneKey := normalizePhone(contact.phone, r.phoneCountry)
+		if phoneKey == "" {
+			continue
+		}
+		if _, err := r.conn().ExecContext(ctx, keyPhoneQuery, contact.tenantID, contact.id, phoneKey); err != nil {
+			return keyed, fmt.Errorf(keyPhonesError, err)
+		}
+		keyed++
+	}
+	return keyed, nil
+}
+
+// claimPhone runs a write that claims a phone number unless duplicate is
+// set, and runs it again as a duplicate when a concurrent transaction claimed
+// the number first.
+func claimPhone(ctx context.Context, tx *sql.Tx, write func(duplicate bool) error) error {
+	if _, err := tx.ExecContext(ctx, claimSavepointQuery); err != nil {
+		return err
+	}
+	err := write(false)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == uniqueViolationCode && pqErr.Constraint == phoneKeyIndex {
+		if _, err := tx.ExecContext(ctx, rollbackClaimQuery); err != nil {
+			return err
+		}
+		err = write(true)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, releaseClaimQuery)
+	return err
+}
+
+// moveRows runs a query that moves rows to the survivor and returns their IDs
+// with the contact they belonged to.
+func moveRows(ctx context.Context, tx *sql.Tx, query, tenantID string, mergedIDs interface{}, survivorID int) ([]movedRow, error) {
+	rows, err := tx.QueryContext(ctx, query, tenantID, mergedIDs, survivorID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var moved []movedRow
+	for rows.Next() {
+		var row movedRow
+		if err := rows.Scan(&row.ID, &row.ContactID); err != nil {
+			return nil, err
+		}
+		moved = append(moved, row)
+	}
+	return moved, rows.Err()
+}
+
+func restoreRows(ctx context.Context, tx *sql.Tx, query, tenantID string, survivorID int, moved []movedRow) error {
+	if len(moved) == 0 {
+		return nil
+	}
+	ids := make([]int64, len(moved))
+	contactIDs := make([]int64, len(moved))
+	for i, row := range moved {
+		ids[i], contactIDs[i] = int64(row.ID), int64(row.ContactID)
+	}
+	_, err := tx.ExecContext(ctx, query, tenantID, survivorID, pq.Array(ids), pq.Array(contactIDs))
+	return err
+}
+
+// takeRelations deletes the relations from and to the contacts and returns
+// them, so they can be put back under the same IDs.
+func takeRelations(ctx context.Context, tx *sql.Tx, tenantID string, contactIDs interface{}) ([]Relation, error) {
+	rows, err := tx.QueryContext(ctx, takeRelationsQuery, tenantID, contactIDs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var relations []Relation
+	for rows.Next() {
+		var relation Relation
+		if err := rows.Scan(&relation.ID, &relation.ContactID, &relation.RelatedID, &relation.Type); err != nil {
+			return nil, err
+		}
+		relations = append(relations, relation)
+	}
+	return relations, rows.Err()
+}
+
+// putRelation inserts a relation under its ID unless one of its contacts is
+// gone or the relation already exists.
+func putRelation(ctx context.Context, tx *sql.Tx, tenantID string, relation Relation) error {
+	_, err := tx.ExecContext(ctx, putRelationQuery, relation.ID, tenantID, relation.ContactID, relation.RelatedID, relation.Type)
+	return err
+}
+
+// restoreArgs are the arguments of the queries that restore a contact. An
+// organization deleted since is left out.
+func restoreArgs(tenantID string, contact Contact) ([]interface{}, error) {
+	customFields, err := encodeCustomFields(contact.CustomFields)
+	if err != nil {
+		return nil, err
+	}
+	return []interface{}{tenantID, contact.ID, contact.FirstName, contact.LastName, contact.PhoneNumber, contact.Address,
+		contact.Birthday, contact.Anniversary, pq.Array(nonNilStrings(contact.Groups)), contact.OrganizationID, contact.JobTitle,
+		contact.Department, customFields}, nil
+}
+
+// scanMerge scans the merge columns followed by any extra columns.
+func scanMerge(row rowScanner, merge *Merge, extra ...interface{}) error {
+	var mergedIDs []int64
+	err := row.Scan(append([]interface{}{&merge.ID, &merge.SurvivorID, pq.Array(&mergedIDs), &merge.MergedBy, &merge.CreatedAt, &merge.UndoneAt}, extra...)...)
+	if err != nil {
+		return err
+	}
+	merge.MergedIDs = make([]int, len(mergedIDs))
+	for i, id := range mergedIDs {
+		merge.MergedIDs[i] = int(id)
+	}
+	return nil
+}
+
+// checkOrganization makes sure a contact is only linked to an organization
+// of the same tenant.
+func (r *contactRepository) checkOrganization(ctx context.Context, tenantID string, organizationID *int) error {
+	if organizationID == nil {
+		return nil
+	}
+	var exists bool
+	if err := r.conn().QueryRowContext(ctx, organizationExists, tenantID, *organizationID).Scan(&exists); err != nil {
+		return fmt.Errorf(checkOrgError, err)
+	}
+	if !exists {
+		return ErrOrganizationNotFound
+	}
+	return nil
+}
+
+// viewer returns the leading arguments of the queries that check which
+// contacts the caller can see.
+func viewer(ctx context.Context) ([]interface{}, error) {
+	tenantID, err := auth.TenantID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	principal, _ := auth.FromContext(ctx)
+	return []interface{}{tenantID, principal.Owner(), pq.Array(nonNilStrings(principal.Teams))}, nil
+}
+
+func ownerOf(ctx context.Context) string {
+	principal, _ := auth.FromContext(ctx)
+	return principal.Owner()
+}
+
+func subjectOf(ctx context.Context) string {
+	if principal, ok := auth.FromContext(ctx); ok {
+		return principal.Subject
+	}
+	return ""
+}
+
+func int64s(ids []int) []int64 {
+	converted := make([]int64, len(ids))
+	for i, id := range ids {
+		converted[i] = int64(id)
+	}
+	return converted
+}
+
+// filterCustomFields adds a condition for every custom field value to match.
+func filterCustomFields(query string, args []interface{}, fields map[string]string) (string, []interface{}) {
+	// Sort the field names so the same filters always produce the same statement
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		query += fmt.Sprintf(customFieldFilter, len(args)+1, len(args)+2)
+		args = append(args, name, fields[name])
+	}
+	return query, args
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanContact scans the contact columns followed by any extra columns.
+func scanContact(row rowScanner, contact *Contact, extra ...interface{}) error {
+	var customFields []byte
+	err := row.Scan(append([]interface{}{&contact.ID, &contact.FirstName, &contact.LastName, &contact.PhoneNumber, &contact.Address,
+		&contact.Birthday, &contact.Anniversary, pq.Array(&contact.Groups), &contact.UpdatedAt,
+		&contact.OrganizationID, &contact.Organization, &contact.JobTitle, &contact.Department, &customFields, &contact.Owner}, extra...)...)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(customFields, &contact.CustomFields)
+}
+
+func scanNote(row rowScanner, note *Note) error {
+	return row.Scan(&note.ID, &note.ContactID, &note.Author, &note.Text, &note.CreatedAt, &note.EditedAt)
+}
+
+func scanContacts(rows *sql.Rows) ([]Contact, error) {
+	var contacts []Contact
+	for rows.Next() {
+		var contact Contact
+		if err := scanContact(rows, &contact); err != nil {
+			return nil, fmt.Errorf(scanContactError, err)
+		}
+		contacts = append(contacts, contact)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf(rowsError, err)
+	}
+
+	return contacts, nil
+}
+
+// nonNilStrings keeps NOT NULL array columns satisfied when a client omits
+// the field entirely.
+func nonNilStrings(groups []string) []string {
+	if groups == nil {
+		return []string{}
+	}
+	return groups
+}
+
+func encodeCustomFields(fields map[string]interface{}) (string, error) {
+	if fields == nil {
+		return "{}", nil
+	}
+	encoded, err := json.Marshal(fields)
+	if err != nil {
+		return "", fmt.Errorf(encodeCustomFieldsError, err)
+	}
+	return string(encoded), nil
+}
+
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == uniqueViolationCode
+}
+
+// isRetryable reports whether err aborted a transaction that may succeed
+// when run again.
+func isRetryable(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && (pqErr.Code == serializationFailureCode || pqErr.Code == deadlockDetectedCode)
+}
+
+func isForeignKeyViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == foreignKeyViolationCode
 }
@@ -2,33 +2,645 @@ package contacts
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/benhuri/phone-book-api/internal/auth"
+	"github.com/benhuri/phone-book-api/internal/httputil"
+	"github.com/go-playground/validator/v10"
+)
+
+const (
+	validationErrorPrefix = "Validation error: "
+	undefinedFieldProblem = "%s is not a defined custom field"
+	requiredFieldProblem  = "%s is required"
+	fieldTypeProblem      = "%s must be a %s"
+	fieldOptionProblem    = "%s must be one of %s"
+	fieldPatternProblem   = "%s does not match the required pattern"
+	fieldTakenProblem     = "%s is already used by another contact"
+
+	shareLinkTTL         = 7 * 24 * time.Hour
+	shareLinkURL         = "/public/links/%d?expires=%d&signature=%s"
+	shareLinkPayload     = "%d.%d"
+	shareLinkExpiryError = "expires_at must be in the future"
+
+	importNoteAuthor = "import"
+	noVCardsError    = "request body contains no vCards"
+)
+
+var (
+	ErrShareLinkExpiry = errors.New(shareLinkExpiryError)
+	ErrNoVCards        = errors.New(noVCardsError)
+
+	errImportRejected = errors.New("import rejected")
 )
 
+var phoneValuePattern = regexp.MustCompile(`^\+?[0-9]{7,15}$`)
+
+// ValidationError reports every problem found with a request so that clients
+// can fix them all at once.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return validationErrorPrefix + strings.Join(e.Problems, ", ")
+}
+
 type Service struct {
-	repo Repository
+	repo         Repository
+	linkSecret   []byte
+	publicURL    string
+	phoneCountry string
+	duplicates   DuplicatePolicy
+}
+
+// NewService signs share links with linkSecret. Their URLs are prefixed with
+// publicURL, the address clients reach the service at, or are relative when
+// it is empty. Phone numbers without a country code, such as 0541234567, are
+// taken to be in the country with the calling code phoneCountry when looking
+// for duplicates. New contacts whose number the caller already has are
+// handled by the duplicates policy.
+func NewService(repo Repository, linkSecret []byte, publicURL, phoneCountry string, duplicates DuplicatePolicy) *Service {
+	return &Service{repo: repo, linkSecret: linkSecret, publicURL: strings.TrimRight(publicURL, "/"), phoneCountry: phoneCountry, duplicates: duplicates}
+}
+
+// withRepo returns a copy of the service that uses repo, such as the one
+// WithTx passes to its function.
+func (s *Service) withRepo(repo Repository) *Service {
+	txService := *s
+	txService.repo = repo
+	return &txService
+}
+
+func (s *Service) GetContacts(ctx context.Context, sharedOnly bool, page, limit int) ([]Contact, error) {
+	offset := (page - 1) * limit
+	return s.repo.FetchContacts(ctx, sharedOnly, limit, offset)
+}
+
+func (s *Service) SearchContact(ctx context.Context, query string, fields map[string]string) ([]Contact, error) {
+	return s.repo.FindContact(ctx, query, fields)
+}
+
+// AddContact adds the contact under the duplicate policy, or allowing
+// duplicates when force is set. Under DuplicatesWarn it returns the IDs of
+// the other contacts with the number, and under DuplicatesReject it returns
+// a *DuplicateError naming them instead of adding the contact.
+func (s *Service) AddContact(ctx context.Context, contact *Contact, force bool) ([]int, error) {
+	if force || s.duplicates == DuplicatesAllow {
+		return nil, s.repo.CreateContact(ctx, contact)
+	}
+	if s.duplicates == DuplicatesReject {
+		return nil, s.repo.CreateUniqueContact(ctx, contact)
+	}
+	if err := s.repo.CreateContact(ctx, contact); err != nil {
+		return nil, err
+	}
+	return s.repo.FindSamePhone(ctx, contact)
+}
+
+func (s *Service) EditContact(ctx context.Context, contact *Contact) error {
+	return s.repo.UpdateContact(ctx, contact)
+}
+
+func (s *Service) DeleteContact(ctx context.Context, id int) error {
+	return s.repo.RemoveContact(ctx, id)
+}
+
+func (s *Service) GetTrash(ctx context.Context, page, limit int) ([]Contact, error) {
+	offset := (page - 1) * limit
+	return s.repo.FetchTrash(ctx, limit, offset)
+}
+
+func (s *Service) RestoreContact(ctx context.Context, id int) (*Contact, error) {
+	return s.repo.RestoreContact(ctx, id)
+}
+
+func (s *Service) PurgeContact(ctx context.Context, id int) error {
+	return s.repo.PurgeContact(ctx, id)
+}
+
+func (s *Service) GetDatedContacts(ctx context.Context, group string) ([]Contact, error) {
+	return s.repo.FetchDatedContacts(ctx, group)
+}
+
+// GetCalendarModified returns when the tenant's contacts last changed.
+func (s *Service) GetCalendarModified(ctx context.Context) (time.Time, error) {
+	return s.repo.CalendarModified(ctx)
+}
+
+// Export writes the contacts the filter selects as vCards, or as CSV or
+// NDJSON rows of the given fields, and returns how many it wrote. Rows are
+// written as they are read and flushed every exportFlushRows rows. The total
+// for progress is counted first, so only pass progress when it is wanted.
+func (s *Service) Export(ctx context.Context, w io.Writer, opts ExportOptions, progress Progress) (int, error) {
+	fields, err := s.repo.FetchCustomFields(ctx)
+	if err != nil {
+		return 0, err
+	}
+	rw, err := newRowWriter(w, opts, fields)
+	if err != nil {
+		return 0, err
+	}
+	total := 0
+	if progress != nil {
+		if total, err = s.repo.CountContacts(ctx, opts.Filter); err != nil {
+			return 0, err
+		}
+	}
+
+	count := 0
+	err = s.repo.ExportContacts(ctx, opts.Filter, func(contact Contact, notes []string) error {
+		count++
+		if err := rw.write(contact, notes); err != nil {
+			return err
+		}
+		if progress != nil {
+			progress(count, total)
+		}
+		if count%exportFlushRows == 0 {
+			if err := rw.flush(); err != nil {
+				return err
+			}
+			flush(w)
+		}
+		return nil
+	})
+	if err != nil {
+		return count, err
+	}
+	return count, rw.flush()
+}
+
+// CheckExport returns ErrUnknownExportField when an export asks for fields
+// that do not exist, so queued exports can be refused up front.
+func (s *Service) CheckExport(ctx context.Context, opts ExportOptions) error {
+	if opts.Format == FormatVCard || len(opts.Fields) == 0 {
+		return nil
+	}
+	fields, err := s.repo.FetchCustomFields(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = exportFieldList(opts.Fields, fields)
+	return err
+}
+
+// flush sends what has been written so far when w is an HTTP response.
+func flush(w io.Writer) {
+	if flusher, ok := w.(interface{ Flush() }); ok {
+		flusher.Flush()
+	}
+}
+
+// ImportVCards creates a contact for every valid card, or updates the contact
+// whose UID a card exported from this service carries. Cards with errors are
+// skipped and a dry run writes nothing. Notes are only added to new contacts,
+// so importing the same cards twice does not repeat them.
+func (s *Service) ImportVCards(ctx context.Context, r io.Reader, dryRun bool, progress Progress) (*ImportResult, error) {
+	cards, err := readVCards(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(cards) == 0 {
+		return nil, ErrNoVCards
+	}
+	fields, err := s.repo.FetchCustomFields(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	imported := make([]importedCard, len(cards))
+	for i, card := range cards {
+		imported[i] = mapVCard(card, fields)
+	}
+	return s.importAll(ctx, imported, fields, dryRun, progress)
+}
+
+// ImportCSV creates a contact for every valid row. Best-effort imports skip
+// rows with errors. All-or-nothing imports run in one transaction, which
+// rolls back when any row has errors, and report the result as rejected.
+func (s *Service) ImportCSV(ctx context.Context, body []byte, opts CSVImportOptions, progress Progress) (*ImportResult, error) {
+	fields, err := s.repo.FetchCustomFields(ctx)
+	if err != nil {
+		return nil, err
+	}
+	profiles, err := s.repo.FetchImportProfiles(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !opts.AllOrNothing || opts.DryRun {
+		rows, profile, err := readCSVImport(body, opts, profiles, fields)
+		if err != nil {
+			return nil, err
+		}
+		result, err := s.importAll(ctx, rows, fields, opts.DryRun, progress)
+		if err != nil {
+			return nil, err
+		}
+		result.Profile = profile
+		return result, nil
+	}
+
+	var result *ImportResult
+	err = s.repo.WithTx(ctx, func(repo Repository) error {
+		// Importing changes the rows, so a retried transaction reads them again
+		rows, profile, err := readCSVImport(body, opts, profiles, fields)
+		if err != nil {
+			return err
+		}
+		if result, err = s.withRepo(repo).importAll(ctx, rows, fields, false, progress); err != nil {
+			return err
+		}
+		result.Profile = profile
+		if result.Skipped > 0 {
+			return errImportRejected
+		}
+		return nil
+	})
+	if errors.Is(err, errImportRejected) {
+		result.Rejected = true
+		result.Created, result.Updated, result.Skipped = 0, 0, len(result.Records)
+		for i := range result.Records {
+			record := &result.Records[i]
+			if record.Action == ImportCreate {
+				// The contact was rolled back
+				record.Contact.ID = 0
+			}
+			record.Action = ImportSkip
+		}
+		return result, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (s *Service) importAll(ctx context.Context, cards []importedCard, fields []CustomField, dryRun bool, progress Progress) (*ImportResult, error) {
+	author := importNoteAuthor
+	if principal, ok := auth.FromContext(ctx); ok && principal.Subject != "" {
+		author = principal.Subject
+	}
+
+	result := &ImportResult{DryRun: dryRun, Records: make([]ImportRecord, 0, len(cards))}
+	for i := range cards {
+		record, err := s.importCard(ctx, &cards[i], fields, author, dryRun)
+		if err != nil {
+			return nil, err
+		}
+
+		switch record.Action {
+		case ImportCreate:
+			result.Created++
+		case ImportUpdate:
+			result.Updated++
+		default:
+			result.Skipped++
+		}
+		result.Records = append(result.Records, record)
+		if progress != nil {
+			progress(i+1, len(cards))
+		}
+	}
+	return result, nil
 }
 
-func NewService(repo Repository) *Service {
-	return &Service{repo: repo}
+func (s *Service) importCard(ctx context.Context, imported *importedCard, fields []CustomField, author string, dryRun bool) (ImportRecord, error) {
+	contact := &imported.contact
+	record := ImportRecord{Line: imported.line, Action: ImportCreate, Contact: contact}
+
+	if imported.organization != "" {
+		id, err := s.repo.FindOrganizationID(ctx, imported.organization)
+		if err != nil {
+			return record, err
+		}
+		if id != 0 {
+			contact.OrganizationID, contact.Organization = &id, imported.organization
+		}
+	}
+	if imported.uidID != 0 {
+		writable, err := s.repo.ContactWritable(ctx, imported.uidID)
+		if err != nil {
+			return record, err
+		}
+		if writable {
+			contact.ID, record.Action = imported.uidID, ImportUpdate
+		}
+	}
+
+	// Run the same checks as the contact endpoints
+	var validationErrs validator.ValidationErrors
+	if err := validate.Struct(contact); errors.As(err, &validationErrs) {
+		for _, fieldErr := range validationErrs {
+			name, _, _ := strings.Cut(fieldErr.StructField(), "[")
+			line, ok := imported.lines[name]
+			if !ok {
+				line = imported.line
+			}
+			imported.addError(line, httputil.ValidationMessage(fieldErr))
+		}
+	}
+	for _, note := range imported.notes {
+		if err := validate.Struct(Note{Author: author, Text: note.text}); errors.As(err, &validationErrs) {
+			for _, fieldErr := range validationErrs {
+				imported.addError(note.line, httputil.ValidationMessage(fieldErr))
+			}
+		}
+	}
+	err := s.checkCustomFields(ctx, fields, contact)
+	var validationErr *ValidationError
+	if errors.As(err, &validationErr) {
+		line, ok := imported.lines["CustomFields"]
+		if !ok {
+			line = imported.line
+		}
+		for _, problem := range validationErr.Problems {
+			imported.addError(line, problem)
+		}
+	} else if err != nil {
+		return record, err
+	}
+
+	sort.SliceStable(imported.errors, func(i, j int) bool { return imported.errors[i].Line < imported.errors[j].Line })
+	record.Errors = imported.errors
+	if len(record.Errors) > 0 {
+		record.Action = ImportSkip
+		return record, nil
+	}
+	if dryRun {
+		return record, nil
+	}
+
+	if record.Action == ImportUpdate {
+		err := s.repo.UpdateContact(ctx, contact)
+		if errors.Is(err, ErrContactNotFound) {
+			// Deleted since it was checked
+			record.Action = ImportSkip
+			record.Errors = []ImportError{{Line: imported.line, Message: contactNotFoundError}}
+			return record, nil
+		}
+		return record, err
+	}
+
+	if err := s.repo.CreateContact(ctx, contact); err != nil {
+		return record, err
+	}
+	for _, note := range imported.notes {
+		if err := s.repo.CreateNote(ctx, &Note{ContactID: contact.ID, Author: author, Text: note.text}); err != nil {
+			return record, err
+		}
+	}
+	return record, nil
+}
+
+func (s *Service) GetOrganizationContacts(ctx context.Context, organizationID, page, limit int) ([]Contact, error) {
+	offset := (page - 1) * limit
+	return s.repo.FetchOrganizationContacts(ctx, organizationID, limit, offset)
+}
+
+func (s *Service) GetCustomFields(ctx context.Context) ([]CustomField, error) {
+	return s.repo.FetchCustomFields(ctx)
+}
+
+func (s *Service) AddCustomField(ctx context.Context, field *CustomField) error {
+	return s.repo.CreateCustomField(ctx, field)
+}
+
+func (s *Service) EditCustomField(ctx context.Context, field *CustomField) error {
+	return s.repo.UpdateCustomField(ctx, field)
 }
 
-func (s *Service) GetContacts(page, limit int) ([]Contact, error) {
+func (s *Service) DeleteCustomField(ctx context.Context, id int) error {
+	return s.repo.RemoveCustomField(ctx, id)
+}
+
+func (s *Service) GetImportProfiles(ctx context.Context) ([]ImportProfile, error) {
+	return s.repo.FetchImportProfiles(ctx)
+}
+
+func (s *Service) AddImportProfile(ctx context.Context, profile *ImportProfile) error {
+	return s.repo.CreateImportProfile(ctx, profile)
+}
+
+func (s *Service) EditImportProfile(ctx context.Context, profile *ImportProfile) error {
+	return s.repo.UpdateImportProfile(ctx, profile)
+}
+
+func (s *Service) DeleteImportProfile(ctx context.Context, id int) error {
+	return s.repo.RemoveImportProfile(ctx, id)
+}
+
+func (s *Service) GetNotes(ctx context.Context, contactID, page, limit int) ([]Note, error) {
 	offset := (page - 1) * limit
-	return s.repo.FetchContacts(context.Background(), limit, offset)
+	return s.repo.FetchNotes(ctx, contactID, limit, offset)
+}
+
+func (s *Service) AddNote(ctx context.Context, note *Note) error {
+	return s.repo.CreateNote(ctx, note)
+}
+
+func (s *Service) EditNote(ctx context.Context, note *Note) error {
+	return s.repo.UpdateNote(ctx, note)
 }
 
-func (s *Service) SearchContact(query string) ([]Contact, error) {
-	return s.repo.FindContact(context.Background(), query)
+func (s *Service) DeleteNote(ctx context.Context, contactID, id int) error {
+	return s.repo.RemoveNote(ctx, contactID, id)
 }
 
-func (s *Service) AddContact(contact *Contact) error {
-	return s.repo.CreateContact(context.Background(), contact)
+func (s *Service) GetRelations(ctx context.Context, contactID, depth int) ([]Relation, error) {
+	return s.repo.FetchRelations(ctx, contactID, depth)
 }
 
-func (s *Service) EditContact(contact Contact) error {
-	return s.repo.UpdateContact(context.Background(), contact)
+func (s *Service) AddRelation(ctx context.Context, relation *Relation) error {
+	return s.repo.CreateRelation(ctx, relation)
+}
+
+func (s *Service) DeleteRelation(ctx context.Context, contactID, id int) error {
+	return s.repo.RemoveRelation(ctx, contactID, id)
+}
+
+func (s *Service) GetShareLinks(ctx context.Context, contactID int) ([]ShareLink, error) {
+	links, err := s.repo.FetchShareLinks(ctx, contactID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range links {
+		links[i].URL = s.shareLinkURL(links[i])
+	}
+	return links, nil
+}
+
+// AddShareLink creates a link that expires after a week unless the request
+// sets another expiry.
+func (s *Service) AddShareLink(ctx context.Context, link *ShareLink) error {
+	if link.ExpiresAt == nil {
+		expiresAt := time.Now().Add(shareLinkTTL)
+		link.ExpiresAt = &expiresAt
+	}
+	if !link.ExpiresAt.After(time.Now()) {
+		return ErrShareLinkExpiry
+	}
+	// The URL carries the expiry in whole seconds
+	expiresAt := link.ExpiresAt.Truncate(time.Second)
+	link.ExpiresAt = &expiresAt
+
+	if err := s.repo.CreateShareLink(ctx, link); err != nil {
+		return err
+	}
+	link.URL = s.shareLinkURL(*link)
+	return nil
+}
+
+func (s *Service) RevokeShareLink(ctx context.Context, contactID, id int) error {
+	return s.repo.RevokeShareLink(ctx, contactID, id)
+}
+
+// ViewShareLink checks the link's signature before counting the view, so
+// forged URLs never reach the database.
+func (s *Service) ViewShareLink(ctx context.Context, id int, expires int64, signature string) (*Contact, error) {
+	if !hmac.Equal([]byte(signature), []byte(s.signShareLink(id, expires))) {
+		return nil, ErrShareLinkNotFound
+	}
+	if time.Now().Unix() >= expires {
+		return nil, ErrShareLinkGone
+	}
+	contact, err := s.repo.ViewShareLink(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	// Public cards do not tell who shared them
+	contact.Owner = ""
+	return contact, nil
+}
+
+func (s *Service) shareLinkURL(link ShareLink) string {
+	expires := link.ExpiresAt.Unix()
+	return s.publicURL + fmt.Sprintf(shareLinkURL, link.ID, expires, s.signShareLink(link.ID, expires))
+}
+
+func (s *Service) signShareLink(id int, expires int64) string {
+	mac := hmac.New(sha256.New, s.linkSecret)
+	fmt.Fprintf(mac, shareLinkPayload, id, expires)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// ValidateCustomFields checks a contact's custom field values against the
+// defined fields. It returns a *ValidationError when the values are invalid.
+func (s *Service) ValidateCustomFields(ctx context.Context, contact *Contact) error {
+	fields, err := s.repo.FetchCustomFields(ctx)
+	if err != nil {
+		return err
+	}
+	return s.checkCustomFields(ctx, fields, contact)
+}
+
+func (s *Service) checkCustomFields(ctx context.Context, fields []CustomField, contact *Contact) error {
+	var problems []string
+	defined := make(map[string]bool, len(fields))
+	for _, field := range fields {
+		defined[field.Name] = true
+
+		value, ok := contact.CustomFields[field.Name]
+		if !ok || value == nil || value == "" {
+			// Empty values are not stored so they never collide on unique fields
+			delete(contact.CustomFields, field.Name)
+			if field.Required {
+				problems = append(problems, fmt.Sprintf(requiredFieldProblem, field.Name))
+			}
+			continue
+		}
+
+		if problem := checkCustomValue(field, value); problem != "" {
+			problems = append(problems, problem)
+			continue
+		}
+
+		if field.Unique {
+			taken, err := s.repo.CustomValueTaken(ctx, field.Name, value, contact.ID)
+			if err != nil {
+				return err
+			}
+			if taken {
+				problems = append(problems, fmt.Sprintf(fieldTakenProblem, field.Name))
+			}
+		}
+	}
+
+	var undefined []string
+	for name := range contact.CustomFields {
+		if !defined[name] {
+			undefined = append(undefined, fmt.Sprintf(undefinedFieldProblem, name))
+		}
+	}
+	sort.Strings(undefined)
+	problems = append(problems, undefined...)
+
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+func checkCustomValue(field CustomField, value interface{}) string {
+	var text string
+	switch v := value.(type) {
+	case float64:
+		if field.Type != FieldTypeNumber {
+			return fmt.Sprintf(fieldTypeProblem, field.Name, field.Type)
+		}
+		text = strconv.FormatFloat(v, 'f', -1, 64)
+	case string:
+		if field.Type == FieldTypeNumber {
+			return fmt.Sprintf(fieldTypeProblem, field.Name, field.Type)
+		}
+		text = v
+	default:
+		return fmt.Sprintf(fieldTypeProblem, field.Name, field.Type)
+	}
+
+	switch field.Type {
+	case FieldTypeDate:
+		if _, err := time.Parse(dateLayout, text); err != nil {
+			return fmt.Sprintf(fieldTypeProblem, field.Name, "date in YYYY-MM-DD format")
+		}
+	case FieldTypeEnum:
+		if !containsString(field.Options, text) {
+			return fmt.Sprintf(fieldOptionProblem, field.Name, strings.Join(field.Options, " "))
+		}
+	case FieldTypePhone:
+		if !phoneValuePattern.MatchString(text) {
+			return fmt.Sprintf(fieldTypeProblem, field.Name, "phone number")
+		}
+	case FieldTypeEmail:
+		if validate.Var(text, "email") != nil {
+			return fmt.Sprintf(fieldTypeProblem, field.Name, "valid email address")
+		}
+	}
+
+	if field.Pattern != "" {
+		pattern, err := regexp.Compile(field.Pattern)
+		if err != nil || !pattern.MatchString(text) {
+			return fmt.Sprintf(fieldPatternProblem, field.Name)
+		}
+	}
+	return ""
 }
 
-func (s *Service) DeleteContact(id int) error {
-	return s.repo.RemoveContact(context.Background(), id)
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
 }
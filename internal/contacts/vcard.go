@@ -0,0 +1,137 @@
+package contacts
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	VCard3 = "3.0"
+	VCard4 = "4.0"
+
+	vcardTimestampLayout = "20060102T150405Z"
+	vcardDateLayout      = "20060102"
+	vcardUIDDomain       = "phone-book-api"
+	vcardProductID       = "-//phone-book-api//Contacts//EN"
+	// vcardCustomPrefix names the extended properties that carry custom
+	// field values, e.g. X-PHONEBOOK-EMPLOYEE-ID for employee_id.
+	vcardCustomPrefix = "X-PHONEBOOK-"
+)
+
+// telTypes maps words in the names of phone custom fields to TEL types.
+var telTypes = []struct{ word, telType string }{
+	{"mobile", "cell"},
+	{"cell", "cell"},
+	{"fax", "fax"},
+	{"pager", "pager"},
+	{"work", "work"},
+	{"office", "work"},
+	{"home", "home"},
+}
+
+// writeVCard renders a contact as a vCard 4.0 (RFC 6350) or 3.0 (RFC 2426).
+// Text values are escaped and lines folded like iCalendar content lines.
+// Custom fields of the email and phone types in fieldTypes become EMAIL and
+// TEL properties, other custom fields extended properties.
+func writeVCard(w io.Writer, version string, contact Contact, notes []string, fieldTypes map[string]string) error {
+	cw := &icalWriter{w: w}
+	cw.line("BEGIN:VCARD")
+	cw.line("VERSION:" + version)
+	cw.line("PRODID:" + vcardProductID)
+	cw.line(fmt.Sprintf("UID:contact-%d@%s", contact.ID, vcardUIDDomain))
+	cw.line("N:" + icalEscape(contact.LastName) + ";" + icalEscape(contact.FirstName) + ";;;")
+	cw.line("FN:" + icalEscape(strings.TrimSpace(contact.FirstName+" "+contact.LastName)))
+	if contact.PhoneNumber != "" {
+		cw.line("TEL;TYPE=voice:" + icalEscape(contact.PhoneNumber))
+	}
+	if contact.Address != "" {
+		// The address is stored as a single line, which goes in the street part
+		cw.line("ADR;TYPE=home:;;" + icalEscape(contact.Address) + ";;;;")
+	}
+	if contact.Birthday != "" {
+		cw.line("BDAY:" + vcardDate(version, contact.Birthday))
+	}
+	if contact.Anniversary != "" {
+		if version == VCard3 {
+			cw.line("X-ANNIVERSARY:" + vcardDate(version, contact.Anniversary))
+		} else {
+			cw.line("ANNIVERSARY:" + vcardDate(version, contact.Anniversary))
+		}
+	}
+	if contact.Organization != "" || contact.Department != "" {
+		cw.line("ORG:" + icalEscape(contact.Organization) + ";" + icalEscape(contact.Department))
+	}
+	if contact.JobTitle != "" {
+		cw.line("TITLE:" + icalEscape(contact.JobTitle))
+	}
+	if len(contact.Groups) > 0 {
+		categories := make([]string, len(contact.Groups))
+		for i, group := range contact.Groups {
+			categories[i] = icalEscape(group)
+		}
+		cw.line("CATEGORIES:" + strings.Join(categories, ","))
+	}
+
+	// Sort the custom fields so the same contact always renders the same card
+	names := make([]string, 0, len(contact.CustomFields))
+	for name := range contact.CustomFields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := icalEscape(customValueText(contact.CustomFields[name]))
+		switch fieldTypes[name] {
+		case FieldTypeEmail:
+			if version == VCard3 {
+				cw.line("EMAIL;TYPE=internet:" + value)
+			} else {
+				cw.line("EMAIL:" + value)
+			}
+		case FieldTypePhone:
+			cw.line("TEL;TYPE=" + telType(name) + ":" + value)
+		default:
+			cw.line(vcardCustomPrefix + strings.ToUpper(strings.ReplaceAll(name, "_", "-")) + ":" + value)
+		}
+	}
+
+	for _, note := range notes {
+		cw.line("NOTE:" + icalEscape(note))
+	}
+	if !contact.UpdatedAt.IsZero() {
+		cw.line("REV:" + contact.UpdatedAt.UTC().Format(vcardTimestampLayout))
+	}
+	cw.line("END:VCARD")
+	return cw.err
+}
+
+// vcardDate uses the basic ISO 8601 format required by vCard 4.0 and keeps
+// the extended format for vCard 3.0.
+func vcardDate(version, date string) string {
+	parsed, err := time.Parse(dateLayout, date)
+	if version == VCard3 || err != nil {
+		return date
+	}
+	return parsed.Format(vcardDateLayout)
+}
+
+func telType(fieldName string) string {
+	for _, t := range telTypes {
+		if strings.Contains(fieldName, t.word) {
+			return t.telType
+		}
+	}
+	return "voice"
+}
+
+// customValueText formats a decoded JSON value without an exponent or
+// trailing zeros for numbers.
+func customValueText(value interface{}) string {
+	if number, ok := value.(float64); ok {
+		return strconv.FormatFloat(number, 'f', -1, 64)
+	}
+	return fmt.Sprint(value)
+}
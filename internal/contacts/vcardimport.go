@@ -0,0 +1,569 @@
+package contacts
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime/quotedprintable"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	maxVCardLineBytes = 1 << 20
+	vcardUIDFormat    = "contact-%d@" + vcardUIDDomain
+	appleOmitYear     = "X-APPLE-OMIT-YEAR"
+
+	noPropertyValueError  = "line is not a vCard property"
+	quotedPrintableError  = "value is not valid quoted-printable"
+	base64ValueError      = "value is not valid base64"
+	invalidUTF8Error      = "value is not valid UTF-8"
+	unsupportedCharset    = "charset %s is not supported"
+	unsupportedVersion    = "vCard version %q is not supported, must be 2.1, 3.0 or 4.0"
+	missingVersion        = "card has no VERSION"
+	unterminatedCardError = "card has no END:VCARD"
+	invalidDateError      = "%s is not a date"
+)
+
+var errYearlessDate = errors.New("date has no year")
+
+// contentLine is a logical line of a vCard, after unfolding, with the number
+// of the physical line it starts on.
+type contentLine struct {
+	line      int
+	text      string
+	softBreak bool
+}
+
+type vcardProperty struct {
+	line   int
+	name   string
+	params map[string][]string
+	value  string
+}
+
+type vcardCard struct {
+	line    int
+	version string
+	props   []vcardProperty
+	errors  []ImportError
+}
+
+// importedCard is a card mapped onto a contact. lines holds the line each
+// contact field was read from, so validation errors can point at it.
+type importedCard struct {
+	line         int
+	contact      Contact
+	notes        []importedNote
+	organization string
+	uidID        int
+	lines        map[string]int
+	errors       []ImportError
+}
+
+type importedNote struct {
+	line int
+	text string
+}
+
+type vcardTel struct {
+	line   int
+	number string
+	types  []string
+}
+
+// readVCards splits the body into cards. Problems within a card are recorded
+// on it, so a broken card does not stop the others from being imported.
+func readVCards(r io.Reader) ([]vcardCard, error) {
+	lines, err := unfoldVCardLines(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var cards []vcardCard
+	depth := 0
+	for _, l := range lines {
+		prop, err := parseVCardProperty(l)
+		if err != nil {
+			if depth == 1 {
+				card := &cards[len(cards)-1]
+				card.errors = append(card.errors, ImportError{Line: l.line, Message: err.Error()})
+			}
+			continue
+		}
+
+		switch {
+		case prop.name == "BEGIN" && strings.EqualFold(prop.value, "VCARD"):
+			// Cards nested in 2.1 AGENT properties are ignored
+			depth++
+			if depth == 1 {
+				cards = append(cards, vcardCard{line: l.line})
+			}
+		case prop.name == "END" && strings.EqualFold(prop.value, "VCARD"):
+			if depth > 0 {
+				depth--
+			}
+		case depth == 1 && prop.name == "VERSION":
+			cards[len(cards)-1].version = strings.TrimSpace(prop.value)
+		case depth == 1:
+			card := &cards[len(cards)-1]
+			card.props = append(card.props, prop)
+		}
+	}
+	if depth > 0 {
+		card := &cards[len(cards)-1]
+		card.errors = append(card.errors, ImportError{Line: card.line, Message: unterminatedCardError})
+	}
+	return cards, nil
+}
+
+// unfoldVCardLines joins folded lines, which continue with a space or tab,
+// and the soft line breaks of vCard 2.1 quoted-printable values, which end
+// with an equals sign.
+func unfoldVCardLines(r io.Reader) ([]contentLine, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxVCardLineBytes)
+
+	var lines []contentLine
+	number := 0
+	for scanner.Scan() {
+		number++
+		text := strings.TrimSuffix(scanner.Text(), "\r")
+		if number == 1 {
+			text = strings.TrimPrefix(text, "\ufeff")
+		}
+
+		last := len(lines) - 1
+		switch {
+		case last >= 0 && lines[last].softBreak:
+			lines[last].text += text
+		case last >= 0 && text != "" && (text[0] == ' ' || text[0] == '\t'):
+			lines[last].text += text[1:]
+		case strings.TrimSpace(text) == "":
+			continue
+		default:
+			lines = append(lines, contentLine{line: number, text: text})
+		}
+
+		l := &lines[len(lines)-1]
+		l.softBreak = isQuotedPrintable(l.text) && strings.HasSuffix(l.text, "=")
+		if l.softBreak {
+			l.text = strings.TrimSuffix(l.text, "=")
+		}
+	}
+	return lines, scanner.Err()
+}
+
+func isQuotedPrintable(text string) bool {
+	head := text
+	if i := strings.IndexByte(text, ':'); i >= 0 {
+		head = text[:i]
+	}
+	return strings.Contains(strings.ToUpper(head), "QUOTED-PRINTABLE")
+}
+
+// parseVCardProperty splits a line into its name, parameters and value.
+// Groups such as item1 in item1.TEL are dropped. Parameters without a name,
+// as in vCard 2.1 TEL;CELL, are encodings or types.
+func parseVCardProperty(l contentLine) (vcardProperty, error) {
+	colon := indexUnquoted(l.text, ':')
+	if colon < 0 {
+		return vcardProperty{}, errors.New(noPropertyValueError)
+	}
+	parts := splitUnquoted(l.text[:colon], ';')
+	name := parts[0]
+	if dot := strings.LastIndexByte(name, '.'); dot >= 0 {
+		name = name[dot+1:]
+	}
+
+	prop := vcardProperty{line: l.line, name: strings.ToUpper(strings.TrimSpace(name)), params: map[string][]string{}, value: l.text[colon+1:]}
+	for _, param := range parts[1:] {
+		key, values, ok := strings.Cut(param, "=")
+		if !ok {
+			switch strings.ToUpper(param) {
+			case "QUOTED-PRINTABLE", "BASE64", "B", "8BIT", "7BIT":
+				key, values = "ENCODING", param
+			default:
+				key, values = "TYPE", param
+			}
+		}
+		key = strings.ToUpper(strings.TrimSpace(key))
+		for _, value := range splitUnquoted(values, ',') {
+			prop.params[key] = append(prop.params[key], strings.Trim(value, `"`))
+		}
+	}
+	return prop, nil
+}
+
+func indexUnquoted(s string, sep byte) int {
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			quoted = !quoted
+		case sep:
+			if !quoted {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+func splitUnquoted(s string, sep byte) []string {
+	var parts []string
+	for {
+		i := indexUnquoted(s, sep)
+		if i < 0 {
+			return append(parts, s)
+		}
+		parts = append(parts, s[:i])
+		s = s[i+1:]
+	}
+}
+
+// param returns the first value of a parameter.
+func (p vcardProperty) param(key string) string {
+	if values := p.params[key]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// types returns the lower-case TYPE values, which vCard 3.0 allows to repeat
+// and 4.0 to list in quotes.
+func (p vcardProperty) types() []string {
+	var types []string
+	for _, value := range p.params["TYPE"] {
+		for _, t := range strings.Split(value, ",") {
+			types = append(types, strings.ToLower(strings.TrimSpace(t)))
+		}
+	}
+	return types
+}
+
+// decodedValue undoes the value's transfer encoding and converts it to UTF-8.
+func (p vcardProperty) decodedValue() (string, error) {
+	value := p.value
+	switch strings.ToUpper(p.param("ENCODING")) {
+	case "QUOTED-PRINTABLE":
+		decoded, err := io.ReadAll(quotedprintable.NewReader(strings.NewReader(value)))
+		if err != nil {
+			return "", errors.New(quotedPrintableError)
+		}
+		value = string(decoded)
+	case "B", "BASE64":
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return "", errors.New(base64ValueError)
+		}
+		value = string(decoded)
+	}
+
+	switch charset := strings.ToUpper(p.param("CHARSET")); charset {
+	case "", "UTF-8", "US-ASCII":
+	case "ISO-8859-1", "LATIN1":
+		// Latin-1 bytes are the first 256 code points
+		runes := make([]rune, len(value))
+		for i := 0; i < len(value); i++ {
+			runes[i] = rune(value[i])
+		}
+		value = string(runes)
+	default:
+		return "", fmt.Errorf(unsupportedCharset, charset)
+	}
+
+	if !utf8.ValidString(value) {
+		return "", errors.New(invalidUTF8Error)
+	}
+	return value, nil
+}
+
+// vcardUnescape undoes the backslash escapes of text values.
+func vcardUnescape(value string) string {
+	if !strings.Contains(value, `\`) {
+		return value
+	}
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] == '\\' && i+1 < len(value) {
+			i++
+			if value[i] == 'n' || value[i] == 'N' {
+				b.WriteByte('\n')
+				continue
+			}
+		}
+		b.WriteByte(value[i])
+	}
+	return b.String()
+}
+
+// splitEscaped splits structured and list values on separators that are not
+// escaped, and unescapes the parts.
+func splitEscaped(value string, sep byte) []string {
+	var parts []string
+	start := 0
+	for i := 0; i < len(value); i++ {
+		switch value[i] {
+		case '\\':
+			i++
+		case sep:
+			parts = append(parts, vcardUnescape(value[start:i]))
+			start = i + 1
+		}
+	}
+	return append(parts, vcardUnescape(value[start:]))
+}
+
+// mapVCard maps a card onto a contact. TEL and EMAIL properties beyond the
+// phone number fill phone and email custom fields of the matching type, and
+// X-PHONEBOOK- properties the custom fields they are named after, as written
+// by writeVCard.
+func mapVCard(card vcardCard, fields []CustomField) importedCard {
+	imported := importedCard{line: card.line, errors: card.errors, lines: map[string]int{}}
+	switch card.version {
+	case "2.1", VCard3, VCard4:
+	case "":
+		imported.addError(card.line, missingVersion)
+	default:
+		imported.addError(card.line, fmt.Sprintf(unsupportedVersion, card.version))
+	}
+
+	contact := &imported.contact
+	var fullName string
+	var fullNameLine int
+	var tels []vcardTel
+	var emails []vcardProperty
+	for _, prop := range card.props {
+		if !importedProperty(prop.name) {
+			continue
+		}
+		value, err := prop.decodedValue()
+		if err != nil {
+			imported.addError(prop.line, prop.name+": "+err.Error())
+			continue
+		}
+
+		switch prop.name {
+		case "N":
+			parts := splitEscaped(value, ';')
+			contact.LastName = strings.TrimSpace(parts[0])
+			if len(parts) > 1 {
+				contact.FirstName = strings.TrimSpace(parts[1])
+			}
+			imported.lines["LastName"], imported.lines["FirstName"] = prop.line, prop.line
+		case "FN":
+			fullName, fullNameLine = strings.TrimSpace(vcardUnescape(value)), prop.line
+		case "TEL":
+			tels = append(tels, vcardTel{line: prop.line, number: cleanPhoneNumber(vcardUnescape(value)), types: prop.types()})
+		case "EMAIL":
+			prop.value = strings.TrimSpace(vcardUnescape(value))
+			emails = append(emails, prop)
+		case "ADR":
+			var parts []string
+			for _, part := range splitEscaped(value, ';') {
+				if part = strings.TrimSpace(part); part != "" {
+					parts = append(parts, strings.ReplaceAll(part, "\n", ", "))
+				}
+			}
+			contact.Address = strings.Join(parts, ", ")
+			imported.lines["Address"] = prop.line
+		case "BDAY", "ANNIVERSARY", "X-ANNIVERSARY":
+			date, err := parseVCardDate(value, prop.param(appleOmitYear))
+			if errors.Is(err, errYearlessDate) {
+				// Contacts only hold full dates
+				continue
+			}
+			if err != nil {
+				imported.addError(prop.line, prop.name+": "+err.Error())
+				continue
+			}
+			if prop.name == "BDAY" {
+				contact.Birthday = date
+				imported.lines["Birthday"] = prop.line
+			} else {
+				contact.Anniversary = date
+				imported.lines["Anniversary"] = prop.line
+			}
+		case "ORG":
+			parts := splitEscaped(value, ';')
+			imported.organization = strings.TrimSpace(parts[0])
+			if len(parts) > 1 {
+				contact.Department = strings.TrimSpace(parts[1])
+				imported.lines["Department"] = prop.line
+			}
+		case "TITLE":
+			contact.JobTitle = strings.TrimSpace(vcardUnescape(value))
+			imported.lines["JobTitle"] = prop.line
+		case "CATEGORIES":
+			for _, group := range splitEscaped(value, ',') {
+				if group = strings.TrimSpace(group); group != "" && !containsString(contact.Groups, group) {
+					contact.Groups = append(contact.Groups, group)
+				}
+			}
+			imported.lines["Groups"] = prop.line
+		case "NOTE":
+			if note := strings.TrimSpace(vcardUnescape(value)); note != "" {
+				imported.notes = append(imported.notes, importedNote{line: prop.line, text: note})
+			}
+		case "UID":
+			var id int
+			if _, err := fmt.Sscanf(strings.TrimSpace(value), vcardUIDFormat, &id); err == nil {
+				imported.uidID = id
+			}
+		default:
+			name := strings.ToLower(strings.ReplaceAll(strings.TrimPrefix(prop.name, vcardCustomPrefix), "-", "_"))
+			imported.setCustom(name, customValue(fields, name, vcardUnescape(value)), prop.line)
+		}
+	}
+
+	// Cards without a structured name, which vCard 4.0 allows, split the
+	// formatted name at the last space
+	if contact.FirstName == "" && contact.LastName == "" && fullName != "" {
+		contact.FirstName = fullName
+		if i := strings.LastIndexByte(fullName, ' '); i > 0 {
+			contact.FirstName, contact.LastName = fullName[:i], fullName[i+1:]
+		}
+		imported.lines["FirstName"], imported.lines["LastName"] = fullNameLine, fullNameLine
+	}
+
+	imported.mapTels(tels, fields)
+	imported.mapEmails(emails, fields)
+	return imported
+}
+
+func importedProperty(name string) bool {
+	switch name {
+	case "N", "FN", "TEL", "EMAIL", "ADR", "BDAY", "ANNIVERSARY", "X-ANNIVERSARY", "ORG", "TITLE", "CATEGORIES", "NOTE", "UID":
+		return true
+	}
+	return strings.HasPrefix(name, vcardCustomPrefix)
+}
+
+// mapTels makes the preferred or voice number, or else the first, the
+// contact's phone number and puts the others in unset phone custom fields
+// whose names match their type.
+func (c *importedCard) mapTels(tels []vcardTel, fields []CustomField) {
+	main := -1
+	for i, tel := range tels {
+		if containsString(tel.types, "pref") || containsString(tel.types, "voice") || len(tel.types) == 0 {
+			main = i
+			break
+		}
+	}
+	if main < 0 && len(tels) > 0 {
+		main = 0
+	}
+
+	for i, tel := range tels {
+		if i == main {
+			c.contact.PhoneNumber = tel.number
+			c.lines["PhoneNumber"] = tel.line
+			continue
+		}
+		kind := "voice"
+		for _, t := range telTypes {
+			if containsString(tel.types, t.telType) {
+				kind = t.telType
+				break
+			}
+		}
+		for _, field := range fields {
+			if field.Type == FieldTypePhone && telType(field.Name) == kind && c.contact.CustomFields[field.Name] == nil {
+				c.setCustom(field.Name, tel.number, tel.line)
+				break
+			}
+		}
+	}
+}
+
+// mapEmails puts addresses in unset email custom fields, preferring fields
+// whose names contain the address type, such as work_email for TYPE=work.
+func (c *importedCard) mapEmails(emails []vcardProperty, fields []CustomField) {
+	for _, email := range emails {
+		var target string
+		for _, field := range fields {
+			if field.Type != FieldTypeEmail || c.contact.CustomFields[field.Name] != nil {
+				continue
+			}
+			if target == "" {
+				target = field.Name
+			}
+			for _, t := range email.types() {
+				if t != "internet" && t != "pref" && strings.Contains(field.Name, t) {
+					target = field.Name
+				}
+			}
+		}
+		if target != "" {
+			c.setCustom(target, email.value, email.line)
+		}
+	}
+}
+
+func (c *importedCard) setCustom(name string, value interface{}, line int) {
+	if c.contact.CustomFields == nil {
+		c.contact.CustomFields = map[string]interface{}{}
+	}
+	c.contact.CustomFields[name] = value
+	c.lines["CustomFields"] = line
+}
+
+func (c *importedCard) addError(line int, message string) {
+	c.errors = append(c.errors, ImportError{Line: line, Message: message})
+}
+
+// customValue converts the text of number fields so that they validate like
+// JSON numbers.
+func customValue(fields []CustomField, name, text string) interface{} {
+	text = strings.TrimSpace(text)
+	for _, field := range fields {
+		if field.Name == name && field.Type == FieldTypeNumber {
+			if number, err := strconv.ParseFloat(text, 64); err == nil {
+				return number
+			}
+		}
+	}
+	return text
+}
+
+// cleanPhoneNumber drops tel: URIs and the punctuation phones format numbers
+// with.
+func cleanPhoneNumber(number string) string {
+	number = strings.TrimPrefix(strings.TrimSpace(number), "tel:")
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '-', '(', ')', '.', '/', '\u00a0':
+			return -1
+		}
+		return r
+	}, number)
+}
+
+// parseVCardDate accepts the basic and extended ISO 8601 dates of vCard 4.0
+// and 3.0, ignoring any time, and reports dates without a year, including
+// those iOS writes with X-APPLE-OMIT-YEAR.
+func parseVCardDate(value, omitYear string) (string, error) {
+	value = strings.TrimSpace(value)
+	if i := strings.IndexByte(value, 'T'); i >= 0 {
+		value = value[:i]
+	}
+	if strings.HasPrefix(value, "--") {
+		return "", errYearlessDate
+	}
+	for _, layout := range []string{dateLayout, vcardDateLayout} {
+		date, err := time.Parse(layout, value)
+		if err != nil {
+			continue
+		}
+		if omitYear != "" && strconv.Itoa(date.Year()) == omitYear {
+			return "", errYearlessDate
+		}
+		return date.Format(dateLayout), nil
+	}
+	return "", fmt.Errorf(invalidDateError, value)
+}
@@ -11,6 +11,13 @@ import (
 
 var DB *sql.DB
 
+// isolationLevels are the values TX_ISOLATION accepts.
+var isolationLevels = map[string]sql.IsolationLevel{
+	"read-committed":  sql.LevelReadCommitted,
+	"repeatable-read": sql.LevelRepeatableRead,
+	"serializable":    sql.LevelSerializable,
+}
+
 func InitDB() {
 	config.InitConfig()
 	connStr := fmt.Sprintf("postgres://%s:%s@%s:%s/%s?sslmode=disable",
@@ -30,3 +37,13 @@ func InitDB() {
 		log.Fatalf("Error connecting to the database: %v", err)
 	}
 }
+
+// ParseIsolation returns the isolation level with the name, such as
+// serializable.
+func ParseIsolation(name string) (sql.IsolationLevel, error) {
+	level, ok := isolationLevels[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown isolation level %q, must be read-committed, repeatable-read or serializable", name)
+	}
+	return level, nil
+}
@@ -0,0 +1,395 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+const (
+	createSchemaError    = "failed to create schema: %w"
+	qualifySubjectsError = "failed to qualify token subjects: %w"
+)
+
+// schemaStatements are applied in order on startup. Every statement must be
+// idempotent so the schema can be re-applied against an existing database.
+var schemaStatements = []string{
+	`CREATE TABLE IF NOT EXISTS contacts (
+		id SERIAL PRIMARY KEY,
+		first_name VARCHAR(50),
+		last_name VARCHAR(50),
+		phone_number VARCHAR(20),
+		address VARCHAR(100)
+	)`,
+	`ALTER TABLE contacts ADD COLUMN IF NOT EXISTS birthday DATE`,
+	`ALTER TABLE contacts ADD COLUMN IF NOT EXISTS anniversary DATE`,
+	`ALTER TABLE contacts ADD COLUMN IF NOT EXISTS groups TEXT[] NOT NULL DEFAULT '{}'`,
+	`ALTER TABLE contacts ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT now()`,
+	`CREATE TABLE IF NOT EXISTS custom_fields (
+		id SERIAL PRIMARY KEY,
+		name VARCHAR(50) NOT NULL UNIQUE,
+		type VARCHAR(10) NOT NULL,
+		required BOOLEAN NOT NULL DEFAULT false,
+		is_unique BOOLEAN NOT NULL DEFAULT false,
+		pattern TEXT NOT NULL DEFAULT '',
+		options TEXT[] NOT NULL DEFAULT '{}'
+	)`,
+	`ALTER TABLE contacts ADD COLUMN IF NOT EXISTS custom_fields JSONB NOT NULL DEFAULT '{}'`,
+	`CREATE TABLE IF NOT EXISTS contact_notes (
+		id SERIAL PRIMARY KEY,
+		contact_id INTEGER NOT NULL REFERENCES contacts (id) ON DELETE CASCADE,
+		author VARCHAR(100) NOT NULL,
+		body TEXT NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		edited_at TIMESTAMPTZ
+	)`,
+	`CREATE INDEX IF NOT EXISTS contact_notes_contact_id_idx ON contact_notes (contact_id, created_at DESC)`,
+	`CREATE TABLE IF NOT EXISTS organizations (
+		id SERIAL PRIMARY KEY,
+		name VARCHAR(100) NOT NULL,
+		main_phone VARCHAR(20) NOT NULL DEFAULT '',
+		website VARCHAR(200) NOT NULL DEFAULT '',
+		address VARCHAR(100) NOT NULL DEFAULT ''
+	)`,
+	`ALTER TABLE contacts ADD COLUMN IF NOT EXISTS organization_id INTEGER REFERENCES organizations (id) ON DELETE SET NULL`,
+	`ALTER TABLE contacts ADD COLUMN IF NOT EXISTS job_title VARCHAR(100) NOT NULL DEFAULT ''`,
+	`ALTER TABLE contacts ADD COLUMN IF NOT EXISTS department VARCHAR(100) NOT NULL DEFAULT ''`,
+	`CREATE INDEX IF NOT EXISTS contacts_organization_id_idx ON contacts (organization_id)`,
+	`CREATE TABLE IF NOT EXISTS contact_relations (
+		id SERIAL PRIMARY KEY,
+		contact_id INTEGER NOT NULL REFERENCES contacts (id) ON DELETE CASCADE,
+		related_id INTEGER NOT NULL REFERENCES contacts (id) ON DELETE CASCADE,
+		type VARCHAR(30) NOT NULL,
+		UNIQUE (contact_id, related_id, type),
+		CHECK (contact_id <> related_id)
+	)`,
+	// Every table is scoped by tenant. Rows created before tenants existed
+	// belong to the default tenant; new rows must always name their tenant.
+	`ALTER TABLE contacts ADD COLUMN IF NOT EXISTS tenant_id VARCHAR(64) NOT NULL DEFAULT 'default'`,
+	`ALTER TABLE contacts ALTER COLUMN tenant_id DROP DEFAULT`,
+	`CREATE INDEX IF NOT EXISTS contacts_tenant_id_idx ON contacts (tenant_id, id)`,
+	`ALTER TABLE custom_fields ADD COLUMN IF NOT EXISTS tenant_id VARCHAR(64) NOT NULL DEFAULT 'default'`,
+	`ALTER TABLE custom_fields ALTER COLUMN tenant_id DROP DEFAULT`,
+	`ALTER TABLE custom_fields DROP CONSTRAINT IF EXISTS custom_fields_name_key`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS custom_fields_tenant_name_idx ON custom_fields (tenant_id, name)`,
+	`ALTER TABLE contact_notes ADD COLUMN IF NOT EXISTS tenant_id VARCHAR(64) NOT NULL DEFAULT 'default'`,
+	`ALTER TABLE contact_notes ALTER COLUMN tenant_id DROP DEFAULT`,
+	`ALTER TABLE contact_relations ADD COLUMN IF NOT EXISTS tenant_id VARCHAR(64) NOT NULL DEFAULT 'default'`,
+	`ALTER TABLE contact_relations ALTER COLUMN tenant_id DROP DEFAULT`,
+	`ALTER TABLE organizations ADD COLUMN IF NOT EXISTS tenant_id VARCHAR(64) NOT NULL DEFAULT 'default'`,
+	`ALTER TABLE organizations ALTER COLUMN tenant_id DROP DEFAULT`,
+	`CREATE INDEX IF NOT EXISTS organizations_tenant_id_idx ON organizations (tenant_id, name)`,
+	`CREATE TABLE IF NOT EXISTS api_keys (
+		id SERIAL PRIMARY KEY,
+		tenant_id VARCHAR(64) NOT NULL,
+		name VARCHAR(100) NOT NULL,
+		prefix VARCHAR(32) NOT NULL UNIQUE,
+		scopes TEXT[] NOT NULL,
+		salt BYTEA NOT NULL,
+		hash BYTEA NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		last_used_at TIMESTAMPTZ,
+		revoked_at TIMESTAMPTZ
+	)`,
+	`CREATE INDEX IF NOT EXISTS api_keys_tenant_id_idx ON api_keys (tenant_id, id)`,
+	`CREATE TABLE IF NOT EXISTS user_roles (
+		tenant_id VARCHAR(64) NOT NULL,
+		user_id VARCHAR(100) NOT NULL,
+		role VARCHAR(20) NOT NULL,
+		PRIMARY KEY (tenant_id, user_id, role)
+	)`,
+	`CREATE TABLE IF NOT EXISTS users (
+		id SERIAL PRIMARY KEY,
+		tenant_id VARCHAR(64) NOT NULL,
+		username VARCHAR(50) NOT NULL,
+		password_hash BYTEA NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		UNIQUE (tenant_id, username)
+	)`,
+	`CREATE TABLE IF NOT EXISTS sessions (
+		token_hash BYTEA PRIMARY KEY,
+		tenant_id VARCHAR(64) NOT NULL,
+		user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+		csrf_token VARCHAR(64) NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		expires_at TIMESTAMPTZ NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS sessions_expires_at_idx ON sessions (expires_at)`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_secret BYTEA`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_enabled BOOLEAN NOT NULL DEFAULT false`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_last_step BIGINT NOT NULL DEFAULT 0`,
+	`ALTER TABLE sessions ADD COLUMN IF NOT EXISTS mfa BOOLEAN NOT NULL DEFAULT false`,
+	`CREATE TABLE IF NOT EXISTS recovery_codes (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+		code_hash BYTEA NOT NULL,
+		used_at TIMESTAMPTZ,
+		UNIQUE (user_id, code_hash)
+	)`,
+	`CREATE TABLE IF NOT EXISTS mfa_roles (
+		tenant_id VARCHAR(64) NOT NULL,
+		role VARCHAR(20) NOT NULL,
+		PRIMARY KEY (tenant_id, role)
+	)`,
+	// Contacts added by a user belong to that user's phone book. Contacts
+	// without an owner belong to the whole tenant.
+	`ALTER TABLE contacts ADD COLUMN IF NOT EXISTS owner_id VARCHAR(100) NOT NULL DEFAULT ''`,
+	`CREATE INDEX IF NOT EXISTS contacts_owner_id_idx ON contacts (tenant_id, owner_id)`,
+	`CREATE TABLE IF NOT EXISTS shares (
+		id SERIAL PRIMARY KEY,
+		tenant_id VARCHAR(64) NOT NULL,
+		owner_id VARCHAR(100) NOT NULL,
+		group_name VARCHAR(50) NOT NULL DEFAULT '',
+		user_id VARCHAR(100) NOT NULL DEFAULT '',
+		team VARCHAR(100) NOT NULL DEFAULT '',
+		permission VARCHAR(5) NOT NULL,
+		expires_at TIMESTAMPTZ,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		UNIQUE (tenant_id, owner_id, group_name, user_id, team),
+		CHECK ((user_id = '') <> (team = ''))
+	)`,
+	`CREATE INDEX IF NOT EXISTS shares_user_id_idx ON shares (tenant_id, user_id)`,
+	`CREATE TABLE IF NOT EXISTS share_links (
+		id SERIAL PRIMARY KEY,
+		tenant_id VARCHAR(64) NOT NULL,
+		contact_id INTEGER NOT NULL REFERENCES contacts (id) ON DELETE CASCADE,
+		expires_at TIMESTAMPTZ NOT NULL,
+		max_views INTEGER,
+		views INTEGER NOT NULL DEFAULT 0,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		revoked_at TIMESTAMPTZ
+	)`,
+	`CREATE INDEX IF NOT EXISTS share_links_contact_id_idx ON share_links (tenant_id, contact_id)`,
+	`CREATE TABLE IF NOT EXISTS import_profiles (
+		id SERIAL PRIMARY KEY,
+		tenant_id VARCHAR(64) NOT NULL,
+		name VARCHAR(50) NOT NULL,
+		columns JSONB NOT NULL,
+		UNIQUE (tenant_id, name)
+	)`,
+	// Jobs keep who submitted them, so workers run them as that caller, and
+	// the body of an import until it finishes.
+	`CREATE TABLE IF NOT EXISTS jobs (
+		id SERIAL PRIMARY KEY,
+		tenant_id VARCHAR(64) NOT NULL,
+		owner_id VARCHAR(100) NOT NULL DEFAULT '',
+		teams TEXT[] NOT NULL DEFAULT '{}',
+		type VARCHAR(10) NOT NULL,
+		format VARCHAR(10) NOT NULL,
+		options JSONB NOT NULL,
+		input BYTEA,
+		status VARCHAR(10) NOT NULL DEFAULT 'queued',
+		attempts INTEGER NOT NULL DEFAULT 0,
+		processed INTEGER NOT NULL DEFAULT 0,
+		total INTEGER NOT NULL DEFAULT 0,
+		import_result JSONB,
+		error TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		started_at TIMESTAMPTZ,
+		heartbeat_at TIMESTAMPTZ,
+		finished_at TIMESTAMPTZ
+	)`,
+	`CREATE INDEX IF NOT EXISTS jobs_tenant_id_idx ON jobs (tenant_id, id)`,
+	`CREATE INDEX IF NOT EXISTS jobs_status_idx ON jobs (status, id)`,
+	`CREATE TABLE IF NOT EXISTS job_results (
+		job_id INTEGER NOT NULL REFERENCES jobs (id) ON DELETE CASCADE,
+		seq INTEGER NOT NULL,
+		data BYTEA NOT NULL,
+		PRIMARY KEY (job_id, seq)
+	)`,
+	// Idempotency keys belong to the caller that sent them. Status is 0 while
+	// the first request with the key runs.
+	`CREATE TABLE IF NOT EXISTS idempotency_keys (
+		tenant_id VARCHAR(64) NOT NULL,
+		subject VARCHAR(200) NOT NULL,
+		key VARCHAR(255) NOT NULL,
+		fingerprint CHAR(64) NOT NULL,
+		status INTEGER NOT NULL DEFAULT 0,
+		header JSONB,
+		body BYTEA,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		expires_at TIMESTAMPTZ NOT NULL,
+		PRIMARY KEY (tenant_id, subject, key)
+	)`,
+	`CREATE INDEX IF NOT EXISTS idempotency_keys_expires_at_idx ON idempotency_keys (expires_at)`,
+	// Merges keep the merged contacts and the rows moved to the survivor as
+	// they were, so that a merge can be undone.
+	`CREATE TABLE IF NOT EXISTS contact_merges (
+		id SERIAL PRIMARY KEY,
+		tenant_id VARCHAR(64) NOT NULL,
+		survivor_id INTEGER NOT NULL REFERENCES contacts (id) ON DELETE CASCADE,
+		merged_ids INTEGER[] NOT NULL,
+		merged_by VARCHAR(200) NOT NULL DEFAULT '',
+		snapshot JSONB NOT NULL,
+		survivor_updated_at TIMESTAMPTZ NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		undone_at TIMESTAMPTZ
+	)`,
+	`CREATE INDEX IF NOT EXISTS contact_merges_tenant_id_idx ON contact_merges (tenant_id, id)`,
+	// Contacts are keyed by their normalized phone number. One contact per
+	// number and tenant claims it; the others are marked duplicates.
+	`ALTER TABLE contacts ADD COLUMN IF NOT EXISTS phone_key TEXT`,
+	`ALTER TABLE contacts ADD COLUMN IF NOT EXISTS duplicate BOOLEAN NOT NULL DEFAULT false`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS contacts_phone_key_idx ON contacts (tenant_id, phone_key) WHERE NOT duplicate`,
+	`CREATE INDEX IF NOT EXISTS contacts_phone_key_lookup_idx ON contacts (tenant_id, phone_key)`,
+	`CREATE TABLE IF NOT EXISTS webhooks (
+		id SERIAL PRIMARY KEY,
+		tenant_id VARCHAR(64) NOT NULL,
+		url TEXT NOT NULL,
+		events TEXT[] NOT NULL,
+		secret VARCHAR(200) NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE INDEX IF NOT EXISTS webhooks_tenant_id_idx ON webhooks (tenant_id, id)`,
+	// Deliveries are queued per webhook and event. Pending deliveries are
+	// tried at next_attempt_at; the others are delivered or dead.
+	`CREATE TABLE IF NOT EXISTS webhook_deliveries (
+		id SERIAL PRIMARY KEY,
+		tenant_id VARCHAR(64) NOT NULL,
+		webhook_id INTEGER NOT NULL REFERENCES webhooks (id) ON DELETE CASCADE,
+		event VARCHAR(50) NOT NULL,
+		payload BYTEA NOT NULL,
+		status VARCHAR(10) NOT NULL DEFAULT 'pending',
+		attempts INTEGER NOT NULL DEFAULT 0,
+		next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		last_status INTEGER NOT NULL DEFAULT 0,
+		last_error TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		delivered_at TIMESTAMPTZ
+	)`,
+	`CREATE INDEX IF NOT EXISTS webhook_deliveries_webhook_id_idx ON webhook_deliveries (tenant_id, webhook_id, id)`,
+	`CREATE INDEX IF NOT EXISTS webhook_deliveries_due_idx ON webhook_deliveries (next_attempt_at, id) WHERE status = 'pending'`,
+	`CREATE TABLE IF NOT EXISTS webhook_attempts (
+		id SERIAL PRIMARY KEY,
+		delivery_id INTEGER NOT NULL REFERENCES webhook_deliveries (id) ON DELETE CASCADE,
+		status_code INTEGER NOT NULL DEFAULT 0,
+		error TEXT NOT NULL DEFAULT '',
+		duration_ms INTEGER NOT NULL DEFAULT 0,
+		attempted_at TIMESTAMPTZ NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS webhook_attempts_delivery_id_idx ON webhook_attempts (delivery_id, id)`,
+	// The outbox holds contact events, written in the transaction of their
+	// change, until every sink has been sent them. Each sink keeps the
+	// sequence number of the last event it was sent.
+	`CREATE TABLE IF NOT EXISTS outbox (
+		seq BIGSERIAL PRIMARY KEY,
+		tenant_id VARCHAR(64) NOT NULL,
+		type VARCHAR(50) NOT NULL,
+		contact_id INTEGER NOT NULL,
+		contact JSONB,
+		merged_ids INTEGER[],
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE INDEX IF NOT EXISTS outbox_tenant_id_idx ON outbox (tenant_id, seq)`,
+	`CREATE TABLE IF NOT EXISTS outbox_cursors (
+		sink VARCHAR(50) PRIMARY KEY,
+		seq BIGINT NOT NULL
+	)`,
+	// Events are read up to settled, below which none can still commit.
+	// pending becomes settled once every transaction older than
+	// pending_xid, which were all the transactions that could have taken
+	// a number up to pending, has ended.
+	`CREATE TABLE IF NOT EXISTS outbox_horizon (
+		id BOOLEAN PRIMARY KEY DEFAULT true CHECK (id),
+		settled BIGINT NOT NULL,
+		pending BIGINT NOT NULL,
+		pending_xid XID8 NOT NULL
+	)`,
+	`INSERT INTO outbox_horizon (settled, pending, pending_xid) SELECT latest, latest, '0' FROM (SELECT COALESCE(max(seq), 0) AS latest FROM outbox) outbox ON CONFLICT DO NOTHING`,
+	// A tenant's birthday calendar last changed when one of its contacts was
+	// last updated, or at changed_at, when one was last deleted
+	`CREATE TABLE IF NOT EXISTS calendar_changes (
+		tenant_id VARCHAR(64) PRIMARY KEY,
+		changed_at TIMESTAMPTZ NOT NULL
+	)`,
+	// Subjects are namespaced by where the caller authenticated, as user:<id>
+	// for local users and jwt:<iss>|<sub> for tokens. Roles, phone books and
+	// shares stored for the bare ID of a local user move to its subject.
+	`ALTER TABLE user_roles ALTER COLUMN user_id TYPE VARCHAR(255)`,
+	`ALTER TABLE contacts ALTER COLUMN owner_id TYPE VARCHAR(255)`,
+	`ALTER TABLE shares ALTER COLUMN owner_id TYPE VARCHAR(255), ALTER COLUMN user_id TYPE VARCHAR(255)`,
+	`ALTER TABLE jobs ALTER COLUMN owner_id TYPE VARCHAR(255)`,
+	`ALTER TABLE idempotency_keys ALTER COLUMN subject TYPE VARCHAR(255)`,
+	`ALTER TABLE contact_merges ALTER COLUMN merged_by TYPE VARCHAR(255)`,
+	`ALTER TABLE contact_notes ALTER COLUMN author TYPE VARCHAR(255)`,
+	`UPDATE user_roles SET user_id = 'user:' || user_id WHERE user_id IN (SELECT id::text FROM users WHERE users.tenant_id = user_roles.tenant_id)`,
+	`UPDATE contacts SET owner_id = 'user:' || owner_id WHERE owner_id IN (SELECT id::text FROM users WHERE users.tenant_id = contacts.tenant_id)`,
+	`UPDATE shares SET owner_id = 'user:' || owner_id WHERE owner_id IN (SELECT id::text FROM users WHERE users.tenant_id = shares.tenant_id)`,
+	`UPDATE shares SET user_id = 'user:' || user_id WHERE user_id IN (SELECT id::text FROM users WHERE users.tenant_id = shares.tenant_id)`,
+	`UPDATE jobs SET owner_id = 'user:' || owner_id WHERE owner_id IN (SELECT id::text FROM users WHERE users.tenant_id = jobs.tenant_id)`,
+	// Deleting a contact moves it and its notes to the trash, from which it
+	// is restored or purged. Notes are searched by word, so only those out
+	// of the trash are indexed.
+	`ALTER TABLE contacts ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ`,
+	`ALTER TABLE contact_notes ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ`,
+	`CREATE INDEX IF NOT EXISTS contacts_trash_idx ON contacts (tenant_id, deleted_at DESC) WHERE deleted_at IS NOT NULL`,
+	`CREATE INDEX IF NOT EXISTS contact_notes_body_search_idx ON contact_notes USING GIN (to_tsvector('simple', body)) WHERE deleted_at IS NULL`,
+	// The values of unique custom fields are copied to custom_field_values,
+	// whose unique constraint keeps two contacts from sharing one. It
+	// replaces the partial index per field that unique fields had before.
+	`CREATE TABLE IF NOT EXISTS custom_field_values (
+		tenant_id VARCHAR(64) NOT NULL,
+		field_id INTEGER NOT NULL REFERENCES custom_fields (id) ON DELETE CASCADE,
+		contact_id INTEGER NOT NULL REFERENCES contacts (id) ON DELETE CASCADE,
+		value JSONB NOT NULL,
+		PRIMARY KEY (contact_id, field_id),
+		UNIQUE (tenant_id, field_id, value)
+	)`,
+	`CREATE INDEX IF NOT EXISTS custom_field_values_field_id_idx ON custom_field_values (field_id)`,
+	`DO $$
+	DECLARE
+		index_name TEXT;
+	BEGIN
+		FOR index_name IN SELECT indexname FROM pg_indexes WHERE tablename = 'contacts' AND indexname LIKE 'contacts\_custom\_field\_%\_key' LOOP
+			EXECUTE format('DROP INDEX IF EXISTS %I', index_name);
+		END LOOP;
+	END $$`,
+}
+
+// qualifyStatements move the bare token subjects left after the schema is
+// applied to the subjects of the issuer in $1.
+var qualifyStatements = []string{
+	`UPDATE user_roles SET user_id = 'jwt:' || $1 || '|' || user_id WHERE user_id NOT LIKE 'user:%' AND user_id NOT LIKE 'jwt:%'`,
+	`UPDATE contacts SET owner_id = 'jwt:' || $1 || '|' || owner_id WHERE owner_id <> '' AND owner_id NOT LIKE 'user:%' AND owner_id NOT LIKE 'jwt:%'`,
+	`UPDATE shares SET owner_id = 'jwt:' || $1 || '|' || owner_id WHERE owner_id <> '' AND owner_id NOT LIKE 'user:%' AND owner_id NOT LIKE 'jwt:%'`,
+	`UPDATE shares SET user_id = 'jwt:' || $1 || '|' || user_id WHERE user_id <> '' AND user_id NOT LIKE 'user:%' AND user_id NOT LIKE 'jwt:%'`,
+	`UPDATE jobs SET owner_id = 'jwt:' || $1 || '|' || owner_id WHERE owner_id <> '' AND owner_id NOT LIKE 'user:%' AND owner_id NOT LIKE 'jwt:%'`,
+}
+
+func CreateSchema(ctx context.Context, db *sql.DB) error {
+	for _, stmt := range schemaStatements {
+		if _, err := db.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf(createSchemaError, err)
+		}
+	}
+	return nil
+}
+
+// QualifyTokenSubjects moves the roles, phone books and shares stored for
+// token subjects from before subjects were namespaced to the subjects of
+// the issuer, and returns how many rows it moved. It is only right when
+// every such token came from that one issuer.
+func QualifyTokenSubjects(ctx context.Context, db *sql.DB, issuer string) (int64, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf(qualifySubjectsError, err)
+	}
+	defer tx.Rollback()
+
+	var moved int64
+	for _, stmt := range qualifyStatements {
+		result, err := tx.ExecContext(ctx, stmt, issuer)
+		if err != nil {
+			return 0, fmt.Errorf(qualifySubjectsError, err)
+		}
+		rows, err := result.RowsAffected()
+		if err != nil {
+			return 0, fmt.Errorf(qualifySubjectsError, err)
+		}
+		moved += rows
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf(qualifySubjectsError, err)
+	}
+	return moved, nil
+}
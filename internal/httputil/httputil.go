@@ -0,0 +1,94 @@
+package httputil
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+)
+
+const (
+	pageParam    = "page"
+	limitParam   = "limit"
+	defaultLimit = 10
+)
+
+// ParsePagination reads the page and limit query parameters, falling back to
+// the first page of 10 items when they are missing or invalid.
+func ParsePagination(r *http.Request) (page, limit int) {
+	page, err := strconv.Atoi(r.URL.Query().Get(pageParam))
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	limit, err = strconv.Atoi(r.URL.Query().Get(limitParam))
+	if err != nil || limit < 1 {
+		limit = defaultLimit
+	}
+
+	return page, limit
+}
+
+func FormatValidationError(err error) string {
+	var errors []string
+	for _, err := range err.(validator.ValidationErrors) {
+		errors = append(errors, ValidationMessage(err))
+	}
+	return "Validation error: " + strings.Join(errors, ", ")
+}
+
+// ValidationMessage describes a single failed validation rule.
+func ValidationMessage(err validator.FieldError) string {
+	switch err.Tag() {
+	case "required", "required_if", "required_without":
+		return err.Field() + " is required"
+	case "min":
+		return err.Field() + " must be at least " + err.Param() + " characters"
+	case "max":
+		return err.Field() + " must be at most " + err.Param() + " characters"
+	case "oneof":
+		return err.Field() + " must be one of " + err.Param()
+	case "nefield":
+		return err.Field() + " must differ from " + err.Param()
+	default:
+		return err.Field() + " is invalid"
+	}
+}
+
+const (
+	problemContentType = "application/problem+json"
+	problemTypeBlank   = "about:blank"
+)
+
+// Problem is an RFC 7807 problem details response.
+type Problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// NewProblem returns the problem details of a response with the status.
+func NewProblem(status int, detail string) Problem {
+	return Problem{
+		Type:   problemTypeBlank,
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+	}
+}
+
+func WriteProblem(w http.ResponseWriter, status int, detail string) {
+	WriteProblemBody(w, status, NewProblem(status, detail))
+}
+
+// WriteProblemBody writes a problem response whose body may be a struct
+// embedding Problem, to add extension members.
+func WriteProblemBody(w http.ResponseWriter, status int, problem interface{}) {
+	w.Header().Set("Content-Type", problemContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(problem)
+}
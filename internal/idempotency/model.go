@@ -0,0 +1,18 @@
+package idempotency
+
+import "net/http"
+
+// Response is a response stored for an idempotency key, replayed to
+// requests that retry with the key.
+type Response struct {
+	Status int
+	Header http.Header
+	Body   []byte
+}
+
+// Reservation is an idempotency key a request holds while it runs.
+type Reservation struct {
+	TenantID string
+	Subject  string
+	Key      string
+}
@@ -0,0 +1,115 @@
+package idempotency
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	// reserveKeyQuery takes a new key, or one whose response has expired or
+	// whose request stopped without finishing. Status 0 marks a request in
+	// flight.
+	reserveKeyQuery = `INSERT INTO idempotency_keys (tenant_id, subject, key, fingerprint, expires_at)
+	VALUES ($1, $2, $3, $4, now() + make_interval(secs => $5))
+	ON CONFLICT (tenant_id, subject, key) DO UPDATE
+	SET fingerprint = EXCLUDED.fingerprint, status = 0, header = NULL, body = NULL, created_at = now(), expires_at = EXCLUDED.expires_at
+	WHERE idempotency_keys.expires_at < now() OR (idempotency_keys.status = 0 AND idempotency_keys.created_at < now() - make_interval(secs => $6))
+	RETURNING key`
+
+	selectKeyQuery   = "SELECT fingerprint, status, header, body FROM idempotency_keys WHERE tenant_id = $1 AND subject = $2 AND key = $3"
+	completeKeyQuery = "UPDATE idempotency_keys SET status = $4, header = $5, body = $6 WHERE tenant_id = $1 AND subject = $2 AND key = $3 AND status = 0"
+	releaseKeyQuery  = "DELETE FROM idempotency_keys WHERE tenant_id = $1 AND subject = $2 AND key = $3 AND status = 0"
+	purgeKeysQuery   = "DELETE FROM idempotency_keys WHERE expires_at < now()"
+
+	reserveKeyError  = "failed to reserve idempotency key: %w"
+	completeKeyError = "failed to store idempotent response: %w"
+	releaseKeyError  = "failed to release idempotency key: %w"
+	purgeKeysError   = "failed to purge idempotency keys: %w"
+)
+
+type Repository interface {
+	// ReserveKey returns true when the request now holds the key. Otherwise
+	// it returns the fingerprint of the request that holds it and that
+	// request's response, which is nil while it is in flight.
+	ReserveKey(ctx context.Context, reservation Reservation, fingerprint string, ttl, lockTimeout time.Duration) (bool, string, *Response, error)
+	CompleteKey(ctx context.Context, reservation Reservation, response *Response) error
+	ReleaseKey(ctx context.Context, reservation Reservation) error
+	PurgeKeys(ctx context.Context) (int64, error)
+}
+
+type keyRepository struct {
+	db *sql.DB
+}
+
+func NewRepository(db *sql.DB) Repository {
+	return &keyRepository{db: db}
+}
+
+func (r *keyRepository) ReserveKey(ctx context.Context, reservation Reservation, fingerprint string, ttl, lockTimeout time.Duration) (bool, string, *Response, error) {
+	var key string
+	err := r.db.QueryRowContext(ctx, reserveKeyQuery, reservation.TenantID, reservation.Subject, reservation.Key, fingerprint,
+		ttl.Seconds(), lockTimeout.Seconds()).Scan(&key)
+	if err == nil {
+		return true, "", nil, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return false, "", nil, fmt.Errorf(reserveKeyError, err)
+	}
+
+	var stored string
+	var status int
+	var header, body []byte
+	err = r.db.QueryRowContext(ctx, selectKeyQuery, reservation.TenantID, reservation.Subject, reservation.Key).Scan(&stored, &status, &header, &body)
+	if errors.Is(err, sql.ErrNoRows) {
+		// Released since the insert conflicted, so still as good as in flight
+		return false, fingerprint, nil, nil
+	}
+	if err != nil {
+		return false, "", nil, fmt.Errorf(reserveKeyError, err)
+	}
+	if status == 0 {
+		return false, stored, nil, nil
+	}
+
+	response := &Response{Status: status, Body: body}
+	if err := json.Unmarshal(header, &response.Header); err != nil {
+		return false, "", nil, fmt.Errorf(reserveKeyError, err)
+	}
+	return false, stored, response, nil
+}
+
+func (r *keyRepository) CompleteKey(ctx context.Context, reservation Reservation, response *Response) error {
+	header, err := json.Marshal(response.Header)
+	if err != nil {
+		return fmt.Errorf(completeKeyError, err)
+	}
+	_, err = r.db.ExecContext(ctx, completeKeyQuery, reservation.TenantID, reservation.Subject, reservation.Key,
+		response.Status, header, response.Body)
+	if err != nil {
+		return fmt.Errorf(completeKeyError, err)
+	}
+	return nil
+}
+
+func (r *keyRepository) ReleaseKey(ctx context.Context, reservation Reservation) error {
+	if _, err := r.db.ExecContext(ctx, releaseKeyQuery, reservation.TenantID, reservation.Subject, reservation.Key); err != nil {
+		return fmt.Errorf(releaseKeyError, err)
+	}
+	return nil
+}
+
+func (r *keyRepository) PurgeKeys(ctx context.Context) (int64, error) {
+	result, err := r.db.ExecContext(ctx, purgeKeysQuery)
+	if err != nil {
+		return 0, fmt.Errorf(purgeKeysError, err)
+	}
+	purged, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf(purgeKeysError, err)
+	}
+	return purged, nil
+}
@@ -0,0 +1,98 @@
+package idempotency
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/benhuri/phone-book-api/internal/auth"
+)
+
+const (
+	// lockTimeout is how long a request may hold a key before a retry can
+	// take it over, in case the request's instance stopped.
+	lockTimeout   = 5 * time.Minute
+	purgeInterval = time.Hour
+
+	keyInFlightError = "a request with this idempotency key is still in progress"
+	keyReusedError   = "this idempotency key was used for a different request"
+)
+
+var (
+	ErrKeyInFlight = errors.New(keyInFlightError)
+	ErrKeyReused   = errors.New(keyReusedError)
+)
+
+type Service struct {
+	repo Repository
+	ttl  time.Duration
+}
+
+// NewService keeps the responses of idempotent requests for ttl.
+func NewService(repo Repository, ttl time.Duration) *Service {
+	return &Service{repo: repo, ttl: ttl}
+}
+
+// Fingerprint identifies a request, so a key cannot be reused for another.
+func Fingerprint(method, uri string, body []byte) string {
+	hash := sha256.New()
+	hash.Write([]byte(method + " " + uri + "\n"))
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Begin reserves the caller's key for a request. When the key was used
+// before by the same request it returns the response to replay instead.
+// Keys are the caller's own, so callers cannot replay each other's
+// responses.
+func (s *Service) Begin(ctx context.Context, key, fingerprint string) (*Reservation, *Response, error) {
+	tenantID, err := auth.TenantID(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	principal, _ := auth.FromContext(ctx)
+	reservation := &Reservation{TenantID: tenantID, Subject: principal.Subject, Key: key}
+
+	reserved, stored, response, err := s.repo.ReserveKey(ctx, *reservation, fingerprint, s.ttl, lockTimeout)
+	switch {
+	case err != nil:
+		return nil, nil, err
+	case reserved:
+		return reservation, nil, nil
+	case stored != fingerprint:
+		return nil, nil, ErrKeyReused
+	case response == nil:
+		return nil, nil, ErrKeyInFlight
+	}
+	return nil, response, nil
+}
+
+// Finish stores the response to the request holding the reservation.
+func (s *Service) Finish(ctx context.Context, reservation *Reservation, response *Response) error {
+	return s.repo.CompleteKey(ctx, *reservation, response)
+}
+
+// Abandon releases a reservation without a response, so the request can be
+// retried with the key.
+func (s *Service) Abandon(ctx context.Context, reservation *Reservation) error {
+	return s.repo.ReleaseKey(ctx, *reservation)
+}
+
+// Run deletes expired keys every purgeInterval until ctx is done.
+func (s *Service) Run(ctx context.Context) {
+	ticker := time.NewTicker(purgeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := s.repo.PurgeKeys(ctx); err != nil {
+				log.Printf("Error purging idempotency keys: %v", err)
+			}
+		}
+	}
+}
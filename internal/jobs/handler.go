@@ -0,0 +1,196 @@
+package jobs
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/benhuri/phone-book-api/internal/contacts"
+	"github.com/benhuri/phone-book-api/internal/httputil"
+	"github.com/gorilla/mux"
+)
+
+const (
+	contentType         = "Content-Type"
+	contentDisposition  = "Content-Disposition"
+	location            = "Location"
+	applicationJSON     = "application/json"
+	idParam             = "id"
+	jobPath             = "/jobs/"
+	invalidJobID        = "Invalid job ID"
+	jobNotFound         = "Job not found"
+	jobFinished         = "Job has already finished"
+	noResult            = "Job has no result, it must be a finished export"
+	unsupportedType     = "Unsupported media type, must be text/vcard or text/csv"
+	importTooLarge      = "Request body too large"
+	invalidExportField  = "Invalid fields, must be contact fields or defined custom fields"
+	internalServerError = "Internal Server Error"
+
+	// maxImportBytes is larger than for imports made in the request, which
+	// hold the connection while they run.
+	maxImportBytes = 100 << 20
+)
+
+// resultTypes are the content type and file name of each export format.
+var resultTypes = map[string][2]string{
+	contacts.FormatCSV:    {"text/csv; charset=utf-8", `attachment; filename="contacts.csv"`},
+	contacts.FormatNDJSON: {"application/x-ndjson", `attachment; filename="contacts.ndjson"`},
+	contacts.FormatVCard:  {"text/vcard; charset=utf-8", `attachment; filename="contacts.vcf"`},
+}
+
+type Handler struct {
+	Service *Service
+}
+
+func NewHandler(service *Service) *Handler {
+	return &Handler{Service: service}
+}
+
+func (h *Handler) GetJobsHandler(w http.ResponseWriter, r *http.Request) {
+	page, limit := httputil.ParsePagination(r)
+	jobs, err := h.Service.GetJobs(r.Context(), page, limit)
+	if err != nil {
+		log.Printf("Error getting jobs: %v", err)
+		http.Error(w, internalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(contentType, applicationJSON)
+	json.NewEncoder(w).Encode(jobs)
+}
+
+func (h *Handler) GetJobHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := jobID(w, r)
+	if !ok {
+		return
+	}
+
+	job, err := h.Service.GetJob(r.Context(), id)
+	if writeJobError(w, err, "Error getting job") {
+		return
+	}
+
+	w.Header().Set(contentType, applicationJSON)
+	json.NewEncoder(w).Encode(job)
+}
+
+// SubmitImportHandler queues an import of a vCard or CSV body, which takes
+// the same options as importing in the request.
+func (h *Handler) SubmitImportHandler(w http.ResponseWriter, r *http.Request) {
+	format := contacts.ImportFormat(r.Header.Get(contentType))
+	if format == "" {
+		http.Error(w, unsupportedType, http.StatusUnsupportedMediaType)
+		return
+	}
+	opts, err := contacts.ParseCSVImportOptions(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxImportBytes))
+	if err != nil {
+		log.Printf("Error reading import: %v", err)
+		http.Error(w, importTooLarge, http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	job, err := h.Service.SubmitImport(r.Context(), format, opts, body)
+	if writeJobError(w, err, "Error submitting import") {
+		return
+	}
+	writeAccepted(w, job)
+}
+
+// SubmitExportHandler queues an export, which takes the same parameters as
+// exporting in the request.
+func (h *Handler) SubmitExportHandler(w http.ResponseWriter, r *http.Request) {
+	opts, err := contacts.ParseExportOptions(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	job, err := h.Service.SubmitExport(r.Context(), opts)
+	if errors.Is(err, contacts.ErrUnknownExportField) {
+		http.Error(w, invalidExportField, http.StatusBadRequest)
+		return
+	}
+	if writeJobError(w, err, "Error submitting export") {
+		return
+	}
+	writeAccepted(w, job)
+}
+
+func (h *Handler) CancelJobHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := jobID(w, r)
+	if !ok {
+		return
+	}
+
+	job, err := h.Service.CancelJob(r.Context(), id)
+	if writeJobError(w, err, "Error canceling job") {
+		return
+	}
+
+	w.Header().Set(contentType, applicationJSON)
+	json.NewEncoder(w).Encode(job)
+}
+
+// GetResultHandler downloads the file a finished export produced.
+func (h *Handler) GetResultHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := jobID(w, r)
+	if !ok {
+		return
+	}
+
+	job, err := h.Service.GetResult(r.Context(), id)
+	if writeJobError(w, err, "Error getting job result") {
+		return
+	}
+
+	types := resultTypes[job.Format]
+	w.Header().Set(contentType, types[0])
+	w.Header().Set(contentDisposition, types[1])
+	if err := h.Service.WriteResult(r.Context(), job, w); err != nil {
+		// The response has started, so the client sees a truncated file
+		log.Printf("Error writing job result: %v", err)
+	}
+}
+
+func writeAccepted(w http.ResponseWriter, job *Job) {
+	w.Header().Set(contentType, applicationJSON)
+	w.Header().Set(location, jobPath+strconv.Itoa(job.ID))
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+}
+
+func jobID(w http.ResponseWriter, r *http.Request) (int, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)[idParam])
+	if err != nil {
+		log.Printf("Invalid job ID: %v", err)
+		http.Error(w, invalidJobID, http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
+
+// writeJobError writes the response for err and reports whether there was one.
+func writeJobError(w http.ResponseWriter, err error, logMessage string) bool {
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, ErrJobNotFound):
+		http.Error(w, jobNotFound, http.StatusNotFound)
+	case errors.Is(err, ErrJobFinished):
+		http.Error(w, jobFinished, http.StatusConflict)
+	case errors.Is(err, ErrNoResult):
+		http.Error(w, noResult, http.StatusConflict)
+	default:
+		log.Printf("%s: %v", logMessage, err)
+		http.Error(w, internalServerError, http.StatusInternalServerError)
+	}
+	return true
+}
@@ -0,0 +1,68 @@
+package jobs
+
+import (
+	"time"
+
+	"github.com/benhuri/phone-book-api/internal/contacts"
+)
+
+const (
+	TypeImport = "import"
+	TypeExport = "export"
+
+	StatusQueued    = "queued"
+	StatusRunning   = "running"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+	StatusCanceled  = "canceled"
+)
+
+// Job is an import or export that workers run in the background. Progress
+// is the percentage of the Total contacts that have been Processed.
+type Job struct {
+	ID         int            `json:"id"`
+	Type       string         `json:"type"`
+	Format     string         `json:"format"`
+	Options    Options        `json:"options"`
+	Status     string         `json:"status"`
+	Progress   int            `json:"progress"`
+	Processed  int            `json:"processed"`
+	Total      int            `json:"total"`
+	Import     *ImportSummary `json:"import,omitempty"`
+	Error      string         `json:"error,omitempty"`
+	CreatedAt  time.Time      `json:"created_at"`
+	StartedAt  *time.Time     `json:"started_at,omitempty"`
+	FinishedAt *time.Time     `json:"finished_at,omitempty"`
+}
+
+// Options are those the job was submitted with. vCard imports only use the
+// dry run option of Import.
+type Options struct {
+	Import *contacts.CSVImportOptions `json:"import,omitempty"`
+	Export *contacts.ExportOptions    `json:"export,omitempty"`
+}
+
+// ImportSummary counts what an import did and lists the errors of the
+// records it skipped, up to maxJobErrors of them.
+type ImportSummary struct {
+	DryRun   bool                   `json:"dry_run,omitempty"`
+	Profile  string                 `json:"profile,omitempty"`
+	Created  int                    `json:"created"`
+	Updated  int                    `json:"updated"`
+	Skipped  int                    `json:"skipped"`
+	Rejected bool                   `json:"rejected,omitempty"`
+	Errors   []contacts.ImportError `json:"errors,omitempty"`
+}
+
+// Claim is a job a worker took from the queue, with the caller who
+// submitted it and the body of an import.
+type Claim struct {
+	Job
+	TenantID string
+	Owner    string
+	Teams    []string
+	Input    []byte
+	// Attempts counts the claims, including those of workers that stopped
+	// while running the job.
+	Attempts int
+}
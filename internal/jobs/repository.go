@@ -0,0 +1,301 @@
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/benhuri/phone-book-api/internal/auth"
+	"github.com/lib/pq"
+)
+
+const (
+	// Queries made for a caller take the tenant and the caller's phone book as
+	// their first arguments. Callers without a phone book act for the tenant
+	// and see every job. Workers address jobs by ID alone.
+	jobColumns        = "id, type, format, options, status, processed, total, import_result, error, created_at, started_at, finished_at"
+	selectJobsQuery   = "SELECT " + jobColumns + " FROM jobs WHERE tenant_id = $1 AND ($2 = '' OR owner_id = $2) ORDER BY id DESC LIMIT $3 OFFSET $4"
+	selectJobQuery    = "SELECT " + jobColumns + " FROM jobs WHERE tenant_id = $1 AND ($2 = '' OR owner_id = $2) AND id = $3"
+	insertJobQuery    = "INSERT INTO jobs (tenant_id, owner_id, teams, type, format, options, input) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id, status, created_at"
+	cancelJobQuery    = "UPDATE jobs SET status = 'canceled', finished_at = now(), input = NULL WHERE tenant_id = $1 AND ($2 = '' OR owner_id = $2) AND id = $3 AND status IN ('queued', 'running') RETURNING " + jobColumns
+	selectResultQuery = "SELECT data FROM job_results WHERE job_id = $1 ORDER BY seq"
+
+	// claimJobQuery takes the oldest queued job, or a running job whose worker
+	// stopped sending heartbeats. Jobs other workers are claiming are skipped
+	// instead of waited for.
+	claimJobQuery = `UPDATE jobs SET status = 'running', attempts = attempts + 1, started_at = now(), heartbeat_at = now()
+	WHERE id = (
+		SELECT id FROM jobs
+		WHERE status = 'queued' OR (status = 'running' AND heartbeat_at < now() - make_interval(secs => $1))
+		ORDER BY id LIMIT 1 FOR UPDATE SKIP LOCKED
+	)
+	RETURNING ` + jobColumns + `, tenant_id, owner_id, teams, input, attempts`
+
+	heartbeatQuery    = "UPDATE jobs SET heartbeat_at = now(), processed = $2, total = $3 WHERE id = $1 AND status = 'running'"
+	finishJobQuery    = "UPDATE jobs SET status = $2, processed = $3, total = $4, import_result = $5, error = $6, finished_at = now(), input = NULL WHERE id = $1 AND status = 'running'"
+	insertResultQuery = "INSERT INTO job_results (job_id, seq, data) VALUES ($1, $2, $3)"
+	clearResultsQuery = "DELETE FROM job_results WHERE job_id = $1"
+	purgeJobsQuery    = "DELETE FROM jobs WHERE finished_at < now() - make_interval(secs => $1)"
+
+	fetchJobsError       = "failed to fetch jobs: %w"
+	fetchJobError        = "failed to fetch job: %w"
+	createJobError       = "failed to create job: %w"
+	cancelJobError       = "failed to cancel job: %w"
+	fetchResultError     = "failed to fetch job result: %w"
+	claimJobError        = "failed to claim job: %w"
+	heartbeatError       = "failed to record job heartbeat: %w"
+	finishJobError       = "failed to finish job: %w"
+	storeResultError     = "failed to store job result: %w"
+	clearResultsError    = "failed to clear job result: %w"
+	purgeJobsError       = "failed to purge jobs: %w"
+	getRowsAffectedError = "failed to get rows affected: %w"
+	rowsError            = "rows error: %w"
+	jobNotFoundError     = "job not found"
+)
+
+var ErrJobNotFound = errors.New(jobNotFoundError)
+
+type Repository interface {
+	FetchJobs(ctx context.Context, limit, offset int) ([]Job, error)
+	FetchJob(ctx context.Context, id int) (*Job, error)
+	CreateJob(ctx context.Context, job *Job, input []byte) error
+	// CancelJob cancels a job that has not finished, returning
+	// ErrJobNotFound for finished jobs too.
+	CancelJob(ctx context.Context, id int) (*Job, error)
+	FetchResult(ctx context.Context, id int, each func([]byte) error) error
+
+	// ClaimJob returns nil when there is no job to run.
+	ClaimJob(ctx context.Context, staleAfter time.Duration) (*Claim, error)
+	// Heartbeat records the progress of a running job and reports false when
+	// the job is no longer running, because it was canceled.
+	Heartbeat(ctx context.Context, id, processed, total int) (bool, error)
+	FinishJob(ctx context.Context, job *Job) error
+	StoreResult(ctx context.Context, id, seq int, data []byte) error
+	ClearResults(ctx context.Context, id int) error
+	PurgeJobs(ctx context.Context, age time.Duration) (int64, error)
+}
+
+type jobRepository struct {
+	db *sql.DB
+}
+
+func NewRepository(db *sql.DB) Repository {
+	return &jobRepository{db: db}
+}
+
+func (r *jobRepository) FetchJobs(ctx context.Context, limit, offset int) ([]Job, error) {
+	args, err := viewer(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := r.db.QueryContext(ctx, selectJobsQuery, append(args, limit, offset)...)
+	if err != nil {
+		return nil, fmt.Errorf(fetchJobsError, err)
+	}
+	defer rows.Close()
+
+	jobs := []Job{}
+	for rows.Next() {
+		var job Job
+		if err := scanJob(rows, &job); err != nil {
+			return nil, fmt.Errorf(fetchJobsError, err)
+		}
+		jobs = append(jobs, job)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf(rowsError, err)
+	}
+	return jobs, nil
+}
+
+func (r *jobRepository) FetchJob(ctx context.Context, id int) (*Job, error) {
+	args, err := viewer(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var job Job
+	err = scanJob(r.db.QueryRowContext(ctx, selectJobQuery, append(args, id)...), &job)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrJobNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf(fetchJobError, err)
+	}
+	return &job, nil
+}
+
+func (r *jobRepository) CreateJob(ctx context.Context, job *Job, input []byte) error {
+	args, err := viewer(ctx)
+	if err != nil {
+		return err
+	}
+	principal, _ := auth.FromContext(ctx)
+	options, err := json.Marshal(job.Options)
+	if err != nil {
+		return fmt.Errorf(createJobError, err)
+	}
+	err = r.db.QueryRowContext(ctx, insertJobQuery, append(args, pq.Array(nonNilStrings(principal.Teams)), job.Type, job.Format,
+		options, input)...).Scan(&job.ID, &job.Status, &job.CreatedAt)
+	if err != nil {
+		return fmt.Errorf(createJobError, err)
+	}
+	return nil
+}
+
+func (r *jobRepository) CancelJob(ctx context.Context, id int) (*Job, error) {
+	args, err := viewer(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var job Job
+	err = scanJob(r.db.QueryRowContext(ctx, cancelJobQuery, append(args, id)...), &job)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrJobNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf(cancelJobError, err)
+	}
+	return &job, nil
+}
+
+// FetchResult passes the chunks of a job's result to each in order, reading
+// one at a time. Callers check that the job is theirs first.
+func (r *jobRepository) FetchResult(ctx context.Context, id int, each func([]byte) error) error {
+	rows, err := r.db.QueryContext(ctx, selectResultQuery, id)
+	if err != nil {
+		return fmt.Errorf(fetchResultError, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return fmt.Errorf(fetchResultError, err)
+		}
+		if err := each(data); err != nil {
+			return err
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf(rowsError, err)
+	}
+	return nil
+}
+
+func (r *jobRepository) ClaimJob(ctx context.Context, staleAfter time.Duration) (*Claim, error) {
+	var claim Claim
+	err := scanJob(r.db.QueryRowContext(ctx, claimJobQuery, staleAfter.Seconds()), &claim.Job,
+		&claim.TenantID, &claim.Owner, pq.Array(&claim.Teams), &claim.Input, &claim.Attempts)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf(claimJobError, err)
+	}
+	return &claim, nil
+}
+
+func (r *jobRepository) Heartbeat(ctx context.Context, id, processed, total int) (bool, error) {
+	result, err := r.db.ExecContext(ctx, heartbeatQuery, id, processed, total)
+	if err != nil {
+		return false, fmt.Errorf(heartbeatError, err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf(getRowsAffectedError, err)
+	}
+	return rowsAffected > 0, nil
+}
+
+// FinishJob records the outcome of a running job. Jobs canceled meanwhile
+// stay canceled.
+func (r *jobRepository) FinishJob(ctx context.Context, job *Job) error {
+	var summary []byte
+	if job.Import != nil {
+		var err error
+		if summary, err = json.Marshal(job.Import); err != nil {
+			return fmt.Errorf(finishJobError, err)
+		}
+	}
+	_, err := r.db.ExecContext(ctx, finishJobQuery, job.ID, job.Status, job.Processed, job.Total, summary, job.Error)
+	if err != nil {
+		return fmt.Errorf(finishJobError, err)
+	}
+	return nil
+}
+
+func (r *jobRepository) StoreResult(ctx context.Context, id, seq int, data []byte) error {
+	if _, err := r.db.ExecContext(ctx, insertResultQuery, id, seq, data); err != nil {
+		return fmt.Errorf(storeResultError, err)
+	}
+	return nil
+}
+
+func (r *jobRepository) ClearResults(ctx context.Context, id int) error {
+	if _, err := r.db.ExecContext(ctx, clearResultsQuery, id); err != nil {
+		return fmt.Errorf(clearResultsError, err)
+	}
+	return nil
+}
+
+// PurgeJobs deletes the jobs, and their results, that finished longer than
+// age ago.
+func (r *jobRepository) PurgeJobs(ctx context.Context, age time.Duration) (int64, error) {
+	result, err := r.db.ExecContext(ctx, purgeJobsQuery, age.Seconds())
+	if err != nil {
+		return 0, fmt.Errorf(purgeJobsError, err)
+	}
+	purged, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf(getRowsAffectedError, err)
+	}
+	return purged, nil
+}
+
+// viewer returns the tenant and the caller's phone book.
+func viewer(ctx context.Context) ([]interface{}, error) {
+	tenantID, err := auth.TenantID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	principal, _ := auth.FromContext(ctx)
+	return []interface{}{tenantID, principal.Owner()}, nil
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanJob scans the job columns followed by any extra columns.
+func scanJob(row rowScanner, job *Job, extra ...interface{}) error {
+	var options, summary []byte
+	err := row.Scan(append([]interface{}{&job.ID, &job.Type, &job.Format, &options, &job.Status, &job.Processed, &job.Total,
+		&summary, &job.Error, &job.CreatedAt, &job.StartedAt, &job.FinishedAt}, extra...)...)
+	if err != nil {
+		return err
+	}
+	if summary != nil {
+		if err := json.Unmarshal(summary, &job.Import); err != nil {
+			return err
+		}
+	}
+	if job.Total > 0 {
+		job.Progress = job.Processed * 100 / job.Total
+	}
+	if job.Status == StatusSucceeded {
+		job.Progress = 100
+	}
+	return json.Unmarshal(options, &job.Options)
+}
+
+func nonNilStrings(values []string) []string {
+	if values == nil {
+		return []string{}
+	}
+	return values
+}
@@ -0,0 +1,176 @@
+package jobs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+
+	"github.com/benhuri/phone-book-api/internal/contacts"
+)
+
+const (
+	// maxJobErrors bounds the record errors kept with an import job.
+	maxJobErrors = 1000
+
+	noResultError    = "job has no result to download"
+	jobFinishedError = "job has already finished"
+	interruptedError = "the import was interrupted and may have imported some records, submit it again to import the rest"
+	rejectedError    = "the import was rejected because some records have errors"
+	jobFailedError   = "the job failed on the server"
+	resultChunkBytes = 1 << 20
+)
+
+var (
+	ErrNoResult    = errors.New(noResultError)
+	ErrJobFinished = errors.New(jobFinishedError)
+	errInterrupted = errors.New(interruptedError)
+	errRejected    = errors.New(rejectedError)
+)
+
+type Service struct {
+	repo     Repository
+	contacts *contacts.Service
+}
+
+func NewService(repo Repository, contactsService *contacts.Service) *Service {
+	return &Service{repo: repo, contacts: contactsService}
+}
+
+func (s *Service) GetJobs(ctx context.Context, page, limit int) ([]Job, error) {
+	offset := (page - 1) * limit
+	return s.repo.FetchJobs(ctx, limit, offset)
+}
+
+func (s *Service) GetJob(ctx context.Context, id int) (*Job, error) {
+	return s.repo.FetchJob(ctx, id)
+}
+
+// SubmitImport queues an import of a vCard or CSV body.
+func (s *Service) SubmitImport(ctx context.Context, format string, opts contacts.CSVImportOptions, body []byte) (*Job, error) {
+	if format == contacts.FormatVCard {
+		opts = contacts.CSVImportOptions{DryRun: opts.DryRun}
+	}
+	job := &Job{Type: TypeImport, Format: format, Options: Options{Import: &opts}}
+	if err := s.repo.CreateJob(ctx, job, body); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// SubmitExport queues an export after checking its fields, so mistakes are
+// reported when the job is submitted rather than when it runs.
+func (s *Service) SubmitExport(ctx context.Context, opts contacts.ExportOptions) (*Job, error) {
+	if err := s.contacts.CheckExport(ctx, opts); err != nil {
+		return nil, err
+	}
+	job := &Job{Type: TypeExport, Format: opts.Format, Options: Options{Export: &opts}}
+	if err := s.repo.CreateJob(ctx, job, nil); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// CancelJob cancels a queued or running job. A running job stops at its
+// next heartbeat.
+func (s *Service) CancelJob(ctx context.Context, id int) (*Job, error) {
+	job, err := s.repo.CancelJob(ctx, id)
+	if errors.Is(err, ErrJobNotFound) {
+		if _, err := s.repo.FetchJob(ctx, id); err == nil {
+			return nil, ErrJobFinished
+		}
+	}
+	return job, err
+}
+
+// GetResult returns an export job whose result can be downloaded.
+func (s *Service) GetResult(ctx context.Context, id int) (*Job, error) {
+	job, err := s.repo.FetchJob(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if job.Type != TypeExport || job.Status != StatusSucceeded {
+		return nil, ErrNoResult
+	}
+	return job, nil
+}
+
+// WriteResult writes the result of a job returned by GetResult.
+func (s *Service) WriteResult(ctx context.Context, job *Job, w io.Writer) error {
+	return s.repo.FetchResult(ctx, job.ID, func(data []byte) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+func (s *Service) runImport(ctx context.Context, claim *Claim, progress contacts.Progress) (*ImportSummary, error) {
+	opts := *claim.Options.Import
+	var result *contacts.ImportResult
+	var err error
+	if claim.Format == contacts.FormatVCard {
+		result, err = s.contacts.ImportVCards(ctx, bytes.NewReader(claim.Input), opts.DryRun, progress)
+	} else {
+		result, err = s.contacts.ImportCSV(ctx, claim.Input, opts, progress)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	summary := &ImportSummary{DryRun: result.DryRun, Profile: result.Profile, Created: result.Created,
+		Updated: result.Updated, Skipped: result.Skipped, Rejected: result.Rejected}
+	for _, record := range result.Records {
+		for _, recordErr := range record.Errors {
+			if len(summary.Errors) < maxJobErrors {
+				summary.Errors = append(summary.Errors, recordErr)
+			}
+		}
+	}
+	if summary.Rejected {
+		return summary, errRejected
+	}
+	return summary, nil
+}
+
+func (s *Service) runExport(ctx context.Context, claim *Claim, progress contacts.Progress) error {
+	// A worker that stopped may have stored part of the result
+	if err := s.repo.ClearResults(ctx, claim.ID); err != nil {
+		return err
+	}
+	w := &resultWriter{ctx: ctx, repo: s.repo, id: claim.ID}
+	if _, err := s.contacts.Export(ctx, w, *claim.Options.Export, progress); err != nil {
+		return err
+	}
+	return w.close()
+}
+
+// resultWriter stores what an export writes in chunks of resultChunkBytes.
+type resultWriter struct {
+	ctx  context.Context
+	repo Repository
+	id   int
+	seq  int
+	buf  []byte
+}
+
+func (w *resultWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for len(w.buf) >= resultChunkBytes {
+		if err := w.store(w.buf[:resultChunkBytes]); err != nil {
+			return 0, err
+		}
+		w.buf = append(w.buf[:0], w.buf[resultChunkBytes:]...)
+	}
+	return len(p), nil
+}
+
+func (w *resultWriter) store(chunk []byte) error {
+	w.seq++
+	return w.repo.StoreResult(w.ctx, w.id, w.seq, chunk)
+}
+
+func (w *resultWriter) close() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	return w.store(w.buf)
+}
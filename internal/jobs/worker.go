@@ -0,0 +1,160 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/benhuri/phone-book-api/internal/auth"
+	"github.com/benhuri/phone-book-api/internal/contacts"
+)
+
+const (
+	pollInterval      = time.Second
+	heartbeatInterval = 5 * time.Second
+	// staleAfter is how long a running job goes without a heartbeat before
+	// another worker takes it over.
+	staleAfter    = time.Minute
+	purgeInterval = time.Hour
+	// jobRetention is how long finished jobs and their results are kept.
+	jobRetention = 7 * 24 * time.Hour
+)
+
+// Run runs queued jobs with the given number of workers until ctx is done.
+func (s *Service) Run(ctx context.Context, workers int) {
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.work(ctx)
+		}()
+	}
+	wg.Wait()
+}
+
+func (s *Service) work(ctx context.Context) {
+	var purged time.Time
+	for ctx.Err() == nil {
+		claim, err := s.repo.ClaimJob(ctx, staleAfter)
+		if err != nil {
+			log.Printf("Error claiming job: %v", err)
+		}
+		if claim != nil {
+			s.run(ctx, claim)
+			continue
+		}
+
+		if time.Since(purged) > purgeInterval {
+			purged = time.Now()
+			if _, err := s.repo.PurgeJobs(ctx, jobRetention); err != nil {
+				log.Printf("Error purging jobs: %v", err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// progress is set by a running job and read by its heartbeat.
+type progress struct {
+	mu          sync.Mutex
+	done, total int
+}
+
+func (p *progress) set(done, total int) {
+	p.mu.Lock()
+	p.done, p.total = done, total
+	p.mu.Unlock()
+}
+
+func (p *progress) get() (int, int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.done, p.total
+}
+
+// run runs a claimed job as the caller who submitted it.
+func (s *Service) run(ctx context.Context, claim *Claim) {
+	principal := &auth.Principal{Subject: claim.Owner, TenantID: claim.TenantID, Teams: claim.Teams}
+	jobCtx, cancel := context.WithCancel(auth.NewContext(ctx, principal))
+	defer cancel()
+
+	var p progress
+	stopped := make(chan struct{})
+	heartbeatDone := make(chan struct{})
+	go func() {
+		defer close(heartbeatDone)
+		s.heartbeat(ctx, claim.ID, &p, cancel, stopped)
+	}()
+
+	job := &claim.Job
+	var err error
+	switch {
+	case claim.Type == TypeExport:
+		err = s.runExport(jobCtx, claim, p.set)
+	case claim.Attempts > 1 && !claim.Options.Import.DryRun && !claim.Options.Import.AllOrNothing:
+		// Running the import again would create its records twice, unlike
+		// an all-or-nothing import whose transaction rolled back
+		err = errInterrupted
+	default:
+		job.Import, err = s.runImport(jobCtx, claim, p.set)
+	}
+	close(stopped)
+	<-heartbeatDone
+
+	// A stopping worker leaves the job for another one, and a canceled job
+	// stays canceled
+	if jobCtx.Err() != nil {
+		return
+	}
+	job.Processed, job.Total = p.get()
+	job.Status = StatusSucceeded
+	if err != nil {
+		job.Status, job.Error = StatusFailed, failureMessage(err)
+	}
+	if err := s.repo.FinishJob(ctx, job); err != nil {
+		log.Printf("Error finishing job: %v", err)
+	}
+}
+
+// heartbeat records the progress of a running job until it stops, and
+// cancels the job when it is canceled.
+func (s *Service) heartbeat(ctx context.Context, id int, p *progress, cancel context.CancelFunc, stopped <-chan struct{}) {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopped:
+			return
+		case <-ticker.C:
+			done, total := p.get()
+			running, err := s.repo.Heartbeat(ctx, id, done, total)
+			if err != nil {
+				log.Printf("Error sending job heartbeat: %v", err)
+				continue
+			}
+			if !running {
+				cancel()
+				return
+			}
+		}
+	}
+}
+
+// failureMessage returns the error to report for a failed job. Errors on
+// the server are logged and reported without their details.
+func failureMessage(err error) string {
+	if message, ok := contacts.ImportErrorMessage(err); ok {
+		return message
+	}
+	if errors.Is(err, errInterrupted) || errors.Is(err, errRejected) || errors.Is(err, contacts.ErrUnknownExportField) {
+		return err.Error()
+	}
+	log.Printf("Error running job: %v", err)
+	return jobFailedError
+}
@@ -2,6 +2,7 @@ package metrics
 
 import (
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -25,11 +26,20 @@ var (
 		},
 		[]string{"method", "endpoint"},
 	)
+
+	apiKeyRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "api_key_requests_total",
+			Help: "Total number of API requests per API key",
+		},
+		[]string{"key_id", "method"},
+	)
 )
 
 func init() {
 	prometheus.MustRegister(apiRequests)
 	prometheus.MustRegister(apiResponseTime)
+	prometheus.MustRegister(apiKeyRequests)
 }
 
 func Middleware(next http.Handler) http.Handler {
@@ -44,6 +54,10 @@ func Middleware(next http.Handler) http.Handler {
 	})
 }
 
+func CountKeyRequest(keyID int, method string) {
+	apiKeyRequests.WithLabelValues(strconv.Itoa(keyID), method).Inc()
+}
+
 func MetricsHandler() http.Handler {
 	return promhttp.Handler()
 }
\ No newline at end of file
@@ -0,0 +1,157 @@
+package organizations
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/benhuri/phone-book-api/internal/httputil"
+	"github.com/go-playground/validator/v10"
+	"github.com/gorilla/mux"
+)
+
+const (
+	contentType           = "Content-Type"
+	applicationJSON       = "application/json"
+	idParam               = "id"
+	invalidRequestError   = "Invalid request payload"
+	invalidOrganizationID = "Invalid organization ID"
+	internalServerError   = "Internal Server Error"
+)
+
+type Handler struct {
+	Service *Service
+}
+
+func NewHandler(service *Service) *Handler {
+	return &Handler{Service: service}
+}
+
+var validate *validator.Validate
+
+func init() {
+	validate = validator.New()
+}
+
+func (h *Handler) GetOrganizationsHandler(w http.ResponseWriter, r *http.Request) {
+	page, limit := httputil.ParsePagination(r)
+
+	organizations, err := h.Service.GetOrganizations(r.Context(), page, limit)
+	if err != nil {
+		log.Printf("Error getting organizations: %v", err)
+		http.Error(w, internalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(contentType, applicationJSON)
+	json.NewEncoder(w).Encode(organizations)
+}
+
+func (h *Handler) GetOrganizationHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)[idParam])
+	if err != nil {
+		log.Printf("Invalid organization ID: %v", err)
+		http.Error(w, invalidOrganizationID, http.StatusBadRequest)
+		return
+	}
+
+	organization, err := h.Service.GetOrganization(r.Context(), id)
+	if errors.Is(err, ErrOrganizationNotFound) {
+		http.Error(w, organizationNotFoundError, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error getting organization: %v", err)
+		http.Error(w, internalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(contentType, applicationJSON)
+	json.NewEncoder(w).Encode(organization)
+}
+
+func (h *Handler) AddOrganizationHandler(w http.ResponseWriter, r *http.Request) {
+	var organization Organization
+	if err := json.NewDecoder(r.Body).Decode(&organization); err != nil {
+		log.Printf("Error decoding organization: %v", err)
+		http.Error(w, invalidRequestError, http.StatusBadRequest)
+		return
+	}
+
+	if err := validate.Struct(organization); err != nil {
+		log.Printf("Validation error: %v", err)
+		http.Error(w, httputil.FormatValidationError(err), http.StatusBadRequest)
+		return
+	}
+
+	if err := h.Service.AddOrganization(r.Context(), &organization); err != nil {
+		log.Printf("Error adding organization: %v", err)
+		http.Error(w, internalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(contentType, applicationJSON)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(organization)
+}
+
+func (h *Handler) EditOrganizationHandler(w http.ResponseWriter, r *http.Request) {
+	var organization Organization
+	if err := json.NewDecoder(r.Body).Decode(&organization); err != nil {
+		log.Printf("Error decoding organization: %v", err)
+		http.Error(w, invalidRequestError, http.StatusBadRequest)
+		return
+	}
+
+	if err := validate.Struct(organization); err != nil {
+		log.Printf("Validation error: %v", err)
+		http.Error(w, httputil.FormatValidationError(err), http.StatusBadRequest)
+		return
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)[idParam])
+	if err != nil {
+		log.Printf("Invalid organization ID: %v", err)
+		http.Error(w, invalidOrganizationID, http.StatusBadRequest)
+		return
+	}
+	organization.ID = id
+
+	err = h.Service.EditOrganization(r.Context(), organization)
+	if errors.Is(err, ErrOrganizationNotFound) {
+		http.Error(w, organizationNotFoundError, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error editing organization: %v", err)
+		http.Error(w, internalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(contentType, applicationJSON)
+	json.NewEncoder(w).Encode(organization)
+}
+
+func (h *Handler) DeleteOrganizationHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)[idParam])
+	if err != nil {
+		log.Printf("Invalid organization ID: %v", err)
+		http.Error(w, invalidOrganizationID, http.StatusBadRequest)
+		return
+	}
+
+	err = h.Service.DeleteOrganization(r.Context(), id)
+	if errors.Is(err, ErrOrganizationNotFound) {
+		http.Error(w, organizationNotFoundError, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error deleting organization: %v", err)
+		http.Error(w, internalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,9 @@
+package organizations
+
+type Organization struct {
+	ID        int    `json:"id"`
+	Name      string `json:"name" validate:"required,min=1,max=100"`
+	MainPhone string `json:"main_phone,omitempty" validate:"omitempty,min=7,max=20"`
+	Website   string `json:"website,omitempty" validate:"omitempty,url,max=200"`
+	Address   string `json:"address,omitempty" validate:"omitempty,min=2,max=100"`
+}
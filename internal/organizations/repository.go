@@ -0,0 +1,139 @@
+package organizations
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/benhuri/phone-book-api/internal/auth"
+)
+
+const (
+	organizationColumns       = "id, name, main_phone, website, address"
+	selectOrganizationsQuery  = "SELECT " + organizationColumns + " FROM organizations WHERE tenant_id = $1 ORDER BY name, id LIMIT $2 OFFSET $3"
+	selectOrganizationQuery   = "SELECT " + organizationColumns + " FROM organizations WHERE tenant_id = $1 AND id = $2"
+	insertOrganizationQuery   = "INSERT INTO organizations (tenant_id, name, main_phone, website, address) VALUES ($1, $2, $3, $4, $5) RETURNING id"
+	updateOrganizationQuery   = "UPDATE organizations SET name = $2, main_phone = $3, website = $4, address = $5 WHERE tenant_id = $1 AND id = $6"
+	deleteOrganizationQuery   = "DELETE FROM organizations WHERE tenant_id = $1 AND id = $2"
+	fetchOrganizationsError   = "failed to fetch organizations: %w"
+	scanOrganizationError     = "failed to scan organization: %w"
+	rowsError                 = "rows error: %w"
+	getOrganizationError      = "failed to get organization: %w"
+	createOrganizationError   = "failed to create organization: %w"
+	updateOrganizationError   = "failed to update organization: %w"
+	removeOrganizationError   = "failed to remove organization: %w"
+	getRowsAffectedError      = "failed to get rows affected: %w"
+	organizationNotFoundError = "organization not found"
+)
+
+var ErrOrganizationNotFound = errors.New(organizationNotFoundError)
+
+type Repository interface {
+	FetchOrganizations(ctx context.Context, limit, offset int) ([]Organization, error)
+	GetOrganization(ctx context.Context, id int) (*Organization, error)
+	CreateOrganization(ctx context.Context, organization *Organization) error
+	UpdateOrganization(ctx context.Context, organization Organization) error
+	RemoveOrganization(ctx context.Context, id int) error
+}
+
+type organizationRepository struct {
+	db *sql.DB
+}
+
+func NewRepository(db *sql.DB) Repository {
+	return &organizationRepository{db: db}
+}
+
+func (r *organizationRepository) FetchOrganizations(ctx context.Context, limit, offset int) ([]Organization, error) {
+	tenantID, err := auth.TenantID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := r.db.QueryContext(ctx, selectOrganizationsQuery, tenantID, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf(fetchOrganizationsError, err)
+	}
+	defer rows.Close()
+
+	var organizations []Organization
+	for rows.Next() {
+		var organization Organization
+		if err := rows.Scan(&organization.ID, &organization.Name, &organization.MainPhone, &organization.Website, &organization.Address); err != nil {
+			return nil, fmt.Errorf(scanOrganizationError, err)
+		}
+		organizations = append(organizations, organization)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf(rowsError, err)
+	}
+
+	return organizations, nil
+}
+
+func (r *organizationRepository) GetOrganization(ctx context.Context, id int) (*Organization, error) {
+	tenantID, err := auth.TenantID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var organization Organization
+	err = r.db.QueryRowContext(ctx, selectOrganizationQuery, tenantID, id).Scan(&organization.ID, &organization.Name, &organization.MainPhone, &organization.Website, &organization.Address)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrOrganizationNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf(getOrganizationError, err)
+	}
+	return &organization, nil
+}
+
+func (r *organizationRepository) CreateOrganization(ctx context.Context, organization *Organization) error {
+	tenantID, err := auth.TenantID(ctx)
+	if err != nil {
+		return err
+	}
+	err = r.db.QueryRowContext(ctx, insertOrganizationQuery, tenantID, organization.Name, organization.MainPhone, organization.Website, organization.Address).Scan(&organization.ID)
+	if err != nil {
+		return fmt.Errorf(createOrganizationError, err)
+	}
+	return nil
+}
+
+func (r *organizationRepository) UpdateOrganization(ctx context.Context, organization Organization) error {
+	tenantID, err := auth.TenantID(ctx)
+	if err != nil {
+		return err
+	}
+	result, err := r.db.ExecContext(ctx, updateOrganizationQuery, tenantID, organization.Name, organization.MainPhone, organization.Website, organization.Address, organization.ID)
+	if err != nil {
+		return fmt.Errorf(updateOrganizationError, err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf(getRowsAffectedError, err)
+	}
+	if rowsAffected == 0 {
+		return ErrOrganizationNotFound
+	}
+	return nil
+}
+
+func (r *organizationRepository) RemoveOrganization(ctx context.Context, id int) error {
+	tenantID, err := auth.TenantID(ctx)
+	if err != nil {
+		return err
+	}
+	result, err := r.db.ExecContext(ctx, deleteOrganizationQuery, tenantID, id)
+	if err != nil {
+		return fmt.Errorf(removeOrganizationError, err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf(getRowsAffectedError, err)
+	}
+	if rowsAffected == 0 {
+		return ErrOrganizationNotFound
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package organizations
+
+import (
+	"context"
+)
+
+type Service struct {
+	repo Repository
+}
+
+func NewService(repo Repository) *Service {
+	return &Service{repo: repo}
+}
+
+func (s *Service) GetOrganizations(ctx context.Context, page, limit int) ([]Organization, error) {
+	offset := (page - 1) * limit
+	return s.repo.FetchOrganizations(ctx, limit, offset)
+}
+
+func (s *Service) GetOrganization(ctx context.Context, id int) (*Organization, error) {
+	return s.repo.GetOrganization(ctx, id)
+}
+
+func (s *Service) AddOrganization(ctx context.Context, organization *Organization) error {
+	return s.repo.CreateOrganization(ctx, organization)
+}
+
+func (s *Service) EditOrganization(ctx context.Context, organization Organization) error {
+	return s.repo.UpdateOrganization(ctx, organization)
+}
+
+func (s *Service) DeleteOrganization(ctx context.Context, id int) error {
+	return s.repo.RemoveOrganization(ctx, id)
+}
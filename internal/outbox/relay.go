@@ -0,0 +1,152 @@
+package outbox
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/benhuri/phone-book-api/internal/contacts"
+)
+
+const (
+	pollInterval = time.Second
+	// retryInterval is how long a sink that failed to take an event waits
+	// before it is sent the event again.
+	retryInterval = 5 * time.Second
+	batchSize     = 100
+	purgeInterval = time.Hour
+	// eventRetention is how long events are kept after every sink has been
+	// sent them, for event streams to catch up from.
+	eventRetention = 7 * 24 * time.Hour
+)
+
+// Sink is sent the events of the outbox in order. An event a sink fails to
+// take is sent again, as are the events sent before an instance stopped
+// and recorded the sink had them, so sinks are sent every event at least
+// once and may tell repeats by their sequence numbers.
+type Sink interface {
+	Publish(ctx context.Context, event contacts.Event) error
+}
+
+type relayed struct {
+	name string
+	sink Sink
+	// live sinks are sent the events written while the instance runs, by
+	// every instance, and keep no cursor
+	live bool
+}
+
+// Relay forwards the events of the outbox to its sinks.
+type Relay struct {
+	repo  Repository
+	sinks []relayed
+}
+
+func NewRelay(repo Repository) *Relay {
+	return &Relay{repo: repo}
+}
+
+// Add forwards every event to the sink once, from whichever instance gets
+// to it. Its progress is kept under the name, so the sink picks up where it
+// left off after a restart.
+func (r *Relay) Add(name string, sink Sink) {
+	r.sinks = append(r.sinks, relayed{name: name, sink: sink})
+}
+
+// AddLive forwards the events written from now on to a sink of this
+// instance, such as its event streams.
+func (r *Relay) AddLive(name string, sink Sink) {
+	r.sinks = append(r.sinks, relayed{name: name, sink: sink, live: true})
+}
+
+// Run forwards events to every sink until ctx is done.
+func (r *Relay) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, s := range r.sinks {
+		wg.Add(1)
+		go func(s relayed) {
+			defer wg.Done()
+			r.forward(ctx, s)
+		}(s)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		r.purge(ctx)
+	}()
+	wg.Wait()
+}
+
+func (r *Relay) forward(ctx context.Context, s relayed) {
+	var after int64
+	if s.live {
+		for ctx.Err() == nil {
+			settled, err := r.repo.SettledSeq(ctx)
+			if err == nil {
+				after = settled
+				break
+			}
+			log.Printf("Error starting the %s sink: %v", s.name, err)
+			wait(ctx, retryInterval)
+		}
+	}
+
+	for ctx.Err() == nil {
+		var sent int
+		var err error
+		if s.live {
+			sent, err = r.forwardLive(ctx, s, &after)
+		} else {
+			sent, err = r.repo.Forward(ctx, s.name, batchSize, func(event contacts.Event) error {
+				return s.sink.Publish(ctx, event)
+			})
+		}
+		if err != nil {
+			log.Printf("Error relaying events to the %s sink: %v", s.name, err)
+			wait(ctx, retryInterval)
+			continue
+		}
+		if sent < batchSize {
+			wait(ctx, pollInterval)
+		}
+	}
+}
+
+// forwardLive sends the events after the cursor and moves it past those
+// the sink took.
+func (r *Relay) forwardLive(ctx context.Context, s relayed, after *int64) (int, error) {
+	events, err := r.repo.FetchEvents(ctx, *after, batchSize)
+	if err != nil {
+		return 0, err
+	}
+	for i, event := range events {
+		if err := s.sink.Publish(ctx, event); err != nil {
+			return i, err
+		}
+		*after = event.Seq
+	}
+	return len(events), nil
+}
+
+func (r *Relay) purge(ctx context.Context) {
+	var names []string
+	for _, s := range r.sinks {
+		if !s.live {
+			names = append(names, s.name)
+		}
+	}
+	for ctx.Err() == nil {
+		if _, err := r.repo.PurgeEvents(ctx, names, eventRetention); err != nil {
+			log.Printf("Error purging outbox events: %v", err)
+		}
+		wait(ctx, purgeInterval)
+	}
+}
+
+func wait(ctx context.Context, d time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(d):
+	}
+}
@@ -0,0 +1,208 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/benhuri/phone-book-api/internal/auth"
+	"github.com/benhuri/phone-book-api/internal/contacts"
+	"github.com/lib/pq"
+)
+
+const (
+	eventColumns            = "seq, tenant_id, type, contact_id, contact, merged_ids, created_at"
+	selectEventsQuery       = "SELECT " + eventColumns + " FROM outbox WHERE seq > $1 AND seq <= $2 ORDER BY seq LIMIT $3"
+	selectTenantEventsQuery = "SELECT " + eventColumns + " FROM outbox WHERE tenant_id = $1 AND seq > $2 AND seq <= $3 ORDER BY seq LIMIT $4"
+	// Events are numbered as they are written and may commit out of order,
+	// so they are read only up to the settled number. The latest number
+	// handed out becomes settled once every transaction running when it
+	// was read has ended, as every transaction that could have taken a
+	// number up to it was running then. The snapshot must be taken after
+	// the number is read, so the two are read in separate statements.
+	selectIssuedQuery = "SELECT CASE WHEN is_called THEN last_value ELSE 0 END FROM outbox_seq_seq"
+	settleQuery       = "WITH advanced AS (UPDATE outbox_horizon SET settled = pending, pending = $1, pending_xid = pg_snapshot_xmax(pg_current_snapshot()) WHERE pg_snapshot_xmin(pg_current_snapshot()) >= pending_xid RETURNING settled) SELECT settled FROM advanced UNION ALL SELECT settled FROM outbox_horizon WHERE NOT EXISTS (SELECT 1 FROM advanced)"
+	// New sinks start after the settled events rather than with the events
+	// kept for the others.
+	insertCursorQuery = "INSERT INTO outbox_cursors (sink, seq) VALUES ($1, $2) ON CONFLICT DO NOTHING"
+	// lockCursorQuery skips a cursor another instance is forwarding from.
+	lockCursorQuery   = "SELECT seq FROM outbox_cursors WHERE sink = $1 FOR UPDATE SKIP LOCKED"
+	updateCursorQuery = "UPDATE outbox_cursors SET seq = $2 WHERE sink = $1"
+	// purgeEventsQuery keeps the events a sink has yet to be sent.
+	purgeEventsQuery = "DELETE FROM outbox WHERE created_at < now() - make_interval(secs => $2) AND seq <= COALESCE((SELECT min(seq) FROM outbox_cursors WHERE sink = ANY($1)), seq)"
+
+	fetchEventsError     = "failed to fetch outbox events: %w"
+	settleEventsError    = "failed to settle outbox events: %w"
+	forwardEventsError   = "failed to forward outbox events: %w"
+	purgeEventsError     = "failed to purge outbox events: %w"
+	getRowsAffectedError = "failed to get rows affected: %w"
+	rowsError            = "rows error: %w"
+)
+
+type Repository interface {
+	// Forward calls send with the settled events the sink has yet to be
+	// sent, up to limit, in order, and records those it took. It stops at the first
+	// event send fails to take and returns its error with the number taken.
+	// While another instance forwards to the sink, it returns 0 and no error.
+	Forward(ctx context.Context, sink string, limit int, send func(contacts.Event) error) (int, error)
+	// FetchEvents returns the settled events of every tenant after seq, in
+	// order.
+	FetchEvents(ctx context.Context, after int64, limit int) ([]contacts.Event, error)
+	// FetchTenantEvents returns the settled events of the caller's tenant
+	// after seq, in order.
+	FetchTenantEvents(ctx context.Context, after int64, limit int) ([]contacts.Event, error)
+	// SettledSeq returns the sequence number up to which every event has
+	// committed or rolled back, so that no event numbered up to it can
+	// appear later. It never decreases.
+	SettledSeq(ctx context.Context) (int64, error)
+	// PurgeEvents deletes the events older than age that the sinks have all
+	// been sent.
+	PurgeEvents(ctx context.Context, sinks []string, age time.Duration) (int64, error)
+}
+
+type outboxRepository struct {
+	db *sql.DB
+}
+
+func NewRepository(db *sql.DB) Repository {
+	return &outboxRepository{db: db}
+}
+
+// Forward holds the sink's cursor locked while it sends, so that events
+// are sent to a sink by one instance at a time, and moves it in the same
+// transaction. An instance that stops before moving it leaves the events to
+// be sent again.
+func (r *outboxRepository) Forward(ctx context.Context, sink string, limit int, send func(contacts.Event) error) (int, error) {
+	settled, err := r.SettledSeq(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := r.db.ExecContext(ctx, insertCursorQuery, sink, settled); err != nil {
+		return 0, fmt.Errorf(forwardEventsError, err)
+	}
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf(forwardEventsError, err)
+	}
+	defer tx.Rollback()
+
+	var cursor int64
+	err = tx.QueryRowContext(ctx, lockCursorQuery, sink).Scan(&cursor)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf(forwardEventsError, err)
+	}
+	events, err := queryEvents(ctx, tx, selectEventsQuery, cursor, settled, limit)
+	if err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	var sendErr error
+	for _, event := range events {
+		if sendErr = send(event); sendErr != nil {
+			break
+		}
+		cursor = event.Seq
+		sent++
+	}
+	if sent > 0 {
+		if _, err := tx.ExecContext(ctx, updateCursorQuery, sink, cursor); err != nil {
+			return 0, fmt.Errorf(forwardEventsError, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return 0, fmt.Errorf(forwardEventsError, err)
+		}
+	}
+	return sent, sendErr
+}
+
+func (r *outboxRepository) FetchEvents(ctx context.Context, after int64, limit int) ([]contacts.Event, error) {
+	settled, err := r.SettledSeq(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return queryEvents(ctx, r.db, selectEventsQuery, after, settled, limit)
+}
+
+func (r *outboxRepository) FetchTenantEvents(ctx context.Context, after int64, limit int) ([]contacts.Event, error) {
+	tenantID, err := auth.TenantID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	settled, err := r.SettledSeq(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return queryEvents(ctx, r.db, selectTenantEventsQuery, tenantID, after, settled, limit)
+}
+
+// SettledSeq also moves the settled number forward when the transactions
+// it waited on have ended, so that it follows the outbox as it is read.
+func (r *outboxRepository) SettledSeq(ctx context.Context) (int64, error) {
+	var issued, settled int64
+	if err := r.db.QueryRowContext(ctx, selectIssuedQuery).Scan(&issued); err != nil {
+		return 0, fmt.Errorf(settleEventsError, err)
+	}
+	if err := r.db.QueryRowContext(ctx, settleQuery, issued).Scan(&settled); err != nil {
+		return 0, fmt.Errorf(settleEventsError, err)
+	}
+	return settled, nil
+}
+
+func (r *outboxRepository) PurgeEvents(ctx context.Context, sinks []string, age time.Duration) (int64, error) {
+	result, err := r.db.ExecContext(ctx, purgeEventsQuery, pq.Array(sinks), age.Seconds())
+	if err != nil {
+		return 0, fmt.Errorf(purgeEventsError, err)
+	}
+	purged, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf(getRowsAffectedError, err)
+	}
+	return purged, nil
+}
+
+// queryer runs statements on the database or in a transaction.
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func queryEvents(ctx context.Context, q queryer, query string, args ...interface{}) ([]contacts.Event, error) {
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf(fetchEventsError, err)
+	}
+	defer rows.Close()
+
+	var events []contacts.Event
+	for rows.Next() {
+		var event contacts.Event
+		var contact []byte
+		var mergedIDs []int64
+		err := rows.Scan(&event.Seq, &event.TenantID, &event.Type, &event.ContactID, &contact, pq.Array(&mergedIDs), &event.OccurredAt)
+		if err != nil {
+			return nil, fmt.Errorf(fetchEventsError, err)
+		}
+		if contact != nil {
+			event.Contact = &contacts.Contact{}
+			if err := json.Unmarshal(contact, event.Contact); err != nil {
+				return nil, fmt.Errorf(fetchEventsError, err)
+			}
+		}
+		for _, id := range mergedIDs {
+			event.MergedIDs = append(event.MergedIDs, int(id))
+		}
+		events = append(events, event)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf(rowsError, err)
+	}
+	return events, nil
+}
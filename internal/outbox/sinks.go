@@ -0,0 +1,71 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/benhuri/phone-book-api/internal/contacts"
+)
+
+const (
+	SinkWebhooks = "webhooks"
+	SinkFile     = "file"
+	SinkStdout   = "stdout"
+	SinkSSE      = "sse"
+
+	openFileError    = "failed to open event file: %w"
+	writeEventError  = "failed to write event: %w"
+	unknownSinkError = "unknown event sink %q, must be webhooks, file, stdout or sse"
+)
+
+// WriterSink writes every event as a line of JSON.
+type WriterSink struct {
+	w io.Writer
+	// file is synced after every event, so that the relay moves past only
+	// the events that are stored
+	file *os.File
+}
+
+func NewWriterSink(w io.Writer) *WriterSink {
+	return &WriterSink{w: w}
+}
+
+// NewFileSink appends the events to the file at path, creating it if needed.
+func NewFileSink(path string) (*WriterSink, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf(openFileError, err)
+	}
+	return &WriterSink{w: file, file: file}, nil
+}
+
+func (s *WriterSink) Publish(ctx context.Context, event contacts.Event) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf(writeEventError, err)
+	}
+	if _, err := s.w.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf(writeEventError, err)
+	}
+	if s.file != nil {
+		if err := s.file.Sync(); err != nil {
+			return fmt.Errorf(writeEventError, err)
+		}
+	}
+	return nil
+}
+
+// CheckSinks returns an error naming the first sink that is not known.
+func CheckSinks(names []string) error {
+	for _, name := range names {
+		switch name {
+		case SinkWebhooks, SinkFile, SinkStdout, SinkSSE:
+		default:
+			return fmt.Errorf(unknownSinkError, name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/benhuri/phone-book-api/internal/auth"
+	"github.com/benhuri/phone-book-api/internal/contacts"
+)
+
+const (
+	// subscriberBuffer is how many events a stream may fall behind by before
+	// it is closed, for the client to reconnect and catch up.
+	subscriberBuffer  = 256
+	keepAliveInterval = 30 * time.Second
+
+	contentTypeHeader   = "Content-Type"
+	cacheControlHeader  = "Cache-Control"
+	lastEventIDHeader   = "Last-Event-ID"
+	textEventStream     = "text/event-stream"
+	noCache             = "no-cache"
+	streamDisabled      = "Event stream is disabled"
+	streamUnsupported   = "Streaming is not supported"
+	invalidLastEventID  = "Invalid Last-Event-ID"
+	internalServerError = "Internal Server Error"
+)
+
+// Stream is a sink that sends the events of each tenant to the clients of
+// the tenant streaming them as server-sent events.
+type Stream struct {
+	repo        Repository
+	mu          sync.Mutex
+	subscribers map[*subscriber]bool
+}
+
+type subscriber struct {
+	tenantID string
+	events   chan contacts.Event
+}
+
+func NewStream(repo Repository) *Stream {
+	return &Stream{repo: repo, subscribers: make(map[*subscriber]bool)}
+}
+
+// Publish never blocks on a client. Clients too far behind are
+// disconnected instead.
+func (s *Stream) Publish(ctx context.Context, event contacts.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for sub := range s.subscribers {
+		if sub.tenantID != event.TenantID {
+			continue
+		}
+		select {
+		case sub.events <- event:
+		default:
+			delete(s.subscribers, sub)
+			close(sub.events)
+		}
+	}
+	return nil
+}
+
+func (s *Stream) subscribe(tenantID string) *subscriber {
+	sub := &subscriber{tenantID: tenantID, events: make(chan contacts.Event, subscriberBuffer)}
+	s.mu.Lock()
+	s.subscribers[sub] = true
+	s.mu.Unlock()
+	return sub
+}
+
+func (s *Stream) unsubscribe(sub *subscriber) {
+	s.mu.Lock()
+	if s.subscribers[sub] {
+		delete(s.subscribers, sub)
+		close(sub.events)
+	}
+	s.mu.Unlock()
+}
+
+type Handler struct {
+	// Stream is nil when the event stream is disabled
+	Stream *Stream
+}
+
+func NewHandler(stream *Stream) *Handler {
+	return &Handler{Stream: stream}
+}
+
+// StreamHandler streams the events of the caller's tenant. Each event's ID
+// is its sequence number, so a client that reconnects with Last-Event-ID is
+// first sent the events it missed.
+func (h *Handler) StreamHandler(w http.ResponseWriter, r *http.Request) {
+	if h.Stream == nil {
+		http.Error(w, streamDisabled, http.StatusNotFound)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, streamUnsupported, http.StatusInternalServerError)
+		return
+	}
+	tenantID, err := auth.TenantID(r.Context())
+	if err != nil {
+		log.Printf("Error streaming events: %v", err)
+		http.Error(w, internalServerError, http.StatusInternalServerError)
+		return
+	}
+	var after int64
+	if lastID := r.Header.Get(lastEventIDHeader); lastID != "" {
+		if after, err = strconv.ParseInt(lastID, 10, 64); err != nil || after < 0 {
+			http.Error(w, invalidLastEventID, http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Subscribing first keeps events written during the catch up
+	sub := h.Stream.subscribe(tenantID)
+	defer h.Stream.unsubscribe(sub)
+
+	w.Header().Set(contentTypeHeader, textEventStream)
+	w.Header().Set(cacheControlHeader, noCache)
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for after > 0 {
+		events, err := h.Stream.repo.FetchTenantEvents(r.Context(), after, batchSize)
+		if err != nil {
+			log.Printf("Error streaming events: %v", err)
+			return
+		}
+		for _, event := range events {
+			if !writeEvent(w, event) {
+				return
+			}
+			after = event.Seq
+		}
+		flusher.Flush()
+		if len(events) < batchSize {
+			break
+		}
+	}
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case event, ok := <-sub.events:
+			if !ok {
+				return
+			}
+			if event.Seq <= after {
+				continue
+			}
+			if !writeEvent(w, event) {
+				return
+			}
+			after = event.Seq
+		}
+		flusher.Flush()
+	}
+}
+
+func writeEvent(w http.ResponseWriter, event contacts.Event) bool {
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Error encoding event: %v", err)
+		return false
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.Seq, event.Type, data)
+	return err == nil
+}
@@ -0,0 +1,129 @@
+package roles
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+
+	"github.com/benhuri/phone-book-api/internal/auth"
+	"github.com/benhuri/phone-book-api/internal/httputil"
+	"github.com/go-playground/validator/v10"
+	"github.com/gorilla/mux"
+)
+
+const (
+	contentType         = "Content-Type"
+	applicationJSON     = "application/json"
+	idParam             = "id"
+	invalidRequestError = "Invalid request payload"
+	invalidSubject      = "Invalid subject, must be user:<id> or jwt:<iss>|<sub>"
+	internalServerError = "Internal Server Error"
+)
+
+type Handler struct {
+	Service *Service
+}
+
+func NewHandler(service *Service) *Handler {
+	return &Handler{Service: service}
+}
+
+var validate *validator.Validate
+
+func init() {
+	validate = validator.New()
+	validate.RegisterValidation("subject", func(fl validator.FieldLevel) bool {
+		return auth.IsSubject(fl.Field().String())
+	})
+}
+
+// subject returns the subject in the path, which is percent-encoded as the
+// issuer of a token subject has slashes.
+func subject(r *http.Request) (string, bool) {
+	subject, err := url.PathUnescape(mux.Vars(r)[idParam])
+	return subject, err == nil && auth.IsSubject(subject)
+}
+
+func (h *Handler) GetRolesHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := subject(r)
+	if !ok {
+		http.Error(w, invalidSubject, http.StatusBadRequest)
+		return
+	}
+	assignment, err := h.Service.GetAssignment(r.Context(), userID)
+	if err != nil {
+		log.Printf("Error getting roles: %v", err)
+		http.Error(w, internalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(contentType, applicationJSON)
+	json.NewEncoder(w).Encode(assignment)
+}
+
+func (h *Handler) SetRolesHandler(w http.ResponseWriter, r *http.Request) {
+	var assignment Assignment
+	if err := json.NewDecoder(r.Body).Decode(&assignment); err != nil {
+		log.Printf("Error decoding roles: %v", err)
+		http.Error(w, invalidRequestError, http.StatusBadRequest)
+		return
+	}
+	userID, ok := subject(r)
+	if !ok {
+		http.Error(w, invalidSubject, http.StatusBadRequest)
+		return
+	}
+	assignment.UserID = userID
+
+	if err := validate.Struct(assignment); err != nil {
+		log.Printf("Validation error: %v", err)
+		http.Error(w, httputil.FormatValidationError(err), http.StatusBadRequest)
+		return
+	}
+
+	if err := h.Service.SetAssignment(r.Context(), assignment); err != nil {
+		log.Printf("Error setting roles: %v", err)
+		http.Error(w, internalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(contentType, applicationJSON)
+	json.NewEncoder(w).Encode(assignment)
+}
+
+func (h *Handler) GetMFAPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	policy, err := h.Service.GetMFAPolicy(r.Context())
+	if err != nil {
+		log.Printf("Error getting mfa policy: %v", err)
+		http.Error(w, internalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(contentType, applicationJSON)
+	json.NewEncoder(w).Encode(policy)
+}
+
+func (h *Handler) SetMFAPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	var policy MFAPolicy
+	if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+		log.Printf("Error decoding mfa policy: %v", err)
+		http.Error(w, invalidRequestError, http.StatusBadRequest)
+		return
+	}
+
+	if err := validate.Struct(policy); err != nil {
+		log.Printf("Validation error: %v", err)
+		http.Error(w, httputil.FormatValidationError(err), http.StatusBadRequest)
+		return
+	}
+
+	if err := h.Service.SetMFAPolicy(r.Context(), policy); err != nil {
+		log.Printf("Error setting mfa policy: %v", err)
+		http.Error(w, internalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(contentType, applicationJSON)
+	json.NewEncoder(w).Encode(policy)
+}
@@ -0,0 +1,14 @@
+package roles
+
+// Assignment lists the roles an admin granted to a user of the tenant, on top
+// of any roles carried by the user's token.
+type Assignment struct {
+	UserID string   `json:"user_id" validate:"required,subject"`
+	Roles  []string `json:"roles" validate:"required,unique,dive,oneof=viewer editor admin auditor"`
+}
+
+// MFAPolicy lists the roles that are only granted to users who logged in with
+// a second factor.
+type MFAPolicy struct {
+	Roles []string `json:"roles" validate:"required,unique,dive,oneof=viewer editor admin auditor"`
+}
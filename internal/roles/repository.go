@@ -0,0 +1,127 @@
+package roles
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/benhuri/phone-book-api/internal/auth"
+	"github.com/lib/pq"
+)
+
+const (
+	selectRolesQuery  = "SELECT role FROM user_roles WHERE tenant_id = $1 AND user_id = $2 ORDER BY role"
+	deleteRolesQuery  = "DELETE FROM user_roles WHERE tenant_id = $1 AND user_id = $2"
+	insertRolesQuery  = "INSERT INTO user_roles (tenant_id, user_id, role) SELECT $1, $2, unnest($3::text[])"
+	selectMFARoles    = "SELECT role FROM mfa_roles WHERE tenant_id = $1 ORDER BY role"
+	deleteMFARoles    = "DELETE FROM mfa_roles WHERE tenant_id = $1"
+	insertMFARoles    = "INSERT INTO mfa_roles (tenant_id, role) SELECT $1, unnest($2::text[])"
+	fetchRolesError   = "failed to fetch roles: %w"
+	scanRoleError     = "failed to scan role: %w"
+	rowsError         = "rows error: %w"
+	replaceRolesError = "failed to replace roles: %w"
+	beginTxError      = "failed to begin transaction: %w"
+	commitTxError     = "failed to commit transaction: %w"
+)
+
+type Repository interface {
+	FetchRoles(ctx context.Context, userID string) ([]string, error)
+	ReplaceRoles(ctx context.Context, assignment Assignment) error
+	FetchMFARoles(ctx context.Context) ([]string, error)
+	ReplaceMFARoles(ctx context.Context, policy MFAPolicy) error
+}
+
+type roleRepository struct {
+	db *sql.DB
+}
+
+func NewRepository(db *sql.DB) Repository {
+	return &roleRepository{db: db}
+}
+
+func (r *roleRepository) FetchRoles(ctx context.Context, userID string) ([]string, error) {
+	tenantID, err := auth.TenantID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return r.queryRoles(ctx, selectRolesQuery, tenantID, userID)
+}
+
+func (r *roleRepository) ReplaceRoles(ctx context.Context, assignment Assignment) error {
+	tenantID, err := auth.TenantID(ctx)
+	if err != nil {
+		return err
+	}
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf(beginTxError, err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, deleteRolesQuery, tenantID, assignment.UserID); err != nil {
+		return fmt.Errorf(replaceRolesError, err)
+	}
+	if _, err := tx.ExecContext(ctx, insertRolesQuery, tenantID, assignment.UserID, pq.Array(assignment.Roles)); err != nil {
+		return fmt.Errorf(replaceRolesError, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf(commitTxError, err)
+	}
+	return nil
+}
+
+func (r *roleRepository) FetchMFARoles(ctx context.Context) ([]string, error) {
+	tenantID, err := auth.TenantID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return r.queryRoles(ctx, selectMFARoles, tenantID)
+}
+
+func (r *roleRepository) ReplaceMFARoles(ctx context.Context, policy MFAPolicy) error {
+	tenantID, err := auth.TenantID(ctx)
+	if err != nil {
+		return err
+	}
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf(beginTxError, err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, deleteMFARoles, tenantID); err != nil {
+		return fmt.Errorf(replaceRolesError, err)
+	}
+	if _, err := tx.ExecContext(ctx, insertMFARoles, tenantID, pq.Array(policy.Roles)); err != nil {
+		return fmt.Errorf(replaceRolesError, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf(commitTxError, err)
+	}
+	return nil
+}
+
+func (r *roleRepository) queryRoles(ctx context.Context, query string, args ...interface{}) ([]string, error) {
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf(fetchRolesError, err)
+	}
+	defer rows.Close()
+
+	roles := []string{}
+	for rows.Next() {
+		var role string
+		if err := rows.Scan(&role); err != nil {
+			return nil, fmt.Errorf(scanRoleError, err)
+		}
+		roles = append(roles, role)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf(rowsError, err)
+	}
+
+	return roles, nil
+}
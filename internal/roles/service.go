@@ -0,0 +1,45 @@
+package roles
+
+import "context"
+
+type Service struct {
+	repo Repository
+}
+
+func NewService(repo Repository) *Service {
+	return &Service{repo: repo}
+}
+
+// FetchRoles makes the service usable as the policy's auth.RoleStore.
+func (s *Service) FetchRoles(ctx context.Context, userID string) ([]string, error) {
+	return s.repo.FetchRoles(ctx, userID)
+}
+
+// FetchMFARoles makes the service usable as the policy's auth.RoleStore.
+func (s *Service) FetchMFARoles(ctx context.Context) ([]string, error) {
+	return s.repo.FetchMFARoles(ctx)
+}
+
+func (s *Service) GetAssignment(ctx context.Context, userID string) (*Assignment, error) {
+	roles, err := s.repo.FetchRoles(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return &Assignment{UserID: userID, Roles: roles}, nil
+}
+
+func (s *Service) SetAssignment(ctx context.Context, assignment Assignment) error {
+	return s.repo.ReplaceRoles(ctx, assignment)
+}
+
+func (s *Service) GetMFAPolicy(ctx context.Context) (*MFAPolicy, error) {
+	roles, err := s.repo.FetchMFARoles(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &MFAPolicy{Roles: roles}, nil
+}
+
+func (s *Service) SetMFAPolicy(ctx context.Context, policy MFAPolicy) error {
+	return s.repo.ReplaceMFARoles(ctx, policy)
+}
@@ -0,0 +1,297 @@
+package router
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/benhuri/phone-book-api/internal/auth"
+	"github.com/benhuri/phone-book-api/internal/config"
+	"github.com/benhuri/phone-book-api/internal/httputil"
+	"github.com/benhuri/phone-book-api/internal/idempotency"
+	"github.com/benhuri/phone-book-api/internal/metrics"
+	"github.com/benhuri/phone-book-api/internal/users"
+	"github.com/gorilla/mux"
+)
+
+const (
+	tenantHeader           = "X-Tenant-ID"
+	missingTenantError     = "Missing tenant"
+	invalidTenantError     = "Invalid tenant ID"
+	authorizationHeader    = "Authorization"
+	authenticateHeader     = "WWW-Authenticate"
+	bearerChallenge        = `Bearer realm="phone-book-api"`
+	bearerScheme           = "bearer "
+	unauthorizedError      = "A valid API key or token is required"
+	missingPermissionError = "The %s permission is required"
+	invalidCSRFError       = "A valid CSRF token is required"
+	idempotencyKeyHeader   = "Idempotency-Key"
+	replayedHeader         = "Idempotent-Replayed"
+	maxIdempotencyKey      = 255
+	invalidKeyError        = "Idempotency-Key must be at most 255 characters"
+	invalidBodyError       = "Invalid request body"
+	internalServerError    = "Internal Server Error"
+
+	// maxStoredResponse bounds the responses kept for idempotency keys.
+	// Larger ones release the key instead.
+	maxStoredResponse = 10 << 20
+)
+
+type Authenticator interface {
+	Authenticate(ctx context.Context, token string) (*auth.Principal, error)
+}
+
+// SessionAuthenticator resolves a browser session cookie to its principal and
+// the CSRF token the session's state-changing requests must carry.
+type SessionAuthenticator interface {
+	AuthenticateSession(ctx context.Context, token string) (*auth.Principal, string, error)
+}
+
+// safeMethods do not change state and need no CSRF token.
+var safeMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+}
+
+// Authenticators tries each authenticator in turn until one accepts the token.
+type Authenticators []Authenticator
+
+func (a Authenticators) Authenticate(ctx context.Context, token string) (*auth.Principal, error) {
+	err := auth.ErrUnauthenticated
+	for _, authenticator := range a {
+		var principal *auth.Principal
+		principal, err = authenticator.Authenticate(ctx, token)
+		if !errors.Is(err, auth.ErrUnauthenticated) {
+			return principal, err
+		}
+	}
+	return nil, err
+}
+
+var tenantIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// TenantMiddleware attaches the caller's principal to the request context.
+// The tenant is read from the X-Tenant-ID header set by the gateway in front
+// of the service, falling back to the configured default tenant.
+func TenantMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenantID := r.Header.Get(tenantHeader)
+		if tenantID == "" {
+			tenantID = config.AppConfig.DefaultTenant
+		}
+		if tenantID == "" {
+			http.Error(w, missingTenantError, http.StatusUnauthorized)
+			return
+		}
+		if !tenantIDPattern.MatchString(tenantID) {
+			http.Error(w, invalidTenantError, http.StatusBadRequest)
+			return
+		}
+
+		// Without authentication the gateway is trusted with full access
+		principal := &auth.Principal{TenantID: tenantID, Scopes: []string{auth.ScopeAdmin}}
+		next.ServeHTTP(w, r.WithContext(auth.NewContext(r.Context(), principal)))
+	})
+}
+
+// AuthMiddleware authenticates the bearer token or session cookie of every
+// request. When authentication is not required, requests without either fall
+// back to TenantMiddleware.
+func AuthMiddleware(authenticator Authenticator, sessions SessionAuthenticator, required bool) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			header := r.Header.Get(authorizationHeader)
+			cookie, cookieErr := r.Cookie(users.SessionCookie)
+
+			var principal *auth.Principal
+			var err error
+			switch {
+			case header != "":
+				principal, err = authenticateBearer(r.Context(), authenticator, header)
+			case cookieErr == nil && sessions != nil:
+				var csrfToken string
+				principal, csrfToken, err = sessions.AuthenticateSession(r.Context(), cookie.Value)
+				// Browsers attach cookies to cross-site requests, so state
+				// changes must prove they come from a page of the session
+				if err == nil && !safeMethods[r.Method] && !validCSRFToken(r.Header.Get(users.CSRFHeader), csrfToken) {
+					httputil.WriteProblem(w, http.StatusForbidden, invalidCSRFError)
+					return
+				}
+			case !required:
+				TenantMiddleware(next).ServeHTTP(w, r)
+				return
+			default:
+				unauthorized(w)
+				return
+			}
+
+			if errors.Is(err, auth.ErrUnauthenticated) {
+				unauthorized(w)
+				return
+			}
+			if err != nil {
+				log.Printf("Error authenticating request: %v", err)
+				http.Error(w, internalServerError, http.StatusInternalServerError)
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(auth.NewContext(r.Context(), principal)))
+
+			if principal.KeyID != 0 {
+				metrics.CountKeyRequest(principal.KeyID, r.Method)
+			}
+		})
+	}
+}
+
+func authenticateBearer(ctx context.Context, authenticator Authenticator, header string) (*auth.Principal, error) {
+	if len(header) <= len(bearerScheme) || !strings.EqualFold(header[:len(bearerScheme)], bearerScheme) {
+		return nil, auth.ErrUnauthenticated
+	}
+	return authenticator.Authenticate(ctx, strings.TrimSpace(header[len(bearerScheme):]))
+}
+
+func validCSRFToken(got, want string) bool {
+	return want != "" && subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1
+}
+
+// authorize rejects requests whose principal lacks the permission. Routes
+// without a permission are open to any authenticated caller.
+func authorize(policy *auth.Policy, permission string, handler http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, ok := auth.FromContext(r.Context())
+		if !ok {
+			unauthorized(w)
+			return
+		}
+		r = r.WithContext(auth.WithPolicy(r.Context(), policy))
+		if permission == "" {
+			handler(w, r)
+			return
+		}
+
+		allowed, err := policy.Authorize(r.Context(), principal, permission)
+		if err != nil {
+			log.Printf("Error authorizing request: %v", err)
+			http.Error(w, internalServerError, http.StatusInternalServerError)
+			return
+		}
+		if !allowed {
+			httputil.WriteProblem(w, http.StatusForbidden, fmt.Sprintf(missingPermissionError, permission))
+			return
+		}
+		handler(w, r)
+	})
+}
+
+func unauthorized(w http.ResponseWriter) {
+	w.Header().Set(authenticateHeader, bearerChallenge)
+	httputil.WriteProblem(w, http.StatusUnauthorized, unauthorizedError)
+}
+
+// IdempotencyMiddleware makes state-changing requests with an
+// Idempotency-Key header safe to retry. The first request with a key runs
+// and its response is stored; retries with the same key and request get
+// that response again, retries with another request get 422 and retries
+// while the first request runs get 409. Server errors are not stored, so
+// they can be retried.
+func IdempotencyMiddleware(keys *idempotency.Service) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get(idempotencyKeyHeader)
+			if key == "" || safeMethods[r.Method] {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if len(key) > maxIdempotencyKey {
+				httputil.WriteProblem(w, http.StatusBadRequest, invalidKeyError)
+				return
+			}
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				httputil.WriteProblem(w, http.StatusBadRequest, invalidBodyError)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+
+			reservation, stored, err := keys.Begin(r.Context(), key, idempotency.Fingerprint(r.Method, r.URL.RequestURI(), body))
+			switch {
+			case errors.Is(err, idempotency.ErrKeyReused):
+				httputil.WriteProblem(w, http.StatusUnprocessableEntity, err.Error())
+				return
+			case errors.Is(err, idempotency.ErrKeyInFlight):
+				httputil.WriteProblem(w, http.StatusConflict, err.Error())
+				return
+			case err != nil:
+				log.Printf("Error reserving idempotency key: %v", err)
+				http.Error(w, internalServerError, http.StatusInternalServerError)
+				return
+			case stored != nil:
+				for name, values := range stored.Header {
+					w.Header()[name] = values
+				}
+				w.Header().Set(replayedHeader, "true")
+				w.WriteHeader(stored.Status)
+				w.Write(stored.Body)
+				return
+			}
+
+			// The outcome is recorded even when the client has gone, as its
+			// retry is what the key is for
+			ctx := context.Background()
+			recorder := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+			defer func() {
+				if p := recover(); p != nil {
+					abandonKey(ctx, keys, reservation)
+					panic(p)
+				}
+			}()
+			next.ServeHTTP(recorder, r)
+
+			if recorder.status >= http.StatusInternalServerError || recorder.overflow {
+				abandonKey(ctx, keys, reservation)
+				return
+			}
+			response := &idempotency.Response{Status: recorder.status, Header: w.Header().Clone(), Body: recorder.body.Bytes()}
+			if err := keys.Finish(ctx, reservation, response); err != nil {
+				log.Printf("Error storing idempotent response: %v", err)
+			}
+		})
+	}
+}
+
+func abandonKey(ctx context.Context, keys *idempotency.Service, reservation *idempotency.Reservation) {
+	if err := keys.Abandon(ctx, reservation); err != nil {
+		log.Printf("Error releasing idempotency key: %v", err)
+	}
+}
+
+// responseRecorder keeps a copy of the response it passes on.
+type responseRecorder struct {
+	http.ResponseWriter
+	status   int
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (rr *responseRecorder) WriteHeader(status int) {
+	rr.status = status
+	rr.ResponseWriter.WriteHeader(status)
+}
+
+func (rr *responseRecorder) Write(p []byte) (int, error) {
+	if rr.body.Len()+len(p) > maxStoredResponse {
+		rr.overflow = true
+	} else if !rr.overflow {
+		rr.body.Write(p)
+	}
+	return rr.ResponseWriter.Write(p)
+}
@@ -1,8 +1,21 @@
 package router
 
 import (
+	"net/http"
+
+	"github.com/benhuri/phone-book-api/internal/apikeys"
+	"github.com/benhuri/phone-book-api/internal/auth"
+	"github.com/benhuri/phone-book-api/internal/config"
 	"github.com/benhuri/phone-book-api/internal/contacts"
+	"github.com/benhuri/phone-book-api/internal/idempotency"
+	"github.com/benhuri/phone-book-api/internal/jobs"
 	"github.com/benhuri/phone-book-api/internal/metrics"
+	"github.com/benhuri/phone-book-api/internal/organizations"
+	"github.com/benhuri/phone-book-api/internal/outbox"
+	"github.com/benhuri/phone-book-api/internal/roles"
+	"github.com/benhuri/phone-book-api/internal/shares"
+	"github.com/benhuri/phone-book-api/internal/users"
+	"github.com/benhuri/phone-book-api/internal/webhooks"
 	"github.com/gorilla/mux"
 )
 
@@ -11,16 +24,166 @@ const (
 	contactsPath       = basePath
 	contactsSearchPath = basePath + "/search"
 	contactIDPath      = basePath + "/{id}"
+	contactsExportPath = basePath + "/export.vcf"
+	rowsExportPath     = basePath + "/export"
+	contactsImportPath = basePath + "/import"
+	csvImportPath      = contactsImportPath + "/csv"
+	batchPath          = basePath + "/batch"
+	duplicatesPath     = basePath + "/duplicates"
+	mergePath          = basePath + "/merge"
+	mergesPath         = basePath + "/merges"
+	undoMergePath      = mergesPath + "/{mergeId}/undo"
+	trashPath          = basePath + "/trash"
+	trashIDPath        = trashPath + "/{id}"
+	restorePath        = trashIDPath + "/restore"
+	importProfilesPath = "/import-profiles"
+	profileIDPath      = importProfilesPath + "/{id}"
+	contactVCardPath   = basePath + "/{id}.vcf"
+	notesPath          = contactIDPath + "/notes"
+	noteIDPath         = notesPath + "/{noteId}"
+	relationsPath      = contactIDPath + "/relations"
+	relationIDPath     = relationsPath + "/{relationId}"
+	shareLinkPath      = contactIDPath + "/share-link"
+	shareLinkIDPath    = shareLinkPath + "/{linkId}"
+	publicLinkPath     = "/public/links/{linkId}"
+	birthdaysPath      = "/calendar/birthdays.ics"
+	customFieldsPath   = "/custom-fields"
+	customFieldIDPath  = customFieldsPath + "/{id}"
+	organizationsPath  = "/organizations"
+	organizationIDPath = organizationsPath + "/{id}"
+	orgContactsPath    = organizationIDPath + "/contacts"
+	apiKeysPath        = "/api-keys"
+	apiKeyIDPath       = apiKeysPath + "/{id}"
+	apiKeyRotatePath   = apiKeyIDPath + "/rotate"
+	usersPath          = "/users"
+	userIDPath         = usersPath + "/{id}"
+	userRolesPath      = userIDPath + "/roles"
+	loginPath          = "/auth/login"
+	logoutPath         = "/auth/logout"
+	mfaEnrollPath      = "/auth/mfa/enroll"
+	mfaConfirmPath     = "/auth/mfa/confirm"
+	mfaDisablePath     = "/auth/mfa/disable"
+	mfaPolicyPath      = "/mfa-policy"
+	sharesPath         = "/shares"
+	shareIDPath        = sharesPath + "/{id}"
+	jobsPath           = "/jobs"
+	jobImportPath      = jobsPath + "/import"
+	jobExportPath      = jobsPath + "/export"
+	jobIDPath          = jobsPath + "/{id}"
+	jobResultPath      = jobIDPath + "/result"
+	jobCancelPath      = jobIDPath + "/cancel"
+	webhooksPath       = "/webhooks"
+	webhookIDPath      = webhooksPath + "/{id}"
+	deliveriesPath     = webhookIDPath + "/deliveries"
+	deliveryIDPath     = deliveriesPath + "/{deliveryId}"
+	redeliverPath      = deliveryIDPath + "/redeliver"
+	eventsPath         = "/events"
 	metricsPath        = "/metrics"
 )
 
-func NewRouter(handler *contacts.Handler) *mux.Router {
-	r := mux.NewRouter()
-	r.HandleFunc(contactsPath, handler.AddContactHandler).Methods("POST")
-	r.HandleFunc(contactsPath, handler.GetContactsHandler).Methods("GET")
-	r.HandleFunc(contactsSearchPath, handler.SearchContactHandler).Methods("GET")
-	r.HandleFunc(contactIDPath, handler.EditContactHandler).Methods("PUT")
-	r.HandleFunc(contactIDPath, handler.DeleteContactHandler).Methods("DELETE")
+type route struct {
+	path       string
+	method     string
+	permission string
+	handler    http.HandlerFunc
+}
+
+func NewRouter(handler *contacts.Handler, organizationHandler *organizations.Handler, keyHandler *apikeys.Handler, roleHandler *roles.Handler, userHandler *users.Handler, shareHandler *shares.Handler, jobHandler *jobs.Handler, webhookHandler *webhooks.Handler, eventHandler *outbox.Handler, keys *idempotency.Service, authenticator Authenticator, policy *auth.Policy) *mux.Router {
+	// Paths are matched encoded, so that a subject in a path may have slashes
+	r := mux.NewRouter().UseEncodedPath()
 	r.Handle(metricsPath, metrics.MetricsHandler()).Methods("GET")
+	r.HandleFunc(loginPath, userHandler.LoginHandler).Methods("POST")
+	r.HandleFunc(publicLinkPath, handler.PublicContactHandler).Methods("GET")
+
+	// Every route declares the permission it needs, which the policy checks
+	// against the caller's roles and scopes
+	routes := []route{
+		{contactsPath, "POST", auth.PermContactsWrite, handler.AddContactHandler},
+		{contactsPath, "GET", auth.PermContactsRead, handler.GetContactsHandler},
+		{contactsSearchPath, "GET", auth.PermContactsRead, handler.SearchContactHandler},
+		// The export path must come first, as it also matches the vCard path
+		{contactsExportPath, "GET", auth.PermContactsRead, handler.ExportVCardsHandler},
+		{rowsExportPath, "GET", auth.PermContactsRead, handler.ExportContactsHandler},
+		{contactVCardPath, "GET", auth.PermContactsRead, handler.GetVCardHandler},
+		{contactsImportPath, "POST", auth.PermContactsWrite, handler.ImportVCardsHandler},
+		{csvImportPath, "POST", auth.PermContactsWrite, handler.ImportCSVHandler},
+		{batchPath, "POST", auth.PermContactsWrite, handler.BatchHandler},
+		{duplicatesPath, "GET", auth.PermContactsRead, handler.DuplicatesHandler},
+		{mergePath, "POST", auth.PermContactsWrite, handler.MergeHandler},
+		{mergesPath, "GET", auth.PermContactsRead, handler.GetMergesHandler},
+		{undoMergePath, "POST", auth.PermContactsWrite, handler.UndoMergeHandler},
+		{trashPath, "GET", auth.PermContactsRead, handler.GetTrashHandler},
+		{restorePath, "POST", auth.PermContactsWrite, handler.RestoreContactHandler},
+		{trashIDPath, "DELETE", auth.PermContactsWrite, handler.PurgeContactHandler},
+		{contactIDPath, "PUT", auth.PermContactsWrite, handler.EditContactHandler},
+		{contactIDPath, "DELETE", auth.PermContactsWrite, handler.DeleteContactHandler},
+		{notesPath, "GET", auth.PermContactsRead, handler.GetNotesHandler},
+		{notesPath, "POST", auth.PermContactsWrite, handler.AddNoteHandler},
+		{noteIDPath, "PUT", auth.PermContactsWrite, handler.EditNoteHandler},
+		{noteIDPath, "DELETE", auth.PermContactsWrite, handler.DeleteNoteHandler},
+		{relationsPath, "GET", auth.PermContactsRead, handler.GetRelationsHandler},
+		{relationsPath, "POST", auth.PermContactsWrite, handler.AddRelationHandler},
+		{relationIDPath, "DELETE", auth.PermContactsWrite, handler.DeleteRelationHandler},
+		{shareLinkPath, "GET", auth.PermContactsWrite, handler.GetShareLinksHandler},
+		{shareLinkPath, "POST", auth.PermContactsWrite, handler.AddShareLinkHandler},
+		{shareLinkIDPath, "DELETE", auth.PermContactsWrite, handler.RevokeShareLinkHandler},
+		{birthdaysPath, "GET", auth.PermContactsRead, handler.BirthdayCalendarHandler},
+		{customFieldsPath, "GET", auth.PermContactsRead, handler.GetCustomFieldsHandler},
+		{customFieldsPath, "POST", auth.PermSchemaWrite, handler.AddCustomFieldHandler},
+		{customFieldIDPath, "PUT", auth.PermSchemaWrite, handler.EditCustomFieldHandler},
+		{customFieldIDPath, "DELETE", auth.PermSchemaWrite, handler.DeleteCustomFieldHandler},
+		{importProfilesPath, "GET", auth.PermContactsRead, handler.GetImportProfilesHandler},
+		{importProfilesPath, "POST", auth.PermContactsWrite, handler.AddImportProfileHandler},
+		{profileIDPath, "PUT", auth.PermContactsWrite, handler.EditImportProfileHandler},
+		{profileIDPath, "DELETE", auth.PermContactsWrite, handler.DeleteImportProfileHandler},
+		{jobsPath, "GET", auth.PermContactsRead, jobHandler.GetJobsHandler},
+		{jobImportPath, "POST", auth.PermContactsWrite, jobHandler.SubmitImportHandler},
+		{jobExportPath, "POST", auth.PermContactsRead, jobHandler.SubmitExportHandler},
+		{jobIDPath, "GET", auth.PermContactsRead, jobHandler.GetJobHandler},
+		{jobResultPath, "GET", auth.PermContactsRead, jobHandler.GetResultHandler},
+		{jobCancelPath, "POST", auth.PermContactsWrite, jobHandler.CancelJobHandler},
+		{webhooksPath, "GET", auth.PermWebhooksRead, webhookHandler.GetWebhooksHandler},
+		{webhooksPath, "POST", auth.PermWebhooksWrite, webhookHandler.AddWebhookHandler},
+		{webhookIDPath, "GET", auth.PermWebhooksRead, webhookHandler.GetWebhookHandler},
+		{webhookIDPath, "PUT", auth.PermWebhooksWrite, webhookHandler.UpdateWebhookHandler},
+		{webhookIDPath, "DELETE", auth.PermWebhooksWrite, webhookHandler.DeleteWebhookHandler},
+		{deliveriesPath, "GET", auth.PermWebhooksRead, webhookHandler.GetDeliveriesHandler},
+		{deliveryIDPath, "GET", auth.PermWebhooksRead, webhookHandler.GetDeliveryHandler},
+		{redeliverPath, "POST", auth.PermWebhooksWrite, webhookHandler.RedeliverHandler},
+		{eventsPath, "GET", auth.PermEventsRead, eventHandler.StreamHandler},
+		{organizationsPath, "GET", auth.PermContactsRead, organizationHandler.GetOrganizationsHandler},
+		{organizationsPath, "POST", auth.PermContactsWrite, organizationHandler.AddOrganizationHandler},
+		{organizationIDPath, "GET", auth.PermContactsRead, organizationHandler.GetOrganizationHandler},
+		{organizationIDPath, "PUT", auth.PermContactsWrite, organizationHandler.EditOrganizationHandler},
+		{organizationIDPath, "DELETE", auth.PermContactsWrite, organizationHandler.DeleteOrganizationHandler},
+		{orgContactsPath, "GET", auth.PermContactsRead, handler.GetOrganizationContactsHandler},
+		{sharesPath, "GET", auth.PermContactsRead, shareHandler.GetSharesHandler},
+		{sharesPath, "POST", auth.PermContactsWrite, shareHandler.AddShareHandler},
+		{shareIDPath, "PUT", auth.PermContactsWrite, shareHandler.EditShareHandler},
+		{shareIDPath, "DELETE", auth.PermContactsWrite, shareHandler.DeleteShareHandler},
+		{apiKeysPath, "GET", auth.PermAPIKeysRead, keyHandler.GetKeysHandler},
+		{apiKeysPath, "POST", auth.PermAPIKeysWrite, keyHandler.AddKeyHandler},
+		{apiKeyRotatePath, "POST", auth.PermAPIKeysWrite, keyHandler.RotateKeyHandler},
+		{apiKeyIDPath, "DELETE", auth.PermAPIKeysWrite, keyHandler.RevokeKeyHandler},
+		{usersPath, "GET", auth.PermUsersRead, userHandler.GetUsersHandler},
+		{usersPath, "POST", auth.PermUsersWrite, userHandler.AddUserHandler},
+		{userIDPath, "DELETE", auth.PermUsersWrite, userHandler.DeleteUserHandler},
+		{userRolesPath, "GET", auth.PermRolesRead, roleHandler.GetRolesHandler},
+		{userRolesPath, "PUT", auth.PermRolesWrite, roleHandler.SetRolesHandler},
+		{mfaPolicyPath, "GET", auth.PermRolesRead, roleHandler.GetMFAPolicyHandler},
+		{mfaPolicyPath, "PUT", auth.PermRolesWrite, roleHandler.SetMFAPolicyHandler},
+		{logoutPath, "POST", "", userHandler.LogoutHandler},
+		{mfaEnrollPath, "POST", "", userHandler.EnrollMFAHandler},
+		{mfaConfirmPath, "POST", "", userHandler.ConfirmMFAHandler},
+		{mfaDisablePath, "POST", "", userHandler.DisableMFAHandler},
+	}
+
+	// Every API route acts on behalf of an authenticated tenant
+	api := r.PathPrefix("/").Subrouter()
+	api.Use(AuthMiddleware(authenticator, userHandler.Service, config.AppConfig.AuthRequired))
+	api.Use(IdempotencyMiddleware(keys))
+	for _, route := range routes {
+		api.Handle(route.path, authorize(policy, route.permission, route.handler)).Methods(route.method)
+	}
 	return r
 }
@@ -0,0 +1,143 @@
+package shares
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/benhuri/phone-book-api/internal/auth"
+	"github.com/benhuri/phone-book-api/internal/httputil"
+	"github.com/go-playground/validator/v10"
+	"github.com/gorilla/mux"
+)
+
+const (
+	contentType         = "Content-Type"
+	applicationJSON     = "application/json"
+	idParam             = "id"
+	invalidRequestError = "Invalid request payload"
+	invalidShareID      = "Invalid share ID"
+	internalServerError = "Internal Server Error"
+)
+
+type Handler struct {
+	Service *Service
+}
+
+func NewHandler(service *Service) *Handler {
+	return &Handler{Service: service}
+}
+
+var validate *validator.Validate
+
+func init() {
+	validate = validator.New()
+	// Shares name a user by subject, so that a token's user and a local user
+	// with the same ID are never confused
+	validate.RegisterValidation("subject", func(fl validator.FieldLevel) bool {
+		return fl.Field().String() == "" || auth.IsSubject(fl.Field().String())
+	})
+}
+
+func (h *Handler) GetSharesHandler(w http.ResponseWriter, r *http.Request) {
+	shares, err := h.Service.GetShares(r.Context())
+	if err != nil {
+		log.Printf("Error getting shares: %v", err)
+		http.Error(w, internalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(contentType, applicationJSON)
+	json.NewEncoder(w).Encode(shares)
+}
+
+func (h *Handler) AddShareHandler(w http.ResponseWriter, r *http.Request) {
+	share, ok := decodeShare(w, r)
+	if !ok {
+		return
+	}
+
+	err := h.Service.AddShare(r.Context(), share)
+	if writeShareError(w, err, "Error adding share") {
+		return
+	}
+
+	w.Header().Set(contentType, applicationJSON)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(share)
+}
+
+func (h *Handler) EditShareHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)[idParam])
+	if err != nil {
+		log.Printf("Invalid share ID: %v", err)
+		http.Error(w, invalidShareID, http.StatusBadRequest)
+		return
+	}
+
+	share, ok := decodeShare(w, r)
+	if !ok {
+		return
+	}
+	share.ID = id
+
+	err = h.Service.EditShare(r.Context(), share)
+	if writeShareError(w, err, "Error editing share") {
+		return
+	}
+
+	w.Header().Set(contentType, applicationJSON)
+	json.NewEncoder(w).Encode(share)
+}
+
+func (h *Handler) DeleteShareHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)[idParam])
+	if err != nil {
+		log.Printf("Invalid share ID: %v", err)
+		http.Error(w, invalidShareID, http.StatusBadRequest)
+		return
+	}
+
+	err = h.Service.DeleteShare(r.Context(), id)
+	if writeShareError(w, err, "Error deleting share") {
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func decodeShare(w http.ResponseWriter, r *http.Request) (*Share, bool) {
+	var share Share
+	if err := json.NewDecoder(r.Body).Decode(&share); err != nil {
+		log.Printf("Error decoding share: %v", err)
+		http.Error(w, invalidRequestError, http.StatusBadRequest)
+		return nil, false
+	}
+
+	if err := validate.Struct(share); err != nil {
+		log.Printf("Validation error: %v", err)
+		http.Error(w, httputil.FormatValidationError(err), http.StatusBadRequest)
+		return nil, false
+	}
+	return &share, true
+}
+
+// writeShareError reports whether err was written as the response.
+func writeShareError(w http.ResponseWriter, err error, message string) bool {
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, ErrNoPhoneBook), errors.Is(err, ErrShareWithSelf), errors.Is(err, ErrExpiredShare):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrShareNotFound):
+		http.Error(w, shareNotFoundError, http.StatusNotFound)
+	case errors.Is(err, ErrShareExists):
+		http.Error(w, shareExistsError, http.StatusConflict)
+	default:
+		log.Printf("%s: %v", message, err)
+		http.Error(w, internalServerError, http.StatusInternalServerError)
+	}
+	return true
+}
@@ -0,0 +1,21 @@
+package shares
+
+import "time"
+
+const (
+	PermissionRead  = "read"
+	PermissionWrite = "write"
+)
+
+// Share gives a user or a team access to the owner's phone book, or only to
+// its contacts in a group when Group is set.
+type Share struct {
+	ID         int        `json:"id"`
+	Owner      string     `json:"owner"`
+	Group      string     `json:"group,omitempty" validate:"omitempty,max=50"`
+	UserID     string     `json:"user_id,omitempty" validate:"required_without=Team,excluded_with=Team,subject"`
+	Team       string     `json:"team,omitempty" validate:"max=100"`
+	Permission string     `json:"permission" validate:"required,oneof=read write"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
@@ -0,0 +1,161 @@
+package shares
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/benhuri/phone-book-api/internal/auth"
+	"github.com/lib/pq"
+)
+
+const (
+	// Queries take the tenant and the caller's phone book as their first
+	// arguments, followed by the caller's teams when listing. Callers without
+	// a phone book act for the tenant and manage every share.
+	shareColumns         = "id, owner_id, group_name, user_id, team, permission, expires_at, created_at"
+	selectSharesQuery    = "SELECT " + shareColumns + " FROM shares WHERE tenant_id = $1 AND ($2 = '' OR owner_id = $2 OR user_id = $2 OR (team <> '' AND team = ANY($3))) ORDER BY id"
+	insertShareQuery     = "INSERT INTO shares (tenant_id, owner_id, group_name, user_id, team, permission, expires_at) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id, created_at"
+	updateShareQuery     = "UPDATE shares SET group_name = $3, user_id = $4, team = $5, permission = $6, expires_at = $7 WHERE tenant_id = $1 AND ($2 = '' OR owner_id = $2) AND id = $8 RETURNING owner_id, created_at"
+	deleteShareQuery     = "DELETE FROM shares WHERE tenant_id = $1 AND ($2 = '' OR owner_id = $2) AND id = $3"
+	fetchSharesError     = "failed to fetch shares: %w"
+	createShareError     = "failed to create share: %w"
+	updateShareError     = "failed to update share: %w"
+	removeShareError     = "failed to remove share: %w"
+	getRowsAffectedError = "failed to get rows affected: %w"
+	rowsError            = "rows error: %w"
+	shareNotFoundError   = "share not found"
+	shareExistsError     = "share already exists"
+	uniqueViolationCode  = "23505"
+)
+
+var (
+	ErrShareNotFound = errors.New(shareNotFoundError)
+	ErrShareExists   = errors.New(shareExistsError)
+)
+
+type Repository interface {
+	// FetchShares returns the shares the caller made and those made with the
+	// caller or the caller's teams.
+	FetchShares(ctx context.Context) ([]Share, error)
+	CreateShare(ctx context.Context, share *Share) error
+	UpdateShare(ctx context.Context, share *Share) error
+	RemoveShare(ctx context.Context, id int) error
+}
+
+type shareRepository struct {
+	db *sql.DB
+}
+
+func NewRepository(db *sql.DB) Repository {
+	return &shareRepository{db: db}
+}
+
+func (r *shareRepository) FetchShares(ctx context.Context) ([]Share, error) {
+	args, err := viewer(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := r.db.QueryContext(ctx, selectSharesQuery, args...)
+	if err != nil {
+		return nil, fmt.Errorf(fetchSharesError, err)
+	}
+	defer rows.Close()
+
+	shares := []Share{}
+	for rows.Next() {
+		var share Share
+		if err := scanShare(rows, &share); err != nil {
+			return nil, fmt.Errorf(fetchSharesError, err)
+		}
+		shares = append(shares, share)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf(rowsError, err)
+	}
+
+	return shares, nil
+}
+
+func (r *shareRepository) CreateShare(ctx context.Context, share *Share) error {
+	args, err := viewer(ctx)
+	if err != nil {
+		return err
+	}
+	share.Owner = args[1].(string)
+	err = r.db.QueryRowContext(ctx, insertShareQuery, append(args[:2], share.Group, share.UserID, share.Team, share.Permission,
+		share.ExpiresAt)...).Scan(&share.ID, &share.CreatedAt)
+	if isUniqueViolation(err) {
+		return ErrShareExists
+	}
+	if err != nil {
+		return fmt.Errorf(createShareError, err)
+	}
+	return nil
+}
+
+func (r *shareRepository) UpdateShare(ctx context.Context, share *Share) error {
+	args, err := viewer(ctx)
+	if err != nil {
+		return err
+	}
+	err = r.db.QueryRowContext(ctx, updateShareQuery, append(args[:2], share.Group, share.UserID, share.Team, share.Permission,
+		share.ExpiresAt, share.ID)...).Scan(&share.Owner, &share.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrShareNotFound
+	}
+	if isUniqueViolation(err) {
+		return ErrShareExists
+	}
+	if err != nil {
+		return fmt.Errorf(updateShareError, err)
+	}
+	return nil
+}
+
+func (r *shareRepository) RemoveShare(ctx context.Context, id int) error {
+	args, err := viewer(ctx)
+	if err != nil {
+		return err
+	}
+	result, err := r.db.ExecContext(ctx, deleteShareQuery, append(args[:2], id)...)
+	if err != nil {
+		return fmt.Errorf(removeShareError, err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf(getRowsAffectedError, err)
+	}
+	if rowsAffected == 0 {
+		return ErrShareNotFound
+	}
+	return nil
+}
+
+func viewer(ctx context.Context) ([]interface{}, error) {
+	tenantID, err := auth.TenantID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	principal, _ := auth.FromContext(ctx)
+	teams := principal.Teams
+	if teams == nil {
+		teams = []string{}
+	}
+	return []interface{}{tenantID, principal.Owner(), pq.Array(teams)}, nil
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanShare(row rowScanner, share *Share) error {
+	return row.Scan(&share.ID, &share.Owner, &share.Group, &share.UserID, &share.Team, &share.Permission, &share.ExpiresAt, &share.CreatedAt)
+}
+
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == uniqueViolationCode
+}
@@ -0,0 +1,70 @@
+package shares
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/benhuri/phone-book-api/internal/auth"
+)
+
+const (
+	noPhoneBookError   = "only users with a phone book of their own can share it"
+	shareWithSelfError = "a phone book cannot be shared with its owner"
+	expiredShareError  = "expires_at must be in the future"
+)
+
+var (
+	ErrNoPhoneBook   = errors.New(noPhoneBookError)
+	ErrShareWithSelf = errors.New(shareWithSelfError)
+	ErrExpiredShare  = errors.New(expiredShareError)
+)
+
+type Service struct {
+	repo Repository
+}
+
+func NewService(repo Repository) *Service {
+	return &Service{repo: repo}
+}
+
+func (s *Service) GetShares(ctx context.Context) ([]Share, error) {
+	return s.repo.FetchShares(ctx)
+}
+
+// AddShare shares the caller's own phone book. API keys and admin tokens
+// act for the tenant, whose contacts everyone already sees.
+func (s *Service) AddShare(ctx context.Context, share *Share) error {
+	principal, ok := auth.FromContext(ctx)
+	if !ok || principal.Owner() == "" {
+		return ErrNoPhoneBook
+	}
+	if share.UserID == principal.Owner() {
+		return ErrShareWithSelf
+	}
+	if err := checkExpiry(share); err != nil {
+		return err
+	}
+	return s.repo.CreateShare(ctx, share)
+}
+
+func (s *Service) EditShare(ctx context.Context, share *Share) error {
+	if principal, ok := auth.FromContext(ctx); ok && share.UserID != "" && share.UserID == principal.Owner() {
+		return ErrShareWithSelf
+	}
+	if err := checkExpiry(share); err != nil {
+		return err
+	}
+	return s.repo.UpdateShare(ctx, share)
+}
+
+func (s *Service) DeleteShare(ctx context.Context, id int) error {
+	return s.repo.RemoveShare(ctx, id)
+}
+
+func checkExpiry(share *Share) error {
+	if share.ExpiresAt != nil && !share.ExpiresAt.After(time.Now()) {
+		return ErrExpiredShare
+	}
+	return nil
+}
@@ -0,0 +1,305 @@
+package users
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/benhuri/phone-book-api/internal/auth"
+	"github.com/benhuri/phone-book-api/internal/httputil"
+	"github.com/go-playground/validator/v10"
+	"github.com/gorilla/mux"
+)
+
+const (
+	contentType         = "Content-Type"
+	applicationJSON     = "application/json"
+	retryAfterHeader    = "Retry-After"
+	tenantHeader        = "X-Tenant-ID"
+	idParam             = "id"
+	invalidRequestError = "Invalid request payload"
+	invalidUserID       = "Invalid user ID"
+	localUsersOnlyError = "MFA is only available to local user sessions"
+	internalServerError = "Internal Server Error"
+)
+
+type Handler struct {
+	Service *Service
+	// secureCookie is only disabled for local development over plain HTTP.
+	secureCookie bool
+}
+
+func NewHandler(service *Service, secureCookie bool) *Handler {
+	return &Handler{Service: service, secureCookie: secureCookie}
+}
+
+var validate *validator.Validate
+
+func init() {
+	validate = validator.New()
+}
+
+func (h *Handler) GetUsersHandler(w http.ResponseWriter, r *http.Request) {
+	page, limit := httputil.ParsePagination(r)
+
+	users, err := h.Service.GetUsers(r.Context(), page, limit)
+	if err != nil {
+		log.Printf("Error getting users: %v", err)
+		http.Error(w, internalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(contentType, applicationJSON)
+	json.NewEncoder(w).Encode(users)
+}
+
+func (h *Handler) AddUserHandler(w http.ResponseWriter, r *http.Request) {
+	var user User
+	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
+		log.Printf("Error decoding user: %v", err)
+		http.Error(w, invalidRequestError, http.StatusBadRequest)
+		return
+	}
+
+	if err := validate.Struct(user); err != nil {
+		log.Printf("Validation error: %v", err)
+		http.Error(w, httputil.FormatValidationError(err), http.StatusBadRequest)
+		return
+	}
+
+	err := h.Service.AddUser(r.Context(), &user)
+	if errors.Is(err, ErrUsernameTaken) {
+		http.Error(w, usernameTakenError, http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Error adding user: %v", err)
+		http.Error(w, internalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(contentType, applicationJSON)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(user)
+}
+
+func (h *Handler) DeleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)[idParam])
+	if err != nil {
+		log.Printf("Invalid user ID: %v", err)
+		http.Error(w, invalidUserID, http.StatusBadRequest)
+		return
+	}
+
+	err = h.Service.DeleteUser(r.Context(), id)
+	if errors.Is(err, ErrUserNotFound) {
+		http.Error(w, userNotFoundError, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error deleting user: %v", err)
+		http.Error(w, internalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) LoginHandler(w http.ResponseWriter, r *http.Request) {
+	var credentials Credentials
+	if err := json.NewDecoder(r.Body).Decode(&credentials); err != nil {
+		log.Printf("Error decoding credentials: %v", err)
+		http.Error(w, invalidRequestError, http.StatusBadRequest)
+		return
+	}
+	if credentials.Tenant == "" {
+		credentials.Tenant = r.Header.Get(tenantHeader)
+	}
+
+	if err := validate.Struct(credentials); err != nil {
+		log.Printf("Validation error: %v", err)
+		http.Error(w, httputil.FormatValidationError(err), http.StatusBadRequest)
+		return
+	}
+
+	session, token, err := h.Service.Login(r.Context(), credentials, clientAddress(r))
+	var throttled *ThrottleError
+	if errors.As(err, &throttled) {
+		w.Header().Set(retryAfterHeader, strconv.Itoa(int(math.Ceil(throttled.RetryAfter.Seconds()))))
+		httputil.WriteProblem(w, http.StatusTooManyRequests, tooManyAttemptsError)
+		return
+	}
+	if errors.Is(err, ErrInvalidCredentials) || errors.Is(err, ErrInvalidCode) || errors.Is(err, ErrCodeRequired) {
+		httputil.WriteProblem(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("Error logging in: %v", err)
+		http.Error(w, internalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  session.ExpiresAt,
+		HttpOnly: true,
+		Secure:   h.secureCookie,
+		SameSite: http.SameSiteLaxMode,
+	})
+	w.Header().Set(contentType, applicationJSON)
+	json.NewEncoder(w).Encode(session)
+}
+
+func (h *Handler) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(SessionCookie); err == nil {
+		if err := h.Service.Logout(r.Context(), cookie.Value); err != nil {
+			log.Printf("Error logging out: %v", err)
+			http.Error(w, internalServerError, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookie,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   h.secureCookie,
+		SameSite: http.SameSiteLaxMode,
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) EnrollMFAHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := sessionUserID(r)
+	if !ok {
+		http.Error(w, localUsersOnlyError, http.StatusBadRequest)
+		return
+	}
+
+	enrollment, err := h.Service.EnrollTOTP(r.Context(), userID)
+	if errors.Is(err, ErrMFAEnabled) {
+		http.Error(w, mfaEnabledError, http.StatusConflict)
+		return
+	}
+	if errors.Is(err, ErrUserNotFound) {
+		http.Error(w, userNotFoundError, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error enrolling mfa: %v", err)
+		http.Error(w, internalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(contentType, applicationJSON)
+	json.NewEncoder(w).Encode(enrollment)
+}
+
+func (h *Handler) ConfirmMFAHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := sessionUserID(r)
+	if !ok {
+		http.Error(w, localUsersOnlyError, http.StatusBadRequest)
+		return
+	}
+	request, ok := decodeCodeRequest(w, r)
+	if !ok {
+		return
+	}
+
+	var sessionToken string
+	if cookie, err := r.Cookie(SessionCookie); err == nil {
+		sessionToken = cookie.Value
+	}
+
+	codes, err := h.Service.ConfirmTOTP(r.Context(), userID, request.Code, sessionToken)
+	if errors.Is(err, ErrInvalidCode) || errors.Is(err, ErrMFANotEnrolled) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, ErrMFAEnabled) {
+		http.Error(w, mfaEnabledError, http.StatusConflict)
+		return
+	}
+	if errors.Is(err, ErrUserNotFound) {
+		http.Error(w, userNotFoundError, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error confirming mfa: %v", err)
+		http.Error(w, internalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(contentType, applicationJSON)
+	json.NewEncoder(w).Encode(map[string][]string{"recovery_codes": codes})
+}
+
+func (h *Handler) DisableMFAHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := sessionUserID(r)
+	if !ok {
+		http.Error(w, localUsersOnlyError, http.StatusBadRequest)
+		return
+	}
+	request, ok := decodeCodeRequest(w, r)
+	if !ok {
+		return
+	}
+
+	err := h.Service.DisableTOTP(r.Context(), userID, request.Code)
+	if errors.Is(err, ErrInvalidCode) || errors.Is(err, ErrMFANotEnrolled) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, ErrUserNotFound) {
+		http.Error(w, userNotFoundError, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error disabling mfa: %v", err)
+		http.Error(w, internalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// sessionUserID returns the local user behind the request.
+func sessionUserID(r *http.Request) (int, bool) {
+	principal, ok := auth.FromContext(r.Context())
+	if !ok || principal.UserID == 0 {
+		return 0, false
+	}
+	return principal.UserID, true
+}
+
+func decodeCodeRequest(w http.ResponseWriter, r *http.Request) (CodeRequest, bool) {
+	var request CodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		log.Printf("Error decoding code: %v", err)
+		http.Error(w, invalidRequestError, http.StatusBadRequest)
+		return request, false
+	}
+	if err := validate.Struct(request); err != nil {
+		log.Printf("Validation error: %v", err)
+		http.Error(w, httputil.FormatValidationError(err), http.StatusBadRequest)
+		return request, false
+	}
+	return request, true
+}
+
+// clientAddress is the peer address of the request. Forwarding headers are
+// ignored because clients can forge them to dodge throttling.
+func clientAddress(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
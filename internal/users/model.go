@@ -0,0 +1,48 @@
+package users
+
+import "time"
+
+type User struct {
+	ID         int       `json:"id"`
+	Username   string    `json:"username" validate:"required,min=3,max=50"`
+	Password   string    `json:"password,omitempty" validate:"required,min=12,max=72"`
+	MFAEnabled bool      `json:"mfa_enabled"`
+	CreatedAt  time.Time `json:"created_at"`
+
+	passwordHash []byte
+	// totpSecret is set on enrollment and only used once MFAEnabled is set.
+	totpSecret   []byte
+	totpLastStep int64
+}
+
+type Credentials struct {
+	// Tenant defaults to the X-Tenant-ID header and then the default tenant.
+	Tenant   string `json:"tenant" validate:"omitempty,max=64"`
+	Username string `json:"username" validate:"required,max=50"`
+	Password string `json:"password" validate:"required,max=72"`
+	// Code is a TOTP or recovery code, required for users with MFA.
+	Code string `json:"code,omitempty" validate:"omitempty,max=20"`
+}
+
+// Enrollment is returned when a user starts enrolling an authenticator app.
+type Enrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"otpauth_uri"`
+}
+
+type CodeRequest struct {
+	Code string `json:"code" validate:"required,max=20"`
+}
+
+// Session is a browser login. Its token is only known to the client's cookie;
+// the store keeps a hash of it.
+type Session struct {
+	UserID    int       `json:"user_id"`
+	CSRFToken string    `json:"csrf_token"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// MFA is set when the user proved a second factor for this session.
+	MFA bool `json:"mfa"`
+
+	tenantID  string
+	tokenHash []byte
+}
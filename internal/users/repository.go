@@ -0,0 +1,340 @@
+package users
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/benhuri/phone-book-api/internal/auth"
+	"github.com/lib/pq"
+)
+
+const (
+	userColumns           = "id, username, totp_enabled, created_at, password_hash, totp_secret, totp_last_step"
+	selectUsersQuery      = "SELECT " + userColumns + " FROM users WHERE tenant_id = $1 ORDER BY username LIMIT $2 OFFSET $3"
+	selectUserQuery       = "SELECT " + userColumns + " FROM users WHERE tenant_id = $1 AND id = $2"
+	selectUserByName      = "SELECT " + userColumns + " FROM users WHERE tenant_id = $1 AND username = $2"
+	insertUserQuery       = "INSERT INTO users (tenant_id, username, password_hash) VALUES ($1, $2, $3) RETURNING id, created_at"
+	deleteUserQuery       = "DELETE FROM users WHERE tenant_id = $1 AND id = $2"
+	setTOTPSecretQuery    = "UPDATE users SET totp_secret = $3 WHERE tenant_id = $1 AND id = $2 AND NOT totp_enabled"
+	enableTOTPQuery       = "UPDATE users SET totp_enabled = true, totp_last_step = $3 WHERE tenant_id = $1 AND id = $2 AND NOT totp_enabled AND totp_secret IS NOT NULL"
+	disableTOTPQuery      = "UPDATE users SET totp_enabled = false, totp_secret = NULL, totp_last_step = 0 WHERE tenant_id = $1 AND id = $2"
+	useTOTPStepQuery      = "UPDATE users SET totp_last_step = $2 WHERE id = $1 AND totp_last_step < $2"
+	deleteRecoveryCodes   = "DELETE FROM recovery_codes WHERE user_id = $1"
+	insertRecoveryCodes   = "INSERT INTO recovery_codes (user_id, code_hash) SELECT $1, unnest($2::bytea[])"
+	useRecoveryCodeQuery  = "UPDATE recovery_codes SET used_at = now() WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL"
+	insertSessionQuery    = "INSERT INTO sessions (token_hash, tenant_id, user_id, csrf_token, expires_at, mfa) VALUES ($1, $2, $3, $4, $5, $6)"
+	selectSessionQuery    = "SELECT tenant_id, user_id, csrf_token, expires_at, mfa FROM sessions WHERE token_hash = $1 AND expires_at > now()"
+	markSessionMFAQuery   = "UPDATE sessions SET mfa = true WHERE token_hash = $1"
+	deleteSessionQuery    = "DELETE FROM sessions WHERE token_hash = $1"
+	deleteExpiredSessions = "DELETE FROM sessions WHERE expires_at <= now()"
+	fetchUsersError       = "failed to fetch users: %w"
+	scanUserError         = "failed to scan user: %w"
+	createUserError       = "failed to create user: %w"
+	removeUserError       = "failed to remove user: %w"
+	updateMFAError        = "failed to update mfa: %w"
+	createSessionError    = "failed to create session: %w"
+	getSessionError       = "failed to get session: %w"
+	removeSessionError    = "failed to remove session: %w"
+	removeExpiredError    = "failed to remove expired sessions: %w"
+	beginTxError          = "failed to begin transaction: %w"
+	commitTxError         = "failed to commit transaction: %w"
+	getRowsAffectedError  = "failed to get rows affected: %w"
+	rowsError             = "rows error: %w"
+	userNotFoundError     = "user not found"
+	usernameTakenError    = "username already taken"
+	sessionNotFoundError  = "session not found"
+	mfaEnabledError       = "mfa is already enabled"
+	uniqueViolationCode   = "23505"
+)
+
+var (
+	ErrUserNotFound    = errors.New(userNotFoundError)
+	ErrUsernameTaken   = errors.New(usernameTakenError)
+	ErrSessionNotFound = errors.New(sessionNotFoundError)
+	ErrMFAEnabled      = errors.New(mfaEnabledError)
+)
+
+type Repository interface {
+	FetchUsers(ctx context.Context, limit, offset int) ([]User, error)
+	// GetUserByName and the session lookups run before a principal exists
+	// and therefore take the tenant explicitly or are unscoped.
+	GetUserByName(ctx context.Context, tenantID, username string) (*User, error)
+	GetUser(ctx context.Context, id int) (*User, error)
+	CreateUser(ctx context.Context, user *User) error
+	RemoveUser(ctx context.Context, id int) error
+	SetTOTPSecret(ctx context.Context, id int, secret []byte) error
+	// EnableTOTP replaces the user's recovery codes with the hashed ones.
+	EnableTOTP(ctx context.Context, id int, step int64, codeHashes [][]byte) error
+	DisableTOTP(ctx context.Context, id int) error
+	// UseTOTPStep and UseRecoveryCode consume a second factor and report
+	// false when it was already used.
+	UseTOTPStep(ctx context.Context, id int, step int64) (bool, error)
+	UseRecoveryCode(ctx context.Context, id int, codeHash []byte) (bool, error)
+	CreateSession(ctx context.Context, session *Session) error
+	GetSession(ctx context.Context, tokenHash []byte) (*Session, error)
+	RemoveSession(ctx context.Context, tokenHash []byte) error
+	MarkSessionMFA(ctx context.Context, tokenHash []byte) error
+	RemoveExpiredSessions(ctx context.Context) error
+}
+
+type userRepository struct {
+	db *sql.DB
+}
+
+func NewRepository(db *sql.DB) Repository {
+	return &userRepository{db: db}
+}
+
+func (r *userRepository) FetchUsers(ctx context.Context, limit, offset int) ([]User, error) {
+	tenantID, err := auth.TenantID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := r.db.QueryContext(ctx, selectUsersQuery, tenantID, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf(fetchUsersError, err)
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, *user)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf(rowsError, err)
+	}
+
+	return users, nil
+}
+
+func (r *userRepository) GetUserByName(ctx context.Context, tenantID, username string) (*User, error) {
+	user, err := scanUser(r.db.QueryRowContext(ctx, selectUserByName, tenantID, username))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrUserNotFound
+	}
+	return user, err
+}
+
+func (r *userRepository) GetUser(ctx context.Context, id int) (*User, error) {
+	tenantID, err := auth.TenantID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	user, err := scanUser(r.db.QueryRowContext(ctx, selectUserQuery, tenantID, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrUserNotFound
+	}
+	return user, err
+}
+
+func (r *userRepository) CreateUser(ctx context.Context, user *User) error {
+	tenantID, err := auth.TenantID(ctx)
+	if err != nil {
+		return err
+	}
+	err = r.db.QueryRowContext(ctx, insertUserQuery, tenantID, user.Username, user.passwordHash).Scan(&user.ID, &user.CreatedAt)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == uniqueViolationCode {
+		return ErrUsernameTaken
+	}
+	if err != nil {
+		return fmt.Errorf(createUserError, err)
+	}
+	return nil
+}
+
+func (r *userRepository) RemoveUser(ctx context.Context, id int) error {
+	tenantID, err := auth.TenantID(ctx)
+	if err != nil {
+		return err
+	}
+	result, err := r.db.ExecContext(ctx, deleteUserQuery, tenantID, id)
+	if err != nil {
+		return fmt.Errorf(removeUserError, err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf(getRowsAffectedError, err)
+	}
+	if rowsAffected == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+func (r *userRepository) CreateSession(ctx context.Context, session *Session) error {
+	_, err := r.db.ExecContext(ctx, insertSessionQuery, session.tokenHash, session.tenantID, session.UserID, session.CSRFToken, session.ExpiresAt, session.MFA)
+	if err != nil {
+		return fmt.Errorf(createSessionError, err)
+	}
+	return nil
+}
+
+func (r *userRepository) GetSession(ctx context.Context, tokenHash []byte) (*Session, error) {
+	session := Session{tokenHash: tokenHash}
+	err := r.db.QueryRowContext(ctx, selectSessionQuery, tokenHash).Scan(&session.tenantID, &session.UserID, &session.CSRFToken, &session.ExpiresAt, &session.MFA)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf(getSessionError, err)
+	}
+	return &session, nil
+}
+
+func (r *userRepository) RemoveSession(ctx context.Context, tokenHash []byte) error {
+	if _, err := r.db.ExecContext(ctx, deleteSessionQuery, tokenHash); err != nil {
+		return fmt.Errorf(removeSessionError, err)
+	}
+	return nil
+}
+
+func (r *userRepository) RemoveExpiredSessions(ctx context.Context) error {
+	if _, err := r.db.ExecContext(ctx, deleteExpiredSessions); err != nil {
+		return fmt.Errorf(removeExpiredError, err)
+	}
+	return nil
+}
+
+func (r *userRepository) MarkSessionMFA(ctx context.Context, tokenHash []byte) error {
+	if _, err := r.db.ExecContext(ctx, markSessionMFAQuery, tokenHash); err != nil {
+		return fmt.Errorf(updateMFAError, err)
+	}
+	return nil
+}
+
+func (r *userRepository) SetTOTPSecret(ctx context.Context, id int, secret []byte) error {
+	tenantID, err := auth.TenantID(ctx)
+	if err != nil {
+		return err
+	}
+	result, err := r.db.ExecContext(ctx, setTOTPSecretQuery, tenantID, id, secret)
+	if err != nil {
+		return fmt.Errorf(updateMFAError, err)
+	}
+	return r.checkMFAUpdated(ctx, result, id)
+}
+
+func (r *userRepository) EnableTOTP(ctx context.Context, id int, step int64, codeHashes [][]byte) error {
+	tenantID, err := auth.TenantID(ctx)
+	if err != nil {
+		return err
+	}
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf(beginTxError, err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, enableTOTPQuery, tenantID, id, step)
+	if err != nil {
+		return fmt.Errorf(updateMFAError, err)
+	}
+	if err := r.checkMFAUpdated(ctx, result, id); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, deleteRecoveryCodes, id); err != nil {
+		return fmt.Errorf(updateMFAError, err)
+	}
+	if _, err := tx.ExecContext(ctx, insertRecoveryCodes, id, pq.ByteaArray(codeHashes)); err != nil {
+		return fmt.Errorf(updateMFAError, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf(commitTxError, err)
+	}
+	return nil
+}
+
+func (r *userRepository) DisableTOTP(ctx context.Context, id int) error {
+	tenantID, err := auth.TenantID(ctx)
+	if err != nil {
+		return err
+	}
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf(beginTxError, err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, disableTOTPQuery, tenantID, id)
+	if err != nil {
+		return fmt.Errorf(updateMFAError, err)
+	}
+	if rowsAffected, err := result.RowsAffected(); err != nil {
+		return fmt.Errorf(getRowsAffectedError, err)
+	} else if rowsAffected == 0 {
+		return ErrUserNotFound
+	}
+	if _, err := tx.ExecContext(ctx, deleteRecoveryCodes, id); err != nil {
+		return fmt.Errorf(updateMFAError, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf(commitTxError, err)
+	}
+	return nil
+}
+
+func (r *userRepository) UseTOTPStep(ctx context.Context, id int, step int64) (bool, error) {
+	result, err := r.db.ExecContext(ctx, useTOTPStepQuery, id, step)
+	if err != nil {
+		return false, fmt.Errorf(updateMFAError, err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf(getRowsAffectedError, err)
+	}
+	return rowsAffected == 1, nil
+}
+
+func (r *userRepository) UseRecoveryCode(ctx context.Context, id int, codeHash []byte) (bool, error) {
+	result, err := r.db.ExecContext(ctx, useRecoveryCodeQuery, id, codeHash)
+	if err != nil {
+		return false, fmt.Errorf(updateMFAError, err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf(getRowsAffectedError, err)
+	}
+	return rowsAffected == 1, nil
+}
+
+// checkMFAUpdated tells a missing user apart from one that already enabled MFA.
+func (r *userRepository) checkMFAUpdated(ctx context.Context, result sql.Result, id int) error {
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf(getRowsAffectedError, err)
+	}
+	if rowsAffected == 1 {
+		return nil
+	}
+	if _, err := r.GetUser(ctx, id); err != nil {
+		return err
+	}
+	return ErrMFAEnabled
+}
+
+func scanUser(row rowScanner) (*User, error) {
+	var user User
+	err := row.Scan(&user.ID, &user.Username, &user.MFAEnabled, &user.CreatedAt, &user.passwordHash, &user.totpSecret, &user.totpLastStep)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf(scanUserError, err)
+	}
+	return &user, nil
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
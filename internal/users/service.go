@@ -0,0 +1,311 @@
+package users
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/benhuri/phone-book-api/internal/auth"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	SessionCookie = "session"
+	CSRFHeader    = "X-CSRF-Token"
+
+	tokenBytes         = 32
+	recoveryCodeCount  = 10
+	recoveryCodeBytes  = 5
+	recoveryCodeLength = 8
+	userLoginLimit     = 5
+	addressLoginLimit  = 20
+	loginWindow        = 15 * time.Minute
+
+	invalidCredentialsError = "invalid username or password"
+	tooManyAttemptsError    = "too many failed login attempts"
+	hashPasswordError       = "failed to hash password: %w"
+	generateTokenError      = "failed to generate session token: %w"
+	invalidSessionError     = "invalid session: %w"
+	codeRequiredError       = "a one-time code is required"
+	invalidCodeError        = "invalid one-time code"
+	mfaNotEnrolledError     = "mfa is not enrolled"
+	generateSecretError     = "failed to generate mfa secret: %w"
+)
+
+var (
+	ErrInvalidCredentials = errors.New(invalidCredentialsError)
+	ErrTooManyAttempts    = errors.New(tooManyAttemptsError)
+	ErrCodeRequired       = errors.New(codeRequiredError)
+	ErrInvalidCode        = errors.New(invalidCodeError)
+	ErrMFANotEnrolled     = errors.New(mfaNotEnrolledError)
+)
+
+// ThrottleError is returned while logins for a user or address are blocked.
+type ThrottleError struct {
+	RetryAfter time.Duration
+}
+
+func (e *ThrottleError) Error() string {
+	return tooManyAttemptsError
+}
+
+func (e *ThrottleError) Unwrap() error {
+	return ErrTooManyAttempts
+}
+
+// dummyHash is compared against when a user does not exist, so that unknown
+// usernames take as long to reject as wrong passwords.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("phone-book-api"), bcrypt.DefaultCost)
+
+type Service struct {
+	repo          Repository
+	sessionTTL    time.Duration
+	defaultTenant string
+	userAttempts  *throttle
+	addrAttempts  *throttle
+}
+
+func NewService(repo Repository, sessionTTL time.Duration, defaultTenant string) *Service {
+	return &Service{
+		repo:          repo,
+		sessionTTL:    sessionTTL,
+		defaultTenant: defaultTenant,
+		userAttempts:  newThrottle(userLoginLimit, loginWindow),
+		addrAttempts:  newThrottle(addressLoginLimit, loginWindow),
+	}
+}
+
+func (s *Service) GetUsers(ctx context.Context, page, limit int) ([]User, error) {
+	offset := (page - 1) * limit
+	return s.repo.FetchUsers(ctx, limit, offset)
+}
+
+func (s *Service) AddUser(ctx context.Context, user *User) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf(hashPasswordError, err)
+	}
+	user.passwordHash = hash
+	user.Password = ""
+	return s.repo.CreateUser(ctx, user)
+}
+
+func (s *Service) DeleteUser(ctx context.Context, id int) error {
+	return s.repo.RemoveUser(ctx, id)
+}
+
+// Login verifies the credentials and starts a session. It returns the
+// session token to set as cookie along with the session.
+func (s *Service) Login(ctx context.Context, credentials Credentials, address string) (*Session, string, error) {
+	tenantID := credentials.Tenant
+	if tenantID == "" {
+		tenantID = s.defaultTenant
+	}
+	userKey := tenantID + "/" + credentials.Username
+	now := time.Now()
+
+	wait := s.userAttempts.retryAfter(userKey, now)
+	if addrWait := s.addrAttempts.retryAfter(address, now); addrWait > wait {
+		wait = addrWait
+	}
+	if wait > 0 {
+		return nil, "", &ThrottleError{RetryAfter: wait}
+	}
+
+	user, err := s.repo.GetUserByName(ctx, tenantID, credentials.Username)
+	if err != nil && !errors.Is(err, ErrUserNotFound) {
+		return nil, "", err
+	}
+	hash := dummyHash
+	if user != nil {
+		hash = user.passwordHash
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(credentials.Password)) != nil || user == nil {
+		s.userAttempts.fail(userKey, now)
+		s.addrAttempts.fail(address, now)
+		return nil, "", ErrInvalidCredentials
+	}
+
+	if user.MFAEnabled {
+		if credentials.Code == "" {
+			return nil, "", ErrCodeRequired
+		}
+		ok, err := s.useSecondFactor(ctx, user, credentials.Code, now)
+		if err != nil {
+			return nil, "", err
+		}
+		// Wrong codes count as failures so that codes cannot be guessed
+		if !ok {
+			s.userAttempts.fail(userKey, now)
+			s.addrAttempts.fail(address, now)
+			return nil, "", ErrInvalidCode
+		}
+	}
+	s.userAttempts.reset(userKey)
+
+	if err := s.repo.RemoveExpiredSessions(ctx); err != nil {
+		log.Printf("Error removing expired sessions: %v", err)
+	}
+
+	token, err := newToken()
+	if err != nil {
+		return nil, "", err
+	}
+	csrfToken, err := newToken()
+	if err != nil {
+		return nil, "", err
+	}
+	session := &Session{
+		UserID:    user.ID,
+		CSRFToken: csrfToken,
+		ExpiresAt: now.Add(s.sessionTTL),
+		MFA:       user.MFAEnabled,
+		tenantID:  tenantID,
+		tokenHash: hashToken(token),
+	}
+	if err := s.repo.CreateSession(ctx, session); err != nil {
+		return nil, "", err
+	}
+	return session, token, nil
+}
+
+func (s *Service) Logout(ctx context.Context, token string) error {
+	return s.repo.RemoveSession(ctx, hashToken(token))
+}
+
+// AuthenticateSession resolves a session cookie to its user and returns the
+// CSRF token that state-changing requests of the session must carry.
+func (s *Service) AuthenticateSession(ctx context.Context, token string) (*auth.Principal, string, error) {
+	session, err := s.repo.GetSession(ctx, hashToken(token))
+	if errors.Is(err, ErrSessionNotFound) {
+		return nil, "", fmt.Errorf(invalidSessionError, auth.ErrUnauthenticated)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Users get their roles from role assignments, keyed by their subject
+	principal := &auth.Principal{
+		Subject:    auth.UserSubject(session.UserID),
+		TenantID:   session.tenantID,
+		UserID:     session.UserID,
+		MFAMissing: !session.MFA,
+	}
+	return principal, session.CSRFToken, nil
+}
+
+// EnrollTOTP generates a new authenticator secret for the user. It only takes
+// effect once confirmed with a code from the authenticator.
+func (s *Service) EnrollTOTP(ctx context.Context, userID int) (*Enrollment, error) {
+	user, err := s.repo.GetUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if user.MFAEnabled {
+		return nil, ErrMFAEnabled
+	}
+
+	secret := make([]byte, totpSecretBytes)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf(generateSecretError, err)
+	}
+	if err := s.repo.SetTOTPSecret(ctx, userID, secret); err != nil {
+		return nil, err
+	}
+	return &Enrollment{Secret: totpEncoding.EncodeToString(secret), URI: totpURI(user.Username, secret)}, nil
+}
+
+// ConfirmTOTP enables MFA for the user and returns their recovery codes,
+// which are shown only once. The session the code was entered in counts as
+// verified from then on.
+func (s *Service) ConfirmTOTP(ctx context.Context, userID int, code, sessionToken string) ([]string, error) {
+	user, err := s.repo.GetUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if user.MFAEnabled {
+		return nil, ErrMFAEnabled
+	}
+	if user.totpSecret == nil {
+		return nil, ErrMFANotEnrolled
+	}
+	step, ok := matchTOTP(user.totpSecret, code, time.Now())
+	if !ok {
+		return nil, ErrInvalidCode
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([][]byte, recoveryCodeCount)
+	for i := range codes {
+		raw := make([]byte, recoveryCodeBytes)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, fmt.Errorf(generateSecretError, err)
+		}
+		encoded := totpEncoding.EncodeToString(raw)
+		codes[i] = encoded[:recoveryCodeLength/2] + "-" + encoded[recoveryCodeLength/2:]
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+	if err := s.repo.EnableTOTP(ctx, userID, step, hashes); err != nil {
+		return nil, err
+	}
+
+	if sessionToken != "" {
+		if err := s.repo.MarkSessionMFA(ctx, hashToken(sessionToken)); err != nil {
+			return nil, err
+		}
+	}
+	return codes, nil
+}
+
+// DisableTOTP turns MFA off after checking a current code.
+func (s *Service) DisableTOTP(ctx context.Context, userID int, code string) error {
+	user, err := s.repo.GetUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if !user.MFAEnabled {
+		return ErrMFANotEnrolled
+	}
+	ok, err := s.useSecondFactor(ctx, user, code, time.Now())
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrInvalidCode
+	}
+	return s.repo.DisableTOTP(ctx, userID)
+}
+
+// useSecondFactor accepts a TOTP code or an unused recovery code. Each TOTP
+// step and recovery code can only be used once.
+func (s *Service) useSecondFactor(ctx context.Context, user *User, code string, now time.Time) (bool, error) {
+	if step, ok := matchTOTP(user.totpSecret, code, now); ok {
+		return s.repo.UseTOTPStep(ctx, user.ID, step)
+	}
+	return s.repo.UseRecoveryCode(ctx, user.ID, hashRecoveryCode(code))
+}
+
+func newToken() (string, error) {
+	token := make([]byte, tokenBytes)
+	if _, err := rand.Read(token); err != nil {
+		return "", fmt.Errorf(generateTokenError, err)
+	}
+	return base64.RawURLEncoding.EncodeToString(token), nil
+}
+
+func hashToken(token string) []byte {
+	hash := sha256.Sum256([]byte(token))
+	return hash[:]
+}
+
+// hashRecoveryCode ignores case and separators so codes can be typed loosely.
+func hashRecoveryCode(code string) []byte {
+	normalized := strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+	return hashToken(normalized)
+}
@@ -0,0 +1,70 @@
+package users
+
+import (
+	"sync"
+	"time"
+)
+
+// throttleSweepSize is the number of tracked keys above which expired
+// windows are swept on every failure.
+const throttleSweepSize = 1024
+
+// throttle counts failed login attempts per key in fixed windows. It is kept
+// in memory, so each instance of the service throttles on its own.
+type throttle struct {
+	limit  int
+	window time.Duration
+
+	mu       sync.Mutex
+	failures map[string]*failureWindow
+}
+
+type failureWindow struct {
+	count   int
+	resetAt time.Time
+}
+
+func newThrottle(limit int, window time.Duration) *throttle {
+	return &throttle{limit: limit, window: window, failures: make(map[string]*failureWindow)}
+}
+
+// retryAfter returns how long the key is blocked, or zero when it is not.
+func (t *throttle) retryAfter(key string, now time.Time) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	failures, ok := t.failures[key]
+	if !ok || !now.Before(failures.resetAt) {
+		return 0
+	}
+	if failures.count < t.limit {
+		return 0
+	}
+	return failures.resetAt.Sub(now)
+}
+
+func (t *throttle) fail(key string, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.failures) > throttleSweepSize {
+		for k, failures := range t.failures {
+			if !now.Before(failures.resetAt) {
+				delete(t.failures, k)
+			}
+		}
+	}
+
+	failures, ok := t.failures[key]
+	if !ok || !now.Before(failures.resetAt) {
+		failures = &failureWindow{resetAt: now.Add(t.window)}
+		t.failures[key] = failures
+	}
+	failures.count++
+}
+
+func (t *throttle) reset(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.failures, key)
+}
@@ -0,0 +1,62 @@
+package users
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+const (
+	totpPeriod      = 30
+	totpDigits      = 6
+	totpModulus     = 1000000
+	totpSecretBytes = 20
+	// totpDrift is the number of steps accepted before and after the current
+	// one, to tolerate clock drift between server and authenticator.
+	totpDrift  = 1
+	totpIssuer = "phone-book-api"
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// totpCode computes the RFC 6238 code for a time step.
+func totpCode(secret []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%totpModulus)
+}
+
+// matchTOTP returns the time step the code is valid for within the drift
+// window, or false when it matches none.
+func matchTOTP(secret []byte, code string, now time.Time) (int64, bool) {
+	current := now.Unix() / totpPeriod
+	for step := current - totpDrift; step <= current+totpDrift; step++ {
+		if hmac.Equal([]byte(totpCode(secret, step)), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// totpURI builds the otpauth:// URI that authenticator apps scan.
+func totpURI(username string, secret []byte) string {
+	label := url.PathEscape(totpIssuer + ":" + username)
+	query := url.Values{
+		"secret":    {totpEncoding.EncodeToString(secret)},
+		"issuer":    {totpIssuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(totpDigits)},
+		"period":    {fmt.Sprint(totpPeriod)},
+	}
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
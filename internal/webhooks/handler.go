@@ -0,0 +1,232 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/benhuri/phone-book-api/internal/httputil"
+	"github.com/go-playground/validator/v10"
+	"github.com/gorilla/mux"
+)
+
+const (
+	idParam             = "id"
+	deliveryIDParam     = "deliveryId"
+	invalidRequestError = "Invalid request payload"
+	invalidWebhookID    = "Invalid webhook ID"
+	invalidDeliveryID   = "Invalid delivery ID"
+	webhookNotFound     = "Webhook not found"
+	deliveryNotFound    = "Webhook delivery not found"
+	internalServerError = "Internal Server Error"
+)
+
+type Handler struct {
+	Service *Service
+}
+
+func NewHandler(service *Service) *Handler {
+	return &Handler{Service: service}
+}
+
+var validate *validator.Validate
+
+func init() {
+	validate = validator.New()
+	validate.RegisterValidation("webhookurl", func(fl validator.FieldLevel) bool {
+		u, err := url.Parse(fl.Field().String())
+		return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+	})
+}
+
+func (h *Handler) GetWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	webhooks, err := h.Service.GetWebhooks(r.Context())
+	if err != nil {
+		log.Printf("Error getting webhooks: %v", err)
+		http.Error(w, internalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(contentTypeHeader, applicationJSON)
+	json.NewEncoder(w).Encode(webhooks)
+}
+
+func (h *Handler) GetWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := webhookID(w, r)
+	if !ok {
+		return
+	}
+
+	webhook, err := h.Service.GetWebhook(r.Context(), id)
+	if writeWebhookError(w, err, "Error getting webhook") {
+		return
+	}
+
+	w.Header().Set(contentTypeHeader, applicationJSON)
+	json.NewEncoder(w).Encode(webhook)
+}
+
+// AddWebhookHandler registers a webhook. The response holds its secret,
+// which is not returned again.
+func (h *Handler) AddWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	webhook, ok := decodeWebhook(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.Service.AddWebhook(r.Context(), webhook); err != nil {
+		log.Printf("Error adding webhook: %v", err)
+		http.Error(w, internalServerError, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(contentTypeHeader, applicationJSON)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(webhook)
+}
+
+// UpdateWebhookHandler replaces a webhook's URL and events, and its secret
+// when one is given.
+func (h *Handler) UpdateWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := webhookID(w, r)
+	if !ok {
+		return
+	}
+	webhook, ok := decodeWebhook(w, r)
+	if !ok {
+		return
+	}
+	webhook.ID = id
+
+	err := h.Service.UpdateWebhook(r.Context(), webhook)
+	if writeWebhookError(w, err, "Error updating webhook") {
+		return
+	}
+
+	w.Header().Set(contentTypeHeader, applicationJSON)
+	json.NewEncoder(w).Encode(webhook)
+}
+
+func (h *Handler) DeleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := webhookID(w, r)
+	if !ok {
+		return
+	}
+
+	err := h.Service.DeleteWebhook(r.Context(), id)
+	if writeWebhookError(w, err, "Error deleting webhook") {
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetDeliveriesHandler lists a webhook's deliveries, newest first.
+func (h *Handler) GetDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := webhookID(w, r)
+	if !ok {
+		return
+	}
+	page, limit := httputil.ParsePagination(r)
+
+	deliveries, err := h.Service.GetDeliveries(r.Context(), id, page, limit)
+	if writeWebhookError(w, err, "Error getting webhook deliveries") {
+		return
+	}
+
+	w.Header().Set(contentTypeHeader, applicationJSON)
+	json.NewEncoder(w).Encode(deliveries)
+}
+
+// GetDeliveryHandler returns a delivery with the log of its attempts.
+func (h *Handler) GetDeliveryHandler(w http.ResponseWriter, r *http.Request) {
+	webhookID, id, ok := deliveryID(w, r)
+	if !ok {
+		return
+	}
+
+	delivery, err := h.Service.GetDelivery(r.Context(), webhookID, id)
+	if writeWebhookError(w, err, "Error getting webhook delivery") {
+		return
+	}
+
+	w.Header().Set(contentTypeHeader, applicationJSON)
+	json.NewEncoder(w).Encode(delivery)
+}
+
+// RedeliverHandler queues a delivery again, including a dead or delivered
+// one, and returns it with its attempts reset.
+func (h *Handler) RedeliverHandler(w http.ResponseWriter, r *http.Request) {
+	webhookID, id, ok := deliveryID(w, r)
+	if !ok {
+		return
+	}
+
+	delivery, err := h.Service.Redeliver(r.Context(), webhookID, id)
+	if writeWebhookError(w, err, "Error redelivering webhook delivery") {
+		return
+	}
+
+	w.Header().Set(contentTypeHeader, applicationJSON)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(delivery)
+}
+
+func decodeWebhook(w http.ResponseWriter, r *http.Request) (*Webhook, bool) {
+	var webhook Webhook
+	if err := json.NewDecoder(r.Body).Decode(&webhook); err != nil {
+		log.Printf("Error decoding webhook: %v", err)
+		http.Error(w, invalidRequestError, http.StatusBadRequest)
+		return nil, false
+	}
+	if err := validate.Struct(webhook); err != nil {
+		log.Printf("Validation error: %v", err)
+		http.Error(w, httputil.FormatValidationError(err), http.StatusBadRequest)
+		return nil, false
+	}
+	return &webhook, true
+}
+
+func webhookID(w http.ResponseWriter, r *http.Request) (int, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)[idParam])
+	if err != nil {
+		log.Printf("Invalid webhook ID: %v", err)
+		http.Error(w, invalidWebhookID, http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
+
+func deliveryID(w http.ResponseWriter, r *http.Request) (int, int, bool) {
+	webhookID, ok := webhookID(w, r)
+	if !ok {
+		return 0, 0, false
+	}
+	id, err := strconv.Atoi(mux.Vars(r)[deliveryIDParam])
+	if err != nil {
+		log.Printf("Invalid delivery ID: %v", err)
+		http.Error(w, invalidDeliveryID, http.StatusBadRequest)
+		return 0, 0, false
+	}
+	return webhookID, id, true
+}
+
+// writeWebhookError writes the response for err and reports whether there
+// was one.
+func writeWebhookError(w http.ResponseWriter, err error, logMessage string) bool {
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, ErrWebhookNotFound):
+		http.Error(w, webhookNotFound, http.StatusNotFound)
+	case errors.Is(err, ErrDeliveryNotFound):
+		http.Error(w, deliveryNotFound, http.StatusNotFound)
+	default:
+		log.Printf("%s: %v", logMessage, err)
+		http.Error(w, internalServerError, http.StatusInternalServerError)
+	}
+	return true
+}
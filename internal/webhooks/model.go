@@ -0,0 +1,56 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"time"
+)
+
+const (
+	StatusPending   = "pending"
+	StatusDelivered = "delivered"
+	StatusDead      = "dead"
+)
+
+// Webhook is a URL that is sent the contact events it subscribes to. The
+// secret signs every delivery and is only returned when it is set.
+type Webhook struct {
+	ID        int       `json:"id"`
+	URL       string    `json:"url" validate:"required,url,webhookurl,max=2000"`
+	Events    []string  `json:"events" validate:"required,min=1,unique,dive,oneof=contact.created contact.updated contact.deleted contact.merged"`
+	Secret    string    `json:"secret,omitempty" validate:"omitempty,min=16,max=200"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Delivery is an event queued for a webhook. Pending deliveries are tried
+// at NextAttemptAt; deliveries that fail every attempt are dead.
+type Delivery struct {
+	ID            int             `json:"id"`
+	WebhookID     int             `json:"webhook_id"`
+	Event         string          `json:"event"`
+	Payload       json.RawMessage `json:"payload"`
+	Status        string          `json:"status"`
+	Attempts      int             `json:"attempts"`
+	NextAttemptAt *time.Time      `json:"next_attempt_at,omitempty"`
+	LastStatus    int             `json:"last_status,omitempty"`
+	LastError     string          `json:"last_error,omitempty"`
+	CreatedAt     time.Time       `json:"created_at"`
+	DeliveredAt   *time.Time      `json:"delivered_at,omitempty"`
+	// Log lists every attempt, oldest first, when a single delivery is fetched
+	Log []Attempt `json:"log,omitempty"`
+}
+
+// Attempt is one try at a delivery, with the status the receiver answered
+// or the error that kept it from answering.
+type Attempt struct {
+	StatusCode  int       `json:"status_code,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	DurationMS  int       `json:"duration_ms"`
+	AttemptedAt time.Time `json:"attempted_at"`
+}
+
+// Claim is a delivery a worker took from the queue, with where to send it.
+type Claim struct {
+	Delivery
+	URL    string
+	Secret string
+}
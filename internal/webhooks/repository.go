@@ -0,0 +1,355 @@
+package webhooks
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/benhuri/phone-book-api/internal/auth"
+	"github.com/lib/pq"
+)
+
+const (
+	// Queries made for a caller take the tenant as their first argument.
+	// Workers address deliveries by ID alone.
+	webhookColumns        = "id, url, events, created_at"
+	selectWebhooksQuery   = "SELECT " + webhookColumns + " FROM webhooks WHERE tenant_id = $1 ORDER BY id"
+	selectWebhookQuery    = "SELECT " + webhookColumns + " FROM webhooks WHERE tenant_id = $1 AND id = $2"
+	insertWebhookQuery    = "INSERT INTO webhooks (tenant_id, url, events, secret) VALUES ($1, $2, $3, $4) RETURNING id, created_at"
+	updateWebhookQuery    = "UPDATE webhooks SET url = $3, events = $4, secret = COALESCE(NULLIF($5, ''), secret) WHERE tenant_id = $1 AND id = $2 RETURNING created_at"
+	deleteWebhookQuery    = "DELETE FROM webhooks WHERE tenant_id = $1 AND id = $2"
+	enqueueQuery          = "INSERT INTO webhook_deliveries (tenant_id, webhook_id, event, payload) SELECT tenant_id, id, $2, $3 FROM webhooks WHERE tenant_id = $1 AND $2 = ANY(events) AND created_at <= $4"
+	deliveryColumns       = "id, webhook_id, event, payload, status, attempts, CASE WHEN status = 'pending' THEN next_attempt_at END, last_status, last_error, created_at, delivered_at"
+	selectDeliveriesQuery = "SELECT " + deliveryColumns + " FROM webhook_deliveries WHERE tenant_id = $1 AND webhook_id = $2 ORDER BY id DESC LIMIT $3 OFFSET $4"
+	selectDeliveryQuery   = "SELECT " + deliveryColumns + " FROM webhook_deliveries WHERE tenant_id = $1 AND webhook_id = $2 AND id = $3"
+	selectAttemptsQuery   = "SELECT status_code, error, duration_ms, attempted_at FROM webhook_attempts WHERE delivery_id = $1 ORDER BY id"
+	redeliverQuery        = "UPDATE webhook_deliveries SET status = 'pending', attempts = 0, next_attempt_at = now() WHERE tenant_id = $1 AND webhook_id = $2 AND id = $3 RETURNING " + deliveryColumns
+
+	// claimDeliveryQuery takes the delivery that has been due the longest and
+	// leases it by moving its next attempt past the time it may take, so that
+	// it is tried again if the worker stops. Deliveries other workers are
+	// claiming are skipped instead of waited for.
+	claimDeliveryQuery = `UPDATE webhook_deliveries SET attempts = attempts + 1, next_attempt_at = now() + make_interval(secs => $1)
+	WHERE id = (
+		SELECT id FROM webhook_deliveries
+		WHERE status = 'pending' AND next_attempt_at <= now()
+		ORDER BY next_attempt_at, id LIMIT 1 FOR UPDATE SKIP LOCKED
+	)
+	RETURNING ` + deliveryColumns + `, (SELECT url FROM webhooks WHERE webhooks.id = webhook_id), (SELECT secret FROM webhooks WHERE webhooks.id = webhook_id)`
+
+	insertAttemptQuery = "INSERT INTO webhook_attempts (delivery_id, status_code, error, duration_ms, attempted_at) VALUES ($1, $2, $3, $4, $5)"
+	// finishAttemptQuery marks a delivery delivered, pending until its next
+	// attempt, or dead when it has none. Deliveries redelivered meanwhile
+	// are left for their new attempts.
+	finishAttemptQuery   = "UPDATE webhook_deliveries SET status = $2, next_attempt_at = COALESCE($3, next_attempt_at), last_status = $4, last_error = $5, delivered_at = CASE WHEN $2 = 'delivered' THEN now() END WHERE id = $1 AND attempts = $6 AND status = 'pending'"
+	purgeDeliveriesQuery = "DELETE FROM webhook_deliveries WHERE status <> 'pending' AND created_at < now() - make_interval(secs => $1)"
+
+	fetchWebhooksError    = "failed to fetch webhooks: %w"
+	fetchWebhookError     = "failed to fetch webhook: %w"
+	createWebhookError    = "failed to create webhook: %w"
+	updateWebhookError    = "failed to update webhook: %w"
+	removeWebhookError    = "failed to remove webhook: %w"
+	enqueueError          = "failed to queue webhook deliveries: %w"
+	fetchDeliveriesError  = "failed to fetch webhook deliveries: %w"
+	fetchDeliveryError    = "failed to fetch webhook delivery: %w"
+	redeliverError        = "failed to redeliver webhook delivery: %w"
+	claimDeliveryError    = "failed to claim webhook delivery: %w"
+	recordAttemptError    = "failed to record webhook attempt: %w"
+	purgeDeliveriesError  = "failed to purge webhook deliveries: %w"
+	getRowsAffectedError  = "failed to get rows affected: %w"
+	rowsError             = "rows error: %w"
+	webhookNotFoundError  = "webhook not found"
+	deliveryNotFoundError = "webhook delivery not found"
+)
+
+var (
+	ErrWebhookNotFound  = errors.New(webhookNotFoundError)
+	ErrDeliveryNotFound = errors.New(deliveryNotFoundError)
+)
+
+type Repository interface {
+	FetchWebhooks(ctx context.Context) ([]Webhook, error)
+	FetchWebhook(ctx context.Context, id int) (*Webhook, error)
+	CreateWebhook(ctx context.Context, webhook *Webhook) error
+	// UpdateWebhook keeps the secret when the webhook has none.
+	UpdateWebhook(ctx context.Context, webhook *Webhook) error
+	RemoveWebhook(ctx context.Context, id int) error
+
+	// Enqueue queues a delivery of the payload to every webhook of the tenant
+	// that subscribes to the event and was registered by the time it
+	// occurred, and returns how many it queued.
+	Enqueue(ctx context.Context, tenantID, event string, occurredAt time.Time, payload []byte) (int64, error)
+	FetchDeliveries(ctx context.Context, webhookID, limit, offset int) ([]Delivery, error)
+	// FetchDelivery returns the delivery with the log of its attempts.
+	FetchDelivery(ctx context.Context, webhookID, id int) (*Delivery, error)
+	// Redeliver queues a delivery again, whatever its status, with all its
+	// attempts ahead of it.
+	Redeliver(ctx context.Context, webhookID, id int) (*Delivery, error)
+
+	// ClaimDelivery returns nil when no delivery is due.
+	ClaimDelivery(ctx context.Context, lease time.Duration) (*Claim, error)
+	// RecordAttempt logs an attempt at a claimed delivery. The delivery is
+	// tried again at next, or is dead when next is nil, unless it succeeded.
+	RecordAttempt(ctx context.Context, claim *Claim, attempt Attempt, next *time.Time) error
+	PurgeDeliveries(ctx context.Context, age time.Duration) (int64, error)
+}
+
+type webhookRepository struct {
+	db *sql.DB
+}
+
+func NewRepository(db *sql.DB) Repository {
+	return &webhookRepository{db: db}
+}
+
+func (r *webhookRepository) FetchWebhooks(ctx context.Context) ([]Webhook, error) {
+	tenantID, err := auth.TenantID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := r.db.QueryContext(ctx, selectWebhooksQuery, tenantID)
+	if err != nil {
+		return nil, fmt.Errorf(fetchWebhooksError, err)
+	}
+	defer rows.Close()
+
+	webhooks := []Webhook{}
+	for rows.Next() {
+		var webhook Webhook
+		if err := scanWebhook(rows, &webhook); err != nil {
+			return nil, fmt.Errorf(fetchWebhooksError, err)
+		}
+		webhooks = append(webhooks, webhook)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf(rowsError, err)
+	}
+	return webhooks, nil
+}
+
+func (r *webhookRepository) FetchWebhook(ctx context.Context, id int) (*Webhook, error) {
+	tenantID, err := auth.TenantID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var webhook Webhook
+	err = scanWebhook(r.db.QueryRowContext(ctx, selectWebhookQuery, tenantID, id), &webhook)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrWebhookNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf(fetchWebhookError, err)
+	}
+	return &webhook, nil
+}
+
+func (r *webhookRepository) CreateWebhook(ctx context.Context, webhook *Webhook) error {
+	tenantID, err := auth.TenantID(ctx)
+	if err != nil {
+		return err
+	}
+	err = r.db.QueryRowContext(ctx, insertWebhookQuery, tenantID, webhook.URL, pq.Array(webhook.Events), webhook.Secret).
+		Scan(&webhook.ID, &webhook.CreatedAt)
+	if err != nil {
+		return fmt.Errorf(createWebhookError, err)
+	}
+	return nil
+}
+
+func (r *webhookRepository) UpdateWebhook(ctx context.Context, webhook *Webhook) error {
+	tenantID, err := auth.TenantID(ctx)
+	if err != nil {
+		return err
+	}
+	err = r.db.QueryRowContext(ctx, updateWebhookQuery, tenantID, webhook.ID, webhook.URL, pq.Array(webhook.Events), webhook.Secret).
+		Scan(&webhook.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrWebhookNotFound
+	}
+	if err != nil {
+		return fmt.Errorf(updateWebhookError, err)
+	}
+	return nil
+}
+
+func (r *webhookRepository) RemoveWebhook(ctx context.Context, id int) error {
+	tenantID, err := auth.TenantID(ctx)
+	if err != nil {
+		return err
+	}
+	result, err := r.db.ExecContext(ctx, deleteWebhookQuery, tenantID, id)
+	if err != nil {
+		return fmt.Errorf(removeWebhookError, err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf(getRowsAffectedError, err)
+	}
+	if rowsAffected == 0 {
+		return ErrWebhookNotFound
+	}
+	return nil
+}
+
+func (r *webhookRepository) Enqueue(ctx context.Context, tenantID, event string, occurredAt time.Time, payload []byte) (int64, error) {
+	result, err := r.db.ExecContext(ctx, enqueueQuery, tenantID, event, payload, occurredAt)
+	if err != nil {
+		return 0, fmt.Errorf(enqueueError, err)
+	}
+	queued, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf(getRowsAffectedError, err)
+	}
+	return queued, nil
+}
+
+func (r *webhookRepository) FetchDeliveries(ctx context.Context, webhookID, limit, offset int) ([]Delivery, error) {
+	tenantID, err := auth.TenantID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := r.db.QueryContext(ctx, selectDeliveriesQuery, tenantID, webhookID, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf(fetchDeliveriesError, err)
+	}
+	defer rows.Close()
+
+	deliveries := []Delivery{}
+	for rows.Next() {
+		var delivery Delivery
+		if err := scanDelivery(rows, &delivery); err != nil {
+			return nil, fmt.Errorf(fetchDeliveriesError, err)
+		}
+		deliveries = append(deliveries, delivery)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf(rowsError, err)
+	}
+	return deliveries, nil
+}
+
+func (r *webhookRepository) FetchDelivery(ctx context.Context, webhookID, id int) (*Delivery, error) {
+	tenantID, err := auth.TenantID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var delivery Delivery
+	err = scanDelivery(r.db.QueryRowContext(ctx, selectDeliveryQuery, tenantID, webhookID, id), &delivery)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrDeliveryNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf(fetchDeliveryError, err)
+	}
+
+	rows, err := r.db.QueryContext(ctx, selectAttemptsQuery, id)
+	if err != nil {
+		return nil, fmt.Errorf(fetchDeliveryError, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var attempt Attempt
+		if err := rows.Scan(&attempt.StatusCode, &attempt.Error, &attempt.DurationMS, &attempt.AttemptedAt); err != nil {
+			return nil, fmt.Errorf(fetchDeliveryError, err)
+		}
+		delivery.Log = append(delivery.Log, attempt)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf(rowsError, err)
+	}
+	return &delivery, nil
+}
+
+func (r *webhookRepository) Redeliver(ctx context.Context, webhookID, id int) (*Delivery, error) {
+	tenantID, err := auth.TenantID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var delivery Delivery
+	err = scanDelivery(r.db.QueryRowContext(ctx, redeliverQuery, tenantID, webhookID, id), &delivery)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrDeliveryNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf(redeliverError, err)
+	}
+	return &delivery, nil
+}
+
+func (r *webhookRepository) ClaimDelivery(ctx context.Context, lease time.Duration) (*Claim, error) {
+	var claim Claim
+	err := scanDelivery(r.db.QueryRowContext(ctx, claimDeliveryQuery, lease.Seconds()), &claim.Delivery, &claim.URL, &claim.Secret)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf(claimDeliveryError, err)
+	}
+	return &claim, nil
+}
+
+func (r *webhookRepository) RecordAttempt(ctx context.Context, claim *Claim, attempt Attempt, next *time.Time) error {
+	status := StatusDelivered
+	if attempt.StatusCode < 200 || attempt.StatusCode > 299 {
+		status = StatusPending
+		if next == nil {
+			status = StatusDead
+		}
+	}
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf(recordAttemptError, err)
+	}
+	defer tx.Rollback()
+	_, err = tx.ExecContext(ctx, insertAttemptQuery, claim.ID, attempt.StatusCode, attempt.Error, attempt.DurationMS, attempt.AttemptedAt)
+	if err != nil {
+		return fmt.Errorf(recordAttemptError, err)
+	}
+	_, err = tx.ExecContext(ctx, finishAttemptQuery, claim.ID, status, next, attempt.StatusCode, attempt.Error, claim.Attempts)
+	if err != nil {
+		return fmt.Errorf(recordAttemptError, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf(recordAttemptError, err)
+	}
+	return nil
+}
+
+// PurgeDeliveries deletes the delivered and dead deliveries, and their logs,
+// queued longer than age ago.
+func (r *webhookRepository) PurgeDeliveries(ctx context.Context, age time.Duration) (int64, error) {
+	result, err := r.db.ExecContext(ctx, purgeDeliveriesQuery, age.Seconds())
+	if err != nil {
+		return 0, fmt.Errorf(purgeDeliveriesError, err)
+	}
+	purged, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf(getRowsAffectedError, err)
+	}
+	return purged, nil
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanWebhook(row rowScanner, webhook *Webhook) error {
+	return row.Scan(&webhook.ID, &webhook.URL, pq.Array(&webhook.Events), &webhook.CreatedAt)
+}
+
+// scanDelivery scans the delivery columns followed by any extra columns.
+func scanDelivery(row rowScanner, delivery *Delivery, extra ...interface{}) error {
+	var payload []byte
+	err := row.Scan(append([]interface{}{&delivery.ID, &delivery.WebhookID, &delivery.Event, &payload, &delivery.Status, &delivery.Attempts,
+		&delivery.NextAttemptAt, &delivery.LastStatus, &delivery.LastError, &delivery.CreatedAt, &delivery.DeliveredAt}, extra...)...)
+	if err != nil {
+		return err
+	}
+	delivery.Payload = payload
+	return nil
+}
@@ -0,0 +1,120 @@
+package webhooks
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/benhuri/phone-book-api/internal/contacts"
+)
+
+const (
+	secretBytes     = 32
+	signaturePrefix = "sha256="
+
+	generateSecretError = "failed to generate webhook secret: %w"
+	encodeEventError    = "failed to encode event: %w"
+)
+
+type Service struct {
+	repo        Repository
+	client      *http.Client
+	maxAttempts int
+	backoff     time.Duration
+}
+
+// NewService returns a service that tries each delivery up to maxAttempts
+// times, waiting backoff after the first failure and twice as long after
+// each one that follows. Deliveries to loopback, link-local and private
+// addresses fail unless allowPrivate is set.
+func NewService(repo Repository, maxAttempts int, backoff time.Duration, allowPrivate bool) *Service {
+	return &Service{
+		repo:        repo,
+		client:      newClient(allowPrivate),
+		maxAttempts: maxAttempts,
+		backoff:     backoff,
+	}
+}
+
+func (s *Service) GetWebhooks(ctx context.Context) ([]Webhook, error) {
+	return s.repo.FetchWebhooks(ctx)
+}
+
+func (s *Service) GetWebhook(ctx context.Context, id int) (*Webhook, error) {
+	return s.repo.FetchWebhook(ctx, id)
+}
+
+// AddWebhook generates a secret for a webhook that has none.
+func (s *Service) AddWebhook(ctx context.Context, webhook *Webhook) error {
+	if webhook.Secret == "" {
+		secret, err := newSecret()
+		if err != nil {
+			return err
+		}
+		webhook.Secret = secret
+	}
+	return s.repo.CreateWebhook(ctx, webhook)
+}
+
+func (s *Service) UpdateWebhook(ctx context.Context, webhook *Webhook) error {
+	return s.repo.UpdateWebhook(ctx, webhook)
+}
+
+func (s *Service) DeleteWebhook(ctx context.Context, id int) error {
+	return s.repo.RemoveWebhook(ctx, id)
+}
+
+func (s *Service) GetDeliveries(ctx context.Context, webhookID, page, limit int) ([]Delivery, error) {
+	if _, err := s.repo.FetchWebhook(ctx, webhookID); err != nil {
+		return nil, err
+	}
+	offset := (page - 1) * limit
+	return s.repo.FetchDeliveries(ctx, webhookID, limit, offset)
+}
+
+func (s *Service) GetDelivery(ctx context.Context, webhookID, id int) (*Delivery, error) {
+	return s.repo.FetchDelivery(ctx, webhookID, id)
+}
+
+func (s *Service) Redeliver(ctx context.Context, webhookID, id int) (*Delivery, error) {
+	return s.repo.Redeliver(ctx, webhookID, id)
+}
+
+// Publish queues the event for the webhooks of its tenant that subscribe
+// to it. Webhooks are not sent the events that occurred before they were
+// registered.
+func (s *Service) Publish(ctx context.Context, event contacts.Event) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf(encodeEventError, err)
+	}
+	_, err = s.repo.Enqueue(ctx, event.TenantID, event.Type, event.OccurredAt, payload)
+	return err
+}
+
+// Sign returns the signature of a delivery sent at the Unix timestamp: the
+// hex HMAC-SHA256 of the timestamp, a dot and the body, keyed by the secret.
+// Receivers compute it the same way to check that a delivery came from
+// this service and was not replayed long after.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+func newSecret() (string, error) {
+	secret := make([]byte, secretBytes)
+	if _, err := rand.Read(secret); err != nil {
+		return "", fmt.Errorf(generateSecretError, err)
+	}
+	return hex.EncodeToString(secret), nil
+}
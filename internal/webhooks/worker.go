@@ -0,0 +1,220 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	pollInterval = time.Second
+	// claimLease is how long a claimed delivery waits before another worker
+	// tries it, in case the worker that claimed it stopped.
+	claimLease = time.Minute
+	// maxBackoff caps the wait between attempts.
+	maxBackoff    = 6 * time.Hour
+	purgeInterval = time.Hour
+	// deliveryRetention is how long delivered and dead deliveries are kept.
+	deliveryRetention = 7 * 24 * time.Hour
+	// requestTimeout bounds each attempt, so a slow receiver cannot hold a
+	// worker.
+	requestTimeout = 10 * time.Second
+	dialTimeout    = 5 * time.Second
+
+	privateDestinationError = "webhook destination %s is not a public address"
+
+	eventHeader       = "X-Webhook-Event"
+	deliveryHeader    = "X-Webhook-Delivery"
+	timestampHeader   = "X-Webhook-Timestamp"
+	signatureHeader   = "X-Webhook-Signature"
+	contentTypeHeader = "Content-Type"
+	applicationJSON   = "application/json"
+)
+
+// Run delivers queued events with the given number of workers until ctx is
+// done.
+func (s *Service) Run(ctx context.Context, workers int) {
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.work(ctx)
+		}()
+	}
+	wg.Wait()
+}
+
+func (s *Service) work(ctx context.Context) {
+	var purged time.Time
+	for ctx.Err() == nil {
+		claim, err := s.repo.ClaimDelivery(ctx, claimLease)
+		if err != nil {
+			log.Printf("Error claiming webhook delivery: %v", err)
+		}
+		if claim != nil {
+			s.deliver(ctx, claim)
+			continue
+		}
+
+		if time.Since(purged) > purgeInterval {
+			purged = time.Now()
+			if _, err := s.repo.PurgeDeliveries(ctx, deliveryRetention); err != nil {
+				log.Printf("Error purging webhook deliveries: %v", err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// deliver makes one attempt at a claimed delivery and schedules the next
+// one if it fails.
+func (s *Service) deliver(ctx context.Context, claim *Claim) {
+	attempt := s.send(ctx, claim)
+	// A stopping worker leaves the delivery to be claimed again
+	if ctx.Err() != nil {
+		return
+	}
+
+	var next *time.Time
+	if claim.Attempts < s.maxAttempts {
+		at := time.Now().Add(s.backoffFor(claim.Attempts))
+		next = &at
+	}
+	if err := s.repo.RecordAttempt(ctx, claim, attempt, next); err != nil {
+		log.Printf("Error recording webhook attempt: %v", err)
+	}
+}
+
+func (s *Service) send(ctx context.Context, claim *Claim) Attempt {
+	attempt := Attempt{AttemptedAt: time.Now().UTC()}
+	defer func() {
+		attempt.DurationMS = int(time.Since(attempt.AttemptedAt).Milliseconds())
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, claim.URL, bytes.NewReader(claim.Payload))
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	timestamp := attempt.AttemptedAt.Unix()
+	req.Header.Set(contentTypeHeader, applicationJSON)
+	req.Header.Set(eventHeader, claim.Event)
+	req.Header.Set(deliveryHeader, strconv.Itoa(claim.ID))
+	req.Header.Set(timestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(signatureHeader, Sign(claim.Secret, timestamp, claim.Payload))
+
+	// Only the status of a response is kept, as the delivery log must not
+	// show what a receiver answered.
+	resp, err := s.client.Do(req)
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	resp.Body.Close()
+	attempt.StatusCode = resp.StatusCode
+	return attempt
+}
+
+// newClient returns the client deliveries are sent with. It does not follow
+// redirects and, unless allowPrivate is set, refuses to connect to addresses
+// that are not public. The address is checked as it is dialed, so that a
+// host name cannot resolve elsewhere once it is checked.
+func newClient(allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	if !allowPrivate {
+		dialer.Control = refusePrivate
+	}
+	return &http.Client{
+		Timeout: requestTimeout,
+		// No proxy, which would be dialed instead of the receiver
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			ForceAttemptHTTP2:   true,
+			TLSHandshakeTimeout: dialTimeout,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// deniedPrefixes are the addresses deliveries are not sent to unless private
+// destinations are allowed: this host, private and shared networks, link-local
+// addresses and multicast.
+var deniedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("224.0.0.0/4"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("::/96"),
+	netip.MustParsePrefix("64:ff9b:1::/48"),
+	netip.MustParsePrefix("fc00::/7"),
+	netip.MustParsePrefix("fe80::/10"),
+	netip.MustParsePrefix("fec0::/10"),
+	netip.MustParsePrefix("ff00::/8"),
+}
+
+// nat64Prefix embeds an IPv4 address in its last 32 bits, which a NAT64
+// gateway connects to.
+var nat64Prefix = netip.MustParsePrefix("64:ff9b::/96")
+
+func refusePrivate(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	if !isPublic(addrPort.Addr()) {
+		return fmt.Errorf(privateDestinationError, addrPort.Addr())
+	}
+	return nil
+}
+
+// isPublic reports whether addr is outside deniedPrefixes, once the IPv4
+// address it carries is taken out of an IPv4-mapped or NAT64 address.
+func isPublic(addr netip.Addr) bool {
+	addr = addr.WithZone("").Unmap()
+	if nat64Prefix.Contains(addr) {
+		ipv6 := addr.As16()
+		var ipv4 [4]byte
+		copy(ipv4[:], ipv6[12:])
+		addr = netip.AddrFrom4(ipv4)
+	}
+	for _, prefix := range deniedPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// backoffFor returns how long to wait after the given number of failed
+// attempts.
+func (s *Service) backoffFor(attempts int) time.Duration {
+	backoff := s.backoff
+	for i := 1; i < attempts && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+	return backoff
+}
@@ -0,0 +1,163 @@
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/benhuri/phone-book-api/internal/apikeys"
+	"github.com/benhuri/phone-book-api/internal/auth"
+	"github.com/benhuri/phone-book-api/internal/config"
+	"github.com/benhuri/phone-book-api/internal/contacts"
+	"github.com/benhuri/phone-book-api/internal/database"
+	"github.com/benhuri/phone-book-api/internal/idempotency"
+	"github.com/benhuri/phone-book-api/internal/jobs"
+	"github.com/benhuri/phone-book-api/internal/organizations"
+	"github.com/benhuri/phone-book-api/internal/outbox"
+	"github.com/benhuri/phone-book-api/internal/roles"
+	approuter "github.com/benhuri/phone-book-api/internal/router"
+	"github.com/benhuri/phone-book-api/internal/shares"
+	"github.com/benhuri/phone-book-api/internal/users"
+	"github.com/benhuri/phone-book-api/internal/webhooks"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	apiKeysPath    = "/api-keys"
+	bootstrapToken = "test-bootstrap-token"
+)
+
+// newAuthRouter builds the application router with authentication required.
+// API keys are always accepted, followed by the extra authenticators.
+func newAuthRouter(extra ...approuter.Authenticator) *mux.Router {
+	config.AppConfig.AuthRequired = true
+	defer func() { config.AppConfig.AuthRequired = false }()
+
+	rolesService := roles.NewService(roles.NewRepository(database.DB))
+	keysService := apikeys.NewService(apikeys.NewRepository(database.DB), bootstrapToken, tenantA)
+	return approuter.NewRouter(
+		contactHandler,
+		organizations.NewHandler(organizations.NewService(organizations.NewRepository(database.DB))),
+		apikeys.NewHandler(keysService),
+		roles.NewHandler(rolesService),
+		users.NewHandler(users.NewService(users.NewRepository(database.DB), time.Hour, tenantA), true),
+		shares.NewHandler(shares.NewService(shares.NewRepository(database.DB))),
+		jobs.NewHandler(jobs.NewService(jobs.NewRepository(database.DB), contactHandler.Service)),
+		webhooks.NewHandler(webhooksService),
+		outbox.NewHandler(eventStream),
+		idempotency.NewService(idempotency.NewRepository(database.DB), time.Hour),
+		append(approuter.Authenticators{keysService}, extra...),
+		auth.NewPolicy(rolesService),
+	)
+}
+
+func bearerRequest(t *testing.T, handler http.Handler, token, method, url string, body interface{}) *httptest.ResponseRecorder {
+	var payload bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&payload).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req, err := http.NewRequest(method, url, &payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestAPIKeys(t *testing.T) {
+	logrus.Info("Running TestAPIKeys")
+	authRouter := newAuthRouter()
+
+	// Requests without credentials are rejected
+	rr := bearerRequest(t, authRouter, "", "GET", contactsPath, nil)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.NotEmpty(t, rr.Header().Get("WWW-Authenticate"))
+
+	rr = bearerRequest(t, authRouter, "pbk_000000000000.wrong", "GET", contactsPath, nil)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	// The bootstrap token creates a read-only key
+	rr = bearerRequest(t, authRouter, bootstrapToken, "POST", apiKeysPath, apikeys.APIKey{
+		Name:   "reader",
+		Scopes: []string{auth.ScopeContactsRead},
+	})
+	assert.Equal(t, http.StatusCreated, rr.Code)
+
+	var key apikeys.APIKey
+	if err := json.NewDecoder(rr.Body).Decode(&key); err != nil {
+		t.Fatal(err)
+	}
+	assert.NotEmpty(t, key.Token)
+
+	// Invalid scopes are rejected
+	rr = bearerRequest(t, authRouter, bootstrapToken, "POST", apiKeysPath, apikeys.APIKey{
+		Name:   "bogus",
+		Scopes: []string{"contacts:everything"},
+	})
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	// The key can read but not write
+	rr = bearerRequest(t, authRouter, key.Token, "GET", contactsPath, nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	rr = bearerRequest(t, authRouter, key.Token, "POST", contactsPath, contacts.Contact{
+		FirstName:   "Keyed",
+		LastName:    "Writer",
+		PhoneNumber: "5550006000",
+		Address:     "Key Street",
+	})
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	rr = bearerRequest(t, authRouter, key.Token, "GET", apiKeysPath, nil)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	// Listed keys never include secrets
+	rr = bearerRequest(t, authRouter, bootstrapToken, "GET", apiKeysPath, nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var keys []apikeys.APIKey
+	if err := json.NewDecoder(rr.Body).Decode(&keys); err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, keys, 1)
+	assert.Empty(t, keys[0].Token)
+	assert.NotNil(t, keys[0].LastUsedAt)
+
+	// Rotating invalidates the old token
+	keyURL := apiKeysPath + "/" + strconv.Itoa(key.ID)
+	rr = bearerRequest(t, authRouter, bootstrapToken, "POST", keyURL+"/rotate", nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var rotated apikeys.APIKey
+	if err := json.NewDecoder(rr.Body).Decode(&rotated); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, key.ID, rotated.ID)
+	assert.NotEqual(t, key.Token, rotated.Token)
+
+	rr = bearerRequest(t, authRouter, key.Token, "GET", contactsPath, nil)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	rr = bearerRequest(t, authRouter, rotated.Token, "GET", contactsPath, nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	// Revoked keys are rejected
+	rr = bearerRequest(t, authRouter, bootstrapToken, "DELETE", keyURL, nil)
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+
+	rr = bearerRequest(t, authRouter, rotated.Token, "GET", contactsPath, nil)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+}
@@ -0,0 +1,99 @@
+package test
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/benhuri/phone-book-api/internal/contacts"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func batchOperation(op, ref string, id int, idRef string, contact interface{}) contacts.BatchOperation {
+	operation := contacts.BatchOperation{Op: op, Ref: ref, ID: id, IDRef: idRef}
+	if contact != nil {
+		operation.Contact, _ = json.Marshal(contact)
+	}
+	return operation
+}
+
+func TestBatch(t *testing.T) {
+	logrus.Info("Running TestBatch")
+	authRouter := newAuthRouter()
+
+	carl := contacts.Contact{FirstName: "Carl", LastName: "Batch", PhoneNumber: "5550010001", Address: "1 Batch St"}
+	dora := contacts.Contact{FirstName: "Dora", LastName: "Batch", PhoneNumber: "5550010002", Address: "2 Batch St"}
+
+	// Later operations name contacts the batch created by their ref
+	batch := contacts.BatchRequest{Operations: []contacts.BatchOperation{
+		batchOperation(contacts.BatchCreate, "carl", 0, "", carl),
+		batchOperation(contacts.BatchCreate, "dora", 0, "", dora),
+		batchOperation(contacts.BatchPatch, "", 0, "carl", map[string]interface{}{"job_title": "Clerk"}),
+		batchOperation(contacts.BatchDelete, "", 0, "dora", nil),
+	}}
+	rr := bearerRequest(t, authRouter, bootstrapToken, "POST", batchPath, batch)
+	if !assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String()) {
+		t.FailNow()
+	}
+	var response contacts.BatchResponse
+	json.NewDecoder(rr.Body).Decode(&response)
+	assert.Equal(t, contacts.BatchAtomic, response.Mode)
+	assert.False(t, response.RolledBack)
+	if !assert.Len(t, response.Results, 4) {
+		t.FailNow()
+	}
+	assert.Equal(t, http.StatusCreated, response.Results[0].Status)
+	assert.Equal(t, "carl", response.Results[0].Ref)
+	carlID := response.Results[0].ID
+	assert.Equal(t, http.StatusOK, response.Results[2].Status)
+	assert.Equal(t, carlID, response.Results[2].ID)
+	assert.Equal(t, "Clerk", response.Results[2].Contact.JobTitle)
+	assert.Equal(t, "1 Batch St", response.Results[2].Contact.Address)
+	assert.Equal(t, http.StatusNoContent, response.Results[3].Status)
+	defer bearerRequest(t, authRouter, bootstrapToken, "DELETE", contactsPath+"/"+strconv.Itoa(carlID), nil)
+
+	// An atomic batch applies nothing when an operation fails
+	eve := contacts.Contact{FirstName: "Eve", LastName: "Batch", PhoneNumber: "5550010003", Address: "3 Batch St"}
+	batch = contacts.BatchRequest{Operations: []contacts.BatchOperation{
+		batchOperation(contacts.BatchCreate, "eve", 0, "", eve),
+		batchOperation(contacts.BatchUpdate, "", carlID, "", contacts.Contact{FirstName: "Carl"}),
+		batchOperation(contacts.BatchDelete, "", carlID, "", nil),
+	}}
+	rr = bearerRequest(t, authRouter, bootstrapToken, "POST", batchPath, batch)
+	assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+	response = contacts.BatchResponse{}
+	json.NewDecoder(rr.Body).Decode(&response)
+	assert.True(t, response.RolledBack)
+	if assert.Len(t, response.Results, 3) {
+		assert.Equal(t, http.StatusFailedDependency, response.Results[0].Status)
+		assert.Equal(t, http.StatusBadRequest, response.Results[1].Status)
+		assert.NotEmpty(t, response.Results[1].Error)
+		assert.Equal(t, http.StatusFailedDependency, response.Results[2].Status)
+	}
+	rr = bearerRequest(t, authRouter, bootstrapToken, "GET", contactsSearchPath+"?query=Batch", nil)
+	assert.NotContains(t, rr.Body.String(), "Eve")
+	assert.Contains(t, rr.Body.String(), "Clerk")
+
+	// A partial batch applies the operations that succeed
+	batch.Mode = contacts.BatchPartial
+	batch.Operations = append(batch.Operations[:2], batchOperation(contacts.BatchDelete, "", 999999, "", nil))
+	rr = bearerRequest(t, authRouter, bootstrapToken, "POST", batchPath, batch)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	response = contacts.BatchResponse{}
+	json.NewDecoder(rr.Body).Decode(&response)
+	if assert.Len(t, response.Results, 3) {
+		assert.Equal(t, http.StatusCreated, response.Results[0].Status)
+		assert.Equal(t, http.StatusBadRequest, response.Results[1].Status)
+		assert.Equal(t, http.StatusNotFound, response.Results[2].Status)
+		defer bearerRequest(t, authRouter, bootstrapToken, "DELETE", contactsPath+"/"+strconv.Itoa(response.Results[0].ID), nil)
+	}
+
+	rr = bearerRequest(t, authRouter, bootstrapToken, "POST", batchPath, contacts.BatchRequest{Mode: "some"})
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	batch = contacts.BatchRequest{Operations: []contacts.BatchOperation{batchOperation(contacts.BatchPatch, "", 0, "nobody", nil)}}
+	rr = bearerRequest(t, authRouter, bootstrapToken, "POST", batchPath, batch)
+	assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+	assert.Contains(t, rr.Body.String(), "id_ref")
+}
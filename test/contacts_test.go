@@ -8,10 +8,16 @@ import (
 	"net/http/httptest"
 	"os"
 	"strconv"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/benhuri/phone-book-api/internal/contacts"
 	"github.com/benhuri/phone-book-api/internal/database"
+	"github.com/benhuri/phone-book-api/internal/organizations"
+	"github.com/benhuri/phone-book-api/internal/outbox"
+	approuter "github.com/benhuri/phone-book-api/internal/router"
+	"github.com/benhuri/phone-book-api/internal/webhooks"
 	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
@@ -24,6 +30,28 @@ const (
 	contactsPath        = basePath
 	contactsSearchPath  = basePath + "/search"
 	contactIDPath       = basePath + "/{id}"
+	contactsExportPath  = basePath + "/export.vcf"
+	rowsExportPath      = basePath + "/export"
+	contactVCardPath    = basePath + "/{id}.vcf"
+	contactsImportPath  = basePath + "/import"
+	csvImportPath       = contactsImportPath + "/csv"
+	batchPath           = basePath + "/batch"
+	duplicatesPath      = basePath + "/duplicates"
+	mergePath           = basePath + "/merge"
+	mergesPath          = basePath + "/merges"
+	undoMergePath       = mergesPath + "/{mergeId}/undo"
+	importProfilesPath  = "/import-profiles"
+	profileIDPath       = importProfilesPath + "/{id}"
+	birthdaysPath       = "/calendar/birthdays.ics"
+	notesPath           = contactIDPath + "/notes"
+	noteIDPath          = notesPath + "/{noteId}"
+	relationsPath       = contactIDPath + "/relations"
+	relationIDPath      = relationsPath + "/{relationId}"
+	customFieldsPath    = "/custom-fields"
+	customFieldIDPath   = customFieldsPath + "/{id}"
+	organizationsPath   = "/organizations"
+	organizationIDPath  = organizationsPath + "/{id}"
+	orgContactsPath     = organizationIDPath + "/contacts"
 	pageParam           = "page"
 	limitParam          = "limit"
 	queryParam          = "query"
@@ -33,6 +61,8 @@ const (
 )
 
 var contactHandler *contacts.Handler
+var webhooksService *webhooks.Service
+var eventStream *outbox.Stream
 var router *mux.Router
 var testContact contacts.Contact
 
@@ -40,32 +70,45 @@ func setup() {
 	logrus.Info("Setting up the test environment")
 	database.InitDB()
 
-	// Create the contacts table if it doesn't exist
-	createTableQuery := `
-	CREATE TABLE IF NOT EXISTS contacts (
-		id SERIAL PRIMARY KEY,
-		first_name VARCHAR(50),
-		last_name VARCHAR(50),
-		phone_number VARCHAR(20),
-		address VARCHAR(100)
-	);`
-	_, err := database.DB.ExecContext(context.Background(), createTableQuery)
-	if err != nil {
-		logrus.Fatalf("Failed to create contacts table: %v", err)
+	// Create or upgrade the database schema
+	if err := database.CreateSchema(context.Background(), database.DB); err != nil {
+		logrus.Fatalf("Failed to create database schema: %v", err)
 	}
 
 	// Initialize the contacts repository, service, and handler
-	contactsRepo := contacts.NewRepository(database.DB)
-	contactsService := contacts.NewService(contactsRepo)
+	contactsRepo := contacts.NewRepository(database.DB, contacts.TxConfig{MaxRetries: 3}, "972")
+	contactsService := contacts.NewService(contactsRepo, []byte(shareLinkSecret), "", "972", contacts.DuplicatesWarn)
 	contactHandler = contacts.NewHandler(contactsService)
+	webhooksService = webhooks.NewService(webhooks.NewRepository(database.DB), 3, 50*time.Millisecond, true)
+	eventStream = outbox.NewStream(outbox.NewRepository(database.DB))
+
+	organizationsRepo := organizations.NewRepository(database.DB)
+	organizationsService := organizations.NewService(organizationsRepo)
+	organizationHandler := organizations.NewHandler(organizationsService)
 
 	// Initialize the router
 	router = mux.NewRouter()
+	router.Use(approuter.TenantMiddleware)
 	router.HandleFunc(contactsPath, contactHandler.AddContactHandler).Methods("POST")
 	router.HandleFunc(contactsPath, contactHandler.GetContactsHandler).Methods("GET")
 	router.HandleFunc(contactsSearchPath, contactHandler.SearchContactHandler).Methods("GET")
 	router.HandleFunc(contactIDPath, contactHandler.EditContactHandler).Methods("PUT")
 	router.HandleFunc(contactIDPath, contactHandler.DeleteContactHandler).Methods("DELETE")
+	router.HandleFunc(notesPath, contactHandler.GetNotesHandler).Methods("GET")
+	router.HandleFunc(notesPath, contactHandler.AddNoteHandler).Methods("POST")
+	router.HandleFunc(noteIDPath, contactHandler.EditNoteHandler).Methods("PUT")
+	router.HandleFunc(noteIDPath, contactHandler.DeleteNoteHandler).Methods("DELETE")
+	router.HandleFunc(relationsPath, contactHandler.GetRelationsHandler).Methods("GET")
+	router.HandleFunc(relationsPath, contactHandler.AddRelationHandler).Methods("POST")
+	router.HandleFunc(relationIDPath, contactHandler.DeleteRelationHandler).Methods("DELETE")
+	router.HandleFunc(birthdaysPath, contactHandler.BirthdayCalendarHandler).Methods("GET")
+	router.HandleFunc(customFieldsPath, contactHandler.GetCustomFieldsHandler).Methods("GET")
+	router.HandleFunc(customFieldsPath, contactHandler.AddCustomFieldHandler).Methods("POST")
+	router.HandleFunc(customFieldIDPath, contactHandler.EditCustomFieldHandler).Methods("PUT")
+	router.HandleFunc(customFieldIDPath, contactHandler.DeleteCustomFieldHandler).Methods("DELETE")
+	router.HandleFunc(organizationsPath, organizationHandler.AddOrganizationHandler).Methods("POST")
+	router.HandleFunc(organizationIDPath, organizationHandler.GetOrganizationHandler).Methods("GET")
+	router.HandleFunc(orgContactsPath, contactHandler.GetOrganizationContactsHandler).Methods("GET")
 
 	// Create a test contact
 	testContact = contacts.Contact{
@@ -99,6 +142,41 @@ func teardown() {
 		logrus.Fatalf("Failed to delete test data: %v", err)
 	}
 
+	_, err = database.DB.ExecContext(context.Background(), `DELETE FROM custom_fields`)
+	if err != nil {
+		logrus.Fatalf("Failed to delete test custom fields: %v", err)
+	}
+
+	_, err = database.DB.ExecContext(context.Background(), `DELETE FROM organizations`)
+	if err != nil {
+		logrus.Fatalf("Failed to delete test organizations: %v", err)
+	}
+
+	_, err = database.DB.ExecContext(context.Background(), `DELETE FROM api_keys`)
+	if err != nil {
+		logrus.Fatalf("Failed to delete test api keys: %v", err)
+	}
+
+	_, err = database.DB.ExecContext(context.Background(), `DELETE FROM user_roles`)
+	if err != nil {
+		logrus.Fatalf("Failed to delete test user roles: %v", err)
+	}
+
+	_, err = database.DB.ExecContext(context.Background(), `DELETE FROM mfa_roles`)
+	if err != nil {
+		logrus.Fatalf("Failed to delete test mfa roles: %v", err)
+	}
+
+	_, err = database.DB.ExecContext(context.Background(), `DELETE FROM shares`)
+	if err != nil {
+		logrus.Fatalf("Failed to delete test shares: %v", err)
+	}
+
+	_, err = database.DB.ExecContext(context.Background(), `DELETE FROM users`)
+	if err != nil {
+		logrus.Fatalf("Failed to delete test users: %v", err)
+	}
+
 	// Reset the ID sequence
 	resetSequenceQuery := `ALTER SEQUENCE contacts_id_seq RESTART WITH 1`
 	_, err = database.DB.ExecContext(context.Background(), resetSequenceQuery)
@@ -290,3 +368,535 @@ func TestDeleteContact(t *testing.T) {
 		assert.NotEqual(t, createdContact.ID, c.ID)
 	}
 }
+
+func TestBirthdayCalendar(t *testing.T) {
+	logrus.Info("Running TestBirthdayCalendar")
+	contact := contacts.Contact{
+		FirstName:   "Ada",
+		LastName:    "Lovelace",
+		PhoneNumber: "5550001111",
+		Address:     "12 St James Sq",
+		Birthday:    "1815-12-10",
+		Groups:      []string{"family"},
+	}
+	body, _ := json.Marshal(contact)
+	req, err := http.NewRequest("POST", contactsPath, bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+
+	var createdContact contacts.Contact
+	err = json.NewDecoder(rr.Body).Decode(&createdContact)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Fetch the feed filtered by group
+	req, err = http.NewRequest("GET", birthdaysPath+"?group=family", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), "UID:birthday-"+strconv.Itoa(createdContact.ID)+"@phone-book-api\r\n")
+	assert.Contains(t, rr.Body.String(), "DTSTART;VALUE=DATE:18151210\r\n")
+	assert.Contains(t, rr.Body.String(), "RRULE:FREQ=YEARLY\r\n")
+
+	// A conditional request with the returned ETag must not resend the feed
+	etag := rr.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+	req, err = http.NewRequest("GET", birthdaysPath+"?group=family", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("If-None-Match", etag)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusNotModified, rr.Code)
+
+	// So must one with the returned modification date
+	modified := rr.Header().Get("Last-Modified")
+	assert.NotEmpty(t, modified)
+	req, err = http.NewRequest("GET", birthdaysPath+"?group=family", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("If-Modified-Since", modified)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusNotModified, rr.Code)
+
+	// Contacts outside the group are not part of the feed
+	req, err = http.NewRequest("GET", birthdaysPath+"?group=work", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.NotContains(t, rr.Body.String(), "UID:birthday-"+strconv.Itoa(createdContact.ID)+"@")
+
+	// Deleting the contact changes the feed, so the same conditional requests
+	// are sent the feed without its event. HTTP dates only carry whole
+	// seconds, so the deletion must come a second later.
+	time.Sleep(time.Second)
+	req, err = http.NewRequest("DELETE", contactsPath+"/"+strconv.Itoa(createdContact.ID), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+
+	req, err = http.NewRequest("GET", birthdaysPath+"?group=family", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("If-None-Match", etag)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.NotEqual(t, etag, rr.Header().Get("ETag"))
+	assert.NotContains(t, rr.Body.String(), "UID:birthday-"+strconv.Itoa(createdContact.ID)+"@")
+
+	req, err = http.NewRequest("GET", birthdaysPath+"?group=family", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("If-Modified-Since", modified)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.NotEqual(t, modified, rr.Header().Get("Last-Modified"))
+	assert.NotContains(t, rr.Body.String(), "UID:birthday-"+strconv.Itoa(createdContact.ID)+"@")
+}
+
+func TestCustomFields(t *testing.T) {
+	logrus.Info("Running TestCustomFields")
+	// Define a required, unique custom field
+	field := contacts.CustomField{
+		Name:     "employee_id",
+		Type:     contacts.FieldTypeString,
+		Required: true,
+		Unique:   true,
+		Pattern:  "^E[0-9]{4}$",
+	}
+	body, _ := json.Marshal(field)
+	req, err := http.NewRequest("POST", customFieldsPath, bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+
+	err = json.NewDecoder(rr.Body).Decode(&field)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Remove the field again so the other tests are not required to set it
+	defer func() {
+		req, _ := http.NewRequest("DELETE", customFieldsPath+"/"+strconv.Itoa(field.ID), nil)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusNoContent, rr.Code)
+	}()
+
+	contact := contacts.Contact{
+		FirstName:    "Grace",
+		LastName:     "Hopper",
+		PhoneNumber:  "5550002222",
+		Address:      "1 Navy Yard",
+		CustomFields: map[string]interface{}{"employee_id": "X12"},
+	}
+
+	// A value that does not match the pattern is rejected
+	body, _ = json.Marshal(contact)
+	req, err = http.NewRequest("POST", contactsPath, bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), "employee_id does not match the required pattern")
+
+	// A valid value is stored with the contact
+	contact.CustomFields["employee_id"] = "E1234"
+	body, _ = json.Marshal(contact)
+	req, err = http.NewRequest("POST", contactsPath, bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+
+	// The same value on another contact violates the unique flag
+	req, err = http.NewRequest("POST", contactsPath, bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), "employee_id is already used by another contact")
+
+	// Concurrent contacts claiming the same value pass the check together,
+	// and all but one are still turned down
+	var wg sync.WaitGroup
+	codes := make([]int, 5)
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			racer := contacts.Contact{FirstName: "Racer", LastName: strconv.Itoa(i), PhoneNumber: "555000300" + strconv.Itoa(i),
+				Address: "1 Navy Yard", CustomFields: map[string]interface{}{"employee_id": "E5678"}}
+			body, _ := json.Marshal(racer)
+			req, _ := http.NewRequest("POST", contactsPath, bytes.NewBuffer(body))
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+			codes[i] = rr.Code
+		}(i)
+	}
+	wg.Wait()
+	created := 0
+	for _, code := range codes {
+		if code == http.StatusCreated {
+			created++
+		} else {
+			assert.Equal(t, http.StatusBadRequest, code)
+		}
+	}
+	assert.Equal(t, 1, created)
+
+	// Search can filter on the custom field value
+	req, err = http.NewRequest("GET", contactsSearchPath+"?custom.employee_id=E1234", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var searchResults []contacts.Contact
+	err = json.NewDecoder(rr.Body).Decode(&searchResults)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Len(t, searchResults, 1)
+	assert.Equal(t, "E1234", searchResults[0].CustomFields["employee_id"])
+
+	// A definition the stored values do not conform to is turned down
+	edited := field
+	edited.Type = contacts.FieldTypeNumber
+	edited.Pattern = ""
+	body, _ = json.Marshal(edited)
+	req, _ = http.NewRequest("PUT", customFieldsPath+"/"+strconv.Itoa(field.ID), bytes.NewBuffer(body))
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	edited.Type = contacts.FieldTypeString
+	edited.Pattern = "^E[0-9]+$"
+	body, _ = json.Marshal(edited)
+	req, _ = http.NewRequest("PUT", customFieldsPath+"/"+strconv.Itoa(field.ID), bytes.NewBuffer(body))
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+	// A field made unique again still holds its values to it
+	edited.Unique = false
+	body, _ = json.Marshal(edited)
+	req, _ = http.NewRequest("PUT", customFieldsPath+"/"+strconv.Itoa(field.ID), bytes.NewBuffer(body))
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	edited.Unique = true
+	body, _ = json.Marshal(edited)
+	req, _ = http.NewRequest("PUT", customFieldsPath+"/"+strconv.Itoa(field.ID), bytes.NewBuffer(body))
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	contact.PhoneNumber = "5550002223"
+	body, _ = json.Marshal(contact)
+	req, _ = http.NewRequest("POST", contactsPath, bytes.NewBuffer(body))
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), "employee_id is already used by another contact")
+}
+
+func TestContactNotes(t *testing.T) {
+	logrus.Info("Running TestContactNotes")
+	contactNotesPath := contactsPath + "/" + strconv.Itoa(testContact.ID) + "/notes"
+
+	// Add a note to the test contact
+	note := contacts.Note{
+		Author: "reception",
+		Text:   "Prefers **WhatsApp**, call after 5pm",
+	}
+	body, _ := json.Marshal(note)
+	req, err := http.NewRequest("POST", contactNotesPath, bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+
+	var createdNote contacts.Note
+	err = json.NewDecoder(rr.Body).Decode(&createdNote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, testContact.ID, createdNote.ContactID)
+	assert.Nil(t, createdNote.EditedAt)
+
+	// Edit the note text
+	note.Text = "Prefers Signal, call after 6pm"
+	body, _ = json.Marshal(note)
+	req, err = http.NewRequest("PUT", contactNotesPath+"/"+strconv.Itoa(createdNote.ID), bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var editedNote contacts.Note
+	err = json.NewDecoder(rr.Body).Decode(&editedNote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, note.Text, editedNote.Text)
+	assert.Equal(t, "reception", editedNote.Author)
+	assert.NotNil(t, editedNote.EditedAt)
+
+	// The note text is searchable
+	req, err = http.NewRequest("GET", contactsSearchPath+"?query=Signal", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var searchResults []contacts.Contact
+	err = json.NewDecoder(rr.Body).Decode(&searchResults)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, searchResults, 1)
+	assert.Equal(t, testContact.ID, searchResults[0].ID)
+
+	// Delete the note and verify the list is empty again
+	req, err = http.NewRequest("DELETE", contactNotesPath+"/"+strconv.Itoa(createdNote.ID), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+
+	req, err = http.NewRequest("GET", contactNotesPath+"?page=1&limit=10", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var notes []contacts.Note
+	err = json.NewDecoder(rr.Body).Decode(&notes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, notes)
+}
+
+func createContact(t *testing.T, contact contacts.Contact) contacts.Contact {
+	body, _ := json.Marshal(contact)
+	req, err := http.NewRequest("POST", contactsPath, bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Failed to create contact: %v", rr.Body.String())
+	}
+
+	var createdContact contacts.Contact
+	err = json.NewDecoder(rr.Body).Decode(&createdContact)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return createdContact
+}
+
+func addRelation(t *testing.T, contactID int, relation contacts.Relation) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(relation)
+	req, err := http.NewRequest("POST", contactsPath+"/"+strconv.Itoa(contactID)+"/relations", bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestContactRelations(t *testing.T) {
+	logrus.Info("Running TestContactRelations")
+	employee := createContact(t, contacts.Contact{FirstName: "Eve", LastName: "Employee", PhoneNumber: "5550003001", Address: "1 Office Rd"})
+	manager := createContact(t, contacts.Contact{FirstName: "Max", LastName: "Manager", PhoneNumber: "5550003002", Address: "1 Office Rd"})
+	director := createContact(t, contacts.Contact{FirstName: "Dora", LastName: "Director", PhoneNumber: "5550003003", Address: "1 Office Rd"})
+
+	// Max is Eve's manager and Dora is Max's manager
+	rr := addRelation(t, employee.ID, contacts.Relation{RelatedID: manager.ID, Type: "manager"})
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	rr = addRelation(t, manager.ID, contacts.Relation{RelatedID: director.ID, Type: "manager"})
+	assert.Equal(t, http.StatusCreated, rr.Code)
+
+	// Duplicates and self-relations are rejected
+	rr = addRelation(t, employee.ID, contacts.Relation{RelatedID: manager.ID, Type: "manager"})
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	rr = addRelation(t, employee.ID, contacts.Relation{RelatedID: employee.ID, Type: "spouse"})
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	// The inverse relation is maintained automatically
+	req, err := http.NewRequest("GET", contactsPath+"/"+strconv.Itoa(manager.ID)+"/relations", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var relations []contacts.Relation
+	err = json.NewDecoder(rr.Body).Decode(&relations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	types := make(map[int]string)
+	for _, relation := range relations {
+		types[relation.RelatedID] = relation.Type
+	}
+	assert.Equal(t, "report", types[employee.ID])
+	assert.Equal(t, "manager", types[director.ID])
+
+	// Walking two levels from Eve reaches Dora through Max
+	req, err = http.NewRequest("GET", contactsPath+"/"+strconv.Itoa(employee.ID)+"/relations?depth=2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	relations = nil
+	err = json.NewDecoder(rr.Body).Decode(&relations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reachedDirector bool
+	for _, relation := range relations {
+		if relation.RelatedID == director.ID {
+			reachedDirector = true
+			assert.Equal(t, 2, relation.Depth)
+		}
+		assert.NotEqual(t, employee.ID, relation.RelatedID)
+	}
+	assert.True(t, reachedDirector)
+}
+
+func TestOrganizationContacts(t *testing.T) {
+	logrus.Info("Running TestOrganizationContacts")
+	organization := organizations.Organization{
+		Name:      "Initech",
+		MainPhone: "5550004000",
+		Website:   "https://initech.example",
+	}
+	body, _ := json.Marshal(organization)
+	req, err := http.NewRequest("POST", organizationsPath, bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+
+	err = json.NewDecoder(rr.Body).Decode(&organization)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Link a contact to the organization
+	employee := createContact(t, contacts.Contact{
+		FirstName:      "Peter",
+		LastName:       "Gibbons",
+		PhoneNumber:    "5550004001",
+		Address:        "4120 Freidrich Ln",
+		OrganizationID: &organization.ID,
+		JobTitle:       "Programmer",
+		Department:     "Engineering",
+	})
+	assert.Equal(t, "Initech", employee.Organization)
+
+	// The contact is listed under the organization
+	req, err = http.NewRequest("GET", organizationsPath+"/"+strconv.Itoa(organization.ID)+"/contacts", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var members []contacts.Contact
+	err = json.NewDecoder(rr.Body).Decode(&members)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, members, 1)
+	assert.Equal(t, employee.ID, members[0].ID)
+	assert.Equal(t, "Programmer", members[0].JobTitle)
+
+	// Searching by organization name finds the contact
+	req, err = http.NewRequest("GET", contactsSearchPath+"?query=Initech", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var searchResults []contacts.Contact
+	err = json.NewDecoder(rr.Body).Decode(&searchResults)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, searchResults, 1)
+	assert.Equal(t, employee.ID, searchResults[0].ID)
+
+	// Linking to an organization that does not exist is rejected
+	missing := 999999
+	body, _ = json.Marshal(contacts.Contact{FirstName: "Milton", LastName: "Waddams", PhoneNumber: "5550004002", Address: "Basement", OrganizationID: &missing})
+	req, err = http.NewRequest("POST", contactsPath, bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
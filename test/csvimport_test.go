@@ -0,0 +1,118 @@
+package test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/benhuri/phone-book-api/internal/contacts"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/text/encoding/charmap"
+)
+
+const googleCSV = "First Name,Middle Name,Last Name,Birthday,Notes,Labels,Phone 1 - Label,Phone 1 - Value,Address 1 - Formatted\n" +
+	"Dana,,Csvimport,1990-03-04,\"Two line\nnote\",* myContacts ::: csv-friends,Mobile,555-000-6001,\"1 Road\nTown\"\n" +
+	"Bad,,Csvimport,someday,,,,,\n"
+
+func csvRequest(t *testing.T, handler http.Handler, url, body string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest("POST", url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+bootstrapToken)
+	req.Header.Set(contentType, "text/csv")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestCSVImport(t *testing.T) {
+	logrus.Info("Running TestCSVImport")
+	authRouter := newAuthRouter()
+
+	// The Google layout is detected from the header
+	rr := csvRequest(t, authRouter, csvImportPath+"?dry_run=true", googleCSV)
+	if !assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String()) {
+		t.FailNow()
+	}
+	var preview contacts.ImportResult
+	json.NewDecoder(rr.Body).Decode(&preview)
+	assert.Equal(t, contacts.ProfileGoogle, preview.Profile)
+	assert.Equal(t, 1, preview.Created)
+	assert.Equal(t, 1, preview.Skipped)
+	if assert.Len(t, preview.Records, 2) {
+		dana := preview.Records[0].Contact
+		assert.Equal(t, "5550006001", dana.PhoneNumber)
+		assert.Equal(t, "1 Road, Town", dana.Address)
+		assert.Equal(t, []string{"csv-friends"}, dana.Groups)
+		assert.Equal(t, 5, preview.Records[1].Line)
+		assert.Contains(t, preview.Records[1].Errors, contacts.ImportError{Line: 5, Message: "Birthday: someday is not a date"})
+	}
+
+	// All-or-nothing imports write nothing when a row fails
+	rr = csvRequest(t, authRouter, csvImportPath+"?mode=all-or-nothing", googleCSV)
+	assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+	var rejected contacts.ImportResult
+	json.NewDecoder(rr.Body).Decode(&rejected)
+	assert.True(t, rejected.Rejected)
+	assert.Equal(t, 0, rejected.Created)
+	assert.Equal(t, len(rejected.Records), rejected.Skipped)
+	for _, record := range rejected.Records {
+		// Rows that were written before the failing one are rolled back
+		assert.Equal(t, contacts.ImportSkip, record.Action)
+		if record.Contact != nil {
+			assert.Zero(t, record.Contact.ID)
+		}
+	}
+	rr = bearerRequest(t, authRouter, bootstrapToken, "GET", contactsSearchPath+"?query=Csvimport", nil)
+	assert.NotContains(t, rr.Body.String(), "Dana")
+
+	rr = csvRequest(t, authRouter, csvImportPath, googleCSV)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var result contacts.ImportResult
+	json.NewDecoder(rr.Body).Decode(&result)
+	assert.Equal(t, 1, result.Created)
+	assert.Equal(t, 1, result.Skipped)
+	notesURL := strings.Replace(notesPath, "{id}", strconv.Itoa(result.Records[0].Contact.ID), 1)
+	rr = bearerRequest(t, authRouter, bootstrapToken, "GET", notesURL, nil)
+	assert.Contains(t, rr.Body.String(), "Two line\\nnote")
+
+	// Stored profiles map custom layouts
+	profile := contacts.ImportProfile{Name: "crm", Columns: map[string]string{
+		"Vorname": "first_name", "Nachname": "last_name", "Telefon": "phone_number", "Strasse": "address",
+	}}
+	rr = bearerRequest(t, authRouter, bootstrapToken, "POST", importProfilesPath, profile)
+	if !assert.Equal(t, http.StatusCreated, rr.Code, rr.Body.String()) {
+		t.FailNow()
+	}
+	json.NewDecoder(rr.Body).Decode(&profile)
+	defer bearerRequest(t, authRouter, bootstrapToken, "DELETE", strings.Replace(profileIDPath, "{id}", strconv.Itoa(profile.ID), 1), nil)
+	rr = bearerRequest(t, authRouter, bootstrapToken, "POST", importProfilesPath, profile)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	rr = bearerRequest(t, authRouter, bootstrapToken, "POST", importProfilesPath, contacts.ImportProfile{Name: "google", Columns: profile.Columns})
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	rr = bearerRequest(t, authRouter, bootstrapToken, "POST", importProfilesPath, contacts.ImportProfile{Name: "bad", Columns: map[string]string{"X": "nickname"}})
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	crmCSV, _ := charmap.Windows1255.NewEncoder().String("Vorname;Nachname;Telefon;Strasse\nשרה;Csvimport;5550006002;רחוב הרצל 1\n")
+	rr = csvRequest(t, authRouter, csvImportPath+"?profile=crm&encoding=windows-1255&delimiter=;", crmCSV)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	json.NewDecoder(rr.Body).Decode(&result)
+	assert.Equal(t, "crm", result.Profile)
+	assert.Equal(t, 1, result.Created)
+	if assert.Len(t, result.Records, 1) {
+		assert.Equal(t, "שרה", result.Records[0].Contact.FirstName)
+		assert.Equal(t, "רחוב הרצל 1", result.Records[0].Contact.Address)
+	}
+
+	rr = csvRequest(t, authRouter, csvImportPath+"?encoding=ebcdic", googleCSV)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	rr = csvRequest(t, authRouter, csvImportPath+"?profile=missing", googleCSV)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	rr = csvRequest(t, authRouter, csvImportPath, "Foo,Bar\n1,2\n")
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
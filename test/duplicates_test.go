@@ -0,0 +1,240 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/benhuri/phone-book-api/internal/auth"
+	"github.com/benhuri/phone-book-api/internal/contacts"
+	"github.com/benhuri/phone-book-api/internal/database"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// findCluster returns the duplicate cluster holding the contact, if any.
+func findCluster(clusters []contacts.DuplicateCluster, contactID int) *contacts.DuplicateCluster {
+	for i := range clusters {
+		for _, contact := range clusters[i].Contacts {
+			if contact.ID == contactID {
+				return &clusters[i]
+			}
+		}
+	}
+	return nil
+}
+
+func TestMergeDuplicates(t *testing.T) {
+	logrus.Info("Running TestMergeDuplicates")
+	authRouter := newAuthRouter()
+	ctx := auth.NewContext(context.Background(), &auth.Principal{Subject: "bootstrap", TenantID: tenantA, Scopes: []string{auth.ScopeAdmin}})
+	repo := contacts.NewRepository(database.DB, contacts.TxConfig{}, "972")
+
+	dan := contacts.Contact{FirstName: "Dan", LastName: "Duplikat", PhoneNumber: "0541234567", Address: "1 Merge St", Groups: []string{"work"}}
+	rr := bearerRequest(t, authRouter, bootstrapToken, "POST", contactsPath, dan)
+	if !assert.Equal(t, http.StatusCreated, rr.Code, rr.Body.String()) {
+		t.FailNow()
+	}
+	json.NewDecoder(rr.Body).Decode(&dan)
+	defer repo.RemoveContact(ctx, dan.ID)
+
+	// The same number in international format, which the API would reject
+	daniel := contacts.Contact{FirstName: "Daniel", LastName: "Duplikat", PhoneNumber: "+972541234567", JobTitle: "Engineer", Groups: []string{"family"}}
+	if !assert.NoError(t, repo.CreateContact(ctx, &daniel)) {
+		t.FailNow()
+	}
+	defer repo.RemoveContact(ctx, daniel.ID)
+
+	note := contacts.Note{ContactID: daniel.ID, Author: "reception", Text: "Met at the conference"}
+	assert.NoError(t, repo.CreateNote(ctx, &note))
+
+	// Both contacts are found in one cluster, matched by their phone number
+	rr = bearerRequest(t, authRouter, bootstrapToken, "GET", duplicatesPath+"?limit=100", nil)
+	if !assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String()) {
+		t.FailNow()
+	}
+	var clusters []contacts.DuplicateCluster
+	json.NewDecoder(rr.Body).Decode(&clusters)
+	cluster := findCluster(clusters, dan.ID)
+	if assert.NotNil(t, cluster) {
+		assert.Len(t, cluster.Contacts, 2)
+		assert.Greater(t, cluster.Confidence, contacts.DefaultMinConfidence)
+		if assert.Len(t, cluster.Matches, 1) {
+			assert.True(t, cluster.Matches[0].PhoneMatch)
+		}
+	}
+
+	rr = bearerRequest(t, authRouter, bootstrapToken, "GET", duplicatesPath+"?min_confidence=2", nil)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	// Merging into Dan keeps Dan's name, takes Daniel's first name when
+	// chosen, fills the empty job title and unions the groups
+	request := contacts.MergeRequest{
+		SurvivorID: dan.ID,
+		ContactIDs: []int{daniel.ID},
+		Fields:     map[string]int{"first_name": daniel.ID},
+	}
+	rr = bearerRequest(t, authRouter, bootstrapToken, "POST", mergePath, request)
+	if !assert.Equal(t, http.StatusCreated, rr.Code, rr.Body.String()) {
+		t.FailNow()
+	}
+	var merge contacts.Merge
+	json.NewDecoder(rr.Body).Decode(&merge)
+	assert.Equal(t, []int{daniel.ID}, merge.MergedIDs)
+	if assert.NotNil(t, merge.Contact) {
+		assert.Equal(t, "Daniel", merge.Contact.FirstName)
+		assert.Equal(t, "0541234567", merge.Contact.PhoneNumber)
+		assert.Equal(t, "Engineer", merge.Contact.JobTitle)
+		assert.ElementsMatch(t, []string{"work", "family"}, merge.Contact.Groups)
+	}
+
+	_, err := repo.FetchContact(ctx, daniel.ID)
+	assert.ErrorIs(t, err, contacts.ErrContactNotFound)
+	notes, err := repo.FetchNotes(ctx, dan.ID, 10, 0)
+	if assert.NoError(t, err) && assert.Len(t, notes, 1) {
+		assert.Equal(t, note.ID, notes[0].ID)
+	}
+
+	// Choices must name contacts of the merge
+	request = contacts.MergeRequest{SurvivorID: dan.ID, ContactIDs: []int{dan.ID}}
+	rr = bearerRequest(t, authRouter, bootstrapToken, "POST", mergePath, request)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	request = contacts.MergeRequest{SurvivorID: dan.ID, ContactIDs: []int{daniel.ID}, Fields: map[string]int{"phone": daniel.ID}}
+	rr = bearerRequest(t, authRouter, bootstrapToken, "POST", mergePath, request)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	rr = bearerRequest(t, authRouter, bootstrapToken, "GET", mergesPath, nil)
+	if assert.Equal(t, http.StatusOK, rr.Code) {
+		var merges []contacts.Merge
+		json.NewDecoder(rr.Body).Decode(&merges)
+		if assert.NotEmpty(t, merges) {
+			assert.Equal(t, merge.ID, merges[0].ID)
+		}
+	}
+
+	// Undoing the merge restores both contacts and moves the note back
+	undoPath := mergesPath + "/" + strconv.Itoa(merge.ID) + "/undo"
+	rr = bearerRequest(t, authRouter, bootstrapToken, "POST", undoPath, nil)
+	if !assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String()) {
+		t.FailNow()
+	}
+	restored, err := repo.FetchContact(ctx, dan.ID)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "Dan", restored.FirstName)
+		assert.Equal(t, []string{"work"}, restored.Groups)
+	}
+	restored, err = repo.FetchContact(ctx, daniel.ID)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "+972541234567", restored.PhoneNumber)
+	}
+	notes, err = repo.FetchNotes(ctx, daniel.ID, 10, 0)
+	if assert.NoError(t, err) {
+		assert.Len(t, notes, 1)
+	}
+
+	rr = bearerRequest(t, authRouter, bootstrapToken, "POST", undoPath, nil)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	rr = bearerRequest(t, authRouter, bootstrapToken, "POST", mergesPath+"/0/undo", nil)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestDuplicatePolicy(t *testing.T) {
+	logrus.Info("Running TestDuplicatePolicy")
+	ctx := auth.NewContext(context.Background(), &auth.Principal{Subject: "bootstrap", TenantID: tenantA, Scopes: []string{auth.ScopeAdmin}})
+	repo := contacts.NewRepository(database.DB, contacts.TxConfig{}, "972")
+	warnService := contactHandler.Service
+	defer func() { contactHandler.Service = warnService }()
+	contactHandler.Service = contacts.NewService(repo, []byte(shareLinkSecret), "", "972", contacts.DuplicatesReject)
+	rbacRouter := newRBACRouter()
+
+	rina := contacts.Contact{FirstName: "Rina", LastName: "Reject", PhoneNumber: "0551234567", Address: "1 Policy St"}
+	rr := bearerRequest(t, rbacRouter, bootstrapToken, "POST", contactsPath, rina)
+	if !assert.Equal(t, http.StatusCreated, rr.Code, rr.Body.String()) {
+		t.FailNow()
+	}
+	json.NewDecoder(rr.Body).Decode(&rina)
+	defer repo.RemoveContact(ctx, rina.ID)
+	rinaPath := contactsPath + "/" + strconv.Itoa(rina.ID)
+
+	// The same number is rejected, pointing to Rina
+	copyOf := rina
+	copyOf.ID = 0
+	copyOf.LastName = "Again"
+	rr = bearerRequest(t, rbacRouter, bootstrapToken, "POST", contactsPath, copyOf)
+	if assert.Equal(t, http.StatusConflict, rr.Code, rr.Body.String()) {
+		assert.Equal(t, rinaPath, rr.Header().Get("Location"))
+		var problem struct {
+			Status     int    `json:"status"`
+			Contact    string `json:"contact"`
+			ContactIDs []int  `json:"contact_ids"`
+		}
+		json.NewDecoder(rr.Body).Decode(&problem)
+		assert.Equal(t, http.StatusConflict, problem.Status)
+		assert.Equal(t, rinaPath, problem.Contact)
+		assert.Equal(t, []int{rina.ID}, problem.ContactIDs)
+	}
+	// So is the number in international format
+	twin := contacts.Contact{FirstName: "Rina", LastName: "Twin", PhoneNumber: "+972551234567", Address: "2 Policy St"}
+	_, err := contactHandler.Service.AddContact(ctx, &twin, false)
+	var duplicateErr *contacts.DuplicateError
+	if assert.ErrorAs(t, err, &duplicateErr) {
+		assert.Equal(t, []int{rina.ID}, duplicateErr.ContactIDs)
+	}
+
+	// Only callers allowed to force may override the policy
+	editorToken := roleToken(t, "policy-editor", auth.RoleEditor)
+	rr = bearerRequest(t, rbacRouter, editorToken, "POST", contactsPath+"?force=true", copyOf)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	rr = bearerRequest(t, rbacRouter, bootstrapToken, "POST", contactsPath+"?force=maybe", copyOf)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	rr = bearerRequest(t, rbacRouter, bootstrapToken, "POST", contactsPath+"?force=true", copyOf)
+	if assert.Equal(t, http.StatusCreated, rr.Code, rr.Body.String()) {
+		var forced contacts.Contact
+		json.NewDecoder(rr.Body).Decode(&forced)
+		defer repo.RemoveContact(ctx, forced.ID)
+	}
+
+	// Under the warn policy the contact is added and the others are named
+	contactHandler.Service = warnService
+	copyOf.LastName = "Warned"
+	rr = bearerRequest(t, rbacRouter, bootstrapToken, "POST", contactsPath, copyOf)
+	if assert.Equal(t, http.StatusCreated, rr.Code, rr.Body.String()) {
+		var warned contacts.Contact
+		json.NewDecoder(rr.Body).Decode(&warned)
+		defer repo.RemoveContact(ctx, warned.ID)
+		assert.Contains(t, rr.Header().Get("Warning"), strconv.Itoa(rina.ID))
+		assert.Contains(t, rr.Header().Values("Link"), `<`+rinaPath+`>; rel="duplicate"`)
+	}
+}
+
+func TestConcurrentPhoneClaims(t *testing.T) {
+	logrus.Info("Running TestConcurrentPhoneClaims")
+	ctx := auth.NewContext(context.Background(), &auth.Principal{Subject: "bootstrap", TenantID: tenantA, Scopes: []string{auth.ScopeAdmin}})
+	repo := contacts.NewRepository(database.DB, contacts.TxConfig{}, "972")
+
+	racers := make([]contacts.Contact, 4)
+	for i := range racers {
+		racers[i] = contacts.Contact{FirstName: "Racer", LastName: strconv.Itoa(i), PhoneNumber: "055765432" + strconv.Itoa(i), Address: "1 Race St"}
+		if !assert.NoError(t, repo.CreateContact(ctx, &racers[i])) {
+			t.FailNow()
+		}
+		defer repo.RemoveContact(ctx, racers[i].ID)
+	}
+
+	// Updates racing to the same number all succeed, and one of them claims it
+	errs := make(chan error, len(racers))
+	for i := range racers {
+		racers[i].PhoneNumber = "0557654399"
+		go func(contact contacts.Contact) {
+			errs <- repo.UpdateContact(ctx, &contact)
+		}(racers[i])
+	}
+	for range racers {
+		assert.NoError(t, <-errs)
+	}
+	ids, err := repo.FindSamePhone(ctx, &contacts.Contact{PhoneNumber: "+972557654399"})
+	assert.NoError(t, err)
+	assert.Len(t, ids, len(racers))
+}
@@ -0,0 +1,114 @@
+package test
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/benhuri/phone-book-api/internal/contacts"
+	"github.com/benhuri/phone-book-api/internal/database"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+const bulkExportGroup = "bulk-export"
+
+// cancelOnFlush cancels the request after the first flush, like a client
+// that disconnects during an export.
+type cancelOnFlush struct {
+	*httptest.ResponseRecorder
+	cancel context.CancelFunc
+}
+
+func (w *cancelOnFlush) Flush() {
+	w.ResponseRecorder.Flush()
+	w.cancel()
+}
+
+func TestRowsExport(t *testing.T) {
+	logrus.Info("Running TestRowsExport")
+	authRouter := newAuthRouter()
+
+	field := contacts.CustomField{Name: "badge", Type: contacts.FieldTypeString}
+	rr := bearerRequest(t, authRouter, bootstrapToken, "POST", customFieldsPath, field)
+	if !assert.Equal(t, http.StatusCreated, rr.Code, rr.Body.String()) {
+		t.FailNow()
+	}
+	json.NewDecoder(rr.Body).Decode(&field)
+	defer bearerRequest(t, authRouter, bootstrapToken, "DELETE", customFieldsPath+"/"+strconv.Itoa(field.ID), nil)
+
+	anna := contacts.Contact{FirstName: "Anna", LastName: "Rowexport", PhoneNumber: "5550007001", Address: "1 Row St, Town",
+		Groups: []string{"rows", "csv, quoted"}, CustomFields: map[string]interface{}{"badge": "B7"}}
+	bert := contacts.Contact{FirstName: "Bert", LastName: "Rowexport", PhoneNumber: "5550007002", Address: "2 Row St"}
+	for _, contact := range []*contacts.Contact{&anna, &bert} {
+		rr = bearerRequest(t, authRouter, bootstrapToken, "POST", contactsPath, contact)
+		if !assert.Equal(t, http.StatusCreated, rr.Code, rr.Body.String()) {
+			t.FailNow()
+		}
+		json.NewDecoder(rr.Body).Decode(contact)
+	}
+
+	// The CSV export has a header of import targets and the search filters
+	rr = bearerRequest(t, authRouter, bootstrapToken, "GET", rowsExportPath+"?query=Rowexport", nil)
+	if !assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String()) {
+		t.FailNow()
+	}
+	assert.Equal(t, "text/csv; charset=utf-8", rr.Header().Get(contentType))
+	records, err := csv.NewReader(rr.Body).ReadAll()
+	if !assert.NoError(t, err) || !assert.Len(t, records, 3) {
+		t.FailNow()
+	}
+	assert.Equal(t, []string{"id", "first_name", "last_name", "phone_number", "address", "birthday", "anniversary",
+		"groups", "organization", "job_title", "department", "custom.badge"}, records[0])
+	assert.Equal(t, []string{strconv.Itoa(anna.ID), "Anna", "Rowexport", "5550007001", "1 Row St, Town", "", "",
+		"rows; csv, quoted", "", "", "", "B7"}, records[1])
+	assert.Equal(t, "Bert", records[2][1])
+
+	rr = bearerRequest(t, authRouter, bootstrapToken, "GET", rowsExportPath+"?query=Rowexport&custom.badge=B7&fields=last_name,custom.badge", nil)
+	assert.Equal(t, "last_name,custom.badge\nRowexport,B7\n", rr.Body.String())
+
+	rr = bearerRequest(t, authRouter, bootstrapToken, "GET", rowsExportPath+"?format=ndjson&group=rows&fields=id,first_name,groups,custom.badge", nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "application/x-ndjson", rr.Header().Get(contentType))
+	assert.Equal(t, `{"id":`+strconv.Itoa(anna.ID)+`,"first_name":"Anna","groups":["rows","csv, quoted"],"custom.badge":"B7"}`+"\n", rr.Body.String())
+
+	rr = bearerRequest(t, authRouter, bootstrapToken, "GET", rowsExportPath+"?format=xml", nil)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	rr = bearerRequest(t, authRouter, bootstrapToken, "GET", rowsExportPath+"?fields=id,custom.missing", nil)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	rr = bearerRequest(t, authRouter, bootstrapToken, "GET", rowsExportPath+"?view=mine", nil)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	// Exports larger than a cursor batch are read in several fetches
+	_, err = database.DB.ExecContext(context.Background(), `INSERT INTO contacts (tenant_id, first_name, last_name, phone_number, address, groups)
+		SELECT $1, 'Bulk', 'Export' || n, '5550008000', 'Bulk St', ARRAY[$2] FROM generate_series(1, 1201) n`, tenantA, bulkExportGroup)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer database.DB.ExecContext(context.Background(), `DELETE FROM contacts WHERE $1 = ANY(groups)`, bulkExportGroup)
+
+	rr = bearerRequest(t, authRouter, bootstrapToken, "GET", rowsExportPath+"?format=ndjson&fields=id&group="+bulkExportGroup, nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.True(t, rr.Flushed)
+	assert.Equal(t, 1201, strings.Count(rr.Body.String(), "\n"))
+
+	// A client that leaves stops the export after the rows already sent
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", rowsExportPath+"?format=ndjson&fields=id&group="+bulkExportGroup, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+bootstrapToken)
+	w := &cancelOnFlush{ResponseRecorder: httptest.NewRecorder(), cancel: cancel}
+	authRouter.ServeHTTP(w, req)
+	assert.Less(t, strings.Count(w.Body.String(), "\n"), 1201)
+
+	rr = bearerRequest(t, authRouter, bootstrapToken, "GET", rowsExportPath+"?query=Rowexport&fields=id", nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+}
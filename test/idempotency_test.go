@@ -0,0 +1,85 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/benhuri/phone-book-api/internal/contacts"
+	"github.com/benhuri/phone-book-api/internal/database"
+	"github.com/benhuri/phone-book-api/internal/idempotency"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+const idempotencyKeyHeader = "Idempotency-Key"
+
+func idempotentRequest(t *testing.T, handler http.Handler, key, method, url string, body interface{}) *httptest.ResponseRecorder {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest(method, url, bytes.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+bootstrapToken)
+	req.Header.Set(idempotencyKeyHeader, key)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestIdempotencyKeys(t *testing.T) {
+	logrus.Info("Running TestIdempotencyKeys")
+	authRouter := newAuthRouter()
+	key := "create-fay-" + strconv.Itoa(testContact.ID)
+	defer database.DB.ExecContext(context.Background(), `DELETE FROM idempotency_keys WHERE key LIKE 'create-fay-%' OR key = 'in-flight'`)
+
+	fay := contacts.Contact{FirstName: "Fay", LastName: "Idempotent", PhoneNumber: "5550011001", Address: "1 Retry St"}
+	rr := idempotentRequest(t, authRouter, key, "POST", contactsPath, fay)
+	if !assert.Equal(t, http.StatusCreated, rr.Code, rr.Body.String()) {
+		t.FailNow()
+	}
+	var created contacts.Contact
+	json.Unmarshal(rr.Body.Bytes(), &created)
+	defer bearerRequest(t, authRouter, bootstrapToken, "DELETE", contactsPath+"/"+strconv.Itoa(created.ID), nil)
+
+	// A retry gets the first response and creates nothing
+	retry := idempotentRequest(t, authRouter, key, "POST", contactsPath, fay)
+	assert.Equal(t, http.StatusCreated, retry.Code)
+	assert.Equal(t, "true", retry.Header().Get("Idempotent-Replayed"))
+	assert.Equal(t, rr.Body.String(), retry.Body.String())
+	rr = bearerRequest(t, authRouter, bootstrapToken, "GET", contactsSearchPath+"?query=Idempotent", nil)
+	var found []contacts.Contact
+	json.NewDecoder(rr.Body).Decode(&found)
+	assert.Len(t, found, 1)
+
+	// The key cannot be used for another request
+	fay.Address = "2 Retry St"
+	rr = idempotentRequest(t, authRouter, key, "POST", contactsPath, fay)
+	assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+
+	// Nor while the first request with it runs
+	deleteURL := contactsPath + "/" + strconv.Itoa(created.ID)
+	_, err := database.DB.ExecContext(context.Background(), `INSERT INTO idempotency_keys (tenant_id, subject, key, fingerprint, expires_at)
+		VALUES ($1, 'bootstrap', 'in-flight', $2, now() + interval '1 hour')`, tenantA, idempotency.Fingerprint("DELETE", deleteURL, []byte("null")))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	rr = idempotentRequest(t, authRouter, "in-flight", "DELETE", deleteURL, nil)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+
+	// Failed requests are stored too, and reads ignore the header
+	rr = idempotentRequest(t, authRouter, key+"-invalid", "POST", contactsPath, contacts.Contact{FirstName: "Fay"})
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	rr = idempotentRequest(t, authRouter, key+"-invalid", "POST", contactsPath, contacts.Contact{FirstName: "Fay"})
+	assert.Equal(t, "true", rr.Header().Get("Idempotent-Replayed"))
+	rr = idempotentRequest(t, authRouter, key, "GET", contactsPath, nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Empty(t, rr.Header().Get("Idempotent-Replayed"))
+}
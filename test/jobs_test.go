@@ -0,0 +1,126 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benhuri/phone-book-api/internal/database"
+	"github.com/benhuri/phone-book-api/internal/jobs"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	jobsPath      = "/jobs"
+	jobImportPath = jobsPath + "/import"
+	jobExportPath = jobsPath + "/export"
+	jobIDPath     = jobsPath + "/{id}"
+	jobResultPath = jobIDPath + "/result"
+	jobCancelPath = jobIDPath + "/cancel"
+	jobTimeout    = 30 * time.Second
+
+	jobsCSV = "first_name,last_name,phone_number,address,groups\n" +
+		"Jana,Jobimport,5550009001,1 Job St,job-import\n" +
+		"Jon,Jobimport,not a number,2 Job St,job-import\n"
+)
+
+func jobURL(path string, id int) string {
+	return strings.Replace(path, "{id}", strconv.Itoa(id), 1)
+}
+
+// waitForJob polls a job until it finishes.
+func waitForJob(t *testing.T, handler http.Handler, id int) jobs.Job {
+	var job jobs.Job
+	deadline := time.Now().Add(jobTimeout)
+	for time.Now().Before(deadline) {
+		rr := bearerRequest(t, handler, bootstrapToken, "GET", jobURL(jobIDPath, id), nil)
+		if !assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String()) {
+			t.FailNow()
+		}
+		json.NewDecoder(rr.Body).Decode(&job)
+		if job.Status != jobs.StatusQueued && job.Status != jobs.StatusRunning {
+			return job
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("job %d did not finish", id)
+	return job
+}
+
+// submitted decodes the job a submission queued.
+func submitted(t *testing.T, rr *httptest.ResponseRecorder) jobs.Job {
+	var job jobs.Job
+	if !assert.Equal(t, http.StatusAccepted, rr.Code, rr.Body.String()) {
+		t.FailNow()
+	}
+	json.NewDecoder(rr.Body).Decode(&job)
+	assert.Equal(t, jobURL(jobIDPath, job.ID), rr.Header().Get("Location"))
+	assert.Equal(t, jobs.StatusQueued, job.Status)
+	return job
+}
+
+func TestJobs(t *testing.T) {
+	logrus.Info("Running TestJobs")
+	authRouter := newAuthRouter()
+	defer database.DB.ExecContext(context.Background(), `DELETE FROM contacts WHERE 'job-import' = ANY(groups)`)
+
+	// Queued jobs can be canceled before a worker takes them
+	queued := submitted(t, bearerRequest(t, authRouter, bootstrapToken, "POST", jobExportPath+"?format=ndjson", nil))
+	rr := bearerRequest(t, authRouter, bootstrapToken, "POST", jobURL(jobCancelPath, queued.ID), nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	rr = bearerRequest(t, authRouter, bootstrapToken, "POST", jobURL(jobCancelPath, queued.ID), nil)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	rr = bearerRequest(t, authRouter, bootstrapToken, "GET", jobURL(jobResultPath, queued.ID), nil)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+
+	// Mistakes are reported when the job is submitted
+	rr = bearerRequest(t, authRouter, bootstrapToken, "POST", jobExportPath+"?fields=id,custom.missing", nil)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	rr = bearerRequest(t, authRouter, bootstrapToken, "POST", jobImportPath, nil)
+	assert.Equal(t, http.StatusUnsupportedMediaType, rr.Code)
+	rr = bearerRequest(t, authRouter, bootstrapToken, "GET", jobURL(jobIDPath, 999999), nil)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	go jobs.NewService(jobs.NewRepository(database.DB), contactHandler.Service).Run(ctx, 2)
+
+	imported := submitted(t, csvRequest(t, authRouter, jobImportPath, jobsCSV))
+	job := waitForJob(t, authRouter, imported.ID)
+	assert.Equal(t, jobs.StatusSucceeded, job.Status, job.Error)
+	assert.Equal(t, 100, job.Progress)
+	assert.Equal(t, 2, job.Total)
+	if assert.NotNil(t, job.Import) {
+		assert.Equal(t, 1, job.Import.Created)
+		assert.Equal(t, 1, job.Import.Skipped)
+		assert.Len(t, job.Import.Errors, 1)
+	}
+
+	// All-or-nothing imports that are rejected fail with their errors
+	rejected := submitted(t, csvRequest(t, authRouter, jobImportPath+"?mode=all-or-nothing", jobsCSV))
+	job = waitForJob(t, authRouter, rejected.ID)
+	assert.Equal(t, jobs.StatusFailed, job.Status)
+	assert.NotEmpty(t, job.Error)
+	assert.True(t, job.Import.Rejected)
+
+	exported := submitted(t, bearerRequest(t, authRouter, bootstrapToken, "POST", jobExportPath+"?format=ndjson&fields=first_name&group=job-import", nil))
+	job = waitForJob(t, authRouter, exported.ID)
+	assert.Equal(t, jobs.StatusSucceeded, job.Status, job.Error)
+	rr = bearerRequest(t, authRouter, bootstrapToken, "GET", jobURL(jobResultPath, exported.ID), nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "application/x-ndjson", rr.Header().Get(contentType))
+	assert.Equal(t, `{"first_name":"Jana"}`+"\n", rr.Body.String())
+
+	rr = bearerRequest(t, authRouter, bootstrapToken, "GET", jobsPath, nil)
+	var listed []jobs.Job
+	json.NewDecoder(rr.Body).Decode(&listed)
+	if assert.NotEmpty(t, listed) {
+		assert.Equal(t, exported.ID, listed[0].ID)
+	}
+}
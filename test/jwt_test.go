@@ -0,0 +1,240 @@
+package test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/benhuri/phone-book-api/internal/auth"
+	"github.com/benhuri/phone-book-api/internal/contacts"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	jwtIssuer   = "https://gateway.test"
+	jwtAudience = "phone-book-api"
+	jwtSecret   = "test-hmac-secret"
+	jwtTenant   = "jwt-tenant"
+)
+
+// jwksServer is a local stand-in for the gateway's JWKS endpoint.
+type jwksServer struct {
+	mu      sync.Mutex
+	keys    []map[string]string
+	fetches int
+}
+
+func (s *jwksServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fetches++
+	json.NewEncoder(w).Encode(map[string]interface{}{"keys": s.keys})
+}
+
+func (s *jwksServer) setKeys(keys ...map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = keys
+}
+
+func rsaJWK(kid string, key *rsa.PrivateKey) map[string]string {
+	return map[string]string{
+		"kty": "RSA",
+		"kid": kid,
+		"use": "sig",
+		"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+func ecJWK(kid string, key *ecdsa.PrivateKey) map[string]string {
+	return map[string]string{
+		"kty": "EC",
+		"kid": kid,
+		"crv": "P-256",
+		"x":   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+		"y":   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+	}
+}
+
+// signJWT signs the claims with an *rsa.PrivateKey, *ecdsa.PrivateKey or
+// HMAC secret, choosing the algorithm from the key type.
+func signJWT(t *testing.T, kid string, key interface{}, claims map[string]interface{}) string {
+	alg := auth.AlgHS256
+	switch key.(type) {
+	case *rsa.PrivateKey:
+		alg = auth.AlgRS256
+	case *ecdsa.PrivateKey:
+		alg = auth.AlgES256
+	}
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	digest := sha256.Sum256([]byte(signed))
+	var signature []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func jwtClaims(scope string) map[string]interface{} {
+	now := time.Now()
+	return map[string]interface{}{
+		"iss":       jwtIssuer,
+		"aud":       []string{jwtAudience, "other-service"},
+		"sub":       "user-42",
+		"tenant_id": jwtTenant,
+		"roles":     []string{"viewer"},
+		"scope":     scope,
+		"iat":       now.Unix(),
+		"nbf":       now.Unix(),
+		"exp":       now.Add(time.Hour).Unix(),
+	}
+}
+
+func TestJWTAuthentication(t *testing.T) {
+	logrus.Info("Running TestJWTAuthentication")
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stub := &jwksServer{}
+	stub.setKeys(rsaJWK("rsa-1", rsaKey), ecJWK("ec-1", ecKey))
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	authenticator := auth.NewJWTAuthenticator(auth.JWTConfig{
+		Issuers:   []string{jwtIssuer},
+		Audience:  jwtAudience,
+		ClockSkew: time.Minute,
+	}, auth.StaticKeys{auth.NewHMACKey("", []byte(jwtSecret))}, auth.NewJWKS(server.URL, time.Hour))
+	authRouter := newAuthRouter(authenticator)
+
+	readScope := auth.ScopeContactsRead
+	writeScope := auth.ScopeContactsRead + " " + auth.ScopeContactsWrite
+
+	// Every supported algorithm is accepted
+	for _, token := range []string{
+		signJWT(t, "rsa-1", rsaKey, jwtClaims(readScope)),
+		signJWT(t, "ec-1", ecKey, jwtClaims(readScope)),
+		signJWT(t, "", []byte(jwtSecret), jwtClaims(readScope)),
+	} {
+		rr := bearerRequest(t, authRouter, token, "GET", contactsPath, nil)
+		assert.Equal(t, http.StatusOK, rr.Code)
+	}
+	assert.Equal(t, 1, stub.fetches, "the JWKS should be cached")
+
+	// Scopes come from the token and the tenant from its tenant_id claim
+	contact := contacts.Contact{FirstName: "Jot", LastName: "Token", PhoneNumber: "5550007000", Address: "JWT Street"}
+	rr := bearerRequest(t, authRouter, signJWT(t, "rsa-1", rsaKey, jwtClaims(readScope)), "POST", contactsPath, contact)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	rr = bearerRequest(t, authRouter, signJWT(t, "rsa-1", rsaKey, jwtClaims(writeScope)), "POST", contactsPath, contact)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+
+	rr = tenantRequest(t, jwtTenant, "GET", contactsPath, nil)
+	var listed []contacts.Contact
+	if err := json.NewDecoder(rr.Body).Decode(&listed); err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, listed, 1)
+
+	// Invalid tokens are rejected
+	expiredWithinSkew := jwtClaims(readScope)
+	expiredWithinSkew["exp"] = time.Now().Add(-30 * time.Second).Unix()
+	rr = bearerRequest(t, authRouter, signJWT(t, "rsa-1", rsaKey, expiredWithinSkew), "GET", contactsPath, nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	invalid := map[string]func(map[string]interface{}){
+		"expired":        func(c map[string]interface{}) { c["exp"] = time.Now().Add(-2 * time.Minute).Unix() },
+		"not yet valid":  func(c map[string]interface{}) { c["nbf"] = time.Now().Add(2 * time.Minute).Unix() },
+		"wrong audience": func(c map[string]interface{}) { c["aud"] = "other-service" },
+		"wrong issuer":   func(c map[string]interface{}) { c["iss"] = "https://evil.test" },
+		"no expiry":      func(c map[string]interface{}) { delete(c, "exp") },
+		"no tenant":      func(c map[string]interface{}) { delete(c, "tenant_id") },
+	}
+	for name, mutate := range invalid {
+		claims := jwtClaims(readScope)
+		mutate(claims)
+		rr = bearerRequest(t, authRouter, signJWT(t, "rsa-1", rsaKey, claims), "GET", contactsPath, nil)
+		assert.Equal(t, http.StatusUnauthorized, rr.Code, name)
+	}
+
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = bearerRequest(t, authRouter, signJWT(t, "ec-1", otherKey, jwtClaims(readScope)), "GET", contactsPath, nil)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code, "wrong signing key")
+
+	unsigned := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." +
+		base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"user-42","tenant_id":"jwt-tenant"}`)) + "."
+	rr = bearerRequest(t, authRouter, unsigned, "GET", contactsPath, nil)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code, "unsigned token")
+}
+
+func TestJWKSRotation(t *testing.T) {
+	logrus.Info("Running TestJWKSRotation")
+	oldKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stub := &jwksServer{}
+	stub.setKeys(rsaJWK("old", oldKey))
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	// A zero TTL lets the test observe rotation without waiting
+	authRouter := newAuthRouter(auth.NewJWTAuthenticator(auth.JWTConfig{Issuers: []string{jwtIssuer}}, auth.NewJWKS(server.URL, 0)))
+
+	rr := bearerRequest(t, authRouter, signJWT(t, "old", oldKey, jwtClaims(auth.ScopeContactsRead)), "GET", contactsPath, nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	stub.setKeys(rsaJWK("new", newKey))
+
+	rr = bearerRequest(t, authRouter, signJWT(t, "new", newKey, jwtClaims(auth.ScopeContactsRead)), "GET", contactsPath, nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	rr = bearerRequest(t, authRouter, signJWT(t, "old", oldKey, jwtClaims(auth.ScopeContactsRead)), "GET", contactsPath, nil)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+}
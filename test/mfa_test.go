@@ -0,0 +1,156 @@
+package test
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benhuri/phone-book-api/internal/auth"
+	"github.com/benhuri/phone-book-api/internal/users"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	mfaEnrollPath  = "/auth/mfa/enroll"
+	mfaConfirmPath = "/auth/mfa/confirm"
+	mfaDisablePath = "/auth/mfa/disable"
+	mfaPolicyPath  = "/mfa-policy"
+	mfaAddress     = "192.0.2.40"
+)
+
+// totp computes the RFC 6238 code an authenticator app shows at the time.
+func totp(t *testing.T, secret string, at time.Time) string {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(at.Unix()/30))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	return fmt.Sprintf("%06d", (binary.BigEndian.Uint32(sum[offset:offset+4])&0x7fffffff)%1000000)
+}
+
+func loginWithCode(t *testing.T, handler http.Handler, username, code string) (*http.Cookie, users.Session, int) {
+	rr := browserRequest(t, handler, mfaAddress, nil, "", "POST", loginPath, users.Credentials{
+		Tenant:   tenantA,
+		Username: username,
+		Password: testPassword,
+		Code:     code,
+	})
+	var session users.Session
+	if rr.Code == http.StatusOK {
+		if err := json.NewDecoder(rr.Body).Decode(&session); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return sessionFrom(rr), session, rr.Code
+}
+
+// enroll enables MFA within the session and returns the secret and recovery codes.
+func enroll(t *testing.T, handler http.Handler, cookie *http.Cookie, session users.Session) (string, []string) {
+	rr := browserRequest(t, handler, mfaAddress, cookie, session.CSRFToken, "POST", mfaEnrollPath, nil)
+	if !assert.Equal(t, http.StatusOK, rr.Code) {
+		t.FailNow()
+	}
+	var enrollment users.Enrollment
+	if err := json.NewDecoder(rr.Body).Decode(&enrollment); err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, strings.HasPrefix(enrollment.URI, "otpauth://totp/"))
+	assert.Contains(t, enrollment.URI, "secret="+enrollment.Secret)
+
+	rr = browserRequest(t, handler, mfaAddress, cookie, session.CSRFToken, "POST", mfaConfirmPath, users.CodeRequest{Code: "000000"})
+	if totp(t, enrollment.Secret, time.Now()) != "000000" {
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+	}
+
+	rr = browserRequest(t, handler, mfaAddress, cookie, session.CSRFToken, "POST", mfaConfirmPath, users.CodeRequest{Code: totp(t, enrollment.Secret, time.Now())})
+	if !assert.Equal(t, http.StatusOK, rr.Code) {
+		t.FailNow()
+	}
+	var confirmed map[string][]string
+	if err := json.NewDecoder(rr.Body).Decode(&confirmed); err != nil {
+		t.Fatal(err)
+	}
+	return enrollment.Secret, confirmed["recovery_codes"]
+}
+
+func TestTOTPLogin(t *testing.T) {
+	logrus.Info("Running TestTOTPLogin")
+	authRouter := newAuthRouter()
+	createUser(t, authRouter, "dave", auth.RoleEditor)
+
+	cookie, session, code := loginWithCode(t, authRouter, "dave", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.False(t, session.MFA)
+
+	secret, recoveryCodes := enroll(t, authRouter, cookie, session)
+	assert.Len(t, recoveryCodes, 10)
+
+	// Enrolling twice is refused
+	rr := browserRequest(t, authRouter, mfaAddress, cookie, session.CSRFToken, "POST", mfaEnrollPath, nil)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+
+	// The password alone no longer logs in
+	_, _, code = loginWithCode(t, authRouter, "dave", "")
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	// The code used to confirm cannot be replayed, the next one is accepted
+	_, _, code = loginWithCode(t, authRouter, "dave", totp(t, secret, time.Now()))
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	_, session, code = loginWithCode(t, authRouter, "dave", totp(t, secret, time.Now().Add(30*time.Second)))
+	assert.Equal(t, http.StatusOK, code)
+	assert.True(t, session.MFA)
+
+	// Recovery codes work once, in any case
+	_, _, code = loginWithCode(t, authRouter, "dave", strings.ToLower(recoveryCodes[0]))
+	assert.Equal(t, http.StatusOK, code)
+	_, _, code = loginWithCode(t, authRouter, "dave", recoveryCodes[0])
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	// Disabling MFA needs a second factor
+	cookie, session, code = loginWithCode(t, authRouter, "dave", recoveryCodes[1])
+	assert.Equal(t, http.StatusOK, code)
+	rr = browserRequest(t, authRouter, mfaAddress, cookie, session.CSRFToken, "POST", mfaDisablePath, users.CodeRequest{Code: recoveryCodes[1]})
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	rr = browserRequest(t, authRouter, mfaAddress, cookie, session.CSRFToken, "POST", mfaDisablePath, users.CodeRequest{Code: recoveryCodes[2]})
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+
+	_, _, code = loginWithCode(t, authRouter, "dave", "")
+	assert.Equal(t, http.StatusOK, code)
+}
+
+func TestMFAPolicy(t *testing.T) {
+	logrus.Info("Running TestMFAPolicy")
+	authRouter := newAuthRouter()
+	createUser(t, authRouter, "erin", auth.RoleEditor)
+
+	rr := bearerRequest(t, authRouter, bootstrapToken, "PUT", mfaPolicyPath, map[string][]string{"roles": {"editor"}})
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	// Without MFA the session does not get the editor role
+	cookie, session, code := loginWithCode(t, authRouter, "erin", "")
+	assert.Equal(t, http.StatusOK, code)
+	rr = browserRequest(t, authRouter, mfaAddress, cookie, "", "GET", contactsPath, nil)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	// Enrolling within the session verifies it
+	enroll(t, authRouter, cookie, session)
+	rr = browserRequest(t, authRouter, mfaAddress, cookie, "", "GET", contactsPath, nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	rr = bearerRequest(t, authRouter, bootstrapToken, "PUT", mfaPolicyPath, map[string][]string{"roles": {}})
+	assert.Equal(t, http.StatusOK, rr.Code)
+}
@@ -0,0 +1,281 @@
+package test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/benhuri/phone-book-api/internal/auth"
+	"github.com/benhuri/phone-book-api/internal/contacts"
+	"github.com/benhuri/phone-book-api/internal/database"
+	"github.com/benhuri/phone-book-api/internal/outbox"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	eventsPath   = "/events"
+	relayTimeout = 10 * time.Second
+)
+
+// recordingSink records the events it takes, failing the first ones it is
+// sent as many times as it is told to.
+type recordingSink struct {
+	mu     sync.Mutex
+	fail   int
+	sent   int
+	events []contacts.Event
+}
+
+func (s *recordingSink) Publish(ctx context.Context, event contacts.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sent++
+	if s.fail > 0 {
+		s.fail--
+		return errors.New("sink is unavailable")
+	}
+	s.events = append(s.events, event)
+	return nil
+}
+
+// contactEvents returns the events the sink took for the contact.
+func (s *recordingSink) contactEvents(contactID int) []contacts.Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var events []contacts.Event
+	for _, event := range s.events {
+		if event.ContactID == contactID {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// waitForEvents polls the sink until it has taken count events for the
+// contact.
+func waitForEvents(t *testing.T, sink *recordingSink, contactID, count int) []contacts.Event {
+	deadline := time.Now().Add(relayTimeout)
+	for time.Now().Before(deadline) {
+		if events := sink.contactEvents(contactID); len(events) >= count {
+			return events
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("sink has no %d events for contact %d", count, contactID)
+	return nil
+}
+
+func TestOutbox(t *testing.T) {
+	logrus.Info("Running TestOutbox")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tenantCtx := auth.NewContext(ctx, &auth.Principal{Subject: "bootstrap", TenantID: tenantA, Scopes: []string{auth.ScopeAdmin}})
+	repo := contacts.NewRepository(database.DB, contacts.TxConfig{}, "972")
+
+	// Sinks get fresh names so that they start at the latest event
+	suffix := strconv.FormatInt(time.Now().UnixNano(), 10)
+	flaky, file := "test-flaky-"+suffix, "test-file-"+suffix
+	defer database.DB.Exec("DELETE FROM outbox_cursors WHERE sink = $1 OR sink = $2", flaky, file)
+	eventFile := filepath.Join(t.TempDir(), "events.ndjson")
+	fileSink, err := outbox.NewFileSink(eventFile)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	sink := &recordingSink{fail: 1}
+	relay := outbox.NewRelay(outbox.NewRepository(database.DB))
+	relay.Add(flaky, sink)
+	relay.Add(file, fileSink)
+	relay.AddLive(outbox.SinkSSE, eventStream)
+	go relay.Run(ctx)
+	// Let the relay set up its cursors before anything is written
+	time.Sleep(2 * time.Second)
+
+	outboxed := contacts.Contact{FirstName: "Otto", LastName: "Outbox", PhoneNumber: "0521230050", Address: "1 Relay St"}
+	if !assert.NoError(t, repo.CreateContact(tenantCtx, &outboxed)) {
+		t.FailNow()
+	}
+	outboxed.JobTitle = "Courier"
+	assert.NoError(t, repo.UpdateContact(tenantCtx, &outboxed))
+	assert.NoError(t, repo.RemoveContact(tenantCtx, outboxed.ID))
+
+	// A rolled back change leaves no event
+	var rolledBack contacts.Contact
+	err = repo.WithTx(tenantCtx, func(tx contacts.Repository) error {
+		rolledBack = contacts.Contact{FirstName: "Rolf", LastName: "Back", PhoneNumber: "0521230051", Address: "1 Relay St"}
+		if err := tx.CreateContact(tenantCtx, &rolledBack); err != nil {
+			return err
+		}
+		return errors.New("roll back")
+	})
+	assert.Error(t, err)
+
+	// Every change is relayed in order, the one the sink failed to take again
+	events := waitForEvents(t, sink, outboxed.ID, 3)
+	if assert.Len(t, events, 3) {
+		assert.Equal(t, contacts.EventCreated, events[0].Type)
+		assert.Equal(t, contacts.EventUpdated, events[1].Type)
+		assert.Equal(t, contacts.EventDeleted, events[2].Type)
+		assert.Less(t, events[0].Seq, events[1].Seq)
+		assert.Less(t, events[1].Seq, events[2].Seq)
+		assert.Equal(t, tenantA, events[0].TenantID)
+		if assert.NotNil(t, events[1].Contact) {
+			assert.Equal(t, "Courier", events[1].Contact.JobTitle)
+		}
+		assert.Nil(t, events[2].Contact)
+	}
+	sink.mu.Lock()
+	assert.Equal(t, len(sink.events)+1, sink.sent)
+	sink.mu.Unlock()
+	assert.Empty(t, sink.contactEvents(rolledBack.ID))
+
+	// The file sink has a line of JSON per event
+	var lines []contacts.Event
+	deadline := time.Now().Add(relayTimeout)
+	for time.Now().Before(deadline) && len(lines) < 3 {
+		lines = nil
+		data, err := os.ReadFile(eventFile)
+		assert.NoError(t, err)
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			var event contacts.Event
+			if json.Unmarshal([]byte(line), &event) == nil && event.ContactID == outboxed.ID {
+				lines = append(lines, event)
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if assert.Len(t, lines, 3) {
+		assert.Equal(t, events[0].Seq, lines[0].Seq)
+		assert.Equal(t, contacts.EventDeleted, lines[2].Type)
+	}
+
+	// A client reconnecting with Last-Event-ID is sent the events it missed,
+	// then the new ones
+	server := httptest.NewServer(newAuthRouter())
+	defer server.Close()
+	streamCtx, stop := context.WithTimeout(ctx, relayTimeout)
+	defer stop()
+	req, _ := http.NewRequestWithContext(streamCtx, "GET", server.URL+eventsPath, nil)
+	req.Header.Set("Authorization", "Bearer "+bootstrapToken)
+	req.Header.Set("Last-Event-ID", strconv.FormatInt(events[0].Seq-1, 10))
+	resp, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	live := contacts.Contact{FirstName: "Liv", LastName: "Stream", PhoneNumber: "0521230052", Address: "1 Relay St"}
+	if !assert.NoError(t, repo.CreateContact(tenantCtx, &live)) {
+		t.FailNow()
+	}
+	defer repo.RemoveContact(tenantCtx, live.ID)
+
+	var streamed []contacts.Event
+	var ids []string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "id: ") {
+			ids = append(ids, strings.TrimPrefix(line, "id: "))
+		}
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		var event contacts.Event
+		json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event)
+		streamed = append(streamed, event)
+		if event.ContactID == live.ID {
+			break
+		}
+	}
+	if assert.GreaterOrEqual(t, len(streamed), 4) {
+		assert.Equal(t, events[0].Seq, streamed[0].Seq)
+		assert.Equal(t, strconv.FormatInt(events[0].Seq, 10), ids[0])
+		last := streamed[len(streamed)-1]
+		assert.Equal(t, live.ID, last.ContactID)
+		assert.Equal(t, contacts.EventCreated, last.Type)
+		for i := 1; i < len(streamed); i++ {
+			assert.Less(t, streamed[i-1].Seq, streamed[i].Seq)
+		}
+	}
+
+	// A malformed Last-Event-ID is rejected
+	rr := httptest.NewRecorder()
+	req = httptest.NewRequest("GET", eventsPath, nil)
+	req.Header.Set("Authorization", "Bearer "+bootstrapToken)
+	req.Header.Set("Last-Event-ID", "latest")
+	newAuthRouter().ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestOutboxCommitOrder(t *testing.T) {
+	logrus.Info("Running TestOutboxCommitOrder")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tenantCtx := auth.NewContext(ctx, &auth.Principal{Subject: "bootstrap", TenantID: tenantA, Scopes: []string{auth.ScopeAdmin}})
+	repo := contacts.NewRepository(database.DB, contacts.TxConfig{}, "972")
+
+	name := "test-order-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	defer database.DB.Exec("DELETE FROM outbox_cursors WHERE sink = $1", name)
+	sink := &recordingSink{}
+	relay := outbox.NewRelay(outbox.NewRepository(database.DB))
+	relay.Add(name, sink)
+	go relay.Run(ctx)
+	time.Sleep(2 * time.Second)
+
+	// The slow transaction numbers its event first and commits last
+	slow := contacts.Contact{FirstName: "Sol", LastName: "Slow", PhoneNumber: "0521230053", Address: "1 Relay St"}
+	numbered := make(chan error, 1)
+	release := make(chan struct{})
+	committed := make(chan error, 1)
+	go func() {
+		committed <- repo.WithTx(tenantCtx, func(tx contacts.Repository) error {
+			err := tx.CreateContact(tenantCtx, &slow)
+			numbered <- err
+			if err != nil {
+				return err
+			}
+			<-release
+			return nil
+		})
+	}()
+	if !assert.NoError(t, <-numbered) {
+		t.FailNow()
+	}
+	fast := contacts.Contact{FirstName: "Fay", LastName: "Fast", PhoneNumber: "0521230054", Address: "1 Relay St"}
+	if !assert.NoError(t, repo.CreateContact(tenantCtx, &fast)) {
+		close(release)
+		t.FailNow()
+	}
+	defer repo.RemoveContact(tenantCtx, fast.ID)
+
+	// The committed event waits for the one numbered before it
+	time.Sleep(2 * time.Second)
+	assert.Empty(t, sink.contactEvents(fast.ID))
+	close(release)
+	if !assert.NoError(t, <-committed) {
+		t.FailNow()
+	}
+	defer repo.RemoveContact(tenantCtx, slow.ID)
+
+	slowEvents := waitForEvents(t, sink, slow.ID, 1)
+	fastEvents := waitForEvents(t, sink, fast.ID, 1)
+	assert.Less(t, slowEvents[0].Seq, fastEvents[0].Seq)
+	sink.mu.Lock()
+	for i := 1; i < len(sink.events); i++ {
+		assert.Less(t, sink.events[i-1].Seq, sink.events[i].Seq)
+	}
+	sink.mu.Unlock()
+}
@@ -0,0 +1,235 @@
+package test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/benhuri/phone-book-api/internal/auth"
+	"github.com/benhuri/phone-book-api/internal/roles"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	metricsPath   = "/metrics"
+	usersPath     = "/users"
+	userRolesPath = usersPath + "/{id}/roles"
+	loginPath     = "/auth/login"
+	logoutPath    = "/auth/logout"
+	missingID     = "999999"
+)
+
+var allRoles = []string{auth.RoleViewer, auth.RoleEditor, auth.RoleAuditor, auth.RoleAdmin}
+
+var (
+	readers  = []string{auth.RoleViewer, auth.RoleEditor, auth.RoleAuditor, auth.RoleAdmin}
+	editors  = []string{auth.RoleEditor, auth.RoleAdmin}
+	auditors = []string{auth.RoleAuditor, auth.RoleAdmin}
+	admins   = []string{auth.RoleAdmin}
+)
+
+// routeRoles lists the roles allowed on every route of the application router.
+var routeRoles = map[string][]string{
+	"GET " + contactsPath:                  readers,
+	"POST " + contactsPath:                 editors,
+	"GET " + contactsSearchPath:            readers,
+	"GET " + contactsExportPath:            readers,
+	"GET " + rowsExportPath:                readers,
+	"GET " + contactVCardPath:              readers,
+	"POST " + contactsImportPath:           editors,
+	"POST " + csvImportPath:                editors,
+	"POST " + batchPath:                    editors,
+	"GET " + duplicatesPath:                readers,
+	"POST " + mergePath:                    editors,
+	"GET " + mergesPath:                    readers,
+	"POST " + undoMergePath:                editors,
+	"GET " + trashPath:                     readers,
+	"POST " + restorePath:                  editors,
+	"DELETE " + trashIDPath:                editors,
+	"GET " + importProfilesPath:            readers,
+	"POST " + importProfilesPath:           editors,
+	"PUT " + profileIDPath:                 editors,
+	"DELETE " + profileIDPath:              editors,
+	"PUT " + contactIDPath:                 editors,
+	"DELETE " + contactIDPath:              editors,
+	"GET " + notesPath:                     readers,
+	"POST " + notesPath:                    editors,
+	"PUT " + noteIDPath:                    editors,
+	"DELETE " + noteIDPath:                 editors,
+	"GET " + relationsPath:                 readers,
+	"POST " + relationsPath:                editors,
+	"DELETE " + relationIDPath:             editors,
+	"GET " + shareLinkPath:                 editors,
+	"POST " + shareLinkPath:                editors,
+	"DELETE " + shareLinkIDPath:            editors,
+	"GET " + birthdaysPath:                 readers,
+	"GET " + customFieldsPath:              readers,
+	"POST " + customFieldsPath:             admins,
+	"PUT " + customFieldIDPath:             admins,
+	"DELETE " + customFieldIDPath:          admins,
+	"GET " + jobsPath:                      readers,
+	"POST " + jobImportPath:                editors,
+	"POST " + jobExportPath:                readers,
+	"GET " + jobIDPath:                     readers,
+	"GET " + jobResultPath:                 readers,
+	"POST " + jobCancelPath:                editors,
+	"GET " + webhooksPath:                  auditors,
+	"POST " + webhooksPath:                 admins,
+	"GET " + webhookIDPath:                 auditors,
+	"PUT " + webhookIDPath:                 admins,
+	"DELETE " + webhookIDPath:              admins,
+	"GET " + deliveriesPath:                auditors,
+	"GET " + deliveryIDPath:                auditors,
+	"POST " + redeliverPath:                admins,
+	"GET " + eventsPath:                    auditors,
+	"GET " + organizationsPath:             readers,
+	"POST " + organizationsPath:            editors,
+	"GET " + organizationIDPath:            readers,
+	"PUT " + organizationIDPath:            editors,
+	"DELETE " + organizationIDPath:         editors,
+	"GET " + orgContactsPath:               readers,
+	"GET " + apiKeysPath:                   auditors,
+	"POST " + apiKeysPath:                  admins,
+	"POST " + apiKeysPath + "/{id}/rotate": admins,
+	"DELETE " + apiKeysPath + "/{id}":      admins,
+	"GET " + usersPath:                     auditors,
+	"POST " + usersPath:                    admins,
+	"DELETE " + usersPath + "/{id}":        admins,
+	"POST " + logoutPath:                   allRoles,
+	"GET " + userRolesPath:                 auditors,
+	"PUT " + userRolesPath:                 admins,
+	"POST " + mfaEnrollPath:                allRoles,
+	"POST " + mfaConfirmPath:               allRoles,
+	"POST " + mfaDisablePath:               allRoles,
+	"GET " + sharesPath:                    readers,
+	"POST " + sharesPath:                   editors,
+	"PUT " + shareIDPath:                   editors,
+	"DELETE " + shareIDPath:                editors,
+	"GET " + mfaPolicyPath:                 auditors,
+	"PUT " + mfaPolicyPath:                 admins,
+}
+
+// subjectPath puts the percent-encoded subject in place of the path's ID.
+func subjectPath(path, subject string) string {
+	return strings.Replace(path, "{id}", url.PathEscape(subject), 1)
+}
+
+func roleToken(t *testing.T, subject string, roles ...string) string {
+	claims := jwtClaims("")
+	claims["sub"] = subject
+	claims["roles"] = roles
+	return signJWT(t, "", []byte(jwtSecret), claims)
+}
+
+func newRBACRouter() *mux.Router {
+	return newAuthRouter(auth.NewJWTAuthenticator(auth.JWTConfig{}, auth.StaticKeys{auth.NewHMACKey("", []byte(jwtSecret))}))
+}
+
+// TestRoutePermissions checks every route of the router against every role.
+// Requests use IDs that do not exist and empty bodies, so allowed requests
+// fail validation or lookup instead of changing data.
+func TestRoutePermissions(t *testing.T) {
+	logrus.Info("Running TestRoutePermissions")
+	rbacRouter := newRBACRouter()
+
+	covered := 0
+	err := rbacRouter.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil || path == metricsPath || path == loginPath || path == publicLinkPath {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+
+		for _, method := range methods {
+			allowed, ok := routeRoles[method+" "+path]
+			if !assert.True(t, ok, "route %s %s is missing from the matrix", method, path) {
+				continue
+			}
+			covered++
+
+			url := strings.NewReplacer("{id}", missingID, "{noteId}", missingID, "{relationId}", missingID, "{linkId}", missingID).Replace(path)
+			for _, role := range allRoles {
+				rr := bearerRequest(t, rbacRouter, roleToken(t, "matrix-"+role, role), method, url, nil)
+				if containsRole(allowed, role) {
+					assert.NotEqual(t, http.StatusForbidden, rr.Code, "%s should be allowed %s %s", role, method, path)
+					assert.NotEqual(t, http.StatusUnauthorized, rr.Code, "%s should be allowed %s %s", role, method, path)
+				} else {
+					assert.Equal(t, http.StatusForbidden, rr.Code, "%s should be denied %s %s", role, method, path)
+					assert.Equal(t, "application/problem+json", rr.Header().Get(contentType))
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, len(routeRoles), covered, "the matrix lists routes the router does not have")
+
+	// Tokens without roles may do nothing
+	rr := bearerRequest(t, rbacRouter, roleToken(t, "nobody"), "GET", contactsPath, nil)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+}
+
+func TestRoleAssignment(t *testing.T) {
+	logrus.Info("Running TestRoleAssignment")
+	rbacRouter := newRBACRouter()
+	adminToken := roleToken(t, "root", auth.RoleAdmin)
+	userToken := roleToken(t, "user-7")
+	rolesURL := subjectPath(userRolesPath, auth.TokenSubject(jwtIssuer, "user-7"))
+
+	rr := bearerRequest(t, rbacRouter, userToken, "GET", contactsPath, nil)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	// Roles are assigned to subjects named with their origin
+	rr = bearerRequest(t, rbacRouter, adminToken, "PUT", subjectPath(userRolesPath, "user-7"), map[string][]string{"roles": {auth.RoleViewer}})
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	// Unknown roles are rejected
+	rr = bearerRequest(t, rbacRouter, adminToken, "PUT", rolesURL, map[string][]string{"roles": {"superuser"}})
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	// Editors cannot grant roles
+	rr = bearerRequest(t, rbacRouter, roleToken(t, "ed", auth.RoleEditor), "PUT", rolesURL, map[string][]string{"roles": {auth.RoleViewer}})
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	rr = bearerRequest(t, rbacRouter, adminToken, "PUT", rolesURL, map[string][]string{"roles": {auth.RoleViewer}})
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	// The assigned role applies to the user's next request
+	rr = bearerRequest(t, rbacRouter, userToken, "GET", contactsPath, nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	rr = bearerRequest(t, rbacRouter, userToken, "DELETE", contactsPath+"/"+missingID, nil)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	rr = bearerRequest(t, rbacRouter, roleToken(t, "audit", auth.RoleAuditor), "GET", rolesURL, nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var assignment roles.Assignment
+	if err := json.NewDecoder(rr.Body).Decode(&assignment); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{auth.RoleViewer}, assignment.Roles)
+
+	// Clearing the roles revokes access
+	rr = bearerRequest(t, rbacRouter, adminToken, "PUT", rolesURL, map[string][]string{"roles": {}})
+	assert.Equal(t, http.StatusOK, rr.Code)
+	rr = bearerRequest(t, rbacRouter, userToken, "GET", contactsPath, nil)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+}
+
+func containsRole(roles []string, role string) bool {
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,116 @@
+package test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benhuri/phone-book-api/internal/contacts"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	shareLinkSecret = "test-share-link-secret"
+	shareLinkPath   = contactIDPath + "/share-link"
+	shareLinkIDPath = shareLinkPath + "/{linkId}"
+	publicLinkPath  = "/public/links/{linkId}"
+)
+
+func publicRequest(t *testing.T, handler http.Handler, url, accept string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestShareLinks(t *testing.T) {
+	logrus.Info("Running TestShareLinks")
+	authRouter := newAuthRouter()
+
+	contact := contacts.Contact{FirstName: "<b>Eve</b>", LastName: "Linked", PhoneNumber: "5550007001", Address: "1 Public Way", JobTitle: "Engineer"}
+	rr := bearerRequest(t, authRouter, bootstrapToken, "POST", contactsPath, contact)
+	if !assert.Equal(t, http.StatusCreated, rr.Code) {
+		t.FailNow()
+	}
+	json.NewDecoder(rr.Body).Decode(&contact)
+	linksURL := strings.Replace(shareLinkPath, "{id}", strconv.Itoa(contact.ID), 1)
+
+	maxViews := 3
+	rr = bearerRequest(t, authRouter, bootstrapToken, "POST", linksURL, contacts.ShareLink{MaxViews: &maxViews})
+	if !assert.Equal(t, http.StatusCreated, rr.Code) {
+		t.FailNow()
+	}
+	var link contacts.ShareLink
+	json.NewDecoder(rr.Body).Decode(&link)
+	assert.True(t, strings.HasPrefix(link.URL, "/public/links/"+strconv.Itoa(link.ID)+"?"))
+	assert.WithinDuration(t, time.Now().Add(7*24*time.Hour), *link.ExpiresAt, time.Minute)
+
+	// Forged links are not found and do not count as views
+	rr = publicRequest(t, authRouter, link.URL+"x", "")
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	forged := strings.Replace(link.URL, "expires=", "expires=9", 1)
+	rr = publicRequest(t, authRouter, forged, "")
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	// The card renders as JSON, HTML and vCard without authentication
+	rr = publicRequest(t, authRouter, link.URL, "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "no-store", rr.Header().Get("Cache-Control"))
+	var shared contacts.Contact
+	json.NewDecoder(rr.Body).Decode(&shared)
+	assert.Equal(t, contact.PhoneNumber, shared.PhoneNumber)
+
+	rr = publicRequest(t, authRouter, link.URL, "text/html,application/xhtml+xml")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Header().Get("Content-Type"), "text/html")
+	assert.Contains(t, rr.Body.String(), "&lt;b&gt;Eve&lt;/b&gt; Linked")
+	assert.NotContains(t, rr.Body.String(), "<b>Eve</b>")
+
+	rr = publicRequest(t, authRouter, link.URL+"&format=vcf", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), "BEGIN:VCARD\r\n")
+	assert.Contains(t, rr.Body.String(), "TEL;TYPE=voice:5550007001\r\n")
+
+	// The view limit is enforced
+	rr = publicRequest(t, authRouter, link.URL, "")
+	assert.Equal(t, http.StatusGone, rr.Code)
+
+	rr = bearerRequest(t, authRouter, bootstrapToken, "GET", linksURL, nil)
+	var links []contacts.ShareLink
+	json.NewDecoder(rr.Body).Decode(&links)
+	if assert.Len(t, links, 1) {
+		assert.Equal(t, 3, links[0].Views)
+		assert.Equal(t, link.URL, links[0].URL)
+	}
+
+	// Revoked links are gone
+	rr = bearerRequest(t, authRouter, bootstrapToken, "POST", linksURL, nil)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	json.NewDecoder(rr.Body).Decode(&link)
+	assert.Nil(t, link.MaxViews)
+
+	linkURL := linksURL + "/" + strconv.Itoa(link.ID)
+	rr = bearerRequest(t, authRouter, bootstrapToken, "DELETE", linkURL, nil)
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+	rr = bearerRequest(t, authRouter, bootstrapToken, "DELETE", linkURL, nil)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	rr = publicRequest(t, authRouter, link.URL, "")
+	assert.Equal(t, http.StatusGone, rr.Code)
+
+	past := time.Now().Add(-time.Minute)
+	rr = bearerRequest(t, authRouter, bootstrapToken, "POST", linksURL, contacts.ShareLink{ExpiresAt: &past})
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	rr = bearerRequest(t, authRouter, bootstrapToken, "POST", strings.Replace(shareLinkPath, "{id}", missingID, 1), nil)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
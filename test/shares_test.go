@@ -0,0 +1,145 @@
+package test
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/benhuri/phone-book-api/internal/auth"
+	"github.com/benhuri/phone-book-api/internal/contacts"
+	"github.com/benhuri/phone-book-api/internal/shares"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	sharesPath       = "/shares"
+	shareIDPath      = sharesPath + "/{id}"
+	sharedContacts   = contactsPath + "?view=shared"
+	familyGroup      = "family"
+	salesTeam        = "sales"
+	shareOwner       = "share-alice"
+	shareRecipient   = "share-bob"
+	shareTeamMember  = "share-carol"
+	shareOutsider    = "share-dave"
+	shareContactsURL = contactsPath + "?limit=100"
+)
+
+func teamToken(t *testing.T, subject string, teams ...string) string {
+	claims := jwtClaims("")
+	claims["sub"] = subject
+	claims["roles"] = []string{auth.RoleEditor}
+	claims["teams"] = teams
+	return signJWT(t, "", []byte(jwtSecret), claims)
+}
+
+func contactIDs(t *testing.T, handler http.Handler, token, url string) []int {
+	rr := bearerRequest(t, handler, token, "GET", url, nil)
+	if !assert.Equal(t, http.StatusOK, rr.Code) {
+		t.FailNow()
+	}
+	var list []contacts.Contact
+	if err := json.NewDecoder(rr.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	ids := []int{}
+	for _, contact := range list {
+		ids = append(ids, contact.ID)
+	}
+	return ids
+}
+
+func addShare(t *testing.T, handler http.Handler, token string, share shares.Share) shares.Share {
+	rr := bearerRequest(t, handler, token, "POST", sharesPath, share)
+	if !assert.Equal(t, http.StatusCreated, rr.Code) {
+		t.FailNow()
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&share); err != nil {
+		t.Fatal(err)
+	}
+	return share
+}
+
+func TestShares(t *testing.T) {
+	logrus.Info("Running TestShares")
+	rbacRouter := newRBACRouter()
+	owner := teamToken(t, shareOwner)
+	recipient := teamToken(t, shareRecipient)
+	teamMember := teamToken(t, shareTeamMember, salesTeam)
+	outsider := teamToken(t, shareOutsider)
+
+	// Contacts added by a user go to the user's own phone book
+	family := contacts.Contact{FirstName: "Fam", LastName: "Ily", PhoneNumber: "5550009001", Address: "Home Street", Groups: []string{familyGroup}}
+	rr := bearerRequest(t, rbacRouter, owner, "POST", contactsPath, family)
+	if !assert.Equal(t, http.StatusCreated, rr.Code) {
+		t.FailNow()
+	}
+	json.NewDecoder(rr.Body).Decode(&family)
+	assert.Equal(t, auth.TokenSubject(jwtIssuer, shareOwner), family.Owner)
+
+	work := contacts.Contact{FirstName: "Co", LastName: "Worker", PhoneNumber: "5550009002", Address: "Office Road"}
+	rr = bearerRequest(t, rbacRouter, owner, "POST", contactsPath, work)
+	json.NewDecoder(rr.Body).Decode(&work)
+
+	assert.Subset(t, contactIDs(t, rbacRouter, owner, shareContactsURL), []int{family.ID, work.ID})
+	assert.NotContains(t, contactIDs(t, rbacRouter, recipient, shareContactsURL), family.ID)
+	assert.Empty(t, contactIDs(t, rbacRouter, recipient, sharedContacts))
+
+	// Sharing a group at read level
+	share := addShare(t, rbacRouter, owner, shares.Share{UserID: auth.TokenSubject(jwtIssuer, shareRecipient), Group: familyGroup, Permission: shares.PermissionRead})
+	assert.Equal(t, auth.TokenSubject(jwtIssuer, shareOwner), share.Owner)
+	assert.Equal(t, []int{family.ID}, contactIDs(t, rbacRouter, recipient, sharedContacts))
+
+	familyURL := contactsPath + "/" + strconv.Itoa(family.ID)
+	family.Address = "New Home Street"
+	rr = bearerRequest(t, rbacRouter, recipient, "PUT", familyURL, family)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	// Upgrading the share to write
+	shareURL := sharesPath + "/" + strconv.Itoa(share.ID)
+	share.Permission = shares.PermissionWrite
+	rr = bearerRequest(t, rbacRouter, recipient, "PUT", shareURL, share)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	rr = bearerRequest(t, rbacRouter, owner, "PUT", shareURL, share)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	rr = bearerRequest(t, rbacRouter, recipient, "PUT", familyURL, family)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	// Recipients see the shares made with them
+	rr = bearerRequest(t, rbacRouter, recipient, "GET", sharesPath, nil)
+	var listed []shares.Share
+	json.NewDecoder(rr.Body).Decode(&listed)
+	assert.Len(t, listed, 1)
+
+	// Sharing the whole phone book with a team
+	addShare(t, rbacRouter, owner, shares.Share{Team: salesTeam, Permission: shares.PermissionRead})
+	assert.ElementsMatch(t, []int{family.ID, work.ID}, contactIDs(t, rbacRouter, teamMember, sharedContacts))
+	assert.Empty(t, contactIDs(t, rbacRouter, outsider, sharedContacts))
+
+	// Expired shares grant nothing and cannot be created
+	past := time.Now().Add(-time.Hour)
+	rr = bearerRequest(t, rbacRouter, owner, "POST", sharesPath, shares.Share{UserID: auth.TokenSubject(jwtIssuer, shareOutsider), Permission: shares.PermissionRead, ExpiresAt: &past})
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	rr = bearerRequest(t, rbacRouter, owner, "POST", sharesPath, shares.Share{UserID: auth.TokenSubject(jwtIssuer, shareOwner), Permission: shares.PermissionRead})
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	rr = bearerRequest(t, rbacRouter, owner, "POST", sharesPath, shares.Share{UserID: auth.TokenSubject(jwtIssuer, shareRecipient), Team: salesTeam, Permission: shares.PermissionRead})
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	rr = bearerRequest(t, rbacRouter, owner, "POST", sharesPath, shares.Share{UserID: auth.TokenSubject(jwtIssuer, shareRecipient), Group: familyGroup, Permission: shares.PermissionRead})
+	assert.Equal(t, http.StatusConflict, rr.Code)
+
+	// Revoking the share
+	rr = bearerRequest(t, rbacRouter, recipient, "DELETE", shareURL, nil)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	rr = bearerRequest(t, rbacRouter, owner, "DELETE", shareURL, nil)
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+	assert.Empty(t, contactIDs(t, rbacRouter, recipient, sharedContacts))
+
+	// Tenant-wide callers see every contact but have no phone book to share
+	tenantToken := signJWT(t, "", []byte(jwtSecret), jwtClaims(auth.ScopeAdmin))
+	assert.Subset(t, contactIDs(t, rbacRouter, tenantToken, shareContactsURL), []int{family.ID, work.ID})
+	rr = bearerRequest(t, rbacRouter, bootstrapToken, "POST", sharesPath, shares.Share{UserID: auth.TokenSubject(jwtIssuer, shareRecipient), Permission: shares.PermissionRead})
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
@@ -0,0 +1,114 @@
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/benhuri/phone-book-api/internal/contacts"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	tenantHeader = "X-Tenant-ID"
+	tenantA      = "tenant-a"
+	tenantB      = "tenant-b"
+)
+
+func tenantRequest(t *testing.T, tenant, method, url string, body interface{}) *httptest.ResponseRecorder {
+	var payload bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&payload).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req, err := http.NewRequest(method, url, &payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(tenantHeader, tenant)
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestTenantIsolation(t *testing.T) {
+	logrus.Info("Running TestTenantIsolation")
+	secret := contacts.Contact{
+		FirstName:   "Isolde",
+		LastName:    "Tenant",
+		PhoneNumber: "5550005000",
+		Address:     "A Street",
+	}
+
+	// Tenant A creates a contact
+	rr := tenantRequest(t, tenantA, "POST", contactsPath, secret)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+
+	var created contacts.Contact
+	err := json.NewDecoder(rr.Body).Decode(&created)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contactURL := contactsPath + "/" + strconv.Itoa(created.ID)
+
+	// Tenant B does not see it in the list
+	rr = tenantRequest(t, tenantB, "GET", contactsPath+"?page=1&limit=100", nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var listed []contacts.Contact
+	err = json.NewDecoder(rr.Body).Decode(&listed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range listed {
+		assert.NotEqual(t, created.ID, c.ID)
+	}
+
+	// Tenant B cannot find it by searching
+	rr = tenantRequest(t, tenantB, "GET", contactsSearchPath+"?query=Isolde", nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var found []contacts.Contact
+	err = json.NewDecoder(rr.Body).Decode(&found)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, found)
+
+	// Tenant B cannot edit, annotate, relate or delete it by guessing the ID
+	edited := secret
+	edited.FirstName = "Hijacked"
+	rr = tenantRequest(t, tenantB, "PUT", contactURL, edited)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	rr = tenantRequest(t, tenantB, "POST", contactURL+"/notes", contacts.Note{Author: "intruder", Text: "hello"})
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	rr = tenantRequest(t, tenantB, "POST", contactsPath, contacts.Contact{FirstName: "Bob", LastName: "Tenant", PhoneNumber: "5550005001", Address: "B Street"})
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	var own contacts.Contact
+	err = json.NewDecoder(rr.Body).Decode(&own)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = tenantRequest(t, tenantB, "POST", contactsPath+"/"+strconv.Itoa(own.ID)+"/relations", contacts.Relation{RelatedID: created.ID, Type: "spouse"})
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	rr = tenantRequest(t, tenantB, "DELETE", contactURL, nil)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	// Tenant A still sees the contact unchanged
+	rr = tenantRequest(t, tenantA, "GET", contactsSearchPath+"?query=Isolde", nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	found = nil
+	err = json.NewDecoder(rr.Body).Decode(&found)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, found, 1)
+	assert.Equal(t, "Isolde", found[0].FirstName)
+}
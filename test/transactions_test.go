@@ -0,0 +1,147 @@
+package test
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/benhuri/phone-book-api/internal/auth"
+	"github.com/benhuri/phone-book-api/internal/contacts"
+	"github.com/benhuri/phone-book-api/internal/database"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithTxRetry(t *testing.T) {
+	logrus.Info("Running TestWithTxRetry")
+	ctx := auth.NewContext(context.Background(), &auth.Principal{Subject: "bootstrap", TenantID: tenantA, Scopes: []string{auth.ScopeAdmin}})
+	repo := contacts.NewRepository(database.DB, contacts.TxConfig{Isolation: sql.LevelRepeatableRead, MaxRetries: 3}, "972")
+
+	contact := contacts.Contact{FirstName: "Rita", LastName: "Retry", PhoneNumber: "5550011001", Address: "1 Retry St"}
+	if !assert.NoError(t, repo.CreateContact(ctx, &contact)) {
+		t.FailNow()
+	}
+	defer repo.RemoveContact(ctx, contact.ID)
+
+	// conflict changes the contact behind the transaction's back on its
+	// first attempt, so the update that follows fails to serialize
+	conflict := func(attempts *int) func(contacts.Repository) error {
+		return func(tx contacts.Repository) error {
+			*attempts++
+			current, err := tx.FetchContact(ctx, contact.ID)
+			if err != nil {
+				return err
+			}
+			if *attempts == 1 {
+				concurrent := *current
+				concurrent.Address = "2 Concurrent St"
+				if err := repo.UpdateContact(ctx, &concurrent); err != nil {
+					return err
+				}
+			}
+			current.JobTitle = "Retried"
+			return tx.UpdateContact(ctx, current)
+		}
+	}
+
+	// The transaction runs again on a snapshot that includes the other change
+	attempts := 0
+	assert.NoError(t, repo.WithTx(ctx, conflict(&attempts)))
+	assert.Equal(t, 2, attempts)
+	updated, err := repo.FetchContact(ctx, contact.ID)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "2 Concurrent St", updated.Address)
+		assert.Equal(t, "Retried", updated.JobTitle)
+	}
+
+	// Without retries the conflict is returned and nothing is written
+	noRetries := contacts.NewRepository(database.DB, contacts.TxConfig{Isolation: sql.LevelRepeatableRead}, "972")
+	attempts = 0
+	assert.Error(t, noRetries.WithTx(ctx, conflict(&attempts)))
+	assert.Equal(t, 1, attempts)
+
+	// Calls within the transaction join it rather than beginning their own
+	attempts = 0
+	err = repo.WithTx(ctx, func(tx contacts.Repository) error {
+		return tx.WithTx(ctx, func(nested contacts.Repository) error {
+			attempts++
+			return nested.RemoveContact(ctx, contact.ID)
+		})
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, attempts)
+	_, err = repo.FetchContact(ctx, contact.ID)
+	assert.ErrorIs(t, err, contacts.ErrContactNotFound)
+}
+
+func TestMemoryWithTx(t *testing.T) {
+	logrus.Info("Running TestMemoryWithTx")
+	ctx := auth.NewContext(context.Background(), &auth.Principal{Subject: "bootstrap", TenantID: tenantA, Scopes: []string{auth.ScopeAdmin}})
+	repo := contacts.NewMemoryRepository("972")
+
+	contact := contacts.Contact{FirstName: "Mona", LastName: "Memory", PhoneNumber: "0541234567", Address: "1 Heap St"}
+	if !assert.NoError(t, repo.CreateContact(ctx, &contact)) {
+		t.FailNow()
+	}
+
+	// A transaction that fails leaves nothing behind
+	failure := errors.New("failed")
+	err := repo.WithTx(ctx, func(tx contacts.Repository) error {
+		changed := contact
+		changed.Address = "2 Rollback St"
+		if err := tx.UpdateContact(ctx, &changed); err != nil {
+			return err
+		}
+		added := contacts.Contact{FirstName: "Gone", LastName: "Memory", PhoneNumber: "0541234568", Address: "3 Rollback St"}
+		if err := tx.CreateContact(ctx, &added); err != nil {
+			return err
+		}
+		// The transaction sees its own changes
+		seen, err := tx.FetchContacts(ctx, false, 10, 0)
+		assert.NoError(t, err)
+		assert.Len(t, seen, 2)
+		return failure
+	})
+	assert.ErrorIs(t, err, failure)
+	stored, err := repo.FetchContacts(ctx, false, 10, 0)
+	if assert.NoError(t, err) && assert.Len(t, stored, 1) {
+		assert.Equal(t, "1 Heap St", stored[0].Address)
+	}
+
+	// One that succeeds keeps all of its changes, including those of the
+	// calls that joined it
+	err = repo.WithTx(ctx, func(tx contacts.Repository) error {
+		changed := contact
+		changed.Address = "4 Commit St"
+		if err := tx.UpdateContact(ctx, &changed); err != nil {
+			return err
+		}
+		return tx.WithTx(ctx, func(nested contacts.Repository) error {
+			return nested.RemoveContact(ctx, contact.ID)
+		})
+	})
+	assert.NoError(t, err)
+	_, err = repo.FetchContact(ctx, contact.ID)
+	assert.ErrorIs(t, err, contacts.ErrContactNotFound)
+	trash, err := repo.FetchTrash(ctx, 10, 0)
+	if assert.NoError(t, err) && assert.Len(t, trash, 1) {
+		assert.Equal(t, "4 Commit St", trash[0].Address)
+	}
+
+	// Atomic batches roll back through the service as they do in SQL
+	service := contacts.NewService(repo, []byte(shareLinkSecret), "", "972", contacts.DuplicatesReject)
+	outcomes, err := service.Batch(ctx, contacts.BatchRequest{Mode: "atomic", Operations: []contacts.BatchOperation{
+		{Op: "create", Contact: json.RawMessage(`{"first_name": "Bea", "last_name": "Batch", "phone_number": "0541234569", "address": "5 Batch St"}`)},
+		{Op: "create", Contact: json.RawMessage(`{"first_name": "Bo", "last_name": "Batch", "phone_number": "0541234569", "address": "6 Batch St"}`)},
+	}})
+	if assert.NoError(t, err) && assert.Len(t, outcomes, 2) {
+		assert.ErrorIs(t, outcomes[0].Err, contacts.ErrBatchRolledBack)
+		var duplicateErr *contacts.DuplicateError
+		assert.ErrorAs(t, outcomes[1].Err, &duplicateErr)
+	}
+	stored, err = repo.FetchContacts(ctx, false, 10, 0)
+	assert.NoError(t, err)
+	assert.Empty(t, stored)
+}
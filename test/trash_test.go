@@ -0,0 +1,112 @@
+package test
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/benhuri/phone-book-api/internal/contacts"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	trashPath   = basePath + "/trash"
+	trashIDPath = trashPath + "/{id}"
+	restorePath = trashIDPath + "/restore"
+)
+
+// inTrash reports whether the trash lists the contact.
+func inTrash(t *testing.T, handler http.Handler, id int) bool {
+	rr := bearerRequest(t, handler, bootstrapToken, "GET", trashPath+"?limit=100", nil)
+	if !assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String()) {
+		t.FailNow()
+	}
+	var trashed []contacts.Contact
+	json.NewDecoder(rr.Body).Decode(&trashed)
+	for _, contact := range trashed {
+		if contact.ID == id {
+			assert.NotNil(t, contact.DeletedAt)
+			return true
+		}
+	}
+	return false
+}
+
+// searchIDs returns the IDs of the contacts a search finds.
+func searchIDs(t *testing.T, handler http.Handler, query string) []int {
+	rr := bearerRequest(t, handler, bootstrapToken, "GET", contactsSearchPath+"?query="+query, nil)
+	if !assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String()) {
+		t.FailNow()
+	}
+	var found []contacts.Contact
+	json.NewDecoder(rr.Body).Decode(&found)
+	ids := make([]int, len(found))
+	for i, contact := range found {
+		ids[i] = contact.ID
+	}
+	return ids
+}
+
+func TestContactTrash(t *testing.T) {
+	logrus.Info("Running TestContactTrash")
+	authRouter := newAuthRouter()
+
+	tova := contacts.Contact{FirstName: "Tova", LastName: "Trash", PhoneNumber: "0521230028", Address: "1 Bin St"}
+	rr := bearerRequest(t, authRouter, bootstrapToken, "POST", contactsPath, tova)
+	if !assert.Equal(t, http.StatusCreated, rr.Code, rr.Body.String()) {
+		t.FailNow()
+	}
+	json.NewDecoder(rr.Body).Decode(&tova)
+	id := strconv.Itoa(tova.ID)
+	contactURL := contactsPath + "/" + id
+	notesURL := strings.Replace(notesPath, "{id}", id, 1)
+
+	// Notes are searched by word
+	note := contacts.Note{Author: "reception", Text: "Allergic to **peanuts**, ask about cashews"}
+	rr = bearerRequest(t, authRouter, bootstrapToken, "POST", notesURL, note)
+	assert.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+	assert.Contains(t, searchIDs(t, authRouter, "peanuts"), tova.ID)
+	assert.Contains(t, searchIDs(t, authRouter, "cashews+allergic"), tova.ID)
+	assert.NotContains(t, searchIDs(t, authRouter, "peanut+butter"), tova.ID)
+
+	// Deleting moves the contact and its notes to the trash
+	rr = bearerRequest(t, authRouter, bootstrapToken, "DELETE", contactURL, nil)
+	assert.Equal(t, http.StatusNoContent, rr.Code, rr.Body.String())
+	assert.True(t, inTrash(t, authRouter, tova.ID))
+	assert.NotContains(t, searchIDs(t, authRouter, "peanuts"), tova.ID)
+	assert.NotContains(t, searchIDs(t, authRouter, "Trash"), tova.ID)
+	rr = bearerRequest(t, authRouter, bootstrapToken, "PUT", contactURL, tova)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	rr = bearerRequest(t, authRouter, bootstrapToken, "DELETE", contactURL, nil)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	// Restoring brings both back
+	rr = bearerRequest(t, authRouter, bootstrapToken, "POST", strings.Replace(restorePath, "{id}", id, 1), nil)
+	if assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String()) {
+		var restored contacts.Contact
+		json.NewDecoder(rr.Body).Decode(&restored)
+		assert.Equal(t, tova.ID, restored.ID)
+		assert.Nil(t, restored.DeletedAt)
+	}
+	assert.False(t, inTrash(t, authRouter, tova.ID))
+	assert.Contains(t, searchIDs(t, authRouter, "peanuts"), tova.ID)
+	rr = bearerRequest(t, authRouter, bootstrapToken, "GET", notesURL, nil)
+	assert.Contains(t, rr.Body.String(), "peanuts")
+	rr = bearerRequest(t, authRouter, bootstrapToken, "POST", strings.Replace(restorePath, "{id}", id, 1), nil)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	// Only contacts in the trash are purged, and for good
+	purgeURL := strings.Replace(trashIDPath, "{id}", id, 1)
+	rr = bearerRequest(t, authRouter, bootstrapToken, "DELETE", purgeURL, nil)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	rr = bearerRequest(t, authRouter, bootstrapToken, "DELETE", contactURL, nil)
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+	rr = bearerRequest(t, authRouter, bootstrapToken, "DELETE", purgeURL, nil)
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+	assert.False(t, inTrash(t, authRouter, tova.ID))
+	rr = bearerRequest(t, authRouter, bootstrapToken, "POST", strings.Replace(restorePath, "{id}", id, 1), nil)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
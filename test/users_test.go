@@ -0,0 +1,196 @@
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/benhuri/phone-book-api/internal/auth"
+	"github.com/benhuri/phone-book-api/internal/contacts"
+	"github.com/benhuri/phone-book-api/internal/users"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	csrfHeader    = "X-CSRF-Token"
+	sessionCookie = "session"
+	testPassword  = "correct horse battery"
+)
+
+// browserRequest sends a request from the given address with an optional
+// session cookie and CSRF token.
+func browserRequest(t *testing.T, handler http.Handler, address string, cookie *http.Cookie, csrfToken, method, url string, body interface{}) *httptest.ResponseRecorder {
+	var payload bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&payload).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req := httptest.NewRequest(method, url, &payload)
+	req.RemoteAddr = address + ":40000"
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	if csrfToken != "" {
+		req.Header.Set(csrfHeader, csrfToken)
+	}
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
+func createUser(t *testing.T, handler http.Handler, username string, roles ...string) users.User {
+	rr := bearerRequest(t, handler, bootstrapToken, "POST", usersPath, users.User{Username: username, Password: testPassword})
+	if !assert.Equal(t, http.StatusCreated, rr.Code) {
+		t.FailNow()
+	}
+	var user users.User
+	if err := json.NewDecoder(rr.Body).Decode(&user); err != nil {
+		t.Fatal(err)
+	}
+
+	rolesURL := subjectPath(userRolesPath, auth.UserSubject(user.ID))
+	rr = bearerRequest(t, handler, bootstrapToken, "PUT", rolesURL, map[string][]string{"roles": roles})
+	assert.Equal(t, http.StatusOK, rr.Code)
+	return user
+}
+
+func login(t *testing.T, handler http.Handler, address, username, password string) *httptest.ResponseRecorder {
+	return browserRequest(t, handler, address, nil, "", "POST", loginPath, users.Credentials{Tenant: tenantA, Username: username, Password: password})
+}
+
+func sessionFrom(rr *httptest.ResponseRecorder) *http.Cookie {
+	for _, cookie := range rr.Result().Cookies() {
+		if cookie.Name == sessionCookie {
+			return cookie
+		}
+	}
+	return nil
+}
+
+func TestSessionLogin(t *testing.T) {
+	logrus.Info("Running TestSessionLogin")
+	authRouter := newAuthRouter()
+	user := createUser(t, authRouter, "alice", auth.RoleEditor)
+	assert.Empty(t, user.Password)
+
+	rr := bearerRequest(t, authRouter, bootstrapToken, "POST", usersPath, users.User{Username: "alice", Password: testPassword})
+	assert.Equal(t, http.StatusConflict, rr.Code)
+
+	rr = login(t, authRouter, "192.0.2.10", "alice", "wrong password")
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.Nil(t, sessionFrom(rr))
+
+	rr = login(t, authRouter, "192.0.2.10", "alice", testPassword)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	cookie := sessionFrom(rr)
+	if !assert.NotNil(t, cookie) {
+		t.FailNow()
+	}
+	assert.True(t, cookie.HttpOnly)
+	assert.True(t, cookie.Secure)
+	assert.Equal(t, http.SameSiteLaxMode, cookie.SameSite)
+
+	var session users.Session
+	if err := json.NewDecoder(rr.Body).Decode(&session); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, user.ID, session.UserID)
+	assert.NotEmpty(t, session.CSRFToken)
+
+	// Reads need no CSRF token, writes do
+	rr = browserRequest(t, authRouter, "192.0.2.10", cookie, "", "GET", contactsPath, nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	contact := contacts.Contact{FirstName: "Cookie", LastName: "Session", PhoneNumber: "5550008000", Address: "Browser Road"}
+	rr = browserRequest(t, authRouter, "192.0.2.10", cookie, "", "POST", contactsPath, contact)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	rr = browserRequest(t, authRouter, "192.0.2.10", cookie, "forged", "POST", contactsPath, contact)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	rr = browserRequest(t, authRouter, "192.0.2.10", cookie, session.CSRFToken, "POST", contactsPath, contact)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+
+	// Logging out ends the session
+	rr = browserRequest(t, authRouter, "192.0.2.10", cookie, session.CSRFToken, "POST", logoutPath, nil)
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+	assert.Equal(t, -1, sessionFrom(rr).MaxAge)
+
+	rr = browserRequest(t, authRouter, "192.0.2.10", cookie, "", "GET", contactsPath, nil)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+}
+
+func TestLoginThrottling(t *testing.T) {
+	logrus.Info("Running TestLoginThrottling")
+	authRouter := newAuthRouter()
+	createUser(t, authRouter, "bob", auth.RoleViewer)
+	createUser(t, authRouter, "carol", auth.RoleViewer)
+
+	// Failures for one user block that user, even with the right password
+	for i := 0; i < 5; i++ {
+		rr := login(t, authRouter, "192.0.2.20", "bob", "wrong password")
+		assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	}
+	rr := login(t, authRouter, "192.0.2.21", "bob", testPassword)
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.NotEmpty(t, rr.Header().Get("Retry-After"))
+
+	// Failures from one address block that address for every user
+	for i := 0; i < 20; i++ {
+		rr = login(t, authRouter, "192.0.2.30", "nobody-"+strconv.Itoa(i), "wrong password")
+		assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	}
+	rr = login(t, authRouter, "192.0.2.30", "carol", testPassword)
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+
+	rr = login(t, authRouter, "192.0.2.31", "carol", testPassword)
+	assert.Equal(t, http.StatusOK, rr.Code)
+}
+
+func TestSubjectNamespaces(t *testing.T) {
+	logrus.Info("Running TestSubjectNamespaces")
+	rbacRouter := newRBACRouter()
+	user := createUser(t, rbacRouter, "namespaced", auth.RoleEditor)
+
+	rr := login(t, rbacRouter, "192.0.2.40", "namespaced", testPassword)
+	if !assert.Equal(t, http.StatusOK, rr.Code) {
+		t.FailNow()
+	}
+	cookie := sessionFrom(rr)
+	var session users.Session
+	if err := json.NewDecoder(rr.Body).Decode(&session); err != nil {
+		t.Fatal(err)
+	}
+	contact := contacts.Contact{FirstName: "Private", LastName: "Entry", PhoneNumber: "5550008100", Address: "Session Road"}
+	rr = browserRequest(t, rbacRouter, "192.0.2.40", cookie, session.CSRFToken, "POST", contactsPath, contact)
+	if !assert.Equal(t, http.StatusCreated, rr.Code) {
+		t.FailNow()
+	}
+	json.NewDecoder(rr.Body).Decode(&contact)
+	contactURL := contactsPath + "/" + strconv.Itoa(contact.ID)
+
+	// A token whose sub is the user's ID is another caller, without the
+	// user's roles
+	claims := jwtClaims("")
+	claims["sub"] = strconv.Itoa(user.ID)
+	claims["tenant_id"] = tenantA
+	claims["roles"] = []string{}
+	lookalike := signJWT(t, "", []byte(jwtSecret), claims)
+	rr = bearerRequest(t, rbacRouter, lookalike, "GET", contactsPath, nil)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	// or the user's phone book
+	claims["roles"] = []string{auth.RoleEditor}
+	lookalike = signJWT(t, "", []byte(jwtSecret), claims)
+	assert.NotContains(t, contactIDs(t, rbacRouter, lookalike, shareContactsURL), contact.ID)
+	rr = bearerRequest(t, rbacRouter, lookalike, "DELETE", contactURL, nil)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	rr = browserRequest(t, rbacRouter, "192.0.2.40", cookie, session.CSRFToken, "DELETE", contactURL, nil)
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+}
@@ -0,0 +1,111 @@
+package test
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/benhuri/phone-book-api/internal/contacts"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVCardExport(t *testing.T) {
+	logrus.Info("Running TestVCardExport")
+	authRouter := newAuthRouter()
+
+	fields := []contacts.CustomField{
+		{Name: "work_email", Type: contacts.FieldTypeEmail},
+		{Name: "mobile_phone", Type: contacts.FieldTypePhone},
+		{Name: "employee_number", Type: contacts.FieldTypeNumber},
+	}
+	for i := range fields {
+		rr := bearerRequest(t, authRouter, bootstrapToken, "POST", customFieldsPath, fields[i])
+		if !assert.Equal(t, http.StatusCreated, rr.Code, rr.Body.String()) {
+			t.FailNow()
+		}
+		json.NewDecoder(rr.Body).Decode(&fields[i])
+	}
+	defer func() {
+		for _, field := range fields {
+			bearerRequest(t, authRouter, bootstrapToken, "DELETE", customFieldsPath+"/"+strconv.Itoa(field.ID), nil)
+		}
+	}()
+
+	// A long name with multi-byte characters has to be folded without
+	// splitting a character
+	contact := contacts.Contact{
+		FirstName:   strings.Repeat("Zoë", 16),
+		LastName:    "O'Brien, Jr.; III",
+		PhoneNumber: "5550009001",
+		Address:     "1 Card St",
+		Birthday:    "1990-02-03",
+		Anniversary: "2015-06-20",
+		Groups:      []string{"cards"},
+		CustomFields: map[string]interface{}{
+			"work_email":      "zoe@example.com",
+			"mobile_phone":    "+15550009002",
+			"employee_number": 1200000,
+		},
+	}
+	rr := bearerRequest(t, authRouter, bootstrapToken, "POST", contactsPath, contact)
+	if !assert.Equal(t, http.StatusCreated, rr.Code, rr.Body.String()) {
+		t.FailNow()
+	}
+	json.NewDecoder(rr.Body).Decode(&contact)
+	other := contacts.Contact{FirstName: "Other", LastName: "Contact", PhoneNumber: "5550009003", Address: "2 Card St"}
+	rr = bearerRequest(t, authRouter, bootstrapToken, "POST", contactsPath, other)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+
+	cardURL := strings.Replace(contactVCardPath, "{id}", strconv.Itoa(contact.ID), 1)
+	rr = bearerRequest(t, authRouter, bootstrapToken, "GET", cardURL, nil)
+	if !assert.Equal(t, http.StatusOK, rr.Code) {
+		t.FailNow()
+	}
+	assert.Equal(t, "text/vcard; charset=utf-8", rr.Header().Get(contentType))
+	assert.Contains(t, rr.Header().Get("Content-Disposition"), "contact-"+strconv.Itoa(contact.ID)+".vcf")
+	card := rr.Body.String()
+	assert.True(t, strings.HasPrefix(card, "BEGIN:VCARD\r\nVERSION:4.0\r\n"))
+	assert.True(t, strings.HasSuffix(card, "END:VCARD\r\n"))
+	assert.Contains(t, card, `N:O'Brien\, Jr.\; III;`)
+	assert.Contains(t, card, "BDAY:19900203\r\n")
+	assert.Contains(t, card, "ANNIVERSARY:20150620\r\n")
+	assert.Contains(t, card, "EMAIL:zoe@example.com\r\n")
+	assert.Contains(t, card, "TEL;TYPE=cell:+15550009002\r\n")
+	assert.Contains(t, card, "X-PHONEBOOK-EMPLOYEE-NUMBER:1200000\r\n")
+	assert.Contains(t, card, "CATEGORIES:cards\r\n")
+	for _, line := range strings.Split(strings.TrimSuffix(card, "\r\n"), "\r\n") {
+		assert.LessOrEqual(t, len(line), 75, "line %q is too long", line)
+		assert.True(t, utf8.ValidString(line), "line %q splits a character", line)
+	}
+	unfolded := strings.ReplaceAll(card, "\r\n ", "")
+	assert.Contains(t, unfolded, "FN:"+contact.FirstName+` O'Brien\, Jr.\; III`+"\r\n")
+
+	rr = bearerRequest(t, authRouter, bootstrapToken, "GET", cardURL+"?version=3.0", nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), "VERSION:3.0\r\n")
+	assert.Contains(t, rr.Body.String(), "BDAY:1990-02-03\r\n")
+	assert.Contains(t, rr.Body.String(), "X-ANNIVERSARY:2015-06-20\r\n")
+	assert.Contains(t, rr.Body.String(), "EMAIL;TYPE=internet:zoe@example.com\r\n")
+
+	rr = bearerRequest(t, authRouter, bootstrapToken, "GET", cardURL+"?version=2.1", nil)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	rr = bearerRequest(t, authRouter, bootstrapToken, "GET", strings.Replace(contactVCardPath, "{id}", "999999", 1), nil)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	// The export holds every card, or only those of a group
+	rr = bearerRequest(t, authRouter, bootstrapToken, "GET", contactsExportPath, nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Header().Get("Content-Disposition"), "contacts.vcf")
+	assert.Contains(t, rr.Body.String(), "FN:Other Contact\r\n")
+	assert.Contains(t, rr.Body.String(), "CATEGORIES:cards\r\n")
+
+	rr = bearerRequest(t, authRouter, bootstrapToken, "GET", contactsExportPath+"?group=cards", nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, 1, strings.Count(rr.Body.String(), "BEGIN:VCARD\r\n"))
+	assert.NotContains(t, rr.Body.String(), "Other")
+}
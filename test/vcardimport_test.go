@@ -0,0 +1,125 @@
+package test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/benhuri/phone-book-api/internal/contacts"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// importCards is an Android vCard 2.1 export with quoted-printable values,
+// an iOS vCard 3.0 export with a folded note and a card missing its phone.
+const importCards = "BEGIN:VCARD\r\n" +
+	"VERSION:2.1\r\n" +
+	"N;CHARSET=UTF-8;ENCODING=QUOTED-PRINTABLE:M=C3=BCller;J=C3=\r\n" +
+	"=BCrgen;;;\r\n" +
+	"TEL;CELL;PREF:555-000-8001\r\n" +
+	"ADR;HOME:;;12 Import Road;Town;;;\r\n" +
+	"END:VCARD\r\n" +
+	"BEGIN:VCARD\r\n" +
+	"VERSION:3.0\r\n" +
+	"N:Importer;Anna;;;\r\n" +
+	"FN:Anna Importer\r\n" +
+	"item1.TEL;type=CELL;type=VOICE;type=pref:(555) 000-8002\r\n" +
+	"ADR;type=HOME:;;1 Folded Way;;;;\r\n" +
+	"BDAY:1985-04-12\r\n" +
+	"CATEGORIES:imported\r\n" +
+	"NOTE:Met at the conference\\, bring\r\n" +
+	"  the slides\r\n" +
+	"END:VCARD\r\n" +
+	"BEGIN:VCARD\r\n" +
+	"VERSION:3.0\r\n" +
+	"N:Broken;Bea;;;\r\n" +
+	"ADR:;;2 Broken St;;;;\r\n" +
+	"BDAY:someday\r\n" +
+	"END:VCARD\r\n"
+
+func importRequest(t *testing.T, handler http.Handler, url, body string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest("POST", url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+bootstrapToken)
+	req.Header.Set(contentType, "text/vcard; charset=utf-8")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestVCardImport(t *testing.T) {
+	logrus.Info("Running TestVCardImport")
+	authRouter := newAuthRouter()
+
+	// A dry run reports every card and writes nothing
+	rr := importRequest(t, authRouter, contactsImportPath+"?dry_run=true", importCards)
+	if !assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String()) {
+		t.FailNow()
+	}
+	var preview contacts.ImportResult
+	json.NewDecoder(rr.Body).Decode(&preview)
+	assert.True(t, preview.DryRun)
+	assert.Equal(t, 2, preview.Created)
+	assert.Equal(t, 1, preview.Skipped)
+	if assert.Len(t, preview.Records, 3) {
+		assert.Equal(t, "Müller", preview.Records[0].Contact.LastName)
+		assert.Equal(t, "Jürgen", preview.Records[0].Contact.FirstName)
+		assert.Equal(t, "5550008001", preview.Records[0].Contact.PhoneNumber)
+		assert.Equal(t, "12 Import Road, Town", preview.Records[0].Contact.Address)
+		assert.Equal(t, 8, preview.Records[1].Line)
+		assert.Equal(t, contacts.ImportSkip, preview.Records[2].Action)
+		assert.Equal(t, []contacts.ImportError{
+			{Line: 19, Message: "PhoneNumber is required"},
+			{Line: 23, Message: "BDAY: someday is not a date"},
+		}, preview.Records[2].Errors)
+	}
+	rr = bearerRequest(t, authRouter, bootstrapToken, "GET", contactsSearchPath+"?query=Importer", nil)
+	assert.NotContains(t, rr.Body.String(), "Importer")
+
+	rr = importRequest(t, authRouter, contactsImportPath, importCards)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var result contacts.ImportResult
+	json.NewDecoder(rr.Body).Decode(&result)
+	assert.False(t, result.DryRun)
+	assert.Equal(t, 2, result.Created)
+	anna := result.Records[1].Contact
+	assert.NotZero(t, anna.ID)
+	assert.Equal(t, []string{"imported"}, anna.Groups)
+	assert.Equal(t, "1985-04-12", anna.Birthday)
+
+	notesURL := strings.Replace(notesPath, "{id}", strconv.Itoa(anna.ID), 1)
+	rr = bearerRequest(t, authRouter, bootstrapToken, "GET", notesURL, nil)
+	var notes []contacts.Note
+	json.NewDecoder(rr.Body).Decode(&notes)
+	if assert.Len(t, notes, 1) {
+		assert.Equal(t, "Met at the conference, bring the slides", notes[0].Text)
+	}
+
+	// Cards exported from the service update the contact they came from
+	cardURL := strings.Replace(contactVCardPath, "{id}", strconv.Itoa(anna.ID), 1)
+	rr = bearerRequest(t, authRouter, bootstrapToken, "GET", cardURL, nil)
+	card := strings.Replace(rr.Body.String(), "N:Importer;Anna;;;", "N:Importer;Annabel;;;", 1)
+	rr = importRequest(t, authRouter, contactsImportPath, card)
+	var updated contacts.ImportResult
+	json.NewDecoder(rr.Body).Decode(&updated)
+	assert.Equal(t, 1, updated.Updated)
+	if assert.Len(t, updated.Records, 1) {
+		assert.Equal(t, anna.ID, updated.Records[0].Contact.ID)
+		assert.Equal(t, "Annabel", updated.Records[0].Contact.FirstName)
+	}
+	rr = bearerRequest(t, authRouter, bootstrapToken, "GET", notesURL, nil)
+	json.NewDecoder(rr.Body).Decode(&notes)
+	assert.Len(t, notes, 1)
+
+	rr = importRequest(t, authRouter, contactsImportPath, "no cards here")
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	rr = importRequest(t, authRouter, contactsImportPath+"?dry_run=maybe", importCards)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	rr = bearerRequest(t, authRouter, bootstrapToken, "POST", contactsImportPath, importCards)
+	assert.Equal(t, http.StatusUnsupportedMediaType, rr.Code)
+}
@@ -0,0 +1,267 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/benhuri/phone-book-api/internal/contacts"
+	"github.com/benhuri/phone-book-api/internal/database"
+	"github.com/benhuri/phone-book-api/internal/outbox"
+	"github.com/benhuri/phone-book-api/internal/webhooks"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	webhooksPath    = "/webhooks"
+	webhookIDPath   = webhooksPath + "/{id}"
+	deliveriesPath  = webhookIDPath + "/deliveries"
+	deliveryIDPath  = deliveriesPath + "/{deliveryId}"
+	redeliverPath   = deliveryIDPath + "/redeliver"
+	deliveryTimeout = 10 * time.Second
+)
+
+// receiver is a webhook endpoint that records what it is sent and answers
+// with the statuses it is given, then with 200. Redirects point to location.
+type receiver struct {
+	mu       sync.Mutex
+	statuses []int
+	location string
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.requests = append(rc.requests, r)
+	rc.bodies = append(rc.bodies, body)
+	status := http.StatusOK
+	if len(rc.statuses) > 0 {
+		status, rc.statuses = rc.statuses[0], rc.statuses[1:]
+	}
+	if status >= 300 && status < 400 {
+		w.Header().Set("Location", rc.location)
+	}
+	w.WriteHeader(status)
+}
+
+func (rc *receiver) answer(statuses ...int) {
+	rc.mu.Lock()
+	rc.statuses = statuses
+	rc.mu.Unlock()
+}
+
+func deliveryURL(path string, webhookID, id int) string {
+	return strings.NewReplacer("{id}", strconv.Itoa(webhookID), "{deliveryId}", strconv.Itoa(id)).Replace(path)
+}
+
+// waitForDelivery polls a webhook's latest delivery until it has the status.
+func waitForDelivery(t *testing.T, handler http.Handler, webhookID int, status string) webhooks.Delivery {
+	var deliveries []webhooks.Delivery
+	deadline := time.Now().Add(deliveryTimeout)
+	for time.Now().Before(deadline) {
+		rr := bearerRequest(t, handler, bootstrapToken, "GET", deliveryURL(deliveriesPath, webhookID, 0), nil)
+		if !assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String()) {
+			t.FailNow()
+		}
+		json.NewDecoder(rr.Body).Decode(&deliveries)
+		if len(deliveries) > 0 && deliveries[0].Status == status {
+			return deliveries[0]
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("webhook %d has no %s delivery", webhookID, status)
+	return webhooks.Delivery{}
+}
+
+func TestWebhooks(t *testing.T) {
+	logrus.Info("Running TestWebhooks")
+	authRouter := newAuthRouter()
+	rc := &receiver{}
+	server := httptest.NewServer(rc)
+	defer server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go webhooksService.Run(ctx, 1)
+	relay := outbox.NewRelay(outbox.NewRepository(database.DB))
+	relay.Add(outbox.SinkWebhooks, webhooksService)
+	go relay.Run(ctx)
+
+	// Only http and https URLs and known events are accepted
+	invalid := webhooks.Webhook{URL: "ftp://example.com/hook", Events: []string{contacts.EventCreated}}
+	rr := bearerRequest(t, authRouter, bootstrapToken, "POST", webhooksPath, invalid)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	invalid = webhooks.Webhook{URL: server.URL, Events: []string{"contact.viewed"}}
+	rr = bearerRequest(t, authRouter, bootstrapToken, "POST", webhooksPath, invalid)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	webhook := webhooks.Webhook{URL: server.URL, Events: []string{contacts.EventCreated, contacts.EventDeleted}}
+	rr = bearerRequest(t, authRouter, bootstrapToken, "POST", webhooksPath, webhook)
+	if !assert.Equal(t, http.StatusCreated, rr.Code, rr.Body.String()) {
+		t.FailNow()
+	}
+	json.NewDecoder(rr.Body).Decode(&webhook)
+	assert.NotEmpty(t, webhook.Secret)
+	webhookURL := deliveryURL(webhookIDPath, webhook.ID, 0)
+	defer bearerRequest(t, authRouter, bootstrapToken, "DELETE", webhookURL, nil)
+
+	// The secret is not returned again
+	rr = bearerRequest(t, authRouter, bootstrapToken, "GET", webhookURL, nil)
+	if assert.Equal(t, http.StatusOK, rr.Code) {
+		var fetched webhooks.Webhook
+		json.NewDecoder(rr.Body).Decode(&fetched)
+		assert.Empty(t, fetched.Secret)
+		assert.Equal(t, webhook.Events, fetched.Events)
+	}
+
+	// A failed attempt is retried after a backoff
+	rc.answer(http.StatusInternalServerError)
+	hooked := contacts.Contact{FirstName: "Hana", LastName: "Hook", PhoneNumber: "0521230049", Address: "1 Webhook St"}
+	rr = bearerRequest(t, authRouter, bootstrapToken, "POST", contactsPath, hooked)
+	if !assert.Equal(t, http.StatusCreated, rr.Code, rr.Body.String()) {
+		t.FailNow()
+	}
+	json.NewDecoder(rr.Body).Decode(&hooked)
+
+	delivered := waitForDelivery(t, authRouter, webhook.ID, webhooks.StatusDelivered)
+	assert.Equal(t, contacts.EventCreated, delivered.Event)
+	assert.Equal(t, 2, delivered.Attempts)
+
+	rc.mu.Lock()
+	if assert.Len(t, rc.requests, 2) {
+		req, body := rc.requests[1], rc.bodies[1]
+		assert.Equal(t, contacts.EventCreated, req.Header.Get("X-Webhook-Event"))
+		assert.Equal(t, strconv.Itoa(delivered.ID), req.Header.Get("X-Webhook-Delivery"))
+		timestamp, err := strconv.ParseInt(req.Header.Get("X-Webhook-Timestamp"), 10, 64)
+		assert.NoError(t, err)
+		assert.Equal(t, webhooks.Sign(webhook.Secret, timestamp, body), req.Header.Get("X-Webhook-Signature"))
+		var event contacts.Event
+		json.Unmarshal(body, &event)
+		assert.Equal(t, hooked.ID, event.ContactID)
+		assert.NotZero(t, event.Seq)
+		if assert.NotNil(t, event.Contact) {
+			assert.Equal(t, "Hana", event.Contact.FirstName)
+		}
+	}
+	rc.mu.Unlock()
+
+	// The log has every attempt
+	rr = bearerRequest(t, authRouter, bootstrapToken, "GET", deliveryURL(deliveryIDPath, webhook.ID, delivered.ID), nil)
+	if assert.Equal(t, http.StatusOK, rr.Code) {
+		var logged webhooks.Delivery
+		json.NewDecoder(rr.Body).Decode(&logged)
+		if assert.Len(t, logged.Log, 2) {
+			assert.Equal(t, http.StatusInternalServerError, logged.Log[0].StatusCode)
+			assert.Equal(t, http.StatusOK, logged.Log[1].StatusCode)
+		}
+	}
+
+	// Updates are not subscribed to
+	hooked.JobTitle = "Receiver"
+	rr = bearerRequest(t, authRouter, bootstrapToken, "PUT", contactsPath+"/"+strconv.Itoa(hooked.ID), hooked)
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+	// A delivery that fails every attempt is dead until it is redelivered
+	rc.answer(http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+	rr = bearerRequest(t, authRouter, bootstrapToken, "DELETE", contactsPath+"/"+strconv.Itoa(hooked.ID), nil)
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+	dead := waitForDelivery(t, authRouter, webhook.ID, webhooks.StatusDead)
+	assert.Equal(t, contacts.EventDeleted, dead.Event)
+	assert.Equal(t, 3, dead.Attempts)
+	assert.Equal(t, http.StatusServiceUnavailable, dead.LastStatus)
+
+	rr = bearerRequest(t, authRouter, bootstrapToken, "POST", deliveryURL(redeliverPath, webhook.ID, dead.ID), nil)
+	assert.Equal(t, http.StatusAccepted, rr.Code, rr.Body.String())
+	redelivered := waitForDelivery(t, authRouter, webhook.ID, webhooks.StatusDelivered)
+	assert.Equal(t, dead.ID, redelivered.ID)
+	assert.Equal(t, 1, redelivered.Attempts)
+
+	rr = bearerRequest(t, authRouter, bootstrapToken, "POST", deliveryURL(redeliverPath, webhook.ID, 0), nil)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	// Redirects are not followed, and only the status is logged
+	target := &receiver{}
+	targetServer := httptest.NewServer(target)
+	defer targetServer.Close()
+	rc.mu.Lock()
+	rc.location = targetServer.URL
+	rc.mu.Unlock()
+	rc.answer(http.StatusFound, http.StatusFound, http.StatusFound)
+	redirected := contacts.Contact{FirstName: "Reda", LastName: "Rect", PhoneNumber: "0521230149", Address: "1 Webhook St"}
+	rr = bearerRequest(t, authRouter, bootstrapToken, "POST", contactsPath, redirected)
+	if !assert.Equal(t, http.StatusCreated, rr.Code, rr.Body.String()) {
+		t.FailNow()
+	}
+	json.NewDecoder(rr.Body).Decode(&redirected)
+	dead = waitForDelivery(t, authRouter, webhook.ID, webhooks.StatusDead)
+	assert.Equal(t, http.StatusFound, dead.LastStatus)
+	assert.Empty(t, dead.LastError)
+	target.mu.Lock()
+	assert.Empty(t, target.requests)
+	target.mu.Unlock()
+	rr = bearerRequest(t, authRouter, bootstrapToken, "DELETE", contactsPath+"/"+strconv.Itoa(redirected.ID), nil)
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+	waitForDelivery(t, authRouter, webhook.ID, webhooks.StatusDelivered)
+
+	// Deleting the webhook deletes its deliveries
+	rr = bearerRequest(t, authRouter, bootstrapToken, "DELETE", webhookURL, nil)
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+	rr = bearerRequest(t, authRouter, bootstrapToken, "GET", deliveryURL(deliveriesPath, webhook.ID, 0), nil)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestWebhookDestinations(t *testing.T) {
+	logrus.Info("Running TestWebhookDestinations")
+	authRouter := newAuthRouter()
+	rc := &receiver{}
+	server := httptest.NewServer(rc)
+	defer server.Close()
+	port := server.URL[strings.LastIndex(server.URL, ":"):]
+
+	// A service that does not allow private destinations will not connect to
+	// the loopback receiver, however its address is written
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	strict := webhooks.NewService(webhooks.NewRepository(database.DB), 1, 50*time.Millisecond, false)
+	go strict.Run(ctx, 1)
+
+	destinations := []string{
+		server.URL,
+		"http://0.0.0.0" + port,
+		"http://[::1]" + port,
+		"http://[::ffff:127.0.0.1]" + port,
+		"http://[64:ff9b::7f00:1]" + port,
+		"http://100.64.0.1" + port,
+		"http://[fd00::1]" + port,
+	}
+	for _, url := range destinations {
+		webhook := webhooks.Webhook{URL: url, Events: []string{contacts.EventCreated}}
+		rr := bearerRequest(t, authRouter, bootstrapToken, "POST", webhooksPath, webhook)
+		if !assert.Equal(t, http.StatusCreated, rr.Code, rr.Body.String()) {
+			t.FailNow()
+		}
+		json.NewDecoder(rr.Body).Decode(&webhook)
+
+		event := contacts.Event{Type: contacts.EventCreated, TenantID: tenantA, OccurredAt: time.Now().UTC()}
+		if !assert.NoError(t, strict.Publish(ctx, event)) {
+			t.FailNow()
+		}
+		dead := waitForDelivery(t, authRouter, webhook.ID, webhooks.StatusDead)
+		assert.Zero(t, dead.LastStatus, url)
+		assert.Contains(t, dead.LastError, "is not a public address", url)
+		bearerRequest(t, authRouter, bootstrapToken, "DELETE", deliveryURL(webhookIDPath, webhook.ID, 0), nil)
+	}
+	rc.mu.Lock()
+	assert.Empty(t, rc.requests)
+	rc.mu.Unlock()
+}